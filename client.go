@@ -0,0 +1,298 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"pastry/format"
+)
+
+// The client is `pastry client <command>`, nc with manners. It asks the server what it
+// supports first, works around what an older server lacks and says so when it can't.
+
+const (
+	clientTimeout = 10 * time.Second
+	clipPreamble  = "clip\n"
+)
+
+func env(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// serverCaps is what a server answered to caps. Servers from before caps have protocol 0
+// and are assumed to know the commands they always had.
+type serverCaps struct {
+	Protocol  int
+	Commands  map[string]bool
+	Preambles map[string]bool
+	Options   map[string]bool
+	MaxPaste  int
+	MaxUpload int
+	Locales   map[string]bool
+}
+
+var protocol0Commands = []string{"get", "grep", "list", "drop"}
+
+func parseCaps(b []byte) serverCaps {
+	c := serverCaps{Commands: make(map[string]bool), Preambles: make(map[string]bool), Options: make(map[string]bool), Locales: make(map[string]bool)}
+	if bytes.HasPrefix(b, []byte("# ")) {
+		for _, cmd := range protocol0Commands {
+			c.Commands[cmd] = true
+		}
+		return c
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		k, v, _ := strings.Cut(l, "=")
+		switch k {
+		case "protocol":
+			c.Protocol, _ = strconv.Atoi(v)
+		case "commands", "preambles", "options", "locales":
+			m := map[string]map[string]bool{"commands": c.Commands, "preambles": c.Preambles, "options": c.Options, "locales": c.Locales}[k]
+			for _, x := range strings.Split(v, ",") {
+				m[x] = true
+			}
+		case "max-paste":
+			c.MaxPaste, _ = strconv.Atoi(v)
+		case "max-upload":
+			c.MaxUpload, _ = strconv.Atoi(v)
+		}
+	}
+	return c
+}
+
+type client struct {
+	readAddr  string
+	writeAddr string
+	key       string
+	lang      string
+	width     int
+	caps      serverCaps
+}
+
+// localAddr turns a listen address like :9182 into one to connect to.
+func localAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
+}
+
+// send writes b to addr and returns everything the server answers until it hangs up.
+func send(addr string, b []byte) ([]byte, error) {
+	c, err := net.DialTimeout("tcp", addr, clientTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(clientTimeout))
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	return io.ReadAll(c)
+}
+
+func (cl *client) command(args ...string) ([]byte, error) {
+	return send(cl.readAddr, []byte(strings.Join(args, " ")+"\n"))
+}
+
+// need fails with a clear error if the server lacks cmd.
+func (cl *client) need(cmd string) error {
+	if !cl.caps.Commands[cmd] {
+		return fmt.Errorf("The server doesn't support %s (protocol %d), it needs upgrading", cmd, cl.caps.Protocol)
+	}
+	return nil
+}
+
+// paste sends stdin to the write port, with the preambles asked for.
+func (cl *client) paste(clip bool) error {
+	text, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	var pre []byte
+	if cl.key != "" {
+		if !cl.caps.Preambles["key"] {
+			return fmt.Errorf("The server doesn't support device keys (protocol %d), leave out --key", cl.caps.Protocol)
+		}
+		pre = append(pre, "key "+cl.key+"\n"...)
+	}
+	if clip {
+		if cl.caps.Protocol > 0 && !cl.caps.Preambles["clip"] {
+			return fmt.Errorf("The server doesn't support the clipboard board (protocol %d)", cl.caps.Protocol)
+		}
+		pre = append(pre, clipPreamble...)
+	}
+	max := cl.caps.MaxPaste
+	if cl.caps.Protocol >= 2 && cl.caps.MaxUpload > max {
+		// kept as a file beyond max-paste
+		max = cl.caps.MaxUpload
+	}
+	if max > 0 && len(pre)+len(text) > max {
+		return fmt.Errorf("Paste of %d bytes is larger than the %d the server takes", len(text), max)
+	}
+	b, err := send(cl.writeAddr, append(pre, text...))
+	if err == nil && bytes.HasPrefix(b, []byte("# Imported")) {
+		// the one answer of the write port that isn't an error
+		return cl.printPaste(b, nil)
+	}
+	return cl.print(b, err)
+}
+
+// tail prints the latest n pastes, with list and get. The tail command of the server is
+// another thing, the last lines of one paste.
+func (cl *client) tail(n int) error {
+	list, err := cl.command("list", "--preview", "1")
+	if err != nil {
+		return err
+	}
+	var idx []string
+	s := bufio.NewScanner(bytes.NewReader(list))
+	for s.Scan() {
+		// "#  7" and "#123", the index is right after the #
+		if l := s.Text(); strings.HasPrefix(l, "#") {
+			if f := strings.Fields(l[1:]); len(f) > 0 {
+				idx = append(idx, f[0])
+			}
+		}
+	}
+	if len(idx) > n {
+		idx = idx[len(idx)-n:]
+	}
+	for _, i := range idx {
+		if err := cl.printPaste(cl.command("get", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isError is true for the "# Message" lines the server answers errors with, and the
+// "ERR: storage full" of the write port. The indexes of list and grep start with "# " too,
+// but never with a letter.
+func isError(b []byte) bool {
+	if bytes.HasPrefix(b, []byte("ERR: ")) && bytes.Count(b, []byte("\n")) == 1 {
+		return true
+	}
+	return len(b) > 2 && bytes.HasPrefix(b, []byte("# ")) && b[2] >= 'A' && b[2] <= 'Z' && bytes.Count(b, []byte("\n")) == 1
+}
+
+// listing runs list, grep or history in the language of the client, when the server has a
+// locale for it, and cuts the lines to the width of the terminal. Servers that take --width
+// do the cutting themselves.
+func (cl *client) listing(cmd []string) error {
+	if lang := format.Match(cl.lang); lang != "" && cl.caps.Locales[lang] {
+		cmd = append([]string{cmd[0], "--lang", lang}, cmd[1:]...)
+	}
+	width := cl.width
+	if width > 0 && cl.caps.Options["width"] {
+		cmd = append([]string{cmd[0], "--width", strconv.Itoa(width)}, cmd[1:]...)
+		width = 0
+	}
+	b, err := cl.command(cmd...)
+	if err != nil || isError(b) || width <= 0 {
+		return cl.print(b, err)
+	}
+	var out bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, len(b)+1)
+	for s.Scan() {
+		out.WriteString(format.Fit(s.Text(), width) + "\n")
+	}
+	return cl.print(out.Bytes(), nil)
+}
+
+// print writes the answer of the server, unless it is an error. Pastes are written as they
+// are, whatever they start with.
+func (cl *client) print(b []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if isError(b) {
+		msg := strings.TrimPrefix(strings.TrimPrefix(string(b), "# "), "ERR: ")
+		return fmt.Errorf("%s", strings.TrimSpace(msg))
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+func (cl *client) printPaste(b []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// runClient handles `pastry client [flags] <command> [args]`.
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("pastry client", flag.ExitOnError)
+	cl := &client{}
+	fs.StringVar(&cl.readAddr, "read-addr", env("PASTRY_READ_ADDR", "localhost:9182"), "Read port of the server (PASTRY_READ_ADDR)")
+	fs.StringVar(&cl.writeAddr, "write-addr", env("PASTRY_WRITE_ADDR", "localhost:9181"), "Write port of the server (PASTRY_WRITE_ADDR)")
+	fs.StringVar(&cl.key, "key", env("PASTRY_KEY", ""), "Device key pastes are sent with (PASTRY_KEY)")
+	clip := fs.Bool("clip", false, "With paste, put it on the clipboard board")
+	fs.StringVar(&cl.lang, "lang", env("LC_ALL", env("LC_MESSAGES", env("LANG", ""))), "Language of the times of list, grep and history (LC_ALL, LC_MESSAGES or LANG)")
+	fs.IntVar(&cl.width, "width", envInt("COLUMNS", 0), "Cut the lines of list, grep and history to this many columns, 0 for no limit (COLUMNS)")
+	fs.Parse(args)
+	cl.readAddr, cl.writeAddr = localAddr(cl.readAddr), localAddr(cl.writeAddr)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("Usage: pastry client [flags] paste|tail [n]|<command> [args]")
+	}
+	b, err := cl.command("caps")
+	if err != nil {
+		return err
+	}
+	cl.caps = parseCaps(b)
+
+	cmd := fs.Args()
+	switch cmd[0] {
+	case "paste":
+		return cl.paste(*clip)
+	case "tail":
+		n := 1
+		if len(cmd) > 1 {
+			if n, err = strconv.Atoi(cmd[1]); err != nil || n < 1 {
+				return fmt.Errorf("Usage: pastry client tail [n]")
+			}
+		}
+		return cl.tail(n)
+	case "caps":
+		return cl.print(b, nil)
+	}
+	if err := cl.need(cmd[0]); err != nil {
+		return err
+	}
+	switch cmd[0] {
+	case "get", "export":
+		return cl.printPaste(cl.command(cmd...))
+	case "list", "grep", "history":
+		return cl.listing(cmd)
+	}
+	return cl.print(cl.command(cmd...))
+}
@@ -0,0 +1,320 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+// Package format is how pastes are shown line by line, by list and grep on the read port,
+// in the web GUI and by the client: times relative to now in the language asked for, and
+// columns padded and cut by how wide they are on screen rather than by bytes.
+//
+// A Formatter is a value with the time it formats against, so the lines of one answer all
+// agree on what now is, and nothing is shared between goroutines.
+package format
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
+)
+
+// WhenColumns is how wide the time column of list and grep is padded to.
+const WhenColumns = 20
+
+// locale is the words of relative times in one language.
+type locale struct {
+	now    string
+	past   string // around the amount, "%s ago"
+	future string
+	// second, minute, hour, day, week, month and year, singular and plural
+	units [7][2]string
+	// a long while, past and future
+	long [2]string
+
+	pastTable, futureTable []humanize.RelTimeMagnitude
+}
+
+var locales = map[string]*locale{
+	"en": {
+		now: "now", past: "%s ago", future: "%s from now",
+		units: [7][2]string{{"second", "seconds"}, {"minute", "minutes"}, {"hour", "hours"}, {"day", "days"},
+			{"week", "weeks"}, {"month", "months"}, {"year", "years"}},
+		long: [2]string{"a long while ago", "a long while from now"},
+	},
+	"de": {
+		now: "jetzt", past: "vor %s", future: "in %s",
+		units: [7][2]string{{"Sekunde", "Sekunden"}, {"Minute", "Minuten"}, {"Stunde", "Stunden"}, {"Tag", "Tagen"},
+			{"Woche", "Wochen"}, {"Monat", "Monaten"}, {"Jahr", "Jahren"}},
+		long: [2]string{"vor langer Zeit", "in ferner Zukunft"},
+	},
+	"sv": {
+		now: "nu", past: "%s sedan", future: "om %s",
+		units: [7][2]string{{"sekund", "sekunder"}, {"minut", "minuter"}, {"timme", "timmar"}, {"dag", "dagar"},
+			{"vecka", "veckor"}, {"månad", "månader"}, {"år", "år"}},
+		long: [2]string{"för länge sedan", "långt fram i tiden"},
+	},
+}
+
+// Locales are the languages times can be written in.
+var Locales = []string{"en", "de", "sv"}
+
+func init() {
+	for _, l := range locales {
+		l.pastTable, l.futureTable = l.table(l.past, l.long[0]), l.table(l.future, l.long[1])
+	}
+}
+
+// table is the magnitudes of humanize.Time, with the words of l, which makes English
+// come out just as humanize writes it.
+func (l *locale) table(around, long string) []humanize.RelTimeMagnitude {
+	const (
+		second = iota
+		minute
+		hour
+		day
+		week
+		month
+		year
+	)
+	one := func(u int) string { return fmt.Sprintf(around, "1 "+l.units[u][0]) }
+	many := func(u int) string { return fmt.Sprintf(around, "%d "+l.units[u][1]) }
+	return []humanize.RelTimeMagnitude{
+		{D: time.Second, Format: l.now, DivBy: time.Second},
+		{D: 2 * time.Second, Format: one(second), DivBy: 1},
+		{D: time.Minute, Format: many(second), DivBy: time.Second},
+		{D: 2 * time.Minute, Format: one(minute), DivBy: 1},
+		{D: time.Hour, Format: many(minute), DivBy: time.Minute},
+		{D: 2 * time.Hour, Format: one(hour), DivBy: 1},
+		{D: humanize.Day, Format: many(hour), DivBy: time.Hour},
+		{D: 2 * humanize.Day, Format: one(day), DivBy: 1},
+		{D: humanize.Week, Format: many(day), DivBy: humanize.Day},
+		{D: 2 * humanize.Week, Format: one(week), DivBy: 1},
+		{D: humanize.Month, Format: many(week), DivBy: humanize.Week},
+		{D: 2 * humanize.Month, Format: one(month), DivBy: 1},
+		{D: humanize.Year, Format: many(month), DivBy: humanize.Month},
+		{D: 18 * humanize.Month, Format: one(year), DivBy: 1},
+		{D: 2 * humanize.Year, Format: fmt.Sprintf(around, "2 "+l.units[year][1]), DivBy: 1},
+		{D: humanize.LongTime, Format: many(year), DivBy: humanize.Year},
+		{D: 1<<63 - 1, Format: strings.ReplaceAll(long, "%", "%%"), DivBy: 1},
+	}
+}
+
+// Match is the first of langs there is a locale for, or "". They can be POSIX locales like
+// sv_SE.UTF-8 or language tags like de-AT, with or without ;q=.
+func Match(langs ...string) string {
+	for _, s := range langs {
+		s, _, _ = strings.Cut(s, ";")
+		s = strings.ToLower(strings.TrimSpace(s))
+		if i := strings.IndexAny(s, "_-.@"); i >= 0 {
+			s = s[:i]
+		}
+		if _, ok := locales[s]; ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// Formatter formats against the time it was made for, in its language.
+type Formatter struct {
+	now     time.Time
+	loc     *locale
+	columns int
+}
+
+// New makes a Formatter for lang, English when there is no locale for it.
+func New(lang string, now time.Time) Formatter {
+	l, ok := locales[Match(lang)]
+	if !ok {
+		l = locales["en"]
+	}
+	return Formatter{now: now, loc: l}
+}
+
+// Columns is f with the rows cut to n columns, the width of the terminal they are shown on.
+// n of 0 or less is no limit.
+func (f Formatter) Columns(n int) Formatter {
+	f.columns = n
+	return f
+}
+
+// Time is t relative to now, like "3 minutes ago".
+func (f Formatter) Time(t time.Time) string {
+	table := f.loc.pastTable
+	if t.After(f.now) {
+		table = f.loc.futureTable
+	}
+	return humanize.CustomRelTime(t, f.now, "", "", table)
+}
+
+// Since is t, which has happened, relative to now. A t after now is from a clock that was
+// ahead, or one that has gone back since, and is "now" rather than "in 2 hours".
+func (f Formatter) Since(t time.Time) string {
+	if t.After(f.now) {
+		t = f.now
+	}
+	return f.Time(t)
+}
+
+// Painter colors the columns of a row, the read port does with --color.
+type Painter interface {
+	Index(string) string
+	When(string) string
+}
+
+// Plain is the Painter that leaves all as it is.
+type Plain struct{}
+
+func (Plain) Index(s string) string { return s }
+func (Plain) When(s string) string  { return s }
+
+// Row is a line of list, or of grep when line, counted from 1, isn't 0: the index of the
+// paste right aligned in three, the line number likewise, the time padded to WhenColumns
+// and text, tab separated, with text cut to the Columns of f. There is no newline at the end.
+func (f Formatter) Row(p Painter, index, line int, when time.Time, text string) string {
+	var b strings.Builder
+	b.WriteString(p.Index(fmt.Sprintf("#% 3d", index)))
+	b.WriteByte('\t')
+	if line > 0 {
+		fmt.Fprintf(&b, "% 3d\t", line)
+	}
+	w := f.Since(when)
+	b.WriteString(p.When(w))
+	b.WriteString(Padding(w, WhenColumns))
+	b.WriteByte('\t')
+	return f.Line(b.String(), text)
+}
+
+// Line is prefix and text, with text cut so the line is no wider than the Columns of f on a
+// terminal. prefix is kept as it is, with its tabs going to the next multiple of eight.
+func (f Formatter) Line(prefix, text string) string {
+	if f.columns <= 0 {
+		return prefix + text
+	}
+	n := f.columns - column(prefix)
+	if n < 1 {
+		n = 1
+	}
+	return prefix + Truncate(text, n)
+}
+
+// Width is how many columns s takes on a terminal. Color escapes take none.
+func Width(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		if l := escape(s[i:]); l > 0 {
+			i += l
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		n += runeWidth(r)
+		i += size
+	}
+	return n
+}
+
+// column is where the end of s is on a terminal, with tabs going to the next multiple of
+// eight.
+func column(s string) int {
+	col := 0
+	for _, part := range strings.SplitAfter(s, "\t") {
+		if strings.HasSuffix(part, "\t") {
+			col += Width(part[:len(part)-1])
+			col += 8 - col%8
+		} else {
+			col += Width(part)
+		}
+	}
+	return col
+}
+
+// escape is the length of the ANSI escape sequence s starts with, like the colors of grep
+// --color, or 0.
+func escape(s string) int {
+	if len(s) < 2 || s[0] != '\x1b' || s[1] != '[' {
+		return 0
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i] >= 0x40 && s[i] <= 0x7e {
+			return i + 1
+		}
+		if s[i] < 0x20 || s[i] > 0x3f {
+			return 0
+		}
+	}
+	return 0
+}
+
+// runeWidth is 2 for the East Asian wide characters and emoji, 0 for the combining and
+// control ones and 1 for the rest.
+func runeWidth(r rune) int {
+	switch {
+	case r == utf8.RuneError:
+		return 1
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) || unicode.IsControl(r):
+		return 0
+	case r >= 0x1100 && r <= 0x115f, r >= 0x2e80 && r <= 0x303e, r >= 0x3041 && r <= 0x33ff,
+		r >= 0x3400 && r <= 0x4dbf, r >= 0x4e00 && r <= 0x9fff, r >= 0xa000 && r <= 0xa4cf,
+		r >= 0xac00 && r <= 0xd7a3, r >= 0xf900 && r <= 0xfaff, r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60, r >= 0xffe0 && r <= 0xffe6, r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f900 && r <= 0x1f9ff, r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
+
+// Padding is the spaces that make s n columns wide, none if it is that already.
+func Padding(s string, n int) string {
+	if w := Width(s); w < n {
+		return strings.Repeat(" ", n-w)
+	}
+	return ""
+}
+
+// Truncate cuts s to n columns, the last of them an ellipsis. n of 0 or less is no limit.
+// Colors cut off in the middle are reset after the ellipsis.
+func Truncate(s string, n int) string {
+	if n <= 0 || Width(s) <= n {
+		return s
+	}
+	w, colored := 0, false
+	for i := 0; i < len(s); {
+		if l := escape(s[i:]); l > 0 {
+			i, colored = i+l, true
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if w+runeWidth(r) > n-1 {
+			if colored {
+				return s[:i] + "…\x1b[0m"
+			}
+			return s[:i] + "…"
+		}
+		w += runeWidth(r)
+		i += size
+	}
+	return s
+}
+
+// Fit cuts a line of plain text to width columns, with the tabs taken as going to the next
+// multiple of eight like a terminal does. A width of 0 or less leaves it as it is.
+func Fit(line string, width int) string {
+	if width <= 0 {
+		return line
+	}
+	var b strings.Builder
+	col := 0
+	for _, r := range line {
+		if r == '\t' {
+			next := col + 8 - col%8
+			b.WriteString(strings.Repeat(" ", next-col))
+			col = next
+			continue
+		}
+		b.WriteRune(r)
+		col += runeWidth(r)
+	}
+	return Truncate(b.String(), width)
+}
@@ -0,0 +1,213 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package format
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var now = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+var durations = []time.Duration{
+	0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond, 2 * time.Second, 59 * time.Second,
+	time.Minute, 90 * time.Second, 2 * time.Minute, 59 * time.Minute, time.Hour, 2 * time.Hour, 23 * time.Hour,
+	humanize.Day, 2 * humanize.Day, 6 * humanize.Day, humanize.Week, 2 * humanize.Week, 29 * humanize.Day,
+	humanize.Month, 2 * humanize.Month, 11 * humanize.Month, humanize.Year, 18 * humanize.Month,
+	2 * humanize.Year, 10 * humanize.Year, humanize.LongTime, 100 * humanize.Year,
+}
+
+func TestTimeEnglishIsHumanize(t *testing.T) {
+	f := New("en", now)
+	for _, d := range durations {
+		for _, then := range []time.Time{now.Add(-d), now.Add(d)} {
+			if got, want := f.Time(then), humanize.RelTime(then, now, "ago", "from now"); got != want {
+				t.Errorf("Time(now%+v) = %q, humanize has %q", then.Sub(now), got, want)
+			}
+		}
+	}
+}
+
+func TestSince(t *testing.T) {
+	f := New("sv", now)
+	if got := f.Since(now.Add(-3 * time.Minute)); got != "3 minuter sedan" {
+		t.Errorf("Since(now-3m) = %q", got)
+	}
+	if got := f.Since(now.Add(2 * time.Hour)); got != "nu" {
+		t.Errorf("Since(now+2h) = %q, want nu", got)
+	}
+}
+
+func TestTimeLocales(t *testing.T) {
+	for _, tc := range []struct {
+		lang string
+		d    time.Duration
+		want string
+	}{
+		{"sv", 0, "nu"},
+		{"sv", -3 * time.Minute, "3 minuter sedan"},
+		{"sv", -time.Hour, "1 timme sedan"},
+		{"sv", 2 * humanize.Day, "om 2 dagar"},
+		{"sv_SE.UTF-8", -5 * humanize.Year, "5 år sedan"},
+		{"de", -3 * time.Minute, "vor 3 Minuten"},
+		{"de-AT", -humanize.Day, "vor 1 Tag"},
+		{"de", 3 * humanize.Week, "in 3 Wochen"},
+		{"de", -100 * humanize.Year, "vor langer Zeit"},
+		{"fr", -3 * time.Minute, "3 minutes ago"},
+		{"", time.Minute, "1 minute from now"},
+	} {
+		if got := New(tc.lang, now).Time(now.Add(tc.d)); got != tc.want {
+			t.Errorf("%s: Time(now%+v) = %q, want %q", tc.lang, tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		langs []string
+		want  string
+	}{
+		{[]string{"sv_SE.UTF-8"}, "sv"},
+		{[]string{"fr-CH", " de;q=0.8", "en;q=0.5"}, "de"},
+		{[]string{"C.UTF-8", "POSIX"}, ""},
+		{[]string{"EN"}, "en"},
+		{nil, ""},
+	} {
+		if got := Match(tc.langs...); got != tc.want {
+			t.Errorf("Match(%q) = %q, want %q", tc.langs, got, tc.want)
+		}
+	}
+}
+
+func TestWidth(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"apple", 5},
+		{"för 3 minuter sedan", 19},
+		{"é", 1},
+		{"日本語", 6},
+		{"🍰 cake", 7},
+		{"\x1b", 0},
+		{"\xff\xfe", 2},
+		{"\x1b[1;31mapple\x1b[0m", 5},
+	} {
+		if got := Width(tc.s); got != tc.want {
+			t.Errorf("Width(%q) = %d, want %d", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"the first line", 0, "the first line"},
+		{"the first line", -1, "the first line"},
+		{"the first line", 14, "the first line"},
+		{"the first line", 9, "the firs…"},
+		{"räksmörgås", 5, "räks…"},
+		{"日本語です", 5, "日本…"},
+		{"日本語です", 6, "日本…"},
+		{"abc", 1, "…"},
+		{"a \x1b[1;31mred\x1b[0m apple", 4, "a \x1b[1;31mr…\x1b[0m"},
+		{"\x1b[1;31mred\x1b[0m apple", 4, "\x1b[1;31mred\x1b[0m…\x1b[0m"},
+	} {
+		got := Truncate(tc.s, tc.n)
+		if got != tc.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tc.s, tc.n, got, tc.want)
+		}
+		if tc.n > 0 && Width(got) > tc.n {
+			t.Errorf("Truncate(%q, %d) is %d wide", tc.s, tc.n, Width(got))
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		n    int
+		want int
+	}{
+		{"now", 20, 17},
+		{"för 3 minuter sedan", 20, 1},
+		{"日本語", 20, 14},
+		{"a long while from now", 20, 0},
+	} {
+		if got := Padding(tc.s, tc.n); got != strings.Repeat(" ", tc.want) {
+			t.Errorf("Padding(%q, %d) = %q, want %d spaces", tc.s, tc.n, got, tc.want)
+		}
+	}
+}
+
+type brackets struct{}
+
+func (brackets) Index(s string) string { return "[" + s + "]" }
+func (brackets) When(s string) string  { return "<" + s + ">" }
+
+func TestRow(t *testing.T) {
+	f := New("en", now)
+	for _, tc := range []struct {
+		p           Painter
+		index, line int
+		when        time.Time
+		want        string
+	}{
+		{Plain{}, 3, 0, now, "#  3\tnow                 \ttext"},
+		{Plain{}, 123, 7, now.Add(-3 * time.Minute), "# 123\t  7\t3 minutes ago       \ttext"},
+		// the padding stays outside of the colors
+		{brackets{}, 3, 0, now, "[#  3]\t<now>                 \ttext"},
+	} {
+		if got := f.Row(tc.p, tc.index, tc.line, tc.when, "text"); got != tc.want {
+			t.Errorf("Row(%d, %d) = %q, want %q", tc.index, tc.line, got, tc.want)
+		}
+	}
+	// cut to the width of the terminal, the text starts at 32 and with a line number at 40
+	for _, tc := range []struct {
+		columns, line int
+		want          string
+	}{
+		{36, 0, "#  3\tnow                 \tsom…"},
+		{0, 0, "#  3\tnow                 \tsome longer text"},
+		{80, 0, "#  3\tnow                 \tsome longer text"},
+		{44, 7, "#  3\t  7\tnow                 \tsom…"},
+		{10, 7, "#  3\t  7\tnow                 \t…"},
+	} {
+		if got := f.Columns(tc.columns).Row(Plain{}, 3, tc.line, now, "some longer text"); got != tc.want {
+			t.Errorf("Row in %d columns = %q, want %q", tc.columns, got, tc.want)
+		}
+	}
+	// the time column is as wide in every language
+	for _, lang := range Locales {
+		row := New(lang, now).Row(Plain{}, 1, 0, now.Add(-3*time.Minute), "text")
+		if cols := strings.Split(row, "\t"); Width(cols[1]) != WhenColumns {
+			t.Errorf("%s: the time column of %q is %d wide", lang, row, Width(cols[1]))
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		width int
+		want  string
+	}{
+		{"#  1\tnow\ttext", 0, "#  1\tnow\ttext"},
+		{"#  1\tnow\ttext", 80, "#  1    now     text"},
+		{"#  1\tnow\ttext", 12, "#  1    now…"},
+		{"日本語\tx", 9, "日本語  x"},
+	} {
+		if got := Fit(tc.line, tc.width); got != tc.want {
+			t.Errorf("Fit(%q, %d) = %q, want %q", tc.line, tc.width, got, tc.want)
+		}
+	}
+}
@@ -3,7 +3,6 @@ module pastry
 go 1.19
 
 require (
-	gerace.dev/zipfs v0.2.0 // indirect
-	github.com/OpenPeeDeeP/xdg v1.0.0 // indirect
-	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/OpenPeeDeeP/xdg v1.0.0
+	github.com/dustin/go-humanize v1.0.1
 )
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+// pastry - a pastebin server for your home network
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"pastry/pastryd"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		if err := runClient(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "pastry:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := pastryd.Export(pastryd.ParseConfig(os.Args[2:]), os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		n, err := pastryd.Import(pastryd.ParseConfig(os.Args[2:]), os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Imported %d pastes", n)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		report, err := pastryd.GC(pastryd.ParseConfig(os.Args[2:]))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print(report)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runService(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := pastryd.ParseConfig(os.Args[1:])
+	if cfg.LogStdout {
+		log.SetOutput(os.Stdout)
+	}
+	s, err := pastryd.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Running as PID 1 in a container there are no default signal handlers.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := s.Reload(); err != nil {
+				log.Printf("Keeping the limits in effect: %v", err)
+			} else {
+				log.Printf("Reloaded %s", cfg.LimitsFile)
+			}
+		}
+	}()
+
+	if err := s.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Wait(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("pastry stopped")
+}
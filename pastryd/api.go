@@ -0,0 +1,464 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API under /api/v1, for scripts and phones that would rather not speak the TCP
+// ports. A paste is addressed by its index, @name or id, like on the read port, and its id
+// is what stays the same as pastes come and go.
+
+const apiPrefix = "/api/v1/pastes"
+
+// pasteMeta is what integrations get to know of a paste in the same shape everywhere: in
+// the API, the webhook, the paste events of /presence and pastry export.
+type pasteMeta struct {
+	ID       string     `json:"id"`
+	Hash     string     `json:"hash,omitempty"` // hex SHA-256 of the text, or of the file of file pastes
+	Size     int64      `json:"size"`           // in bytes, of the text or the file
+	Lang     string     `json:"lang,omitempty"`
+	Tags     []string   `json:"tags,omitempty"`
+	Origin   string     `json:"origin,omitempty"` // the device it came from
+	Expires  *time.Time `json:"expires,omitempty"`
+	Revision string     `json:"revision,omitempty"` // changes with any edit, see ifMatch
+}
+
+func newPasteMeta(e *entry) pasteMeta {
+	return newAPIPaste(0, e).pasteMeta
+}
+
+// apiPaste is a paste as the API shows it.
+type apiPaste struct {
+	Index int `json:"index"`
+	pasteMeta
+	Text     string     `json:"text"`
+	When     time.Time  `json:"when"`
+	Title    string     `json:"title,omitempty"`
+	Name     string     `json:"name,omitempty"`
+	Board    string     `json:"board,omitempty"`
+	Category string     `json:"category,omitempty"`
+	Publish  *time.Time `json:"publish,omitempty"`
+	Remind   *time.Time `json:"remind,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"` // of the last PUT or PATCH
+	Strict   bool       `json:"strict,omitempty"`
+	Mime     string     `json:"mime,omitempty"`  // of file pastes, which are at /download/<index>
+	Count    *textCount `json:"count,omitempty"` // of text pastes, as count has it
+}
+
+func newAPIPaste(i int, e *entry) apiPaste {
+	a := apiPaste{
+		pasteMeta: pasteMeta{
+			ID:      e.ID,
+			Hash:    e.Hash,
+			Size:    e.Size,
+			Lang:    e.Lang,
+			Tags:    e.Tags,
+			Origin:  e.Origin,
+			Expires: timeOpt(e.Expires),
+		},
+		Text:     e.Text,
+		When:     e.When,
+		Title:    e.Title,
+		Name:     e.Name,
+		Board:    e.Board,
+		Category: e.Category,
+		Publish:  timeOpt(e.Publish),
+		Remind:   timeOpt(e.Remind),
+		Modified: timeOpt(e.Modified),
+		Strict:   e.Strict,
+		Mime:     e.Mime,
+	}
+	if e.File == "" {
+		c := countText(e.Text)
+		a.Hash, a.Size, a.Count = textHash(e.Text), int64(len(e.Text)), &c
+	}
+	// of everything but the index
+	b, _ := json.Marshal(a)
+	a.Index, a.Revision = i, strings.Trim(etag(b), `"`)
+	return a
+}
+
+// apiNewPaste is what POST takes. The times are RFC 3339 or ages like 1h and 2d.
+type apiNewPaste struct {
+	Text    string   `json:"text"`
+	Title   string   `json:"title"`
+	Name    string   `json:"name"`
+	Board   string   `json:"board"`
+	Lang    string   `json:"lang"`
+	Tags    []string `json:"tags"`
+	Expires string   `json:"expires"`
+	Publish string   `json:"publish"`
+	Remind  string   `json:"remind"`
+	Strict  bool     `json:"strict"`
+}
+
+// apiEdit is what PUT and PATCH take. PUT replaces the text and everything else of the paste
+// that POST sets, what it leaves out is cleared. PATCH changes only what it gives, and ""
+// clears a time. A revision makes it fail unless the paste still is at that revision.
+type apiEdit struct {
+	Text    *string   `json:"text"`
+	Title   *string   `json:"title"`
+	Name    *string   `json:"name"`
+	Board   *string   `json:"board"`
+	Lang    *string   `json:"lang"`
+	Tags    *[]string `json:"tags"`
+	Expires *string   `json:"expires"`
+	Publish *string   `json:"publish"`
+	Remind  *string   `json:"remind"`
+	Strict  *bool     `json:"strict"`
+
+	Revision string `json:"revision"`
+}
+
+// wantsJSON is whether the Accept header of r prefers JSON to HTML, as scripts asking for
+// application/json do and browsers don't.
+func wantsJSON(r *http.Request) bool {
+	var js, html, any float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		typ, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "q" {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(typ)) {
+		case "application/json":
+			js = math.Max(js, q)
+		case "text/html":
+			html = math.Max(html, q)
+		case "*/*", "text/*":
+			any = math.Max(any, q)
+		}
+	}
+	if html == 0 {
+		html = any
+	}
+	return js > html
+}
+
+// ifMatch checks that the paste a client changes is still the one it saw, at the revision of
+// If-Match or of rev, from the body or the query. Otherwise it answers 409 with the current
+// revision as the ETag, to fetch it again and retry or merge.
+func ifMatch(w http.ResponseWriter, r *http.Request, a apiPaste, rev string) bool {
+	ok := true
+	if h := r.Header.Get("If-Match"); h != "" {
+		ok = false
+		for _, tag := range strings.Split(h, ",") {
+			tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+			ok = ok || tag == "*" || tag == a.Revision
+		}
+	}
+	if ok && (rev == "" || rev == a.Revision) {
+		return true
+	}
+	w.Header().Set("ETag", `"`+a.Revision+`"`)
+	apiError(w, http.StatusConflict, "The paste was changed meanwhile, it is at revision "+a.Revision)
+	return false
+}
+
+func replyJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	replyJSON(w, status, map[string]string{"error": msg})
+}
+
+// listQuery is what the list of pastes is narrowed down to. limit and offset count from the
+// newest, so that limit=5 is the latest five, and the list stays oldest first.
+type listQuery struct {
+	limit, offset int
+	since         time.Time // pasted or edited after
+	text          string    // in the text or title, lowercase
+}
+
+func parseListQuery(q url.Values, now time.Time) (listQuery, error) {
+	var lq listQuery
+	for _, n := range []struct {
+		name string
+		v    *int
+	}{{"limit", &lq.limit}, {"offset", &lq.offset}} {
+		if s := q.Get(n.name); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 {
+				return lq, fmt.Errorf("Invalid %s: %s", n.name, s)
+			}
+			*n.v = v
+		}
+	}
+	if s := q.Get("since"); s != "" {
+		if d, err := parseAge(s); err == nil {
+			lq.since = now.Add(-d)
+		} else if lq.since, err = time.Parse(time.RFC3339, s); err != nil {
+			return lq, fmt.Errorf("Invalid since, neither an age like 1h nor RFC 3339: %s", s)
+		}
+	}
+	lq.text = strings.ToLower(q.Get("q"))
+	return lq, nil
+}
+
+func (lq listQuery) match(e *entry) bool {
+	if !lq.since.IsZero() && !e.lastModified().After(lq.since) {
+		return false
+	}
+	return lq.text == "" || strings.Contains(strings.ToLower(e.Text), lq.text) || strings.Contains(strings.ToLower(e.Title), lq.text)
+}
+
+// page is the part of n pastes, oldest first, that limit and offset leave.
+func (lq listQuery) page(n int) (start, end int) {
+	if end = n - lq.offset; end < 0 {
+		end = 0
+	}
+	if lq.limit > 0 && end > lq.limit {
+		start = end - lq.limit
+	}
+	return start, end
+}
+
+// apiPastes serves /api/v1/pastes, GET lists the pastes and POST adds one.
+func (p *pastry) apiPastes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		now := time.Now()
+		lq, err := parseListQuery(r.URL.Query(), now)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		p.mutex.Lock()
+		var found []int
+		for i, e := range p.texts {
+			if e.visible(now) && lq.match(e) {
+				found = append(found, i)
+			}
+		}
+		start, end := lq.page(len(found))
+		pastes := make([]apiPaste, 0, end-start)
+		for _, i := range found[start:end] {
+			pastes = append(pastes, newAPIPaste(i, p.texts[i]))
+		}
+		p.mutex.Unlock()
+		// how many there are to page through
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(found)))
+		replyJSON(w, http.StatusOK, pastes)
+	case "POST":
+		p.apiCreate(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		apiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (p *pastry) apiCreate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(p.limit().MaxPaste)+64*1024)
+	var n apiNewPaste
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		apiError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	a, status, err := p.create(r, n)
+	if err != nil {
+		apiError(w, status, err.Error())
+		return
+	}
+	if a.ID != "" {
+		w.Header().Set("Location", apiPrefix+"/"+a.ID)
+	}
+	replyJSON(w, status, a)
+}
+
+// create adds the paste n of the request r, the status is 201 or the one of the error.
+func (p *pastry) create(r *http.Request, n apiNewPaste) (apiPaste, int, error) {
+	if len(n.Text) > p.limit().MaxPaste {
+		return apiPaste{}, http.StatusRequestEntityTooLarge, fmt.Errorf("The text is longer than max-paste, %d bytes", p.limit().MaxPaste)
+	}
+	name, err := cleanName(strings.TrimSpace(n.Name))
+	if err != nil {
+		return apiPaste{}, http.StatusBadRequest, err
+	}
+	e := &entry{
+		Text:   n.Text,
+		Title:  strings.TrimSpace(n.Title),
+		Name:   name,
+		Board:  strings.TrimSpace(n.Board),
+		Lang:   strings.TrimSpace(n.Lang),
+		Tags:   n.Tags,
+		Origin: deviceName(r),
+		Strict: n.Strict,
+	}
+	now := time.Now()
+	for _, t := range []struct {
+		s    string
+		time *time.Time
+	}{{n.Expires, &e.Expires}, {n.Publish, &e.Publish}, {n.Remind, &e.Remind}} {
+		if t.s == "" {
+			continue
+		}
+		if *t.time, err = parseWhen(t.s, now); err != nil {
+			return apiPaste{}, http.StatusBadRequest, err
+		}
+	}
+	if rt := p.requestRoute(r); rt != nil {
+		rt.route(e)
+	}
+	if err := p.addEntry(e); err != nil {
+		return apiPaste{}, storeStatus(err), fmt.Errorf("Not stored: %v", err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := len(p.texts) - 1; i >= 0; i-- {
+		// a lazy board keeps the paste e repeats rather than e
+		if t := p.texts[i]; t == e || t.Text == e.Text && t.Board == e.Board {
+			return newAPIPaste(i, t), http.StatusCreated, nil
+		}
+	}
+	return newAPIPaste(-1, e), http.StatusCreated, nil
+}
+
+// apiPaste serves /api/v1/pastes/<id>, GET shows the paste, PUT and PATCH edit it and
+// DELETE drops it.
+func (p *pastry) apiPaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" || r.Method == "PATCH" {
+		p.apiEdit(w, r)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i, e, ok := p.lookupID(strings.TrimPrefix(r.URL.Path, apiPrefix+"/"))
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such paste")
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		if markSeen(e, deviceName(r), time.Now()) {
+			p.store()
+		}
+		a := newAPIPaste(i, e)
+		w.Header().Set("ETag", `"`+a.Revision+`"`)
+		replyJSON(w, http.StatusOK, a)
+	case "DELETE":
+		if !ifMatch(w, r, newAPIPaste(i, e), r.URL.Query().Get("revision")) {
+			return
+		}
+		if err := p.drop(i); err != nil {
+			apiError(w, http.StatusInternalServerError, "Not stored: "+err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// apiEdit changes a paste in place, it keeps its time, id and index and gets a modified time.
+func (p *pastry) apiEdit(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(p.limit().MaxPaste)+64*1024)
+	var ed apiEdit
+	if err := json.NewDecoder(r.Body).Decode(&ed); err != nil {
+		apiError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	put := r.Method == "PUT"
+	switch {
+	case put && ed.Text == nil:
+		apiError(w, http.StatusBadRequest, "PUT replaces the whole paste and needs its text, PATCH changes only what it is given")
+		return
+	case ed.Text != nil && len(*ed.Text) > p.limit().MaxPaste:
+		apiError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The text is longer than max-paste, %d bytes", p.limit().MaxPaste))
+		return
+	}
+	var name string
+	if ed.Name != nil {
+		var err error
+		if name, err = cleanName(strings.TrimSpace(*ed.Name)); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ed.Name = &name
+	}
+	now := time.Now()
+	times := make(map[*string]time.Time)
+	for _, s := range []*string{ed.Expires, ed.Publish, ed.Remind} {
+		if s == nil || *s == "" {
+			continue
+		}
+		t, err := parseWhen(*s, now)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		times[s] = t
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, e, ok := p.lookupID(strings.TrimPrefix(r.URL.Path, apiPrefix+"/"))
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such paste")
+		return
+	}
+	if !ifMatch(w, r, newAPIPaste(i, e), ed.Revision) {
+		return
+	}
+	for _, f := range []struct {
+		v   *string
+		dst *string
+	}{{ed.Title, &e.Title}, {ed.Name, &e.Name}, {ed.Board, &e.Board}, {ed.Lang, &e.Lang}} {
+		if f.v != nil {
+			*f.dst = strings.TrimSpace(*f.v)
+		} else if put {
+			*f.dst = ""
+		}
+	}
+	for _, f := range []struct {
+		v   *string
+		dst *time.Time
+	}{{ed.Expires, &e.Expires}, {ed.Publish, &e.Publish}, {ed.Remind, &e.Remind}} {
+		if f.v != nil || put {
+			*f.dst = times[f.v]
+		}
+	}
+	if ed.Tags != nil {
+		e.Tags = *ed.Tags
+	} else if put {
+		e.Tags = nil
+	}
+	if ed.Strict != nil {
+		e.Strict = *ed.Strict
+	} else if put {
+		e.Strict = false
+	}
+	if ed.Text != nil {
+		e.Text, e.Original = *ed.Text, ""
+		p.normalize(e)
+		e.Category = categorize(e)
+	}
+	e.Modified = now
+	if err := p.store(); err != nil {
+		apiError(w, http.StatusInternalServerError, "Not stored: "+err.Error())
+		return
+	}
+	a := newAPIPaste(i, e)
+	w.Header().Set("ETag", `"`+a.Revision+`"`)
+	replyJSON(w, http.StatusOK, a)
+}
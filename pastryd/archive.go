@@ -0,0 +1,508 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Metadata of exported pastes is kept in PAX records with this vendor prefix.
+const paxPrefix = "PASTRY."
+
+// Export writes everything in the store of cfg as a JSON archive, files included, which
+// Import reads into another store, or on another machine.
+func Export(cfg Config, w io.Writer) error {
+	s, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	s.p.mutex.Lock()
+	err = s.p.writeJSON(w)
+	s.p.mutex.Unlock()
+	if cerr := s.Stop(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Import adds the pastes of an archive, written by Export or the export command, to the
+// store of cfg and returns how many it took, see importEntries. No pastry may be running on the store, as it
+// would write over them.
+func Import(cfg Config, r io.Reader) (int, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := readArchive(b)
+	if err != nil {
+		return 0, err
+	}
+	s, err := New(cfg)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.p.importEntries(entries)
+	if cerr := s.Stop(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// parseRange turns "3", "-1", "0-20" and lists of them into indexes. No arguments means all.
+// Must be called with the mutex held.
+func (p *pastry) parseRange(args []string) ([]int, error) {
+	var idx []int
+	if len(args) == 0 {
+		for i := range p.texts {
+			idx = append(idx, i)
+		}
+		return idx, nil
+	}
+
+	for _, a := range args {
+		if from, to, ok := strings.Cut(a, "-"); ok && from != "" {
+			f, err := p.index(from)
+			if err != nil {
+				return nil, err
+			}
+			t, err := p.index(to)
+			if err != nil {
+				return nil, err
+			}
+			for i := f; i <= t; i++ {
+				idx = append(idx, i)
+			}
+			continue
+		}
+		i, err := p.index(a)
+		if err != nil {
+			return nil, err
+		}
+		idx = append(idx, i)
+	}
+	return idx, nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func paxRecords(e *entry) map[string]string {
+	rec := map[string]string{
+		"id":      e.ID,
+		"title":   e.Title,
+		"name":    e.Name,
+		"board":   e.Board,
+		"lang":    e.Lang,
+		"tags":    strings.Join(e.Tags, ","),
+		"expires": formatTime(e.Expires),
+		"publish": formatTime(e.Publish),
+		"remind":  formatTime(e.Remind),
+	}
+	if e.Strict {
+		rec["strict"] = "true"
+	}
+	if e.Modified.After(e.When) {
+		rec["modified"] = formatTime(e.Modified)
+	}
+	return paxPrefixed(rec)
+}
+
+// paxTomb is the PAX records of a tombstone, an empty file after the pastes.
+func paxTomb(t archiveTomb) map[string]string {
+	return paxPrefixed(map[string]string{"id": t.ID, "deleted": formatTime(t.Deleted)})
+}
+
+func paxPrefixed(rec map[string]string) map[string]string {
+	pax := make(map[string]string)
+	for k, v := range rec {
+		if v != "" {
+			pax[paxPrefix+k] = v
+		}
+	}
+	return pax
+}
+
+// writeTar writes one file per paste, named after its index, and then the tombstones. Must be
+// called with the mutex held.
+func (p *pastry) writeTar(w io.Writer, idx []int) error {
+	tw := tar.NewWriter(w)
+	for _, i := range idx {
+		e := p.texts[i]
+		hdr := &tar.Header{
+			Name:       fmt.Sprintf("%04d.txt", i),
+			Mode:       0644,
+			Size:       int64(len(e.Text)),
+			ModTime:    e.When,
+			Format:     tar.FormatPAX,
+			PAXRecords: paxRecords(e),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, e.Text); err != nil {
+			return err
+		}
+	}
+	for _, t := range p.sortedTombs() {
+		hdr := &tar.Header{
+			Name:       "tombstones/" + t.ID,
+			Mode:       0644,
+			ModTime:    t.Deleted,
+			Format:     tar.FormatPAX,
+			PAXRecords: paxTomb(t),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// archiveEntry is a paste in the JSON archive format, see the README. pastry export writes
+// all of it, while an archive written by hand only needs the text.
+type archiveEntry struct {
+	pasteMeta                      // of which import only takes the id, lang, tags, origin and expiry
+	Text      string               `json:"text"`
+	When      time.Time            `json:"when"`
+	Title     string               `json:"title,omitempty"`
+	Name      string               `json:"name,omitempty"`
+	Board     string               `json:"board,omitempty"`
+	Publish   *time.Time           `json:"publish,omitempty"`
+	Remind    *time.Time           `json:"remind,omitempty"`
+	Modified  *time.Time           `json:"modified,omitempty"`
+	Strict    bool                 `json:"strict,omitempty"`
+	Notify    bool                 `json:"notify,omitempty"`
+	Category  string               `json:"category,omitempty"`
+	Seen      map[string]time.Time `json:"seen,omitempty"`
+	Original  string               `json:"original,omitempty"`
+
+	// the file of a file paste, base64 in the JSON
+	Mime string `json:"mime,omitempty"`
+	Data []byte `json:"data,omitempty"`
+
+	// of a tombstone, with the id and nothing else
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+// archiveTomb is a tombstone in the JSON archive format.
+type archiveTomb struct {
+	ID      string    `json:"id"`
+	Deleted time.Time `json:"deleted"`
+}
+
+func optTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func timeOpt(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (a *archiveEntry) entry() *entry {
+	return &entry{
+		ID:            a.ID,
+		Text:          a.Text,
+		When:          a.When,
+		Title:         a.Title,
+		Name:          a.Name,
+		Board:         a.Board,
+		Lang:          a.Lang,
+		Tags:          a.Tags,
+		Expires:       optTime(a.Expires),
+		Publish:       optTime(a.Publish),
+		Remind:        optTime(a.Remind),
+		Modified:      optTime(a.Modified),
+		Strict:        a.Strict,
+		NotifyPublish: a.Notify,
+		Origin:        a.Origin,
+		Category:      a.Category,
+		SeenBy:        a.Seen,
+		Original:      a.Original,
+		Mime:          a.Mime,
+		data:          a.Data,
+		deleted:       optTime(a.Deleted),
+	}
+}
+
+// archived is e in the JSON archive format, with data as its file.
+func archived(e *entry, data []byte) archiveEntry {
+	return archiveEntry{
+		pasteMeta: newPasteMeta(e),
+		Text:      e.Text,
+		When:      e.When,
+		Title:     e.Title,
+		Name:      e.Name,
+		Board:     e.Board,
+		Publish:   timeOpt(e.Publish),
+		Remind:    timeOpt(e.Remind),
+		Modified:  timeOpt(e.Modified),
+		Strict:    e.Strict,
+		Notify:    e.NotifyPublish,
+		Category:  e.Category,
+		Seen:      e.SeenBy,
+		Original:  e.Original,
+		Mime:      e.Mime,
+		Data:      data,
+	}
+}
+
+// writeJSON writes all pastes as a JSON archive, one paste a line, and then the tombstones,
+// oldest first. Must be called with the mutex held.
+func (p *pastry) writeJSON(w io.Writer) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, e := range p.texts {
+		var data []byte
+		if e.File != "" {
+			f, err := p.openFile(e)
+			if err == nil {
+				data, err = io.ReadAll(f)
+				f.Close()
+			}
+			if err != nil {
+				return fmt.Errorf("The file of #%d: %v", i, err)
+			}
+		}
+		if err := writeArchiveLine(w, i, archived(e, data)); err != nil {
+			return err
+		}
+	}
+	for i, t := range p.sortedTombs() {
+		if err := writeArchiveLine(w, len(p.texts)+i, t); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+// sortedTombs are the tombstones as archived, oldest first. Must be called with the mutex held.
+func (p *pastry) sortedTombs() []archiveTomb {
+	tombs := make([]archiveTomb, 0, len(p.tombs))
+	for id, t := range p.tombs {
+		tombs = append(tombs, archiveTomb{ID: id, Deleted: t})
+	}
+	sort.Slice(tombs, func(i, j int) bool {
+		if !tombs[i].Deleted.Equal(tombs[j].Deleted) {
+			return tombs[i].Deleted.Before(tombs[j].Deleted)
+		}
+		return tombs[i].ID < tombs[j].ID
+	})
+	return tombs
+}
+
+// writeArchiveLine writes v as line i of the array of a JSON archive.
+func writeArchiveLine(w io.Writer, i int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if i == 0 {
+		sep = "\n"
+	}
+	_, err = io.WriteString(w, sep+string(b))
+	return err
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
+
+// paxEntry is the reverse of paxRecords.
+func paxEntry(hdr *tar.Header, text string) *entry {
+	rec := func(k string) string { return hdr.PAXRecords[paxPrefix+k] }
+
+	e := &entry{
+		ID:       rec("id"),
+		Text:     text,
+		When:     hdr.ModTime,
+		Modified: parseTime(rec("modified")),
+		Title:    rec("title"),
+		Name:     rec("name"),
+		Board:    rec("board"),
+		Lang:     rec("lang"),
+		Tags:     splitTags(rec("tags")),
+		Expires:  parseTime(rec("expires")),
+		Publish:  parseTime(rec("publish")),
+		Remind:   parseTime(rec("remind")),
+		deleted:  parseTime(rec("deleted")),
+	}
+	e.Strict, _ = strconv.ParseBool(rec("strict"))
+	return e
+}
+
+func readTar(r io.Reader) ([]*entry, error) {
+	var entries []*entry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(b) {
+			return nil, fmt.Errorf("%s is not UTF-8", hdr.Name)
+		}
+		entries = append(entries, paxEntry(hdr, string(b)))
+	}
+}
+
+func readJSON(b []byte) ([]*entry, error) {
+	var archive []archiveEntry
+	if err := json.Unmarshal(b, &archive); err != nil {
+		return nil, err
+	}
+	entries := make([]*entry, 0, len(archive))
+	for i := range archive {
+		entries = append(entries, archive[i].entry())
+	}
+	return entries, nil
+}
+
+// readArchive accepts both the tar written by export and the JSON archive format.
+func readArchive(b []byte) ([]*entry, error) {
+	if t := bytes.TrimSpace(b); len(t) > 0 && t[0] == '[' {
+		return readJSON(t)
+	}
+	if len(b) > 262 && string(b[257:262]) == "ustar" {
+		return readTar(bytes.NewReader(b))
+	}
+	return nil, fmt.Errorf("Neither a tar archive nor JSON")
+}
+
+// importEntries merges pastes into the history by time, keeping their timestamps and ids,
+// and returns how many it took. A paste already here is the same paste, it is only taken
+// when it was changed later than the one here, which it replaces. Tombstones drop the pastes
+// they are of, and pastes there are tombstones of are left out, see tombstone.go, so merging
+// a stale archive takes nothing.
+func (p *pastry) importEntries(entries []*entry) (int, error) {
+	if p.full() {
+		return 0, errStorageFull
+	}
+	p.mutex.Lock()
+	tombs := 0
+	for _, e := range entries {
+		if !e.deleted.IsZero() {
+			p.buryImported(e.ID, e.deleted)
+			tombs++
+		}
+	}
+	// the latest of each id, of the archive or here
+	latest := make(map[string]*entry, len(p.texts)+len(entries))
+	for _, e := range p.texts {
+		latest[e.ID] = e
+	}
+	for _, e := range entries {
+		if l, ok := latest[e.ID]; e.ID != "" && e.deleted.IsZero() && (!ok || e.lastModified().After(l.lastModified())) {
+			latest[e.ID] = e
+		}
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.deleted.IsZero() && (e.ID == "" || latest[e.ID] == e && !p.buried(e)) {
+			kept = append(kept, e)
+		}
+	}
+	entries = kept
+	if tombs > 0 {
+		// or the pastes would be back on a restart before the import is stored
+		p.store()
+	}
+	p.mutex.Unlock()
+
+	for _, e := range entries {
+		if e.data == nil {
+			continue
+		}
+		if !uploadAllowed(e.Mime) {
+			return 0, fmt.Errorf("Unsupported file type: %s", e.Mime)
+		}
+		name, err := p.saveFile(e.data, e.Mime)
+		if err != nil {
+			return 0, err
+		}
+		e.File, e.Size, e.Hash, e.data = name, int64(len(e.data)), textHash(string(e.data)), nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	here := make(map[string]*entry, len(p.texts))
+	for _, e := range p.texts {
+		here[e.ID] = e
+	}
+	replaced := make(map[*entry]bool)
+	now := time.Now().UTC()
+	kept = entries[:0]
+	for _, e := range entries {
+		delete(p.saved, e.File)
+		if old, ok := here[e.ID]; ok && e.ID != "" {
+			if !e.lastModified().After(old.lastModified()) {
+				// changed here while the files were saved
+				continue
+			}
+			replaced[old] = true
+		}
+		// nor in the future, from a machine with its clock ahead
+		if e.When.IsZero() || e.When.After(now) {
+			e.When = now
+		}
+		if !validName(e.Name) {
+			e.Name = ""
+		}
+		if e.ID == "" {
+			e.ID = newID()
+		}
+		if e.Category == "" {
+			e.Category = categorize(e)
+		}
+		kept = append(kept, e)
+	}
+	entries = kept
+	if len(replaced) > 0 {
+		texts := p.texts[:0]
+		for _, e := range p.texts {
+			if !replaced[e] {
+				texts = append(texts, e)
+			} else if e.File != "" {
+				p.unlinked = append(p.unlinked, e.File)
+			}
+		}
+		p.texts = texts
+	}
+	p.mergeByWhen(entries)
+	return len(entries), p.store()
+}
@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// assets are static files served from memory by their paths, with the content type of
+// their names and an ETag of their contents, so browsers revalidate rather than fetch them
+// again.
+type assets map[string]*asset
+
+type asset struct {
+	data []byte
+	mod  time.Time
+	etag string
+	typ  string // for the names mime doesn't know everywhere
+}
+
+// assetTypes are the content types the system may not have for the files of static/.
+var assetTypes = map[string]string{
+	".webmanifest": "application/manifest+json",
+	".txt":         "text/plain; charset=utf-8",
+	".svg":         "image/svg+xml",
+}
+
+// staticAssets are the files of static/, served at the root of the web GUI: the icons and
+// logo, the manifest of the web app and robots.txt, which keeps crawlers out.
+func staticAssets() (assets, error) {
+	dir, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		return nil, err
+	}
+	a := make(assets)
+	err = fs.WalkDir(dir, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(dir, name)
+		if err != nil {
+			return err
+		}
+		// embedded files have no time, the ETag is what browsers revalidate with
+		a[name] = &asset{data: data, etag: etag(data), typ: assetTypes[path.Ext(name)]}
+		return nil
+	})
+	return a, err
+}
+
+// unzip reads all files of the zip archive b at once, so serving them decompresses nothing.
+func unzip(b []byte) (assets, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	a := make(assets)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		a[f.Name] = &asset{data: data, mod: f.Modified, etag: etag(data)}
+	}
+	return a, nil
+}
+
+func (a assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	f, ok := a[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	if f.typ != "" {
+		w.Header().Set("Content-Type", f.typ)
+	}
+	http.ServeContent(w, r, path.Base(name), f.mod, bytes.NewReader(f.data))
+}
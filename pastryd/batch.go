@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// POST /api/v1/pastes:batch takes an array of operations and answers with the result of
+// each, in the same order, so a sync client or an importer needs one request rather than
+// hundreds. The operations run one after the other and one failing doesn't stop the rest.
+// Indexes are resolved as each operation runs, after the deletes before it, ids are safer.
+
+const (
+	batchPath = apiPrefix + ":batch"
+	maxBatch  = 1000
+)
+
+// batchOp is create with a paste, or delete or tag with an id. Tag adds and removes tags.
+// A revision makes delete and tag fail unless the paste is still at it.
+type batchOp struct {
+	Op       string       `json:"op"`
+	Paste    *apiNewPaste `json:"paste,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Add      []string     `json:"add,omitempty"`
+	Remove   []string     `json:"remove,omitempty"`
+	Revision string       `json:"revision,omitempty"`
+}
+
+// batchResult has the HTTP status the operation would have had on its own, with the
+// paste created or tagged, or the error.
+type batchResult struct {
+	Status int       `json:"status"`
+	Paste  *apiPaste `json:"paste,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func failedOp(status int, msg string) batchResult {
+	return batchResult{Status: status, Error: msg}
+}
+
+func (p *pastry) apiBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		apiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(p.limit().MaxImport))
+	var ops []batchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		apiError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if len(ops) > maxBatch {
+		apiError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d operations a batch", maxBatch))
+		return
+	}
+
+	results := make([]batchResult, 0, len(ops))
+	changed := false
+	for _, op := range ops {
+		switch op.Op {
+		case "create":
+			if op.Paste == nil {
+				results = append(results, failedOp(http.StatusBadRequest, "create needs a paste"))
+				continue
+			}
+			a, status, err := p.create(r, *op.Paste)
+			if err != nil {
+				results = append(results, failedOp(status, err.Error()))
+				continue
+			}
+			results = append(results, batchResult{Status: status, Paste: &a})
+		case "delete", "tag":
+			res := p.batchChange(op)
+			changed = changed || res.Status/100 == 2
+			results = append(results, res)
+		default:
+			results = append(results, failedOp(http.StatusBadRequest, fmt.Sprintf("Unknown op %q, not create, delete or tag", op.Op)))
+		}
+	}
+	if changed {
+		p.mutex.Lock()
+		err := p.store()
+		p.mutex.Unlock()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "Not stored: "+err.Error())
+			return
+		}
+	}
+	replyJSON(w, http.StatusOK, results)
+}
+
+// batchChange deletes or tags a paste, which is stored once the whole batch has run.
+func (p *pastry) batchChange(op batchOp) batchResult {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, e, ok := p.lookupID(op.ID)
+	if !ok {
+		return failedOp(http.StatusNotFound, "No such paste")
+	}
+	if a := newAPIPaste(i, e); op.Revision != "" && op.Revision != a.Revision {
+		return failedOp(http.StatusConflict, "The paste was changed meanwhile, it is at revision "+a.Revision)
+	}
+	if op.Op == "delete" {
+		p.discard(e)
+		p.texts = append(p.texts[:i], p.texts[i+1:]...)
+		return batchResult{Status: http.StatusNoContent}
+	}
+	for _, tag := range op.Remove {
+		var tags []string
+		for _, t := range e.Tags {
+			if !strings.EqualFold(t, tag) {
+				tags = append(tags, t)
+			}
+		}
+		e.Tags = tags
+	}
+	for _, tag := range op.Add {
+		if tag = strings.TrimSpace(tag); tag != "" && !hasTag(e, tag) {
+			e.Tags = append(e.Tags, tag)
+		}
+	}
+	e.Modified = time.Now()
+	a := newAPIPaste(i, e)
+	return batchResult{Status: http.StatusOK, Paste: &a}
+}
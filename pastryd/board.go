@@ -0,0 +1,232 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// boardPolicy limits what a board keeps. Zero means no limit.
+type boardPolicy struct {
+	Name     string
+	Keep     int
+	MaxAge   time.Duration
+	MaxBytes uint64
+	Expire   time.Duration
+
+	// PerDevice is the number of pastes kept from each device, so one pushing its clipboard
+	// all day can't push out what the others pasted. Pastes of no device count as one.
+	PerDevice int
+
+	// Lazy boards are written to disk by the maintenance loop instead of on every
+	// paste, and pasting the same text again moves it to the top.
+	Lazy bool
+}
+
+const (
+	clipboardBoard     = "clipboard"
+	clipboardKeep      = 25
+	clipboardPerDevice = 10
+)
+
+// boardPolicies is a repeatable flag of "name:keep=50,age=1d,size=10MB,expire=7d,per-device=10".
+type boardPolicies []boardPolicy
+
+func (b *boardPolicies) String() string {
+	var s []string
+	for _, bp := range *b {
+		s = append(s, bp.Name)
+	}
+	return strings.Join(s, ";")
+}
+
+// Set accepts one policy, or several separated by ';' as in PASTRY_BOARDS.
+func (b *boardPolicies) Set(s string) error {
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		bp, err := parseBoardPolicy(v)
+		if err != nil {
+			return err
+		}
+		*b = append(*b, bp)
+	}
+	return nil
+}
+
+func parseBoardPolicy(s string) (boardPolicy, error) {
+	name, limits, _ := strings.Cut(s, ":")
+	bp := boardPolicy{Name: strings.TrimSpace(name)}
+	if bp.Name == "" {
+		return bp, fmt.Errorf("Board policy without a name: %s", s)
+	}
+
+	for _, l := range strings.Split(limits, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(l, "=")
+		var err error
+		switch k {
+		case "keep":
+			bp.Keep, err = strconv.Atoi(v)
+		case "age":
+			bp.MaxAge, err = parseAge(v)
+		case "size":
+			bp.MaxBytes, err = humanize.ParseBytes(v)
+		case "expire":
+			bp.Expire, err = parseAge(v)
+		case "per-device":
+			bp.PerDevice, err = strconv.Atoi(v)
+		case "lazy":
+			bp.Lazy = true
+		default:
+			err = fmt.Errorf("Unknown limit %s", k)
+		}
+		if err != nil {
+			return bp, fmt.Errorf("Board %s: %v", bp.Name, err)
+		}
+	}
+	return bp, nil
+}
+
+// withClipboard makes sure there is a clipboard board, which is always lazy.
+func (b boardPolicies) withClipboard() boardPolicies {
+	for i := range b {
+		if b[i].Name == clipboardBoard {
+			b[i].Lazy = true
+			return b
+		}
+	}
+	return append(b, boardPolicy{Name: clipboardBoard, Keep: clipboardKeep, PerDevice: clipboardPerDevice, Lazy: true})
+}
+
+func (p *pastry) policy(board string) *boardPolicy {
+	boards := p.limit().Boards
+	for i := range boards {
+		if boards[i].Name == board {
+			return &boards[i]
+		}
+	}
+	return nil
+}
+
+// boardDefaults gives a new paste the default expiry of its board.
+func (p *pastry) boardDefaults(e *entry) {
+	if bp := p.policy(e.Board); bp != nil && bp.Expire > 0 && e.Expires.IsZero() {
+		e.Expires = e.When.Add(bp.Expire)
+	}
+}
+
+// addLazy adds e to a lazy board as its most recently used paste, and drops the least
+// recently used ones over the limit at once. Must be called with the mutex held.
+func (p *pastry) addLazy(e *entry, bp *boardPolicy) {
+	texts := p.texts[:0]
+	for _, old := range p.texts {
+		if old.Board != e.Board || old.Text != e.Text || old.File != "" {
+			texts = append(texts, old)
+		} else {
+			p.discard(old)
+		}
+	}
+	p.texts = append(texts, e)
+
+	if bp.Keep > 0 || bp.PerDevice > 0 {
+		n := 0
+		devices := make(map[string]int)
+		for i := len(p.texts) - 1; i >= 0; i-- {
+			if t := p.texts[i]; t.Board == e.Board {
+				n++
+				devices[t.Origin]++
+				if bp.Keep > 0 && n > bp.Keep || bp.PerDevice > 0 && devices[t.Origin] > bp.PerDevice {
+					p.discard(t)
+					p.texts = append(p.texts[:i], p.texts[i+1:]...)
+				}
+			}
+		}
+	}
+	p.modified = time.Now()
+	p.dirty = true
+}
+
+// flush writes changes to lazy boards to disk.
+func (p *pastry) flush() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.dirty {
+		p.store()
+	}
+}
+
+// enforceBoards drops the oldest pastes of boards over their limits.
+func (p *pastry) enforceBoards(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	drop := make(map[*entry]bool)
+	for _, bp := range p.limit().Boards {
+		var board []*entry
+		var size uint64
+		devices := make(map[string]int) // pastes left of each device, from here on
+		for _, e := range p.texts {
+			if e.Board == bp.Name {
+				board = append(board, e)
+				size += uint64(len(e.Text)) + uint64(e.Size)
+				devices[e.Origin]++
+			}
+		}
+
+		for n, e := range board {
+			left := len(board) - n
+			if bp.MaxAge > 0 && now.Sub(e.When) > bp.MaxAge ||
+				bp.Keep > 0 && left > bp.Keep ||
+				bp.PerDevice > 0 && devices[e.Origin] > bp.PerDevice ||
+				bp.MaxBytes > 0 && size > bp.MaxBytes {
+				drop[e] = true
+				size -= uint64(len(e.Text)) + uint64(e.Size)
+			}
+			devices[e.Origin]--
+		}
+	}
+
+	if len(drop) > 0 {
+		texts := make([]*entry, 0, len(p.texts)-len(drop))
+		for _, e := range p.texts {
+			if !drop[e] {
+				texts = append(texts, e)
+			} else {
+				p.discard(e)
+			}
+		}
+		p.texts = texts
+		p.store()
+	}
+}
+
+// boards lists the boards in use or with a policy. Must be called with the mutex held.
+func (p *pastry) boards() []string {
+	seen := make(map[string]bool)
+	for _, bp := range p.limit().Boards {
+		seen[bp.Name] = true
+	}
+	for _, e := range p.texts {
+		if e.Board != "" {
+			seen[e.Board] = true
+		}
+	}
+	var names []string
+	for b := range seen {
+		names = append(names, b)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"strings"
+
+	"pastry/format"
+)
+
+// protocolVersion goes up when the TCP protocol changes in a way clients need to know about.
+// Commands and features being added is told by caps. 2 takes write port pastes over max-paste,
+// up to max-upload.
+const protocolVersion = 2
+
+// readCommands are the commands of the read port, as listed by caps.
+var readCommands = []string{"get", "head", "tail", "grep", "list", "drop", "clear", "expire", "publish", "remind", "meta", "count", "info", "stat", "view", "history", "export", "print", "caps", "clipboard", "session"}
+
+// readOptions are the options the commands of the read port take besides their own, --lang
+// and --width by list, grep and history.
+var readOptions = []string{"device", "lang", "width"}
+
+// writePreambles are the first lines the write port understands.
+var writePreambles = []string{"import", "clip", "key"}
+
+// features are the optional parts of pastry that are turned on.
+func (p *pastry) features() []string {
+	var f []string
+	add := func(on bool, name string) {
+		if on {
+			f = append(f, name)
+		}
+	}
+	add(p.cfg.PrinterURL != "", "print")
+	add(p.cfg.TTSURL != "", "announce")
+	add(p.cfg.WebhookURL != "" || p.cfg.NtfyURL != "" || p.cfg.ChatURL != "", "notify")
+	add(p.cfg.Maps, "maps")
+	add(p.cfg.Math, "math")
+	add(p.cfg.Diagrams, "diagrams")
+	add(len(p.cfg.Devices) > 0, "devices")
+	add(p.cfg.TrimBlank, "trim-blank")
+	return f
+}
+
+// caps is what the caps command writes, in the key=value form of meta.
+func (p *pastry) caps() string {
+	lim := p.limit()
+	return fmt.Sprintf("protocol=%d\ncommands=%s\noptions=%s\npreambles=%s\nmax-paste=%d\nmax-import=%d\nmax-upload=%d\nfeatures=%s\nlocales=%s\n",
+		protocolVersion, strings.Join(readCommands, ","), strings.Join(readOptions, ","), strings.Join(writePreambles, ","),
+		lim.MaxPaste, lim.MaxImport, lim.MaxUpload, strings.Join(p.features(), ","), strings.Join(format.Locales, ","))
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Categories are broader than kinds, what a paste is rather than its language. They are
+// guessed when a paste is added and can be changed with meta category=<name>.
+var categories = []string{"code", "log", "url", "prose", "secret", "data"}
+
+var categoryIcons = map[string]string{
+	"code":   "⌨️",
+	"log":    "📜",
+	"url":    "🔗",
+	"prose":  "📝",
+	"secret": "🔒",
+	"data":   "📊",
+}
+
+var secretRe = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----|\bAKIA[0-9A-Z]{16}\b|\bgh[pousr]_[A-Za-z0-9]{36}\b|\bxox[abpr]-[A-Za-z0-9-]{10,}|\bsk-[A-Za-z0-9_-]{20,}|\beyJ[\w-]{10,}\.eyJ[\w-]{10,}\.[\w-]+|(?i)\b(password|passwd|secret|api[_-]?key|token)\s*[:=]\s*\S+`)
+
+func isCategory(c string) bool {
+	for _, x := range categories {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// isToken is true for a single word long and mixed enough to be a password or a key.
+func isToken(t string) bool {
+	if len(t) < 16 || len(t) > 128 || strings.ContainsAny(t, " \t\n/") {
+		return false
+	}
+	var lower, upper, digit bool
+	for _, r := range t {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		}
+	}
+	return lower && upper && digit
+}
+
+// isTable is true for text with the same number of commas, semicolons or tabs on each
+// of at least two lines, CSV and the like.
+func isTable(text string) bool {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) < 2 {
+		return false
+	}
+	for _, sep := range []string{",", ";", "\t"} {
+		n := strings.Count(lines[0], sep)
+		if n == 0 {
+			continue
+		}
+		same := true
+		for _, l := range lines[1:] {
+			if strings.Count(l, sep) != n {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// categorize guesses the category of e, empty for files.
+func categorize(e *entry) string {
+	if e.File != "" {
+		return ""
+	}
+	t := strings.TrimSpace(e.Text)
+	if secretRe.MatchString(t) || isToken(t) {
+		return "secret"
+	}
+	if isDockerLog(t) {
+		return "log"
+	}
+	switch k := kind(e); k {
+	case "empty":
+		return ""
+	case "log", "url":
+		return k
+	case "json", "csv", "tsv", "yaml", "yml", "toml", "xml", "html/xml":
+		return "data"
+	case "text", "txt", "md", "markdown":
+		if isTable(t) {
+			return "data"
+		}
+		return "prose"
+	default:
+		return "code"
+	}
+}
+
+// defaultStrict is true for categories better shown without wrapping.
+func defaultStrict(category string) bool {
+	return category == "log" || category == "data"
+}
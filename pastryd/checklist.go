@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checklists are Markdown task lists, "- [ ] milk" and "- [x] eggs". Ticking a box rewrites
+// the line in the text, so the state is kept and shows up everywhere the text does.
+var checkRe = regexp.MustCompile(`^(\s*[-*+] \[)([ xX])(\] ?)(.*)$`)
+
+type checkItem struct {
+	Line int
+	Text string
+	Item bool
+	Done bool
+}
+
+// checklist splits text into its lines, or returns nil if there are no task list items.
+func checklist(text string) []checkItem {
+	var items []checkItem
+	found := false
+	for n, l := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if m := checkRe.FindStringSubmatch(l); m != nil {
+			items = append(items, checkItem{Line: n, Text: m[4], Item: true, Done: m[2] != " "})
+			found = true
+		} else {
+			items = append(items, checkItem{Line: n, Text: l})
+		}
+	}
+	if !found {
+		return nil
+	}
+	return items
+}
+
+// toggleLine ticks or unticks the item on line n of text.
+func toggleLine(text string, n int, done bool) (string, bool) {
+	lines := strings.Split(text, "\n")
+	if n < 0 || n >= len(lines) {
+		return text, false
+	}
+	m := checkRe.FindStringSubmatch(lines[n])
+	if m == nil {
+		return text, false
+	}
+	mark := " "
+	if done {
+		mark = "x"
+	}
+	lines[n] = m[1] + mark + m[3] + m[4]
+	return strings.Join(lines, "\n"), true
+}
+
+// addItem appends an unticked item, after the text if it doesn't end with a newline.
+func addItem(text, item string) string {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text + "- [ ] " + item + "\n"
+}
+
+// checkPaste handles POST /check/<id>, with line and done to tick a box, which is what the
+// checkboxes of the web GUI send, or the item form of the paste page adding one.
+func (p *pastry) checkPaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, "/check/")
+	_, e, ok := p.lookupID(id)
+	if !ok || e.File != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	item := strings.TrimSpace(r.FormValue("item"))
+	if item != "" {
+		p.toTrash(w, e, false, "Added "+item)
+		e.Text = addItem(e.Text, item)
+	} else {
+		n, err := strconv.Atoi(r.FormValue("line"))
+		if err != nil {
+			http.Error(w, "Invalid line", http.StatusBadRequest)
+			return
+		}
+		text, ok := toggleLine(e.Text, n, r.FormValue("done") != "")
+		if !ok {
+			http.Error(w, "No checklist item on that line", http.StatusBadRequest)
+			return
+		}
+		e.Text = text
+	}
+	e.Original = ""
+	markSeen(e, deviceName(r), time.Now())
+	p.store()
+
+	if item != "" {
+		http.Redirect(w, r, "/p/"+id, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+// The clipboard bridge protocol lets clipboard clients share the clipboard board over the
+// read port. A client sends "clipboard <device>\n" and keeps the connection open. Then
+//
+//	client: PUSH <hash> <length>\n<text>              sets the clipboard
+//	server: CLIP <origin> <hash> <length>\n<text>     someone else set it
+//
+// where hash is the hex SHA-256 of the text. The server sends the current clipboard right
+// away. Clipboards never get their own pushes back, and a push of the text already on top
+// is ignored, so two bridges passing the same text back and forth settle at once.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	clipCommand = "clipboard"
+	maxClip     = 1024 * 1024
+)
+
+type clipSub struct {
+	device string
+	ch     chan *entry
+}
+
+func textHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// clipHead is the newest paste on the clipboard board. Must be called with the mutex held.
+func (p *pastry) clipHead() *entry {
+	for i := len(p.texts) - 1; i >= 0; i-- {
+		if p.texts[i].Board == clipboardBoard {
+			return p.texts[i]
+		}
+	}
+	return nil
+}
+
+// publishClip passes e to all clipboards except the one it came from. A clipboard that
+// doesn't keep up misses updates rather than stalling everyone. Must be called with the mutex held.
+func (p *pastry) publishClip(e *entry) {
+	for sub := range p.clipSubs {
+		if sub.device != e.Origin || e.Origin == "" {
+			select {
+			case sub.ch <- e:
+			default:
+			}
+		}
+	}
+}
+
+func writeClip(w io.Writer, e *entry) error {
+	origin := e.Origin
+	if origin == "" {
+		origin = "-"
+	}
+	_, err := fmt.Fprintf(w, "CLIP %s %s %d\n%s", origin, textHash(e.Text), len(e.Text), e.Text)
+	return err
+}
+
+// readPush reads one PUSH frame.
+func readPush(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	var hash string
+	var n int
+	if _, err := fmt.Sscanf(strings.TrimSpace(line), "PUSH %s %d", &hash, &n); err != nil {
+		return "", fmt.Errorf("Bad frame: %q", line)
+	}
+	if n < 0 || n > maxClip {
+		return "", fmt.Errorf("Clipboard too large: %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	if textHash(string(b)) != hash {
+		return "", fmt.Errorf("Hash mismatch")
+	}
+	if !utf8.Valid(b) {
+		return "", fmt.Errorf("Not UTF-8")
+	}
+	return string(b), nil
+}
+
+func isClipboardCommand(b []byte) bool {
+	line, _, _ := bytes.Cut(b, []byte("\n"))
+	f := strings.Fields(string(line))
+	return len(f) > 0 && f[0] == clipCommand
+}
+
+// clipboardSession runs the bridge protocol, first holds the "clipboard <device>" line
+// and whatever arrived with it.
+func (p *pastry) clipboardSession(ctx context.Context, c net.Conn, first []byte) {
+	line, rest, _ := bytes.Cut(first, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		c.Write([]byte("# Usage: clipboard <device>\n"))
+		return
+	}
+	sub := &clipSub{device: cleanDevice(fields[1]), ch: make(chan *entry, 8)}
+	c.SetReadDeadline(noDeadline)
+
+	p.mutex.Lock()
+	if p.clipSubs == nil {
+		p.clipSubs = make(map[*clipSub]bool)
+	}
+	p.clipSubs[sub] = true
+	if head := p.clipHead(); head != nil {
+		sub.ch <- head
+	}
+	p.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(rest), c))
+		for {
+			text, err := readPush(r)
+			if err != nil {
+				if err != io.EOF {
+					fmt.Fprintf(c, "# %v\n", err)
+				}
+				return
+			}
+			p.pushClip(text, sub.device)
+		}
+	}()
+
+loop:
+	for {
+		select {
+		case e := <-sub.ch:
+			if writeClip(c, e) != nil {
+				break loop
+			}
+		case <-done:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	p.mutex.Lock()
+	delete(p.clipSubs, sub)
+	p.mutex.Unlock()
+}
+
+// pushClip puts text on the clipboard board unless it already is on top.
+func (p *pastry) pushClip(text, device string) {
+	p.mutex.Lock()
+	head := p.clipHead()
+	p.mutex.Unlock()
+
+	if head != nil && head.Text == text {
+		return
+	}
+	p.addEntry(&entry{Text: text, Board: clipboardBoard, Origin: device})
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"strings"
+	"time"
+)
+
+// soonExpiry is when list shows that a paste is about to expire.
+const soonExpiry = time.Hour
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiIndex = "\x1b[33m"
+	ansiWhen  = "\x1b[36m"
+	ansiMatch = "\x1b[1;31m"
+	ansiSoon  = "\x1b[1;33m"
+)
+
+// palette wraps text in ANSI colors when enabled, for `--color` on the read port.
+type palette bool
+
+// colorOption reports whether "--color" or "--color=always" is among args.
+// "--color=never" and "--color=auto" turn colors off, the server can't see the terminal.
+func colorOption(args []string) palette {
+	on := false
+	for _, a := range args {
+		if a == "--color" || a == "--color=always" {
+			on = true
+		} else if strings.HasPrefix(a, "--color=") {
+			on = false
+		}
+	}
+	return palette(on)
+}
+
+func (c palette) paint(code, s string) string {
+	if !c {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// Index and When make a palette the format.Painter of list and grep.
+func (c palette) Index(s string) string {
+	return c.paint(ansiIndex, s)
+}
+
+func (c palette) When(s string) string {
+	return c.paint(ansiWhen, s)
+}
+
+// expiry is the expiry badge of list, in bold yellow when the paste is gone within soonExpiry.
+func (c palette) expiry(e *entry, now time.Time) string {
+	exp := expiresString(e)
+	if exp == "" {
+		return ""
+	}
+	if e.Expires.Sub(now) < soonExpiry {
+		return "[" + c.paint(ansiSoon, exp) + "] "
+	}
+	return "[" + exp + "] "
+}
+
+// match highlights every occurrence of m in l.
+func (c palette) match(l, m string) string {
+	if !c || m == "" {
+		return l
+	}
+	return strings.ReplaceAll(l, m, c.paint(ansiMatch, m))
+}
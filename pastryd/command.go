@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// command is what was sent to the read port, taken apart. parseCommand only looks at the
+// bytes, so what the commands are given can be fuzzed without a server.
+type command struct {
+	name   string   // get, list, ... or "" when nothing but blanks was sent
+	args   []string // the words after the name, without --device
+	device string
+	lang   string // of list, grep and history, --lang
+	width  int    // of the terminal list, grep and history are shown on, --width, or 0
+
+	// grep matches the rest of the line as sent, spaces and all, after its --color, --device,
+	// --lang and --width options.
+	pattern string
+	color   palette
+}
+
+func parseCommand(b []byte) command {
+	s := strings.ReplaceAll(string(b), "\n", "")
+	var cmd command
+	for ok := true; ok; {
+		s, ok = cmd.leadingOption(s)
+	}
+	name, rest := nextWord(s)
+	if name == "" {
+		cmd.device = cleanDevice(cmd.device)
+		return cmd
+	}
+	cmd.name = name
+
+	if cmd.name != "grep" {
+		var device, lang, width string
+		device, cmd.args = takeOption(strings.Fields(rest), "device")
+		if cmd.device == "" {
+			cmd.device = device
+		}
+		cmd.device = cleanDevice(cmd.device)
+		if lang, cmd.args = takeOption(cmd.args, "lang"); cmd.lang == "" {
+			cmd.lang = lang
+		}
+		if width, cmd.args = takeOption(cmd.args, "width"); cmd.width == 0 {
+			cmd.width = parseWidth(width)
+		}
+		return cmd
+	}
+	var opts []string
+	for {
+		if opt, after := nextWord(rest); strings.HasPrefix(opt, "--color") {
+			opts = append(opts, opt)
+			rest = after
+		} else if after, ok := cmd.leadingOption(rest); ok {
+			rest = after
+		} else {
+			cmd.pattern, cmd.color, cmd.device = rest, colorOption(opts), cleanDevice(cmd.device)
+			return cmd
+		}
+	}
+}
+
+// leadingOption takes the option s starts with, --device, --lang or --width, before the name
+// of the command or the pattern of grep. ok is false when s starts with something else.
+func (cmd *command) leadingOption(s string) (rest string, ok bool) {
+	word, rest := nextWord(s)
+	name, value, hasValue := strings.Cut(strings.TrimPrefix(word, "--"), "=")
+	if !strings.HasPrefix(word, "--") {
+		return s, false
+	}
+	if !hasValue {
+		// the value is the next word, unless that is another option
+		if next, after := nextWord(rest); next != "" && !strings.HasPrefix(next, "--") {
+			value, rest = next, after
+		}
+	}
+	switch name {
+	case "device":
+		if cmd.device == "" {
+			cmd.device = value
+		}
+	case "lang":
+		if cmd.lang == "" {
+			cmd.lang = value
+		}
+	case "width":
+		if cmd.width == 0 {
+			cmd.width = parseWidth(value)
+		}
+	default:
+		return s, false
+	}
+	return rest, true
+}
+
+// nextWord is the first word of s and what follows the blank after it.
+func nextWord(s string) (word, rest string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	_, n := utf8.DecodeRuneInString(s[i:])
+	return s[:i], s[i+n:]
+}
+
+// parseWidth is the columns of --width, 0 for no limit when they aren't a positive number.
+func parseWidth(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// arg is the i:th argument, or "".
+func (cmd command) arg(i int) string {
+	if i < len(cmd.args) {
+		return cmd.args[i]
+	}
+	return ""
+}
+
+// from is the arguments from the i:th on.
+func (cmd command) from(i int) []string {
+	if i < len(cmd.args) {
+		return cmd.args[i:]
+	}
+	return nil
+}
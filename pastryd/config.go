@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/OpenPeeDeeP/xdg"
+	"github.com/dustin/go-humanize"
+)
+
+// Config is how a Server is set up. What is left out gets the default of the pastry command,
+// except for the numbers and booleans, which are zero and off. ParseConfig fills it in from
+// the command line.
+type Config struct {
+	HTTPAddr  string // web GUI, :9180
+	WriteAddr string // for adding pastes, :9181
+	ReadAddr  string // for reading pastes, :9182
+	DataDir   string // the XDG cache directory
+	Store     string // gob, see storage.go
+	StoreKey  []byte // encrypts the store and the files, see seal.go
+	NoPersist bool   // keeps everything in memory, nothing is written to DataDir
+
+	// The web GUI answers HTTPS, and HTTP/2, with a certificate and key in PEM files. The
+	// timeouts are off when zero, see webServer in server.go.
+	TLSCert          string
+	TLSKey           string
+	HTTPReadTimeout  time.Duration // for a whole request, 1m from the flags
+	HTTPWriteTimeout time.Duration // for a whole answer
+	HTTPIdleTimeout  time.Duration // of keep-alive connections, 2m from the flags
+	RenderTimeout    time.Duration // of the pages, 30s from the flags, see timeout.go
+	RouteTimeouts    routeTimeouts // of the pages under some routes instead
+	GCInterval       time.Duration // how often to gc, 1d from the flags, see gc.go
+	MinFree          int64         // bytes of the data directory, under it new pastes are refused, see disk.go
+
+	S3URL       string // https://host/bucket[/prefix] of the s3 store
+	S3Region    string // us-east-1
+	S3AccessKey string
+	S3SecretKey string
+
+	LogStdout bool
+	TrimBlank bool
+	MaxBlank  int
+
+	PreviewLen int    // characters of each paste shown by list, 0 for the whole line
+	Locale     string // language of the times, en unless there is a locale for it, see format
+	Devices    deviceRoutes
+
+	// Limits are what pastry starts with, the limits file goes on top, see limits.go.
+	Limits     limits
+	LimitsFile string
+
+	WebhookURL string
+	NtfyURL    string
+	ChatURL    string
+
+	PrinterURL string
+	Maps       bool
+	Math       bool
+	Diagrams   bool
+
+	TTSURL      string
+	TTSToken    string
+	TTSEntity   string
+	TTSPlayer   string
+	AnnounceAll bool
+
+	Landing string // index
+}
+
+func env(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// ParseConfig reads flags, falling back to PASTRY_* environment variables and then the
+// defaults. Like the flag package it exits on flags it can't make sense of.
+func ParseConfig(args []string) Config {
+	var c Config
+	fs := flag.NewFlagSet("pastry", flag.ExitOnError)
+
+	fs.StringVar(&c.HTTPAddr, "http-addr", env("PASTRY_HTTP_ADDR", ":9180"), "Web GUI address (PASTRY_HTTP_ADDR)")
+	fs.StringVar(&c.WriteAddr, "write-addr", env("PASTRY_WRITE_ADDR", ":9181"), "Address for adding snippets (PASTRY_WRITE_ADDR)")
+	fs.StringVar(&c.ReadAddr, "read-addr", env("PASTRY_READ_ADDR", ":9182"), "Address for reading snippets (PASTRY_READ_ADDR)")
+	fs.StringVar(&c.DataDir, "data-dir", env("PASTRY_DATA_DIR", ""), "Where snippets are stored, default is the XDG cache directory (PASTRY_DATA_DIR)")
+	fs.StringVar(&c.Store, "store", env("PASTRY_STORE", "gob"), "How snippets are stored: gob, dir, s3, or sqlite and bolt when built with -tags sqlite or bolt (PASTRY_STORE)")
+	fs.StringVar(&c.TLSCert, "tls-cert", env("PASTRY_TLS_CERT", ""), "PEM certificate, with --tls-key the web GUI is served over HTTPS and HTTP/2 (PASTRY_TLS_CERT)")
+	fs.StringVar(&c.TLSKey, "tls-key", env("PASTRY_TLS_KEY", ""), "PEM private key of --tls-cert (PASTRY_TLS_KEY)")
+	fs.DurationVar(&c.HTTPReadTimeout, "http-read-timeout", envDuration("PASTRY_HTTP_READ_TIMEOUT", time.Minute), "How long the web GUI waits for a whole request, uploads included, 0 for no limit (PASTRY_HTTP_READ_TIMEOUT)")
+	fs.DurationVar(&c.HTTPWriteTimeout, "http-write-timeout", envDuration("PASTRY_HTTP_WRITE_TIMEOUT", 0), "How long the web GUI may take to send an answer, downloads included, 0 for no limit (PASTRY_HTTP_WRITE_TIMEOUT)")
+	fs.DurationVar(&c.HTTPIdleTimeout, "http-idle-timeout", envDuration("PASTRY_HTTP_IDLE_TIMEOUT", 2*time.Minute), "How long the web GUI keeps idle keep-alive connections open (PASTRY_HTTP_IDLE_TIMEOUT)")
+	fs.DurationVar(&c.RenderTimeout, "render-timeout", envDuration("PASTRY_RENDER_TIMEOUT", 30*time.Second), "How long a page of the web GUI may take before it is answered with 503, 0 for no limit (PASTRY_RENDER_TIMEOUT)")
+	if err := c.RouteTimeouts.Set(env("PASTRY_ROUTE_TIMEOUTS", "")); err != nil {
+		log.Fatalf("PASTRY_ROUTE_TIMEOUTS: %v", err)
+	}
+	fs.Var(&c.RouteTimeouts, "route-timeout", "Timeout of the pages under a route instead of --render-timeout, like /pdf=2m, repeatable (PASTRY_ROUTE_TIMEOUTS, ';' separated)")
+	fs.DurationVar(&c.GCInterval, "gc-interval", envDuration("PASTRY_GC_INTERVAL", 24*time.Hour), "How often to remove the files no snippet refers to and compact the store, as pastry gc does, 0 for never (PASTRY_GC_INTERVAL)")
+	fs.BoolVar(&c.NoPersist, "no-persist", envBool("PASTRY_NO_PERSIST", false), "Keep snippets, files, views and limits in memory only, never writing to disk, so all is gone on restart (PASTRY_NO_PERSIST)")
+	fs.BoolVar(&c.LogStdout, "log-stdout", envBool("PASTRY_LOG_STDOUT", false), "Log to stdout instead of stderr (PASTRY_LOG_STDOUT)")
+	fs.BoolVar(&c.TrimBlank, "trim-blank", envBool("PASTRY_TRIM_BLANK", false), "Strip leading and trailing blank lines from new pastes (PASTRY_TRIM_BLANK)")
+	fs.IntVar(&c.MaxBlank, "max-blank", envInt("PASTRY_MAX_BLANK", 2), "With --trim-blank, collapse longer runs of blank lines to this many (PASTRY_MAX_BLANK)")
+	fs.StringVar(&c.Locale, "locale", env("PASTRY_LOCALE", "en"), "Language of times on the read port and in the web GUI, when a browser or --lang asks for none there is: en, de or sv (PASTRY_LOCALE)")
+	fs.IntVar(&c.PreviewLen, "preview-len", envInt("PASTRY_PREVIEW_LEN", 60), "Characters of each paste shown by list, 0 for the whole line (PASTRY_PREVIEW_LEN)")
+	if err := c.Limits.Boards.Set(env("PASTRY_BOARDS", "")); err != nil {
+		log.Fatalf("PASTRY_BOARDS: %v", err)
+	}
+	fs.Var(&c.Limits.Boards, "board", "Board policy like docs:keep=50,age=1d,size=1MB,expire=7d,lazy, repeatable (PASTRY_BOARDS, ';' separated)")
+	if err := c.Devices.Set(env("PASTRY_DEVICES", "")); err != nil {
+		log.Fatalf("PASTRY_DEVICES: %v", err)
+	}
+	fs.Var(&c.Devices, "device", "Device routing like phone:key=secret,board=mobile,expire=7d, repeatable (PASTRY_DEVICES, ';' separated)")
+	fs.StringVar(&c.WebhookURL, "webhook-url", env("PASTRY_WEBHOOK_URL", ""), "Notifications are posted here as JSON (PASTRY_WEBHOOK_URL)")
+	fs.StringVar(&c.NtfyURL, "ntfy-url", env("PASTRY_NTFY_URL", ""), "ntfy topic URL for notifications (PASTRY_NTFY_URL)")
+	fs.StringVar(&c.ChatURL, "chat-url", env("PASTRY_CHAT_URL", ""), "Slack compatible incoming webhook for notifications (PASTRY_CHAT_URL)")
+	fs.StringVar(&c.PrinterURL, "printer-url", env("PASTRY_PRINTER_URL", ""), "IPP printer for the print command, e.g. ipp://printer.local/ipp/print (PASTRY_PRINTER_URL)")
+	fs.StringVar(&c.TTSURL, "tts-url", env("PASTRY_TTS_URL", ""), "Home Assistant TTS service, e.g. http://ha.local:8123/api/services/tts/speak (PASTRY_TTS_URL)")
+	fs.StringVar(&c.TTSToken, "tts-token", env("PASTRY_TTS_TOKEN", ""), "Home Assistant long-lived access token (PASTRY_TTS_TOKEN)")
+	fs.StringVar(&c.TTSEntity, "tts-entity", env("PASTRY_TTS_ENTITY", ""), "TTS entity such as tts.piper, for tts/speak (PASTRY_TTS_ENTITY)")
+	fs.StringVar(&c.TTSPlayer, "tts-player", env("PASTRY_TTS_PLAYER", ""), "Media player to speak on, e.g. media_player.living_room (PASTRY_TTS_PLAYER)")
+	fs.BoolVar(&c.AnnounceAll, "announce-all", envBool("PASTRY_ANNOUNCE_ALL", false), "Read out every new paste, not only the ones tagged announce (PASTRY_ANNOUNCE_ALL)")
+	fs.BoolVar(&c.Maps, "maps", envBool("PASTRY_MAPS", true), "Show an OpenStreetMap preview of places in pastes (PASTRY_MAPS)")
+	fs.BoolVar(&c.Diagrams, "diagrams", envBool("PASTRY_DIAGRAMS", true), "Draw Graphviz and Mermaid pastes as diagrams (PASTRY_DIAGRAMS)")
+	fs.BoolVar(&c.Math, "math", envBool("PASTRY_MATH", true), "Show $...$ and $$...$$ in Markdown pastes as math (PASTRY_MATH)")
+	fs.StringVar(&c.Landing, "landing", env("PASTRY_LANDING", "index"), "What / shows: index, pinned, kiosk or board:<name> (PASTRY_LANDING)")
+	maxPaste := fs.String("max-paste", env("PASTRY_MAX_PASTE", "1MiB"), "Largest paste the write port takes (PASTRY_MAX_PASTE)")
+	maxImport := fs.String("max-import", env("PASTRY_MAX_IMPORT", "256MiB"), "Largest archive the write port imports (PASTRY_MAX_IMPORT)")
+	minFree := fs.String("min-free", env("PASTRY_MIN_FREE", "100MiB"), "Free space of the data directory under which new pastes are refused and the notifiers told, 0 for no check (PASTRY_MIN_FREE)")
+	maxUpload := fs.String("max-upload", env("PASTRY_MAX_UPLOAD", "16MiB"), "Largest file the web GUI takes (PASTRY_MAX_UPLOAD)")
+	readTimeout := fs.String("read-timeout", env("PASTRY_READ_TIMEOUT", "100ms"), "How long the read port waits for a command before sending the latest paste (PASTRY_READ_TIMEOUT)")
+	importIdle := fs.String("import-idle", env("PASTRY_IMPORT_IDLE", "1s"), "How long a paste or an import on the write port may pause before it is taken as complete (PASTRY_IMPORT_IDLE)")
+	fs.StringVar(&c.LimitsFile, "limits-file", env("PASTRY_LIMITS_FILE", ""), "Limits read on top of these flags at start and on SIGHUP, default limits.conf in the data directory (PASTRY_LIMITS_FILE)")
+	fs.StringVar(&c.S3URL, "s3-url", env("PASTRY_S3_URL", ""), "Endpoint, bucket and prefix of --store s3, e.g. https://nas:9000/pastry (PASTRY_S3_URL)")
+	fs.StringVar(&c.S3Region, "s3-region", env("PASTRY_S3_REGION", "us-east-1"), "Region of the bucket (PASTRY_S3_REGION)")
+	c.S3AccessKey = env("PASTRY_S3_ACCESS_KEY", os.Getenv("AWS_ACCESS_KEY_ID"))
+	c.S3SecretKey = env("PASTRY_S3_SECRET_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	keyFile := fs.String("store-key-file", env("PASTRY_STORE_KEY_FILE", ""), "File with the key the store is encrypted with, see the README, or the key itself in PASTRY_STORE_KEY (PASTRY_STORE_KEY_FILE)")
+	fs.Parse(args)
+
+	if key := os.Getenv("PASTRY_STORE_KEY"); key != "" || *keyFile != "" {
+		if *keyFile != "" {
+			b, err := os.ReadFile(*keyFile)
+			if err != nil {
+				log.Fatalf("Failed to read the store key: %v", err)
+			}
+			key = string(b)
+		}
+		var err error
+		if c.StoreKey, err = ParseKey(key); err != nil {
+			log.Fatalf("Invalid store key: %v", err)
+		}
+	}
+
+	for k, v := range map[string]string{"max-paste": *maxPaste, "max-import": *maxImport, "max-upload": *maxUpload,
+		"read-timeout": *readTimeout, "import-idle": *importIdle} {
+		if err := c.Limits.setLimit(k, v); err != nil {
+			log.Fatalf("Invalid --%s: %v", k, err)
+		}
+	}
+	if n, err := humanize.ParseBytes(*minFree); err != nil || n > math.MaxInt64 {
+		log.Fatalf("Invalid --min-free: %s", *minFree)
+	} else {
+		c.MinFree = int64(n)
+	}
+	if c.DataDir == "" {
+		c.DataDir = xdg.New("gmelchett", "pastry").CacheHome()
+	}
+	return c
+}
+
+// withDefaults fills in what c leaves out.
+func (c Config) withDefaults() (Config, error) {
+	def := func(s *string, v string) {
+		if *s == "" {
+			*s = v
+		}
+	}
+	def(&c.HTTPAddr, ":9180")
+	def(&c.WriteAddr, ":9181")
+	def(&c.ReadAddr, ":9182")
+	def(&c.DataDir, xdg.New("gmelchett", "pastry").CacheHome())
+	def(&c.Store, "gob")
+	def(&c.LimitsFile, filepath.Join(c.DataDir, "limits.conf"))
+	def(&c.Landing, "index")
+	if !validLanding(c.Landing) {
+		return c, fmt.Errorf("Invalid landing view %q, use index, pinned, kiosk or board:<name>", c.Landing)
+	}
+
+	l := &c.Limits
+	for _, d := range []struct {
+		v   *int
+		def int
+	}{{&l.MaxPaste, defaultLimits.MaxPaste}, {&l.MaxImport, defaultLimits.MaxImport}, {&l.MaxUpload, defaultLimits.MaxUpload}} {
+		if *d.v <= 0 {
+			*d.v = d.def
+		}
+	}
+	if l.ReadTimeout <= 0 {
+		l.ReadTimeout = defaultLimits.ReadTimeout
+	}
+	if l.ImportIdle <= 0 {
+		l.ImportIdle = defaultLimits.ImportIdle
+	}
+	l.Boards = append(boardPolicies(nil), l.Boards...).withClipboard()
+	return c, nil
+}
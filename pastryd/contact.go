@@ -0,0 +1,149 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"pastry/format"
+)
+
+// maxContacts is how many phone numbers and addresses are picked out of one paste.
+const maxContacts = 5
+
+var (
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// +46 70 123 45 67, (555) 123-4567, 0701234567. No dots, they are more often numbers.
+	phoneRe = regexp.MustCompile(`(?:\+|\()?\b\d[\d ()-]{5,}\d\b`)
+)
+
+type contactLink struct {
+	Text string
+	URL  template.URL
+}
+
+// contact is the phone numbers and mail addresses found in a paste, or a pasted vCard.
+type contact struct {
+	Name   string
+	Phones []contactLink
+	Emails []contactLink
+	VCard  bool
+}
+
+func isVCard(text string) bool {
+	return strings.Contains(text, "BEGIN:VCARD")
+}
+
+func phoneDigits(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r >= '0' && r <= '9' || r == '+' && i == 0 {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// phones finds what looks like phone numbers, 7 to 15 digits that aren't a date. A number
+// without spaces or dashes must start with + or 0, or it is more likely an id.
+func phones(text string) []string {
+	var found []string
+	for _, m := range phoneRe.FindAllString(text, -1) {
+		m = strings.TrimSpace(m)
+		n := len(strings.TrimPrefix(phoneDigits(m), "+"))
+		plain := !strings.ContainsAny(m, " ()-") && m[0] != '+' && m[0] != '0'
+		if n < 7 || n > 15 || plain || isoDateRe.MatchString(m) || strings.Count(m, "(") != strings.Count(m, ")") {
+			continue
+		}
+		found = append(found, m)
+	}
+	return found
+}
+
+// findContact looks for contact details in plain text pastes, code and logs are full
+// of numbers that aren't phone numbers.
+func findContact(e *entry) *contact {
+	if e.File != "" {
+		return nil
+	}
+	if isVCard(e.Text) {
+		return &contact{VCard: true}
+	}
+	if kind(e) != "text" {
+		return nil
+	}
+
+	c := &contact{Name: e.Title}
+	seen := make(map[string]bool)
+	for _, m := range phones(e.Text) {
+		if d := phoneDigits(m); !seen[d] && len(c.Phones) < maxContacts {
+			seen[d] = true
+			c.Phones = append(c.Phones, contactLink{m, template.URL("tel:" + d)})
+		}
+	}
+	for _, m := range emailRe.FindAllString(e.Text, -1) {
+		if !seen[m] && len(c.Emails) < maxContacts {
+			seen[m] = true
+			c.Emails = append(c.Emails, contactLink{m, template.URL("mailto:" + m)})
+		}
+	}
+	if len(c.Phones) == 0 && len(c.Emails) == 0 {
+		return nil
+	}
+	if c.Name == "" {
+		// the first line, if it is not itself a number or an address
+		line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(e.Text), "\n", 2)[0])
+		if line != "" && len(phones(line)) == 0 && !emailRe.MatchString(line) {
+			c.Name = format.Truncate(line, 60)
+		}
+	}
+	return c
+}
+
+// vcard is a vCard 3.0 with what was found, named "Pastry contact" if there is no name.
+func (c *contact) vcard() string {
+	name := c.Name
+	if name == "" {
+		name = "Pastry contact"
+	}
+	lines := []string{"BEGIN:VCARD", "VERSION:3.0", "FN:" + icsText(name), "N:" + icsText(name) + ";;;;"}
+	for _, p := range c.Phones {
+		lines = append(lines, "TEL;TYPE=CELL:"+strings.TrimPrefix(string(p.URL), "tel:"))
+	}
+	for _, m := range c.Emails {
+		lines = append(lines, "EMAIL;TYPE=INTERNET:"+m.Text)
+	}
+	lines = append(lines, "END:VCARD", "")
+	return strings.Join(lines, "\r\n")
+}
+
+// pasteVCF serves /p/<id>.vcf, the paste itself if it is a vCard or else the contact found in it.
+func (p *pastry) pasteVCF(w http.ResponseWriter, r *http.Request, id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i, e, ok := p.lookupID(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c := findContact(e)
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	text := e.Text
+	if !c.VCard {
+		text = c.vcard()
+	}
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"pastry-%d.vcf\"", i))
+	serveConditional(w, r, e.When.Truncate(time.Second), etag([]byte(text)), []byte(text))
+}
@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPhones(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"call +46 70 123 45 67 or (555) 123-4567", []string{"+46 70 123 45 67", "(555) 123-4567"}},
+		{"0701234567", []string{"0701234567"}},
+		// ids, dates and numbers too short or too long
+		{"order 7012345678", nil},
+		{"2023-05-01", nil},
+		{"12-34", nil},
+		{"+1 234 567 890 123 456 789", nil},
+		{"555) 123-4567", nil},
+	} {
+		if got := phones(tc.text); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("phones(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestFindContact(t *testing.T) {
+	for _, tc := range []struct {
+		e                     entry
+		name                  string
+		phones, emails, vcard bool
+	}{
+		{entry{Text: "Anna Svensson\n+46 70 123 45 67\nanna@example.com\n"}, "Anna Svensson", true, true, false},
+		{entry{Text: "anna@example.com\n", Title: "Anna"}, "Anna", false, true, false},
+		// the first line is the number itself, no name
+		{entry{Text: "+46 70 123 45 67\n"}, "", true, false, false},
+		{entry{Text: "BEGIN:VCARD\nVERSION:3.0\nFN:Anna\nEND:VCARD\n"}, "", false, false, true},
+		{entry{Text: "nothing to call here\n"}, "", false, false, false},
+		{entry{Text: "+46 70 123 45 67\n", File: "x.txt"}, "", false, false, false},
+	} {
+		c := findContact(&tc.e)
+		if c == nil {
+			if tc.phones || tc.emails || tc.vcard {
+				t.Errorf("findContact(%q) = nil", tc.e.Text)
+			}
+			continue
+		}
+		if c.Name != tc.name || (len(c.Phones) > 0) != tc.phones || (len(c.Emails) > 0) != tc.emails || c.VCard != tc.vcard {
+			t.Errorf("findContact(%q) = %+v", tc.e.Text, c)
+		}
+	}
+}
+
+func TestContactVCard(t *testing.T) {
+	c := findContact(&entry{Text: "Anna, Svensson\n+46 70 123 45 67\n+46 70 123 45 67\nanna@example.com\n"})
+	want := "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Anna\\, Svensson\r\nN:Anna\\, Svensson;;;;\r\n" +
+		"TEL;TYPE=CELL:+46701234567\r\nEMAIL;TYPE=INTERNET:anna@example.com\r\nEND:VCARD\r\n"
+	if got := c.vcard(); got != want {
+		t.Errorf("vcard = %q\nwant %q", got, want)
+	}
+	if got := (&contact{}).vcard(); !strings.Contains(got, "\r\nFN:Pastry contact\r\n") {
+		t.Errorf("vcard without a name = %q", got)
+	}
+}
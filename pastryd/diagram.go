@@ -0,0 +1,459 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Diagrams are Graphviz DOT and Mermaid pastes, drawn as SVG by dot or mmdc when they are
+// installed. Without them simple graphs, nodes and edges, are laid out here instead.
+
+const (
+	maxDiagramNodes = 200
+	diagramTimeout  = 10 * time.Second
+	// maxDiagramCache is how many drawn diagrams are kept, the cache starts over when full.
+	maxDiagramCache = 32
+)
+
+var (
+	dotRe     = regexp.MustCompile(`^\s*(?:strict\s+)?(di)?graph\b[^{]*\{`)
+	mermaidRe = regexp.MustCompile(`^\s*(graph|flowchart)\s+(TB|TD|BT|LR|RL)\b|^\s*(graph|flowchart|sequenceDiagram|classDiagram|stateDiagram(?:-v2)?|erDiagram|gantt|pie|journey|mindmap|gitGraph|timeline)\s*$`)
+
+	dotCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/|(?m)^\s*#.*$|//[^\n]*`)
+	dotIDRe      = regexp.MustCompile(`^\s*("(?:[^"\\]|\\.)*"|[\w.]+)`)
+	dotAttrRe    = regexp.MustCompile(`\blabel\s*=\s*("(?:[^"\\]|\\.)*"|[\w.]+)`)
+	rankdirRe    = regexp.MustCompile(`\brankdir\s*=\s*"?(LR|RL|TB|BT)`)
+	dotStmtRe    = regexp.MustCompile(`[;\n{}]`)
+
+	mermaidNodeRe = regexp.MustCompile(`^\s*([\w.]+)\s*(\[\[.*?\]\]|\[\(.*?\)\]|\(\(.*?\)\)|\[.*?\]|\(.*?\)|\{.*?\}|>.*?\])?`)
+	mermaidLinkRe = regexp.MustCompile(`^\s*(?:(-->|---|==>|-\.->|-\.-|--o|--x)|--\s*([^-|>][^>]*?)\s*-->)\s*(?:\|([^|]*)\|)?`)
+)
+
+// diagramKind is "dot" or "mermaid" for pastes said to be or looking like one, or "".
+func diagramKind(e *entry) string {
+	if e.File != "" {
+		return ""
+	}
+	switch kind(e) {
+	case "dot", "gv", "graphviz":
+		return "dot"
+	case "mermaid", "mmd":
+		return "mermaid"
+	}
+	first := strings.TrimSpace(e.Text)
+	if dotRe.MatchString(first) && strings.HasSuffix(first, "}") {
+		return "dot"
+	}
+	if l := strings.SplitN(first, "\n", 2)[0]; mermaidRe.MatchString(l) {
+		return "mermaid"
+	}
+	return ""
+}
+
+// runDiagramTool draws text with dot or mmdc, if there is one on the path.
+func runDiagramTool(kind, text string) ([]byte, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), diagramTimeout)
+	defer cancel()
+
+	if kind == "dot" {
+		path, err := exec.LookPath("dot")
+		if err != nil {
+			return nil, false
+		}
+		cmd := exec.CommandContext(ctx, path, "-Tsvg")
+		cmd.Stdin = strings.NewReader(text)
+		out, err := cmd.Output()
+		return out, err == nil
+	}
+
+	path, err := exec.LookPath("mmdc")
+	if err != nil {
+		return nil, false
+	}
+	dir, err := os.MkdirTemp("", "pastry-mermaid")
+	if err != nil {
+		return nil, false
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in.mmd"), filepath.Join(dir, "out.svg")
+	if os.WriteFile(in, []byte(text), 0600) != nil {
+		return nil, false
+	}
+	if exec.CommandContext(ctx, path, "-q", "-i", in, "-o", out).Run() != nil {
+		return nil, false
+	}
+	b, err := os.ReadFile(out)
+	return b, err == nil
+}
+
+type graphNode struct {
+	id, label string
+	rank, pos int
+	x, y, w   float64
+}
+
+type graphEdge struct {
+	from, to *graphNode
+	label    string
+}
+
+type graph struct {
+	nodes    []*graphNode
+	byID     map[string]*graphNode
+	edges    []graphEdge
+	directed bool
+	across   bool // left to right instead of top down
+}
+
+func newGraph() *graph {
+	return &graph{byID: make(map[string]*graphNode), directed: true}
+}
+
+// node returns the node id, adding it if it is new. A label replaces the one it had.
+func (g *graph) node(id, label string) *graphNode {
+	n, ok := g.byID[id]
+	if !ok {
+		n = &graphNode{id: id, label: id}
+		g.byID[id] = n
+		g.nodes = append(g.nodes, n)
+	}
+	if label != "" {
+		n.label = label
+	}
+	return n
+}
+
+func dotUnquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' {
+		s = s[1 : len(s)-1]
+		s = strings.NewReplacer(`\"`, `"`, `\n`, " ", `\l`, " ", `\r`, " ", `\\`, `\`).Replace(s)
+	}
+	return s
+}
+
+// parseDOT reads the nodes and edges of a DOT graph, subgraphs are flattened and styling
+// other than labels is ignored.
+func parseDOT(text string) (*graph, error) {
+	g := newGraph()
+	text = dotCommentRe.ReplaceAllString(text, "")
+	m := dotRe.FindStringSubmatch(text)
+	if m == nil {
+		return nil, errors.New("Not a DOT graph")
+	}
+	g.directed = m[1] != ""
+	if d := rankdirRe.FindStringSubmatch(text); d != nil {
+		g.across = d[1] == "LR" || d[1] == "RL"
+	}
+	body := text[len(m[0]):]
+	end := strings.LastIndex(body, "}")
+	if end < 0 {
+		return nil, errors.New("The DOT graph has no closing }")
+	}
+	body = body[:end]
+
+	for _, stmt := range dotStmtRe.Split(body, -1) {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" || strings.HasPrefix(stmt, "subgraph") || strings.Contains(stmt, "=") && !strings.Contains(stmt, "[") {
+			continue
+		}
+		label := ""
+		if i := strings.Index(stmt, "["); i >= 0 {
+			if l := dotAttrRe.FindStringSubmatch(stmt[i:]); l != nil {
+				label = dotUnquote(l[1])
+			}
+			stmt = stmt[:i]
+		}
+		var ids []string
+		for rest := stmt; ; {
+			id := dotIDRe.FindStringSubmatch(rest)
+			if id == nil {
+				break
+			}
+			ids = append(ids, dotUnquote(id[1]))
+			rest = strings.TrimSpace(rest[len(id[0]):])
+			if !strings.HasPrefix(rest, "->") && !strings.HasPrefix(rest, "--") {
+				break
+			}
+			rest = rest[2:]
+		}
+		switch {
+		case len(ids) == 1 && (ids[0] == "graph" || ids[0] == "node" || ids[0] == "edge"):
+		case len(ids) == 1:
+			g.node(ids[0], label)
+		default:
+			for i := 1; i < len(ids); i++ {
+				g.edges = append(g.edges, graphEdge{g.node(ids[i-1], ""), g.node(ids[i], ""), label})
+			}
+		}
+	}
+	return g, nil
+}
+
+// mermaidLabel is the text of a node shape like [Start], (Round) or {Choice?}.
+func mermaidLabel(shape string) string {
+	s := strings.Trim(shape, "[](){}>")
+	return strings.Trim(strings.TrimSpace(s), `"`)
+}
+
+// parseMermaid reads a Mermaid flowchart, other kinds of Mermaid diagrams give an empty graph.
+func parseMermaid(text string) *graph {
+	g := newGraph()
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	head := strings.Fields(lines[0])
+	if len(head) == 0 || head[0] != "graph" && head[0] != "flowchart" {
+		return g
+	}
+	if len(head) > 1 {
+		g.across = head[1] == "LR" || head[1] == "RL"
+	}
+
+	for _, l := range lines[1:] {
+		l = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(l), ";"))
+		if l == "" || strings.HasPrefix(l, "%%") || strings.HasPrefix(l, "style ") || strings.HasPrefix(l, "classDef ") ||
+			strings.HasPrefix(l, "class ") || strings.HasPrefix(l, "click ") || strings.HasPrefix(l, "linkStyle ") ||
+			strings.HasPrefix(l, "subgraph") || l == "end" || strings.HasPrefix(l, "direction ") {
+			continue
+		}
+		var prev *graphNode
+		label := ""
+		for rest := l; ; {
+			m := mermaidNodeRe.FindStringSubmatch(rest)
+			if m == nil {
+				break
+			}
+			n := g.node(m[1], mermaidLabel(m[2]))
+			if prev != nil {
+				g.edges = append(g.edges, graphEdge{prev, n, label})
+			}
+			rest = rest[len(m[0]):]
+			link := mermaidLinkRe.FindStringSubmatch(rest)
+			if link == nil {
+				break
+			}
+			prev, label = n, strings.TrimSpace(link[2]+link[3])
+			rest = rest[len(link[0]):]
+		}
+	}
+	return g
+}
+
+// layout ranks the nodes by the longest path to them, ignoring edges that close a cycle,
+// and orders each rank by where the nodes they come from are.
+func (g *graph) layout() {
+	const (
+		charWidth = 7.0
+		padding   = 20.0
+		rankGap   = 70.0
+		nodeGap   = 30.0
+	)
+
+	out := make(map[*graphNode][]*graphNode)
+	for _, e := range g.edges {
+		out[e.from] = append(out[e.from], e.to)
+	}
+	// drop edges that go back to a node being visited, the rest is a DAG
+	state := make(map[*graphNode]int)
+	var order []*graphNode
+	var visit func(n *graphNode)
+	visit = func(n *graphNode) {
+		state[n] = 1
+		var keep []*graphNode
+		for _, t := range out[n] {
+			if state[t] == 1 {
+				continue
+			}
+			keep = append(keep, t)
+			if state[t] == 0 {
+				visit(t)
+			}
+		}
+		out[n] = keep
+		state[n] = 2
+		order = append(order, n)
+	}
+	for _, n := range g.nodes {
+		if state[n] == 0 {
+			visit(n)
+		}
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		for _, t := range out[order[i]] {
+			if t.rank < order[i].rank+1 {
+				t.rank = order[i].rank + 1
+			}
+		}
+	}
+
+	ranks := make(map[int][]*graphNode)
+	maxRank := 0
+	for _, n := range g.nodes {
+		ranks[n.rank] = append(ranks[n.rank], n)
+		if n.rank > maxRank {
+			maxRank = n.rank
+		}
+		n.w = float64(len([]rune(n.label)))*charWidth + padding
+	}
+	in := make(map[*graphNode][]*graphNode)
+	for _, e := range g.edges {
+		in[e.to] = append(in[e.to], e.from)
+	}
+	for r := 0; r <= maxRank; r++ {
+		rank := ranks[r]
+		bary := make(map[*graphNode]float64)
+		for i, n := range rank {
+			bary[n] = float64(i)
+			if len(in[n]) > 0 {
+				sum := 0.0
+				for _, f := range in[n] {
+					sum += float64(f.pos)
+				}
+				bary[n] = sum / float64(len(in[n]))
+			}
+		}
+		sort.SliceStable(rank, func(i, j int) bool { return bary[rank[i]] < bary[rank[j]] })
+
+		at := 0.0
+		for i, n := range rank {
+			n.pos = i
+			if g.across {
+				n.x, n.y = float64(r)*(rankGap+120), at
+				at += 30 + nodeGap/2
+			} else {
+				n.x, n.y = at, float64(r)*rankGap
+				at += n.w + nodeGap
+			}
+		}
+	}
+	if g.across {
+		// ranks are as wide as their widest node
+		offset := 0.0
+		for r := 0; r <= maxRank; r++ {
+			widest := 0.0
+			for _, n := range ranks[r] {
+				n.x = offset
+				if n.w > widest {
+					widest = n.w
+				}
+			}
+			offset += widest + rankGap
+		}
+	}
+}
+
+// svg draws g once laid out, boxes with their labels and straight edges between them.
+func (g *graph) svg() []byte {
+	const (
+		margin = 10.0
+		height = 30.0
+	)
+	width, depth := 0.0, 0.0
+	for _, n := range g.nodes {
+		if n.x+n.w > width {
+			width = n.x + n.w
+		}
+		if n.y+height > depth {
+			depth = n.y + height
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="%.0f %.0f %.0f %.0f" font-family="sans-serif" font-size="12">`,
+		width+2*margin, depth+2*margin, -margin, -margin, width+2*margin, depth+2*margin)
+	b.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M0,0 L10,5 L0,10 z" fill="#555"/></marker></defs>`)
+	b.WriteString(`<rect x="-10" y="-10" width="100%" height="100%" fill="white"/>`)
+
+	for _, e := range g.edges {
+		x1, y1, x2, y2 := e.from.x+e.from.w/2, e.from.y+height, e.to.x+e.to.w/2, e.to.y
+		if g.across {
+			x1, y1, x2, y2 = e.from.x+e.from.w, e.from.y+height/2, e.to.x, e.to.y+height/2
+		}
+		if e.from == e.to {
+			fmt.Fprintf(&b, `<path d="M%.1f,%.1f c30,-20 30,20 0,%.1f" fill="none" stroke="#555"/>`, e.from.x+e.from.w, e.from.y+height/3, height/3)
+			continue
+		}
+		marker := ""
+		if g.directed {
+			marker = ` marker-end="url(#arrow)"`
+		}
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555"%s/>`, x1, y1, x2, y2, marker)
+		if e.label != "" {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle" fill="#333">%s</text>`, (x1+x2)/2, (y1+y2)/2-3, html.EscapeString(e.label))
+		}
+	}
+	for _, n := range g.nodes {
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.0f" rx="4" fill="#eef" stroke="#335"/>`, n.x, n.y, n.w, height)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle" fill="#000">%s</text>`, n.x+n.w/2, n.y+height/2+4, html.EscapeString(n.label))
+	}
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// drawDiagram draws text as SVG, with dot or mmdc if there is one and else by itself.
+func drawDiagram(kind, text string) ([]byte, bool) {
+	if b, ok := runDiagramTool(kind, text); ok {
+		return b, true
+	}
+	g := parseMermaid(text)
+	if kind == "dot" {
+		var err error
+		if g, err = parseDOT(text); err != nil {
+			return nil, false
+		}
+	}
+	if len(g.nodes) == 0 || len(g.nodes) > maxDiagramNodes {
+		return nil, false
+	}
+	g.layout()
+	return g.svg(), true
+}
+
+// pasteSVG serves /p/<id>.svg, the diagram of a DOT or Mermaid paste. Drawing may take a
+// while, so it is done without holding the mutex.
+func (p *pastry) pasteSVG(w http.ResponseWriter, r *http.Request, id string) {
+	p.mutex.Lock()
+	_, e, ok := p.lookupID(id)
+	var kind, text, key string
+	var svg []byte
+	var when time.Time
+	if ok {
+		kind, text, when = diagramKind(e), e.Text, e.When
+		key = etag([]byte(kind + "\n" + text))
+		svg = p.diagrams[key]
+	}
+	p.mutex.Unlock()
+
+	if !ok || !p.cfg.Diagrams || kind == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if svg == nil {
+		if svg, ok = drawDiagram(kind, text); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		p.mutex.Lock()
+		if p.diagrams == nil || len(p.diagrams) >= maxDiagramCache {
+			p.diagrams = make(map[string][]byte)
+		}
+		p.diagrams[key] = svg
+		p.mutex.Unlock()
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	serveConditional(w, r, when.Truncate(time.Second), etag(svg), svg)
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import "testing"
+
+func TestParseDOT(t *testing.T) {
+	for _, tc := range []struct {
+		text         string
+		nodes, edges int
+		ok           bool
+	}{
+		{"digraph { a -> b -> c; b -> d }", 4, 3, true},
+		{"graph g {\n  a [label=\"A\"]\n  a -- b // comment\n}", 2, 1, true},
+		{"strict digraph { rankdir=LR; a; b }", 2, 0, true},
+		{"digraph {", 0, 0, false},
+		{"digraph g { a -> b", 0, 0, false},
+		{"not a graph", 0, 0, false},
+	} {
+		g, err := parseDOT(tc.text)
+		if (err == nil) != tc.ok || err == nil && (len(g.nodes) != tc.nodes || len(g.edges) != tc.edges) {
+			t.Errorf("parseDOT(%q) = %v, %v", tc.text, g, err)
+		}
+	}
+}
+
+func TestParseMermaid(t *testing.T) {
+	for _, tc := range []struct {
+		text         string
+		nodes, edges int
+	}{
+		{"graph TD\n  A[Start] --> B{Choice?}\n  B -->|yes| C(Done)", 3, 2},
+		{"flowchart LR\n  a -- label --> b", 2, 1},
+		// cut short, what there is is drawn
+		{"graph TD\n  A[Start --> B(", 1, 0},
+		{"graph TD\n  subgraph one\n  A --> ", 1, 0},
+		{"sequenceDiagram\n  A->>B: hi", 0, 0},
+		{"", 0, 0},
+	} {
+		if g := parseMermaid(tc.text); len(g.nodes) != tc.nodes || len(g.edges) != tc.edges {
+			t.Errorf("parseMermaid(%q) = %d nodes and %d edges, want %d and %d", tc.text, len(g.nodes), len(g.edges), tc.nodes, tc.edges)
+		}
+	}
+	if _, ok := drawDiagram("dot", "digraph {"); ok {
+		t.Errorf("drawDiagram of an unterminated DOT graph drew it")
+	}
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// The disk watchdog looks at the free space of the data directory each time maintain runs.
+// Under --min-free the storage is full and new pastes, uploads and imports are refused before
+// anything is written, with 507 Insufficient Storage on the web GUI and "ERR: storage full" on
+// the write port, rather than the store failing halfway through a save. The notifiers hear of
+// it once as it fills up and once as there is room again. /healthz answers 503 meanwhile, and
+// the statistics page says so. Reading, editing and deleting pastes go on as before.
+
+var errStorageFull = errors.New("storage full")
+
+// errNoDiskFree is diskFree on systems it doesn't know how to ask.
+var errNoDiskFree = errors.New("Not supported on this system")
+
+// full is true while the data directory has less than --min-free.
+func (p *pastry) full() bool {
+	return p.diskFull.Load()
+}
+
+// checkDisk updates the free space of the data directory, and tells the notifiers when it
+// goes under --min-free or back over it.
+func (p *pastry) checkDisk() {
+	if p.cfg.MinFree <= 0 || p.cfg.NoPersist {
+		return
+	}
+	free, err := diskFree(p.cfg.DataDir)
+	if err != nil {
+		if p.diskFree.Swap(-1) == -1 {
+			return
+		}
+		if errors.Is(err, errNoDiskFree) {
+			log.Printf("Warning: --min-free is not supported on this system, the free space of %s is not watched", p.cfg.DataDir)
+		} else {
+			log.Printf("Free space of %s unknown: %v", p.cfg.DataDir, err)
+		}
+		return
+	}
+	p.diskFree.Store(free)
+	full := free < p.cfg.MinFree
+	if p.diskFull.Swap(full) == full {
+		return
+	}
+	n := notification{Title: "Storage full", When: time.Now(),
+		Text: fmt.Sprintf("%s free in %s, under --min-free %s, new pastes are refused", humanize.IBytes(uint64(free)), p.cfg.DataDir, humanize.IBytes(uint64(p.cfg.MinFree)))}
+	if !full {
+		n.Title, n.Text = "Storage no longer full", fmt.Sprintf("%s free in %s, new pastes are taken again", humanize.IBytes(uint64(free)), p.cfg.DataDir)
+	}
+	log.Printf("%s: %s", n.Title, n.Text)
+	p.notify(n)
+}
+
+// storeStatus is the HTTP status of a paste that wasn't stored because of err.
+func storeStatus(err error) int {
+	if errors.Is(err, errStorageFull) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func notStored(w http.ResponseWriter, err error) {
+	http.Error(w, "Not stored: "+err.Error(), storeStatus(err))
+}
+
+// writeNotStored answers a paste on the write port that wasn't stored because of err.
+func writeNotStored(c io.Writer, err error) {
+	if errors.Is(err, errStorageFull) {
+		c.Write([]byte("ERR: " + errStorageFull.Error() + "\n"))
+		return
+	}
+	c.Write([]byte("# Not stored: " + err.Error() + "\n"))
+}
+
+// healthz answers ok, or 503 while the storage is full, for monitoring and load balancers.
+func (p *pastry) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if p.full() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s, %s free\n", errStorageFull, humanize.IBytes(uint64(p.diskFree.Load())))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,11 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+//go:build !linux && !darwin && !freebsd
+
+package pastryd
+
+func diskFree(dir string) (int64, error) {
+	return 0, errNoDiskFree
+}
@@ -0,0 +1,18 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+//go:build linux || darwin || freebsd
+
+package pastryd
+
+import "syscall"
+
+// diskFree is how many bytes of the file system of dir are free for pastry, which isn't root.
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
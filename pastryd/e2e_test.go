@@ -0,0 +1,1911 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasteAndGet(t *testing.T) {
+	ts := startServer(t, Config{})
+	for i, text := range []string{"one apple\n", "two apples\n", "three apples\n"} {
+		// the index, id and permalink of the paste
+		f := strings.Fields(ts.paste(text))
+		if len(f) != 3 || f[0] != strconv.Itoa(i) || f[2] != "http://"+ts.web+"/p/"+f[1] {
+			t.Fatalf("paste answered %q", f)
+		}
+		if code, body := ts.get("/raw/" + f[1]); code != http.StatusOK || body != text {
+			t.Errorf("GET /raw/%s = %d %q, want %q", f[1], code, body, text)
+		}
+	}
+
+	for _, tc := range []struct{ cmd, want string }{
+		{"get", "three apples\n"},
+		{"get 0", "one apple\n"},
+		{"get 1", "two apples\n"},
+		{"get -1", "three apples\n"},
+		{"get -3", "one apple\n"},
+		// out of bounds is silence, not an error
+		{"get 3", ""},
+		{"get -4", ""},
+		{"get x", ""},
+	} {
+		if got := ts.command(tc.cmd); got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+	if got := ts.quiet(); got != "three apples\n" {
+		t.Errorf("read port without a command = %q, want the latest paste", got)
+	}
+}
+
+func TestListPadding(t *testing.T) {
+	ts := startServer(t, Config{PreviewLen: 60})
+	for i := 0; i < 11; i++ {
+		ts.paste("apple\n")
+	}
+	lines := strings.Split(strings.TrimSuffix(ts.command("list"), "\n"), "\n")
+	if len(lines) != 11 {
+		t.Fatalf("list has %d lines, want 11:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	// the index is right aligned in three columns, the time padded to 20
+	line := regexp.MustCompile(`^#( {2}\d| \d\d)\t(.{20,})\tapple$`)
+	for i, l := range lines {
+		m := line.FindStringSubmatch(l)
+		if m == nil {
+			t.Fatalf("list line %d = %q", i, l)
+		}
+		if len(m[2]) != 20 {
+			t.Errorf("time of line %d is %q, %d wide", i, m[2], len(m[2]))
+		}
+	}
+	if !strings.HasPrefix(lines[10], "# 10\t") {
+		t.Errorf("last line = %q", lines[10])
+	}
+}
+
+func TestListPreview(t *testing.T) {
+	ts := startServer(t, Config{PreviewLen: 60})
+	ts.paste("\n\n   {\n  the first line with letters\nsecond\n")
+
+	for _, tc := range []struct{ cmd, want string }{
+		{"list", "the first line with letters"},
+		{"list --preview 9", "the firs…"},
+		{"list --preview 0", "the first line with letters"},
+	} {
+		got := ts.command(tc.cmd)
+		if _, text, _ := strings.Cut(strings.TrimSuffix(got, "\n"), "\t"); !strings.HasSuffix(text, "\t"+tc.want) {
+			t.Errorf("%s = %q, want the preview %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestLang(t *testing.T) {
+	ts := startServer(t, Config{Locale: "de"})
+	ts.paste("one apple\n")
+
+	// a slow machine may take a second, the time column is padded to 20 all the same
+	for _, tc := range []struct{ cmd, want string }{
+		{"list", `^#  0\t(jetzt|vor 1 Sekunde) +\tone apple\n$`},
+		{"list --lang sv", `^#  0\t(nu|1 sekund sedan) +\tone apple\n$`},
+		{"list --lang=fr", `^#  0\t(jetzt|vor 1 Sekunde) +\tone apple\n$`},
+		{"--lang sv list", `^#  0\t(nu|1 sekund sedan) +\tone apple\n$`},
+		{"grep --lang en apple", `^#  0\t  1\t(now|1 second ago) +\tone apple\n$`},
+	} {
+		got := ts.command(tc.cmd)
+		cols := strings.Split(got, "\t")
+		if !regexp.MustCompile(tc.want).MatchString(got) || len(cols[len(cols)-2]) != 20 {
+			t.Errorf("%s = %q, want %s", tc.cmd, got, tc.want)
+		}
+	}
+	req, _ := http.NewRequest("GET", "http://"+ts.web+"/", nil)
+	req.Header.Set("Accept-Language", "sv-SE,sv;q=0.9,en;q=0.5")
+	if _, body := ts.do(http.DefaultClient.Do(req)); !regexp.MustCompile(`>(nu|1 sekund sedan)<`).MatchString(body) {
+		t.Errorf("GET / with Accept-Language sv has no time in Swedish")
+	}
+}
+
+func TestWidth(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("an apple a day\n")
+	ts.paste("one more apple\n")
+	ts.command("meta 1 name=note")
+
+	// the text starts at column 32, or 40 with the line numbers of grep
+	for _, tc := range []struct{ cmd, want string }{
+		{"list --width 36", `^#  0\t.+\tan …\n#  1\t.+\t@no…\n$`},
+		{"--width 36 list", `^#  0\t.+\tan …\n#  1\t.+\t@no…\n$`},
+		{"list --width=200", `^#  0\t.+\tan apple a day\n#  1\t.+\t@note one more apple\n$`},
+		{"grep --width 44 apple", `^#  0\t  1\t.+\tan …\n#  1\t  1\t.+\tone…\n$`},
+		{"grep --width 44 --color apple", `^\x1b.+\tan \x1b\[1;31m…\x1b\[0m\n.+\tone…\n$`},
+		{"history @note --width 24", `^@note~0\t#  1\t.+\t…\n$`},
+	} {
+		if got := ts.command(tc.cmd); !regexp.MustCompile(tc.want).MatchString(got) {
+			t.Errorf("%s = %q, want %s", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestGrepIndexes(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one apple\n")
+	ts.paste("two pears\nand two apples\n")
+
+	got := ts.command("grep two")
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("grep two = %q, want two lines", got)
+	}
+	// paste index, then line number, both padded to three
+	for i, want := range []string{"#  1\t  1\t", "#  1\t  2\t"} {
+		if !strings.HasPrefix(lines[i], want) {
+			t.Errorf("grep line %d = %q, want it to start with %q", i, lines[i], want)
+		}
+	}
+	// --device is not a part of the pattern, before or after the name
+	for _, cmd := range []string{"grep --device phone two", "--device phone grep two", "grep --device=phone two"} {
+		if got := ts.command(cmd); strings.Count(got, "\n") != 2 {
+			t.Errorf("%s = %q, want two lines", cmd, got)
+		}
+	}
+}
+
+func TestPasteTruncatedToMaxPaste(t *testing.T) {
+	ts := startServer(t, Config{Limits: limits{MaxPaste: 16, MaxUpload: 16}})
+	if got := ts.paste(strings.Repeat("0123456789", 4)); !strings.HasPrefix(got, "# Cut to max-paste, 16 bytes\n0 ") {
+		t.Errorf("paste of 40 bytes = %q", got)
+	}
+	if got := ts.command("get"); got != "0123456789012345" {
+		t.Errorf("get = %q, want the first 16 bytes", got)
+	}
+	if got := ts.command("caps"); !strings.Contains(got, "\nmax-paste=16\n") {
+		t.Errorf("caps = %q, want max-paste=16", got)
+	}
+}
+
+func TestPasteInPieces(t *testing.T) {
+	ts := startServer(t, Config{Limits: limits{ImportIdle: time.Second}})
+	// more than one read, from a client that takes its time
+	c, err := net.Dial("tcp", ts.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("ä line of text\n", 10000)
+	c.Write([]byte(big))
+	time.Sleep(100 * time.Millisecond)
+	c.Write([]byte("and the end\n"))
+	c.(*net.TCPConn).CloseWrite()
+	io.ReadAll(c)
+	c.Close()
+	if got := ts.command("get"); got != big+"and the end\n" {
+		t.Errorf("get = %d bytes, want %d", len(got), len(big)+12)
+	}
+
+	// cut to max-paste before a character rather than in it
+	ts = startServer(t, Config{Limits: limits{MaxPaste: 4, MaxUpload: 4}})
+	ts.paste("abcä")
+	if got := ts.command("get"); got != "abc" {
+		t.Errorf("get after cutting ä = %q", got)
+	}
+	if got := ts.paste("\xff\xfe\x00"); got != "# Not stored: Not UTF-8 text\n" {
+		t.Errorf("paste of binary = %q", got)
+	}
+}
+
+func TestLargePaste(t *testing.T) {
+	ts := startServer(t, Config{Limits: limits{MaxPaste: 1024, MaxUpload: 64 * 1024}})
+	c, err := net.Dial("tcp", ts.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an ä split between two writes
+	big := strings.Repeat("a line of text\n", 2000) + "ä\n"
+	c.Write([]byte(big[:len(big)-2]))
+	time.Sleep(100 * time.Millisecond)
+	c.Write([]byte(big[len(big)-2:]))
+	c.(*net.TCPConn).CloseWrite()
+	if reply, _ := io.ReadAll(c); !bytes.HasPrefix(reply, []byte("0 ")) {
+		t.Errorf("paste of %d bytes = %q", len(big), reply)
+	}
+	c.Close()
+	if got := ts.command("get"); got != big {
+		t.Errorf("get = %d bytes, want %d", len(got), len(big))
+	}
+	if code, got := ts.get("/raw/-1"); code != http.StatusOK || got != big {
+		t.Errorf("GET /raw/-1 = %d with %d bytes, want %d", code, len(got), len(big))
+	}
+	ts.restart()
+	code, body := ts.get(apiPrefix + "/-1")
+	var a apiPaste
+	json.Unmarshal([]byte(body), &a)
+	if code != http.StatusOK || a.Size != int64(len(big)) || a.Hash != textHash(big) || a.Mime != spoolMime {
+		t.Errorf("GET %s/-1 after a restart = %d %s", apiPrefix, code, body)
+	}
+
+	// over max-upload it is cut as well
+	if got := ts.paste(strings.Repeat("ä", 40*1024)); !strings.HasPrefix(got, "# Cut to max-upload, 65536 bytes\n1 ") {
+		t.Errorf("paste of 80 KiB = %q", got)
+	}
+	if got := ts.command("get"); got != strings.Repeat("ä", 32*1024) {
+		t.Errorf("get = %d bytes, want 64 KiB", len(got))
+	}
+	if got := ts.paste(strings.Repeat("a", 2048) + "\xff\xfe"); got != "# Not stored: Not UTF-8 text\n" {
+		t.Errorf("paste of binary = %q", got)
+	}
+	if n := len(apiList(t, ts)); n != 2 {
+		t.Errorf("%d pastes, want the two", n)
+	}
+}
+
+func TestSession(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	ts.paste("two, without a newline")
+	c, err := net.Dial("tcp", ts.read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(c)
+	answer := func() string {
+		t.Helper()
+		var n int
+		if _, err := fmt.Fscanf(r, "# %d bytes\n", &n); err != nil {
+			t.Fatalf("no answer: %v", err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("answer of %d bytes: %v", n, err)
+		}
+		return string(b)
+	}
+
+	// the first commands with the session line, and one a while later
+	c.Write([]byte("session\nget 1\n\nget 0\n"))
+	if got := answer(); got != "two, without a newline" {
+		t.Errorf("get 1 = %q", got)
+	}
+	if got := answer(); got != "one\n" {
+		t.Errorf("get 0 = %q", got)
+	}
+	// longer than the read timeout
+	time.Sleep(300 * time.Millisecond)
+	c.Write([]byte("drop 0\nlist\nfrobnicate\n"))
+	if got := answer(); got != "" {
+		t.Errorf("drop 0 = %q", got)
+	}
+	if got := answer(); strings.Count(got, "\n") != 1 || !strings.Contains(got, "two, without") {
+		t.Errorf("list after drop 0 = %q", got)
+	}
+	if got := answer(); got != "# Unknown command\n" {
+		t.Errorf("frobnicate = %q", got)
+	}
+	c.Write([]byte("quit\n"))
+	if rest, _ := io.ReadAll(r); len(rest) != 0 {
+		t.Errorf("after quit = %q", rest)
+	}
+}
+
+func TestHeadTail(t *testing.T) {
+	ts := startServer(t, Config{Limits: limits{MaxPaste: 1024, MaxUpload: 1024 * 1024}})
+	var lines []string
+	for i := 1; i <= 30; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	ts.paste(strings.Join(lines, "\n") + "\n")
+	ts.paste("one\ntwo, without a newline")
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"head 0", strings.Join(lines[:10], "\n") + "\n"},
+		{"tail 0", strings.Join(lines[20:], "\n") + "\n"},
+		{"head 0 3", "line 1\nline 2\nline 3\n"},
+		{"tail 0 2", "line 29\nline 30\n"},
+		{"tail 0 0", ""},
+		{"tail 1 1", "two, without a newline"},
+		{"tail 1 5", "one\ntwo, without a newline"},
+		{"head 1 1", "one\n"},
+		{"tail 0 -1", "# Usage: tail <id> [lines], of a text paste\n"},
+		{"head 0 many", "# Usage: head <id> [lines], of a text paste\n"},
+		{"head 7", "# Usage: head <id> [lines], of a text paste\n"},
+	} {
+		if got := ts.command(tc.cmd); got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+
+	// a paste over max-paste is a file, the end of it past a chunk of the reading
+	big := strings.Repeat("a line of text\n", 10000) + "the end\n"
+	ts.paste(big)
+	if got := ts.command("tail -1 2"); got != "a line of text\nthe end\n" {
+		t.Errorf("tail of a large paste = %q", got)
+	}
+	if got := ts.command("head -1 1"); got != "a line of text\n" {
+		t.Errorf("head of a large paste = %q", got)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ts := startServer(t, Config{})
+	if got := ts.command("stat"); got != "pastes=0\nfiles=0\nbytes=0\n" {
+		t.Errorf("stat of nothing = %q", got)
+	}
+	ts.paste("one\n")
+	ts.paste("a longer one\n")
+	ts.paste("two\n")
+	if code := ts.upload("image/png", []byte("\x89PNG a screenshot")); code != http.StatusSeeOther {
+		t.Fatalf("upload = %d", code)
+	}
+	got := ts.command("stat")
+	for _, want := range []string{"pastes=4\n", "files=1\n", "bytes=38\n", "smallest=4\n", "median=13\n", "mean=9\n", "largest=17\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("stat = %q, without %q", got, want)
+		}
+	}
+	for _, key := range []string{"oldest", "newest"} {
+		if m := regexp.MustCompile(`(?m)^` + key + `=(.*)$`).FindStringSubmatch(got); m == nil {
+			t.Errorf("stat = %q, without %s", got, key)
+		} else if when, err := time.Parse(time.RFC3339, m[1]); err != nil || time.Since(when) > time.Minute {
+			t.Errorf("%s=%s", key, m[1])
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	ts := startServer(t, Config{Limits: limits{MaxPaste: 1024, MaxUpload: 1024 * 1024}})
+	ts.paste("one\ntwo\n\n")
+	big := strings.Repeat("a line of text\n", 1000) + "\n\n"
+	ts.paste(big)
+	ts.upload("image/png", []byte("\x89PNG a screenshot"))
+	id := strings.Fields(ts.paste("three"))[1]
+
+	for _, tc := range []struct {
+		cmd  string
+		want []string
+	}{
+		{"info 0", []string{"index=0\n", "bytes=9\n", "lines=2\n", "sha256=" + textHash("one\ntwo\n\n") + "\n"}},
+		{"info 1", []string{"bytes=15002\n", "lines=1000\n", "sha256=" + textHash(big) + "\n", "mime=" + spoolMime + "\n"}},
+		{"info 2", []string{"bytes=17\n", "mime=image/png\n", "sha256=" + textHash("\x89PNG a screenshot") + "\n"}},
+		{"info -1", []string{"index=3\n", "id=" + id + "\n", "lines=1\n"}},
+	} {
+		got := ts.command(tc.cmd)
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s = %q, without %q", tc.cmd, got, want)
+			}
+		}
+		if m := regexp.MustCompile(`(?m)^when=(.*)$`).FindStringSubmatch(got); m == nil {
+			t.Errorf("%s = %q, without when", tc.cmd, got)
+		} else if when, err := time.Parse(time.RFC3339, m[1]); err != nil || time.Since(when) > time.Minute {
+			t.Errorf("%s: when=%s", tc.cmd, m[1])
+		}
+	}
+	if got := ts.command("info 2"); strings.Contains(got, "lines=") {
+		t.Errorf("info of an image = %q", got)
+	}
+	if got := ts.command("info 9"); got != "# Usage: info <id>\n" {
+		t.Errorf("info 9 = %q", got)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	ts.paste("two\n")
+	ts.paste("three\n")
+	ts.command("drop 1")
+	ts.command("drop")
+	if got := ts.command("list"); strings.Count(got, "\n") != 1 || !strings.HasSuffix(got, "\tone\n") {
+		t.Errorf("list after drops = %q", got)
+	}
+}
+
+func TestClear(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	ts.paste("two\n")
+	ts.upload("image/png", []byte("\x89PNG a screenshot"))
+	for _, cmd := range []string{"clear", "clear yes", "clear yes-really now"} {
+		if got := ts.command(cmd); got != "# Usage: clear yes-really, drops every paste\n" {
+			t.Errorf("%s = %q", cmd, got)
+		}
+	}
+	if got := ts.command("stat"); !strings.HasPrefix(got, "pastes=3\n") {
+		t.Errorf("stat before clear = %q", got)
+	}
+	if got := ts.command("clear yes-really"); got != "Cleared 3 pastes\n" {
+		t.Errorf("clear yes-really = %q", got)
+	}
+	ts.restart()
+	if got := ts.command("list"); got != "" {
+		t.Errorf("list after clear = %q", got)
+	}
+	ts.paste("three\n")
+	if got := ts.command("get 0"); got != "three\n" {
+		t.Errorf("get 0 = %q", got)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("soon gone\n")
+	ts.paste("kept a while\n")
+	ts.command("expire 0 10m")
+	ts.command("expire 1 7d")
+	got := ts.command("list --color")
+	if !regexp.MustCompile(`\[\x1b\[1;33mexpires \d+ minutes from now\x1b\[0m\] soon gone`).MatchString(got) ||
+		!regexp.MustCompile(`\[expires \d+ days from now\] kept`).MatchString(got) {
+		t.Errorf("list --color = %q", got)
+	}
+	if _, body := ts.get("/"); !strings.Contains(body, `<small class="expiry" data-expires="`) {
+		t.Errorf("the index has no expiry countdown: %s", body)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts := startServer(t, Config{})
+	for _, tc := range []struct{ cmd, want string }{
+		{"list --view nothing", "# Unknown view\n"},
+		{"meta 0", "# Usage: meta <id> [title=...] [lang=...] [category=...] [tags=a,b]\n"},
+		{"expire 0 soon", "# Usage: expire <id> <duration>|never\n"},
+	} {
+		if got := ts.command(tc.cmd); got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	for _, store := range []string{"gob", "dir"} {
+		t.Run(store, func(t *testing.T) {
+			ts := startServer(t, Config{Store: store})
+			ts.paste("kept\n")
+			ts.paste("dropped\n")
+			ts.paste("renamed\n")
+			ts.command("drop 1")
+			ts.command("meta 1 title=hello")
+
+			ts.restart()
+			if got := ts.command("get 0"); got != "kept\n" {
+				t.Errorf("get 0 after restart = %q", got)
+			}
+			if got := ts.command("list"); strings.Count(got, "\n") != 2 || !strings.HasSuffix(got, "\thello: renamed\n") {
+				t.Errorf("list after restart = %q", got)
+			}
+		})
+	}
+}
+
+func TestMigrateGob(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("from gob\n")
+	ts.stop()
+
+	ts.cfg.Store = "dir"
+	ts.start()
+	if got := ts.command("get"); got != "from gob\n" {
+		t.Errorf("get in the new store = %q", got)
+	}
+	ts.command("drop")
+	ts.restart()
+	if got := ts.command("list"); got != "" {
+		t.Errorf("dropped pastes came back from pastes.gob: %q", got)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("first\n")
+	ts.paste("second\n")
+	ts.command("meta 1 title=hello tags=a,b name=two")
+	ts.upload("audio/ogg", []byte("OggS of a memo"))
+	// without the times, which may have moved on
+	untimed := regexp.MustCompile(`\t.*\t`)
+	before := untimed.ReplaceAllString(ts.command("list"), " ")
+	ts.stop()
+
+	var archive bytes.Buffer
+	if err := Export(ts.cfg, &archive); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	var entries []archiveEntry
+	if err := json.Unmarshal(archive.Bytes(), &entries); err != nil || len(entries) != 3 {
+		t.Fatalf("the archive has %d pastes: %v", len(entries), err)
+	}
+	if e := entries[2]; e.Hash != textHash("OggS of a memo") || e.Size != 14 || entries[0].Hash != textHash("first\n") {
+		t.Errorf("the archive has the hashes %s and %s", entries[0].Hash, e.Hash)
+	}
+
+	moved := Config{DataDir: t.TempDir(), Store: "dir"}
+	if n, err := Import(moved, bytes.NewReader(archive.Bytes())); err != nil || n != 3 {
+		t.Fatalf("Import = %d, %v", n, err)
+	}
+	ts2 := startServer(t, moved)
+	if got := untimed.ReplaceAllString(ts2.command("list"), " "); got != before {
+		t.Errorf("list after the import = %q, want %q", got, before)
+	}
+	if got := ts2.command("get @two"); got != "second\n" {
+		t.Errorf("get @two = %q", got)
+	}
+	if got := ts2.command("get 2"); got != "OggS of a memo" {
+		t.Errorf("get of the file = %q", got)
+	}
+	ts2.s.p.mutex.Lock()
+	for i, e := range ts2.s.p.texts {
+		if meta := newPasteMeta(e); meta.ID != entries[i].ID || meta.Hash != entries[i].Hash {
+			t.Errorf("#%d is %+v, was %+v", i, meta, entries[i].pasteMeta)
+		}
+	}
+	ts2.s.p.mutex.Unlock()
+}
+
+func TestStoreKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, store := range []string{"gob", "dir"} {
+		t.Run(store, func(t *testing.T) {
+			ts := startServer(t, Config{Store: store})
+			ts.paste("before the key hunter2\n")
+			ts.stop()
+
+			ts.cfg.StoreKey = key
+			ts.start()
+			ts.paste("after the key hunter2\n")
+			ts.paste("dropped\n")
+			ts.command("drop 2")
+			ts.restart()
+			ts.s.p.mutex.Lock()
+			if len(ts.s.p.tombs) != 1 {
+				t.Errorf("tombstones after a restart with the key: %v", ts.s.p.tombs)
+			}
+			ts.s.p.mutex.Unlock()
+			if got := ts.command("get 0"); got != "before the key hunter2\n" {
+				t.Errorf("get 0 with the key = %q", got)
+			}
+			if got := ts.command("get 1"); got != "after the key hunter2\n" {
+				t.Errorf("get 1 with the key = %q", got)
+			}
+			ts.stop()
+			filepath.WalkDir(ts.cfg.DataDir, func(path string, d fs.DirEntry, err error) error {
+				if b, err := os.ReadFile(path); err == nil && bytes.Contains(b, []byte("hunter2")) {
+					t.Errorf("%s is in plaintext", path)
+				}
+				return nil
+			})
+			if b, err := os.ReadFile(filepath.Join(ts.cfg.DataDir, "tombstones.gob")); err != nil || !sealed(b) {
+				t.Errorf("tombstones.gob is not sealed, %v", err)
+			}
+
+			for _, wrong := range [][]byte{nil, bytes.Repeat([]byte{8}, 32)} {
+				cfg := ts.cfg
+				cfg.StoreKey = wrong
+				if s, err := New(cfg); err == nil {
+					s.Stop()
+					t.Errorf("New with the store key %x loaded the store", wrong)
+				}
+			}
+		})
+	}
+}
+
+func TestNoPersist(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pastry")
+	ts := startServer(t, Config{DataDir: dir, NoPersist: true})
+	ts.paste("forgotten\n")
+	ts.command("view save v forgotten")
+	if code, _ := ts.post("/limits", url.Values{"limits": {"max-paste=4KiB"}}); code != http.StatusSeeOther {
+		t.Errorf("POST /limits = %d", code)
+	}
+	if got := ts.command("get"); got != "forgotten\n" {
+		t.Errorf("get = %q", got)
+	}
+	ts.restart()
+	if got := ts.command("list"); got != "" {
+		t.Errorf("list after restart = %q", got)
+	}
+	if got := ts.command("caps"); strings.Contains(got, "\nmax-paste=4096\n") {
+		t.Errorf("caps after restart = %q, the limits were kept", got)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the data directory was created: %v", err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	data := bytes.Repeat([]byte("OggS and some more "), 200000)
+	for name, cfg := range map[string]Config{
+		"plain":      {},
+		"sealed":     {StoreKey: bytes.Repeat([]byte{7}, 32)},
+		"no-persist": {NoPersist: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg.Limits.MaxUpload = 2 * len(data)
+			ts := startServer(t, cfg)
+			if code := ts.upload("audio/ogg", data); code != http.StatusSeeOther {
+				t.Fatalf("POST /upload = %d", code)
+			}
+			if got := ts.command("get"); got != string(data) {
+				t.Errorf("get of the file = %d bytes, want %d", len(got), len(data))
+			}
+			if code, body := ts.get("/download/0"); code != http.StatusOK || body != string(data) {
+				t.Errorf("GET /download/0 = %d with %d bytes, want %d", code, len(body), len(data))
+			}
+			req, _ := http.NewRequest("GET", "http://"+ts.web+"/download/0", nil)
+			req.Header.Set("Range", "bytes=4-12")
+			if code, body := ts.do(http.DefaultClient.Do(req)); code != http.StatusPartialContent || body != " and some" {
+				t.Errorf("GET /download/0 of a range = %d %q", code, body)
+			}
+			// resuming, of the same file only
+			resp, err := http.Get("http://" + ts.web + "/download/0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			for tag, want := range map[string]int{resp.Header.Get("ETag"): http.StatusPartialContent, `"0123456789abcdef"`: http.StatusOK} {
+				req.Header.Set("If-Range", tag)
+				if code, _ := ts.do(http.DefaultClient.Do(req)); code != want {
+					t.Errorf("GET /download/0 of a range, If-Range %s = %d, want %d", tag, code, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilesStoredOnce(t *testing.T) {
+	ts := startServer(t, Config{})
+	files := filepath.Join(ts.cfg.DataDir, "files")
+	for i := 0; i < 3; i++ {
+		ts.upload("image/png", []byte("\x89PNG the same screenshot"))
+	}
+	ts.upload("image/png", []byte("\x89PNG another"))
+	count := func() int {
+		dir, _ := os.ReadDir(files)
+		return len(dir)
+	}
+	if n := count(); n != 2 {
+		t.Fatalf("%d files for two different ones", n)
+	}
+	del := func(id string) {
+		req, _ := http.NewRequest("DELETE", "http://"+ts.web+apiPrefix+"/"+id, nil)
+		if code, body := ts.do(http.DefaultClient.Do(req)); code != http.StatusNoContent {
+			t.Fatalf("DELETE %s = %d %s", id, code, body)
+		}
+	}
+	del("0")
+	del("0")
+	code, body := ts.get("/download/0")
+	if n := count(); n != 2 || code != http.StatusOK || body != "\x89PNG the same screenshot" {
+		t.Errorf("after deleting two of three, %d files and GET /download/0 = %d %q", n, code, body)
+	}
+	del("0")
+	if n := count(); n != 1 {
+		t.Errorf("%d files after deleting the last of three, want 1", n)
+	}
+}
+
+func TestGC(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.upload("image/png", []byte("\x89PNG kept"))
+	for i := 0; i < 20; i++ {
+		ts.paste(fmt.Sprintf("paste %d\n", i))
+	}
+	files := filepath.Join(ts.cfg.DataDir, "files")
+	old := time.Now().Add(-2 * tempFileAge)
+	for name, mod := range map[string]time.Time{"0123abcd.png": time.Now(), ".spool.1": old, ".spool.2": time.Now()} {
+		os.WriteFile(filepath.Join(files, name), []byte("left over"), 0644)
+		os.Chtimes(filepath.Join(files, name), mod, mod)
+	}
+	ts.stop()
+
+	report, err := GC(ts.cfg)
+	if err != nil || !strings.HasPrefix(report, "Removed 2 files no paste refers to, 18 B, compacted the store") {
+		t.Errorf("GC = %q, %v", report, err)
+	}
+	var left []string
+	dir, _ := os.ReadDir(files)
+	for _, f := range dir {
+		left = append(left, f.Name())
+	}
+	if len(left) != 2 || left[0] != ".spool.2" {
+		t.Errorf("files after gc: %q, want the one of the paste and a temporary file in use", left)
+	}
+	if info, err := os.Stat(filepath.Join(ts.cfg.DataDir, "pastes.journal")); err != nil || info.Size() != 0 {
+		t.Errorf("the journal wasn't emptied: %v", err)
+	}
+	ts.start()
+	if code, body := ts.get("/download/0"); code != http.StatusOK || body != "\x89PNG kept" {
+		t.Errorf("GET /download/0 after gc = %d %q", code, body)
+	}
+	if got := ts.command("get"); got != "paste 19\n" {
+		t.Errorf("get after gc = %q", got)
+	}
+}
+
+func TestRawRange(t *testing.T) {
+	ts := startServer(t, Config{Limits: limits{MaxPaste: 16}})
+	for _, text := range []string{"0123456789\n", strings.Repeat("0123456789", 10)} {
+		ts.paste(text)
+		req, _ := http.NewRequest("GET", "http://"+ts.web+"/raw/-1", nil)
+		req.Header.Set("Range", "bytes=2-5")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || string(body) != "2345" || resp.Header.Get("ETag") != etag([]byte(text)) {
+			t.Errorf("GET /raw/-1 of a range of %d bytes = %d %q, ETag %s", len(text), resp.StatusCode, body, resp.Header.Get("ETag"))
+		}
+	}
+}
+
+func TestBoardPerDevice(t *testing.T) {
+	ts := startServer(t, Config{})
+	p := ts.s.p
+	p.addEntry(&entry{Text: "by hand", Board: clipboardBoard, Origin: "phone"})
+	for i := 0; i < 2*clipboardPerDevice; i++ {
+		p.addEntry(&entry{Text: fmt.Sprintf("pushed %d", i), Board: clipboardBoard, Origin: "laptop"})
+	}
+	count := func() map[string]int {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		devices := make(map[string]int)
+		for _, e := range p.texts {
+			devices[e.Origin]++
+		}
+		return devices
+	}
+	if got := count(); got["laptop"] != clipboardPerDevice || got["phone"] != 1 {
+		t.Errorf("the clipboard keeps %v", got)
+	}
+	if got := ts.command("get -1"); got != fmt.Sprintf("pushed %d", 2*clipboardPerDevice-1) {
+		t.Errorf("get -1 = %q", got)
+	}
+
+	// and boards that aren't lazy, in the background
+	var boards boardPolicies
+	if err := boards.Set("docs:keep=5,per-device=2"); err != nil || boards[0].String() != "docs:keep=5,per-device=2" {
+		t.Fatalf("docs:keep=5,per-device=2 is %v, %v", boards, err)
+	}
+	l := *p.limit()
+	l.Boards = boards.withClipboard()
+	p.limits.Store(&l)
+	for i, origin := range []string{"nas", "nas", "nas", "", "", "", "phone"} {
+		p.addEntry(&entry{Text: fmt.Sprintf("doc %d", i), Board: "docs", Origin: origin})
+	}
+	p.enforceBoards(time.Now())
+	var docs []string
+	p.mutex.Lock()
+	for _, e := range p.texts {
+		if e.Board == "docs" {
+			docs = append(docs, e.Text)
+		}
+	}
+	p.mutex.Unlock()
+	if strings.Join(docs, " ") != "doc 2 doc 4 doc 5 doc 6" {
+		t.Errorf("docs keeps %q", docs)
+	}
+}
+
+func TestWeb(t *testing.T) {
+	ts := startServer(t, Config{})
+	code, id := ts.post("/paste", url.Values{"text": {"from the web"}})
+	if id = strings.TrimSpace(id); code != http.StatusSeeOther || len(id) != 16 {
+		t.Fatalf("POST /paste = %d %q", code, id)
+	}
+	if code, _ := ts.post("/paste", url.Values{"title": {"no text"}}); code != http.StatusBadRequest {
+		t.Errorf("POST /paste without text = %d", code)
+	}
+	if got := ts.command("get"); got != "from the web" {
+		t.Errorf("get = %q", got)
+	}
+	// the form goes on to the page of the paste, which keeps its link by the id
+	ts.paste("from the write port\n")
+	if code, body := ts.get("/p/" + id); code != http.StatusOK || !strings.Contains(body, "from the web") {
+		t.Errorf("GET /p/%s = %d", id, code)
+	}
+	ts.command("drop 1")
+	code, body := ts.get("/")
+	if code != http.StatusOK || !strings.Contains(body, "from the web") {
+		t.Errorf("GET / = %d without the paste", code)
+	}
+	// the index changes with its relative dates, it is only cached by its ETag
+	resp, err := http.Get("http://" + ts.web + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Last-Modified") != "" {
+		t.Errorf("GET / has Last-Modified %s", resp.Header.Get("Last-Modified"))
+	}
+	req, _ := http.NewRequest("GET", "http://"+ts.web+"/", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if code, _ := ts.do(http.DefaultClient.Do(req)); code != http.StatusOK {
+		t.Errorf("GET / If-Modified-Since = %d", code)
+	}
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	if code, _ := ts.do(http.DefaultClient.Do(req)); code != http.StatusNotModified {
+		t.Errorf("GET / If-None-Match = %d", code)
+	}
+	if code, body := ts.get("/raw/0"); code != http.StatusOK || body != "from the web" {
+		t.Errorf("GET /raw/0 = %d %q", code, body)
+	}
+	var pastes []apiPaste
+	if code, body := ts.get(apiPrefix); code != http.StatusOK || json.Unmarshal([]byte(body), &pastes) != nil || len(pastes) != 1 {
+		t.Fatalf("GET %s = %d %q", apiPrefix, code, body)
+	}
+	resp, err = http.Get("http://" + ts.web + "/raw/" + pastes[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" ||
+		resp.Header.Get("X-Content-Type-Options") != "nosniff" || resp.Header.Get("Content-Disposition") != `inline; filename="pastry-0.txt"` {
+		t.Errorf("GET /raw/<id> = %d %v", resp.StatusCode, resp.Header)
+	}
+	if code, _ := ts.get("/raw/1"); code != http.StatusNotFound {
+		t.Errorf("GET /raw/1 = %d, want 404", code)
+	}
+	resp, err = http.Get("http://" + ts.web + "/css/pico-master/css/pico.min.css")
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css") || resp.Header.Get("ETag") == "" {
+		t.Errorf("GET of the CSS = %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+	for path, typ := range map[string]string{
+		"/favicon.png":          "image/png",
+		"/logo.png":             "image/png",
+		"/icon-32.png":          "image/png",
+		"/icon.svg":             "image/svg+xml",
+		"/manifest.webmanifest": "application/manifest+json",
+		"/robots.txt":           "text/plain; charset=utf-8",
+	} {
+		resp, err := http.Get("http://" + ts.web + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != typ {
+			t.Errorf("GET %s = %d %q, want %q", path, resp.StatusCode, resp.Header.Get("Content-Type"), typ)
+		}
+	}
+
+	if code, _ := ts.get("/delete/0"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /delete/0 = %d", code)
+	}
+	if code, _ := ts.post("/delete/0", nil); code != http.StatusSeeOther {
+		t.Errorf("POST /delete/0 = %d", code)
+	}
+	if got := ts.command("list"); got != "" {
+		t.Errorf("list after the delete = %q", got)
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to dir.
+func writeCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestWebServer(t *testing.T) {
+	// a request that stalls in its headers is hung up on after --http-read-timeout
+	ts := startServer(t, Config{HTTPReadTimeout: 200 * time.Millisecond})
+	c, err := net.Dial("tcp", ts.web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: pastry\r\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Errorf("a stalled request wasn't closed: %v", err)
+	}
+	if code, _ := ts.get("/"); code != http.StatusOK {
+		t.Errorf("GET / = %d", code)
+	}
+
+	if _, err := New(Config{DataDir: t.TempDir(), TLSCert: "missing.pem", TLSKey: "missing.pem"}); err == nil {
+		t.Errorf("New with a missing certificate didn't fail")
+	}
+	cert, key := writeCert(t, t.TempDir())
+	ts = startServer(t, Config{TLSCert: cert, TLSKey: key})
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ts.web + "/raw/0")
+	if err != nil {
+		t.Fatalf("GET over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /raw/0 over TLS = %s %d, want HTTP/2 and 404", resp.Proto, resp.StatusCode)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	ts.paste("two\n")
+	ts.paste("- [ ] milk\n")
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	page := func(path string) string {
+		code, body := ts.do(browser.Get("http://" + ts.web + path))
+		if code != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, code)
+		}
+		return body
+	}
+	undo := regexp.MustCompile(`action="/undo/([0-9a-f]+)"`)
+
+	if _, body := ts.do(browser.PostForm("http://"+ts.web+"/delete/1", nil)); !strings.Contains(body, "<span>Deleted #1</span>") {
+		t.Fatalf("the index after a delete has no undo: %s", body)
+	}
+	if got := ts.command("list"); strings.Count(got, "\n") != 2 {
+		t.Fatalf("list after the delete = %q", got)
+	}
+	m := undo.FindStringSubmatch(page("/"))
+	if m == nil {
+		t.Fatalf("no undo on the index")
+	}
+	if code, _ := ts.do(browser.PostForm("http://"+ts.web+"/undo/"+m[1], nil)); code != http.StatusOK {
+		t.Errorf("undo = %d", code)
+	}
+	if got := ts.command("get 1"); got != "two\n" {
+		t.Errorf("get 1 after the undo = %q", got)
+	}
+	if undo.MatchString(page("/")) {
+		t.Errorf("the undo is still offered")
+	}
+	if code, _ := ts.do(browser.PostForm("http://"+ts.web+"/undo/"+m[1], nil)); code != http.StatusGone {
+		t.Errorf("a second undo = %d", code)
+	}
+
+	ts.do(browser.PostForm("http://"+ts.web+"/check/2", url.Values{"item": {"eggs"}}))
+	if m = undo.FindStringSubmatch(page("/p/2")); m == nil {
+		t.Fatalf("no undo of the new item")
+	}
+	ts.do(browser.PostForm("http://"+ts.web+"/undo/"+m[1], nil))
+	if got := ts.command("get 2"); got != "- [ ] milk\n" {
+		t.Errorf("get 2 after the undo = %q", got)
+	}
+
+	// the file of a deleted paste is kept for the undo, and removed after it
+	ts.upload("audio/ogg", []byte("OggS memo"))
+	files := filepath.Join(ts.cfg.DataDir, "files")
+	ts.do(browser.PostForm("http://"+ts.web+"/delete/3", nil))
+	if dir, _ := os.ReadDir(files); len(dir) != 1 {
+		t.Errorf("the file is gone before the undo is too late")
+	}
+	ts.s.p.emptyTrash(time.Now().Add(undoGrace))
+	if undo.MatchString(page("/")) {
+		t.Errorf("undo offered after the grace")
+	}
+	if dir, _ := os.ReadDir(files); len(dir) != 0 {
+		t.Errorf("the file is left after the grace: %v", dir)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\ntwo\nthree\n")
+	_, body := ts.get("/edit/0")
+	m := regexp.MustCompile(`action="/edit/([0-9a-f]+)">\s*<input type="hidden" name="rev" value="([0-9a-f]+)"/>`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("the edit page has no revision: %s", body)
+	}
+	id, rev := m[1], m[2]
+	save := func(rev, text string) (int, string) {
+		return ts.post("/edit/"+id, url.Values{"rev": {rev}, "base": {"one\r\ntwo\r\nthree\r\n"}, "basetitle": {""}, "title": {""}, "text": {text}})
+	}
+
+	if code, _ := save(rev, "ONE\r\ntwo\r\nthree\r\n"); code != http.StatusSeeOther {
+		t.Fatalf("the first save = %d", code)
+	}
+	// a save from the same revision is merged with the first
+	code, body := save(rev, "one\ntwo\nTHREE\n")
+	if code != http.StatusConflict || !strings.Contains(body, "merged below") || !strings.Contains(body, ">ONE\ntwo\nTHREE\n</textarea>") {
+		t.Errorf("the second save = %d %s", code, body)
+	}
+	code, body = save(rev, "uno\ntwo\nthree\n")
+	if code != http.StatusConflict || !strings.Contains(body, "&lt;&lt;&lt;&lt;&lt;&lt;&lt; yours\nuno\n=======\nONE\n&gt;&gt;&gt;&gt;&gt;&gt;&gt; theirs\ntwo") {
+		t.Errorf("a conflicting save = %d %s", code, body)
+	}
+	rev = regexp.MustCompile(`name="rev" value="([0-9a-f]+)"`).FindStringSubmatch(body)[1]
+	if code, _ := save(rev, "uno\ntwo\nthree\n"); code != http.StatusSeeOther {
+		t.Errorf("the save of the merge = %d", code)
+	}
+	if got := ts.command("get 0"); got != "uno\ntwo\nthree\n" {
+		t.Errorf("get 0 after the edits = %q", got)
+	}
+}
+
+func TestPasteBody(t *testing.T) {
+	ts := startServer(t, Config{})
+	for _, path := range []string{"/", "/p?title=Notes&lang=go&expires=1d"} {
+		resp, err := http.Post("http://"+ts.web+path, "application/x-www-form-urlencoded", strings.NewReader("a=b&c\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		raw := strings.TrimSpace(string(b))
+		if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(raw, "http://"+ts.web+"/raw/") ||
+			resp.Header.Get("Location") != "/p/"+strings.TrimPrefix(raw, "http://"+ts.web+"/raw/") {
+			t.Fatalf("POST %s = %d %q, Location %q", path, resp.StatusCode, b, resp.Header.Get("Location"))
+		}
+		if resp, err = http.Get(raw); err != nil {
+			t.Fatal(err)
+		}
+		b, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "a=b&c\n" {
+			t.Errorf("GET %s = %q", raw, b)
+		}
+	}
+	if got := ts.command("list"); !strings.HasSuffix(got, "] Notes: a=b&c\n") {
+		t.Errorf("list = %q", got)
+	}
+	if code, _ := ts.get("/p"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /p = %d", code)
+	}
+	resp, err := http.Post("http://"+ts.web+"/p", "text/plain", strings.NewReader(" \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST of blanks = %d", resp.StatusCode)
+	}
+}
+
+func TestPutFile(t *testing.T) {
+	ts := startServer(t, Config{})
+	put := func(path, body string) (int, string) {
+		req, _ := http.NewRequest("PUT", "http://"+ts.web+path, strings.NewReader(body))
+		return ts.do(http.DefaultClient.Do(req))
+	}
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="4" height="4"/>`
+	for _, tc := range []struct {
+		path, body, route string
+	}{
+		{"/files/notes.txt", "milk\neggs\n", "/raw/"},
+		{"/files/Notes.txt?title=Shopping", "milk\neggs\nbread\n", "/raw/"},
+		{"/files/dot.svg", svg, "/download/"},
+	} {
+		code, body := put(tc.path, tc.body)
+		url := strings.TrimSpace(body)
+		if code != http.StatusCreated || !strings.HasPrefix(url, "http://"+ts.web+tc.route) {
+			t.Fatalf("PUT %s = %d %q", tc.path, code, body)
+		}
+		if code, got := ts.get(strings.TrimPrefix(url, "http://"+ts.web)); code != http.StatusOK || got != tc.body {
+			t.Errorf("GET %s = %d %q", url, code, got)
+		}
+	}
+	// the newest paste of a name is the one it stands for
+	if got := ts.command("get @notes.txt"); got != "milk\neggs\nbread\n" {
+		t.Errorf("get @notes.txt = %q", got)
+	}
+	if code, _ := ts.get("/download/@dot.svg"); code != http.StatusOK {
+		t.Errorf("GET /download/@dot.svg = %d", code)
+	}
+	for _, tc := range []struct {
+		path, body string
+		want       int
+	}{
+		{"/files/", "x", http.StatusBadRequest},
+		{"/files/not%20a%20name", "x", http.StatusBadRequest},
+		{"/files/blank.txt", " \n", http.StatusBadRequest},
+		{"/files/bin", "\xff\xfe\x00", http.StatusUnsupportedMediaType},
+	} {
+		if code, body := put(tc.path, tc.body); code != tc.want {
+			t.Errorf("PUT %s = %d %q, want %d", tc.path, code, body, tc.want)
+		}
+	}
+	if code, _ := ts.get("/files/notes.txt"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /files/notes.txt = %d", code)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	ts := startServer(t, Config{})
+	// watch opens a stream and returns a function reading the next count from it
+	watch := func(board string) (func() string, io.Closer) {
+		resp, err := http.Get("http://" + ts.web + "/presence?board=" + board)
+		if err != nil {
+			t.Fatalf("GET /presence: %v", err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("GET /presence is %s", ct)
+		}
+		r := bufio.NewReader(resp.Body)
+		return func() string {
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return err.Error()
+				}
+				if strings.HasPrefix(line, "data: ") {
+					return strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+				}
+			}
+		}, resp.Body
+	}
+	first, _ := watch("house")
+	if got := first(); got != "1" {
+		t.Fatalf("the first viewer counts %s", got)
+	}
+	second, closeSecond := watch("house")
+	other, _ := watch("work")
+	if got := second(); got != "2" {
+		t.Errorf("the second viewer counts %s", got)
+	}
+	if got := first(); got != "2" {
+		t.Errorf("the first viewer counts %s with the second there", got)
+	}
+	if got := other(); got != "1" {
+		t.Errorf("the viewer of another board counts %s", got)
+	}
+	closeSecond.Close()
+	if got := first(); got != "1" {
+		t.Errorf("the first viewer counts %s after the second left", got)
+	}
+	// and new pastes of the board come as events
+	ts.s.p.addEntry(&entry{Text: "at work", Board: "work"})
+	ts.s.p.addEntry(&entry{Text: "at home", Board: "house", Tags: []string{"a"}})
+	var meta pasteMeta
+	if got := first(); json.Unmarshal([]byte(got), &meta) != nil || meta.Hash != textHash("at home") || meta.Size != 7 || meta.Revision == "" {
+		t.Errorf("the paste event = %s", got)
+	}
+
+	// the streams end with the server rather than holding it up
+	start := time.Now()
+	ts.restart()
+	if got := first(); got != "EOF" || time.Since(start) > shutdownTimeout/2 {
+		t.Errorf("the stream after a restart of %v: %s", time.Since(start), got)
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	var routes routeTimeouts
+	if err := routes.Set("/pdf=0; /api/v1/pastes/=20ms"); err != nil {
+		t.Fatal(err)
+	}
+	if err := routes.Set("pdf=2m"); err == nil {
+		t.Errorf("a route without / was taken")
+	}
+	s, err := New(Config{DataDir: t.TempDir(), RenderTimeout: time.Hour, RouteTimeouts: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("done"))
+	}
+	timeouts := s.p.newTimeouts()
+	for _, tc := range []struct {
+		route, want string
+		code        int
+	}{
+		{"/pdf", "done", http.StatusOK},
+		{"/api/v1/pastes/", `{"error":"Pastry is busy`, http.StatusServiceUnavailable},
+	} {
+		if tc.code == http.StatusOK {
+			// without a timeout the handler is left as it is
+			if _, ok := timeouts.wrap(tc.route, slow).(http.HandlerFunc); !ok {
+				t.Errorf("%s has a timeout", tc.route)
+			}
+			continue
+		}
+		rec := httptest.NewRecorder()
+		timeouts.wrap(tc.route, slow).ServeHTTP(rec, httptest.NewRequest("GET", tc.route, nil))
+		if rec.Code != tc.code || !strings.HasPrefix(rec.Body.String(), tc.want) {
+			t.Errorf("%s = %d %q", tc.route, rec.Code, rec.Body.String())
+		}
+	}
+
+	s, err = New(Config{DataDir: t.TempDir(), RenderTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	rec := httptest.NewRecorder()
+	s.p.newTimeouts().wrap("/stats", slow).ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "<h2><a href=\"/\"><img src=\"/logo.png\"/></a>Pastry is busy</h2>") {
+		t.Errorf("/stats = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPI(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("from the write port\n")
+	api := "http://" + ts.web + apiPrefix
+
+	resp, err := http.Post(api, "application/json", strings.NewReader(`{"text": "from the API", "title": "hello", "tags": ["a"], "expires": "1h"}`))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	var created apiPaste
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created.Index != 1 || created.ID == "" || created.Title != "hello" || created.Expires == nil {
+		t.Fatalf("POST = %d %+v", resp.StatusCode, created)
+	}
+	if loc := resp.Header.Get("Location"); loc != apiPrefix+"/"+created.ID {
+		t.Errorf("POST answered with Location %q", loc)
+	}
+	if created.Hash != textHash("from the API") || created.Size != int64(len("from the API")) {
+		t.Errorf("POST answered with hash %s and size %d", created.Hash, created.Size)
+	}
+	if c := created.Count; c == nil || *c != (textCount{Words: 3, Chars: 12, Lines: 1, Minutes: 1}) {
+		t.Errorf("POST answered with count %+v", c)
+	}
+
+	code, body := ts.get(apiPrefix)
+	var pastes []apiPaste
+	if err := json.Unmarshal([]byte(body), &pastes); code != http.StatusOK || err != nil || len(pastes) != 2 || pastes[0].Text != "from the write port\n" {
+		t.Fatalf("GET = %d %s", code, body)
+	}
+	// the index is the same list for scripts asking for JSON, and stays HTML for browsers
+	for _, tc := range []struct {
+		accept string
+		json   bool
+	}{
+		{"application/json", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"*/*", false},
+		{"text/html;q=0.5, application/json", true},
+	} {
+		req, _ := http.NewRequest("GET", "http://"+ts.web+"/", nil)
+		req.Header.Set("Accept", tc.accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /: %v", err)
+		}
+		var index []apiPaste
+		isJSON := resp.Header.Get("Content-Type") == "application/json" && json.NewDecoder(resp.Body).Decode(&index) == nil
+		resp.Body.Close()
+		if isJSON != tc.json || tc.json && (len(index) != 2 || index[1].ID != created.ID) || !strings.Contains(resp.Header.Get("Vary"), "Accept") {
+			t.Errorf("GET / with Accept %q = %s %+v", tc.accept, resp.Header.Get("Content-Type"), index)
+		}
+	}
+	for _, id := range []string{"1", "-1", created.ID} {
+		var got apiPaste
+		if code, body := ts.get(apiPrefix + "/" + id); code != http.StatusOK || json.Unmarshal([]byte(body), &got) != nil || got.Text != "from the API" {
+			t.Errorf("GET %s = %d %s", id, code, body)
+		}
+	}
+
+	// PATCH changes what it is given and PUT replaces it all, both keep the time and the id
+	for _, tc := range []struct {
+		method, body string
+		check        func(apiPaste) bool
+	}{
+		{"PATCH", `{"text": "from the API, fixed"}`, func(got apiPaste) bool {
+			return got.Text == "from the API, fixed" && got.Title == "hello" && got.Expires != nil && len(got.Tags) == 1
+		}},
+		{"PATCH", `{"expires": "", "tags": ["a", "b"]}`, func(got apiPaste) bool {
+			return got.Text == "from the API, fixed" && got.Expires == nil && len(got.Tags) == 2
+		}},
+		{"PUT", `{"text": "replaced", "name": "greeting"}`, func(got apiPaste) bool {
+			return got.Text == "replaced" && got.Name == "greeting" && got.Title == "" && got.Tags == nil
+		}},
+	} {
+		req, _ := http.NewRequest(tc.method, api+"/"+created.ID, strings.NewReader(tc.body))
+		code, body := ts.do(http.DefaultClient.Do(req))
+		var got apiPaste
+		if code != http.StatusOK || json.Unmarshal([]byte(body), &got) != nil || !tc.check(got) ||
+			got.ID != created.ID || !got.When.Equal(created.When) || got.Modified == nil || got.Modified.Before(got.When) {
+			t.Errorf("%s %s = %d %s", tc.method, tc.body, code, body)
+		}
+	}
+	if code, body := ts.get("/raw/@greeting"); code != http.StatusOK || body != "replaced" {
+		t.Errorf("GET /raw/@greeting after PUT = %d %q", code, body)
+	}
+
+	// a change for a revision the paste is no longer at fails, with the one it is at
+	var current apiPaste
+	code, body = ts.get(apiPrefix + "/" + created.ID)
+	if json.Unmarshal([]byte(body), &current) != nil || current.Revision == "" || current.Revision == created.Revision {
+		t.Fatalf("GET after the edits = %d %s, created at revision %s", code, body, created.Revision)
+	}
+	for _, tc := range []struct {
+		method, ifMatch, query, body string
+		want                         int
+	}{
+		{"PATCH", `"` + created.Revision + `"`, "", `{"title": "stale"}`, http.StatusConflict},
+		{"PATCH", "", "", `{"title": "stale", "revision": "` + created.Revision + `"}`, http.StatusConflict},
+		{"DELETE", "", "?revision=" + created.Revision, "", http.StatusConflict},
+		{"DELETE", `"` + created.Revision + `", "nope"`, "", "", http.StatusConflict},
+		{"PATCH", `"nope", "` + current.Revision + `"`, "", `{"title": "fresh"}`, http.StatusOK},
+		// that changed the revision again
+		{"PATCH", "", "", `{"title": "stale", "revision": "` + current.Revision + `"}`, http.StatusConflict},
+		{"PATCH", "*", "", `{"lang": "en"}`, http.StatusOK},
+	} {
+		req, _ := http.NewRequest(tc.method, api+"/"+created.ID+tc.query, strings.NewReader(tc.body))
+		if tc.ifMatch != "" {
+			req.Header.Set("If-Match", tc.ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want || resp.Header.Get("ETag") == "" {
+			t.Errorf("%s with If-Match %s and %s%s = %d, ETag %s, want %d", tc.method, tc.ifMatch, tc.body, tc.query, resp.StatusCode, resp.Header.Get("ETag"), tc.want)
+		}
+	}
+	if code, body := ts.get(apiPrefix + "/" + created.ID); !strings.Contains(body, `"title":"fresh"`) {
+		t.Errorf("GET after the conditional changes = %d %s", code, body)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", apiPrefix, `{"text": `, http.StatusBadRequest},
+		{"PUT", apiPrefix + "/" + created.ID, `{"title": "no text"}`, http.StatusBadRequest},
+		{"PATCH", apiPrefix + "/" + created.ID, `{"name": "not a name"}`, http.StatusBadRequest},
+		{"PATCH", apiPrefix + "/7", `{}`, http.StatusNotFound},
+		{"POST", apiPrefix, `{"text": "x", "name": "not a name"}`, http.StatusBadRequest},
+		{"PATCH", apiPrefix, "", http.StatusMethodNotAllowed},
+		{"GET", apiPrefix + "/7", "", http.StatusNotFound},
+		{"DELETE", apiPrefix + "/" + created.ID, "", http.StatusNoContent},
+		{"DELETE", apiPrefix + "/" + created.ID, "", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(tc.method, "http://"+ts.web+tc.path, strings.NewReader(tc.body))
+		if code, body := ts.do(http.DefaultClient.Do(req)); code != tc.want {
+			t.Errorf("%s %s = %d %s, want %d", tc.method, tc.path, code, body, tc.want)
+		}
+	}
+	if got := ts.command("list"); strings.Count(got, "\n") != 1 {
+		t.Errorf("list after DELETE = %q", got)
+	}
+
+	var doc struct {
+		OpenAPI string
+		Paths   map[string]map[string]interface{}
+		// the properties of the schemas, by name
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]struct{ Type string }
+			}
+		}
+	}
+	code, body = ts.get(openAPIPath)
+	if err := json.Unmarshal([]byte(body), &doc); code != http.StatusOK || err != nil || doc.OpenAPI != "3.0.3" {
+		t.Fatalf("GET %s = %d %v", openAPIPath, code, err)
+	}
+	if _, ok := doc.Paths[apiPrefix+"/{id}"]["patch"]; !ok {
+		t.Errorf("no PATCH in %v", doc.Paths)
+	}
+	paste := doc.Components.Schemas["Paste"].Properties
+	if paste["id"].Type != "string" || paste["index"].Type != "integer" || paste["tags"].Type != "array" || paste["modified"].Type != "string" || paste["count"].Type != "object" {
+		t.Errorf("the Paste schema is %v", paste)
+	}
+}
+
+// An id of only digits is still the id, not an index.
+func TestLookupDigitID(t *testing.T) {
+	ts := startServer(t, Config{})
+	for i := 0; i < 14; i++ {
+		ts.paste(fmt.Sprintf("paste %d\n", i))
+	}
+	p := ts.s.p
+	p.mutex.Lock()
+	p.texts[3].ID = "0000000000000012"
+	p.mutex.Unlock()
+	for path, want := range map[string]string{"/raw/0000000000000012": "paste 3\n", "/raw/12": "paste 12\n", "/raw/-1": "paste 13\n"} {
+		if code, body := ts.get(path); code != http.StatusOK || body != want {
+			t.Errorf("GET %s = %d %q, want %q", path, code, body, want)
+		}
+	}
+}
+
+func TestAPIList(t *testing.T) {
+	ts := startServer(t, Config{})
+	for _, text := range []string{"one apple\n", "two\n", "three apples\n"} {
+		ts.paste(text)
+	}
+	mark := time.Now()
+	for _, text := range []string{"four\n", "five Apples\n"} {
+		ts.paste(text)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string // the first words
+		total int
+	}{
+		{"", []string{"one", "two", "three", "four", "five"}, 5},
+		{"?limit=2", []string{"four", "five"}, 5},
+		{"?limit=2&offset=1", []string{"three", "four"}, 5},
+		{"?offset=4", []string{"one"}, 5},
+		{"?offset=9", nil, 5},
+		{"?limit=9", []string{"one", "two", "three", "four", "five"}, 5},
+		{"?q=APPLE", []string{"one", "three", "five"}, 3},
+		{"?q=apple&limit=1", []string{"five"}, 3},
+		{"?since=" + url.QueryEscape(mark.Format(time.RFC3339Nano)), []string{"four", "five"}, 2},
+		{"?since=1h&q=four", []string{"four"}, 1},
+	} {
+		resp, err := http.Get("http://" + ts.web + apiPrefix + tc.query)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		var pastes []apiPaste
+		json.NewDecoder(resp.Body).Decode(&pastes)
+		resp.Body.Close()
+		var got []string
+		for _, p := range pastes {
+			got = append(got, strings.Fields(p.Text)[0])
+		}
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") || resp.Header.Get("X-Total-Count") != strconv.Itoa(tc.total) {
+			t.Errorf("GET %s = %q of %s, want %q of %d", tc.query, got, resp.Header.Get("X-Total-Count"), tc.want, tc.total)
+		}
+	}
+	for _, q := range []string{"?limit=-1", "?offset=x", "?since=yesterday"} {
+		if code, body := ts.get(apiPrefix + q); code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d %s, want 400", q, code, body)
+		}
+	}
+}
+
+func TestAPIBatch(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	ts.paste("two\n")
+	var ids []string
+	for _, a := range apiList(t, ts) {
+		ids = append(ids, a.ID)
+	}
+
+	ops := fmt.Sprintf(`[
+		{"op": "create", "paste": {"text": "three\n", "tags": ["x"]}},
+		{"op": "create", "paste": {"text": "four\n", "expires": "someday"}},
+		{"op": "tag", "id": %q, "add": ["a", "b"]},
+		{"op": "tag", "id": %q, "add": ["c"], "remove": ["A"]},
+		{"op": "delete", "id": %q, "revision": "stale"},
+		{"op": "delete", "id": %q},
+		{"op": "delete", "id": %q},
+		{"op": "rename"}
+	]`, ids[0], ids[0], ids[1], ids[1], ids[1])
+	resp, err := http.Post("http://"+ts.web+batchPath, "application/json", strings.NewReader(ops))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	var results []batchResult
+	json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	var got []int
+	for _, res := range results {
+		got = append(got, res.Status)
+	}
+	if want := []int{201, 400, 200, 200, 409, 204, 404, 400}; resp.StatusCode != http.StatusOK || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("POST %s = %d with %v, want 200 with %v", batchPath, resp.StatusCode, got, want)
+	}
+	if tags := results[3].Paste.Tags; strings.Join(tags, " ") != "b c" {
+		t.Errorf("tags after the batch = %q, want b c", tags)
+	}
+
+	ts.restart()
+	var texts []string
+	for _, a := range apiList(t, ts) {
+		texts = append(texts, strings.TrimSpace(a.Text)+fmt.Sprint(a.Tags))
+	}
+	if strings.Join(texts, " ") != "one[b c] three[x]" {
+		t.Errorf("pastes after the batch and a restart = %q", texts)
+	}
+
+	if code, body := ts.do(http.Post("http://"+ts.web+batchPath, "application/json",
+		strings.NewReader("["+strings.Repeat(`{"op": "delete", "id": "x"},`, maxBatch)+`{"op": "delete", "id": "x"}]`))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST of %d operations = %d %s, want 413", maxBatch+1, code, body)
+	}
+	if code, _ := ts.get(batchPath); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET %s = %d, want 405", batchPath, code)
+	}
+}
+
+func apiList(t *testing.T, ts *testServer) []apiPaste {
+	t.Helper()
+	resp, err := http.Get("http://" + ts.web + apiPrefix)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	var pastes []apiPaste
+	json.NewDecoder(resp.Body).Decode(&pastes)
+	return pastes
+}
+
+func TestLimitsPage(t *testing.T) {
+	ts := startServer(t, Config{})
+	if code, _ := ts.post("/limits", url.Values{"limits": {"max-paste=bogus"}}); code != http.StatusBadRequest {
+		t.Errorf("POST /limits with a bad size = %d, want 400", code)
+	}
+	if code, _ := ts.post("/limits", url.Values{"limits": {"max-paste=4KiB"}}); code != http.StatusSeeOther {
+		t.Errorf("POST /limits = %d", code)
+	}
+	if got := ts.command("caps"); !strings.Contains(got, "\nmax-paste=4096\n") {
+		t.Errorf("caps after changing the limits = %q", got)
+	}
+	ts.restart()
+	if got := ts.command("caps"); !strings.Contains(got, "\nmax-paste=4096\n") {
+		t.Errorf("caps after a restart = %q, the limits file wasn't read", got)
+	}
+}
+
+func TestStorageFull(t *testing.T) {
+	notes := make(chan notification, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		json.NewDecoder(r.Body).Decode(&n)
+		notes <- n
+	}))
+	defer hook.Close()
+	// no disk has this much free
+	ts := startServer(t, Config{MinFree: 1 << 60, WebhookURL: hook.URL})
+	select {
+	case n := <-notes:
+		if n.Title != "Storage full" {
+			t.Errorf("notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no notification")
+	}
+
+	if got := ts.paste("one\n"); got != "ERR: storage full\n" {
+		t.Errorf("paste = %q", got)
+	}
+	code, body := ts.do(http.Post("http://"+ts.web+"/p", "text/plain", strings.NewReader("two\n")))
+	if code != http.StatusInsufficientStorage {
+		t.Errorf("POST /p = %d %s", code, body)
+	}
+	code, body = ts.do(http.Post("http://"+ts.web+apiPrefix, "application/json", strings.NewReader(`{"text": "three\n"}`)))
+	if code != http.StatusInsufficientStorage {
+		t.Errorf("POST %s = %d %s", apiPrefix, code, body)
+	}
+	if code := ts.upload("image/png", []byte("\x89PNG\r\n\x1a\n")); code != http.StatusInsufficientStorage {
+		t.Errorf("upload = %d", code)
+	}
+	if code, body := ts.get("/healthz"); code != http.StatusServiceUnavailable || !strings.HasPrefix(body, "storage full") {
+		t.Errorf("GET /healthz = %d %q", code, body)
+	}
+	if _, body := ts.get("/stats"); !strings.Contains(body, "The storage is full") {
+		t.Errorf("/stats doesn't say the storage is full")
+	}
+	if got := ts.command("list"); got != "" {
+		t.Errorf("list = %q", got)
+	}
+
+	// with room again
+	ts.s.p.cfg.MinFree = 1
+	ts.s.p.checkDisk()
+	if n := <-notes; n.Title != "Storage no longer full" {
+		t.Errorf("notification %+v", n)
+	}
+	if got := ts.paste("one\n"); !strings.HasPrefix(got, "0 ") {
+		t.Errorf("paste = %q", got)
+	}
+	if code, body := ts.get("/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("GET /healthz = %d %q", code, body)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	// pasted while the clock was two hours ahead, and then NTP set it right
+	p := ts.s.p
+	p.mutex.Lock()
+	ahead := time.Now().Add(2 * time.Hour)
+	p.texts[0].When = ahead
+	p.mutex.Unlock()
+	ts.paste("two\n")
+	p.mutex.Lock()
+	if w := p.texts[1].When; !w.After(ahead) || w.Location() != time.UTC {
+		t.Errorf("pasted at %v, after a paste at %v", w, ahead)
+	}
+	p.mutex.Unlock()
+	if got := ts.command("list"); strings.Count(got, "\tnow") != 2 || !strings.Contains(got, "one\n#  1") {
+		t.Errorf("list = %q", got)
+	}
+	if got := ts.paste("import\n[\n" + `{"text": "from a laptop ahead", "when": "2099-01-01T00:00:00Z"}` + "\n]\n"); got != "# Imported 1 pastes\n" {
+		t.Fatalf("import = %q", got)
+	}
+	// the import is from now rather than 2099, so before the pastes of the clock ahead
+	ts.restart()
+	if got := ts.command("list"); got != "#  0\tnow                 \tfrom a laptop ahead\n#  1\tnow                 \tone\n#  2\tnow                 \ttwo\n" {
+		t.Errorf("list after a restart = %q", got)
+	}
+}
+
+func TestArrivalOrder(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	ts.paste("two\n")
+	ts.paste("three\n")
+	p := ts.s.p
+	order := func() string {
+		t.Helper()
+		var got []string
+		for _, l := range strings.Split(strings.TrimSpace(ts.command("list")), "\n") {
+			got = append(got, l[strings.LastIndex(l, "\t")+1:])
+		}
+		return strings.Join(got, " ")
+	}
+
+	// the clock was all over the place, a day back for two and a year ahead for three
+	p.mutex.Lock()
+	now := time.Now()
+	p.texts[1].When = now.Add(-24 * time.Hour)
+	p.texts[2].When = now.AddDate(1, 0, 0)
+	p.dirty = true
+	p.store()
+	p.mutex.Unlock()
+	ts.restart()
+	if got := order(); got != "one two three" {
+		t.Errorf("after a restart = %q", got)
+	}
+	ts.paste("four\n")
+	if got := order(); got != "one two three four" {
+		t.Errorf("after a paste = %q", got)
+	}
+
+	// a store from before Seq is numbered by When, four was stamped just after three
+	p = ts.s.p
+	p.mutex.Lock()
+	for _, e := range p.texts {
+		e.Seq = 0
+	}
+	p.store()
+	p.mutex.Unlock()
+	ts.restart()
+	if got := order(); got != "two one three four" {
+		t.Errorf("a store without Seq = %q", got)
+	}
+	ts.paste("five\n")
+	if got := order(); got != "two one three four five" {
+		t.Errorf("after a paste = %q", got)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("one\n")
+	ts.paste("two\n")
+	ts.paste("three\n")
+	ts.stop()
+	var stale bytes.Buffer
+	if err := Export(ts.cfg, &stale); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	// a copy of the store from before two was dropped
+	copied := Config{DataDir: t.TempDir()}
+	if n, err := Import(copied, bytes.NewReader(stale.Bytes())); err != nil || n != 3 {
+		t.Fatalf("Import = %d, %v", n, err)
+	}
+
+	ts.start()
+	ts.command("drop 1")
+	ts.restart()
+	// the stale archive doesn't bring two back, nor copies of the other two
+	if got := ts.paste("import\n" + stale.String()); got != "# Imported 0 pastes\n" {
+		t.Errorf("import of the stale archive = %q", got)
+	}
+	if got := ts.command("list"); strings.Contains(got, "two") || strings.Count(got, "\n") != 2 {
+		t.Errorf("list after the import = %q", got)
+	}
+	// the tar of the export command carries the ids and the tombstone as well, the edit of
+	// one replaces it in the copy and two is dropped
+	p := ts.s.p
+	p.mutex.Lock()
+	p.texts[0].Title, p.texts[0].Modified = "edited", time.Now().UTC()
+	p.store()
+	p.mutex.Unlock()
+	if n, err := Import(copied, strings.NewReader(ts.command("export"))); err != nil || n != 1 {
+		t.Fatalf("Import of the tar = %d, %v", n, err)
+	}
+	ts.stop()
+	var fresh bytes.Buffer
+	if err := Export(ts.cfg, &fresh); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if !regexp.MustCompile(`\n\{"id":"[0-9a-f]+","deleted":"[^"]+"\}\n\]\n$`).Match(fresh.Bytes()) {
+		t.Errorf("the archive ends with %q, not a tombstone", fresh.Bytes()[fresh.Len()-80:])
+	}
+
+	// with nothing newer in it, the archive takes nothing from the copy
+	if n, err := Import(copied, bytes.NewReader(fresh.Bytes())); err != nil || n != 0 {
+		t.Fatalf("Import = %d, %v", n, err)
+	}
+	var merged bytes.Buffer
+	if err := Export(copied, &merged); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if m := merged.String(); strings.Contains(m, `"two\n"`) || strings.Count(m, `"text":"one\n"`) != 1 || strings.Count(m, `"text":"three\n"`) != 1 || !strings.Contains(m, `"title":"edited"`) {
+		t.Errorf("the copy after importing the tombstone: %s", m)
+	}
+
+	// and gc prunes it once it is old
+	if report, err := GC(ts.cfg); err != nil || strings.Contains(report, "tombstones") {
+		t.Errorf("GC = %q, %v", report, err)
+	}
+	ts.start()
+	p = ts.s.p
+	p.mutex.Lock()
+	for id := range p.tombs {
+		p.tombs[id] = time.Now().Add(-2 * tombstoneKeep)
+	}
+	p.mutex.Unlock()
+	if r, err := p.gc(time.Now()); err != nil || r.tombs != 1 || len(p.tombs) != 0 {
+		t.Errorf("gc of an old tombstone = %+v, %v", r, err)
+	}
+}
+
+func TestPublishModified(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("later\n")
+	if got := ts.command("publish 0 1h"); strings.HasPrefix(got, "#") {
+		t.Fatalf("publish = %q", got)
+	}
+	// published without a notification, the pages still change and so does modified
+	p := ts.s.p
+	p.mutex.Lock()
+	before := p.modified
+	p.mutex.Unlock()
+	later := time.Now().Add(2 * time.Hour)
+	p.publishDue(later)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.modified.After(before) {
+		t.Errorf("modified %v after publishing, was %v", p.modified, before)
+	}
+}
+
+// A scheduled paste takes over a name once it is published, not before.
+func TestScheduledRevision(t *testing.T) {
+	ts := startServer(t, Config{})
+	ts.paste("first\n")
+	ts.paste("second\n")
+	ts.command("meta 0 name=note")
+	ts.command("meta 1 name=note")
+	if got := ts.command("publish 1 1h"); strings.HasPrefix(got, "#") {
+		t.Fatalf("publish = %q", got)
+	}
+	if got := ts.command("get @note"); got != "first\n" {
+		t.Errorf("get @note before publishing = %q", got)
+	}
+	if got := ts.command("get @note~1"); got != "" {
+		t.Errorf("get @note~1 before publishing = %q", got)
+	}
+	if got := ts.command("history @note"); strings.Count(got, "\n") != 1 {
+		t.Errorf("history @note before publishing = %q", got)
+	}
+	if code, body := ts.get("/n/note"); code != http.StatusOK || !strings.Contains(body, `<pre id="text">first`) || strings.Contains(body, "@note~1") {
+		t.Errorf("/n/note before publishing = %d %q", code, body)
+	}
+
+	p := ts.s.p
+	p.mutex.Lock()
+	p.texts[1].Publish = time.Now().Add(-time.Minute)
+	p.mutex.Unlock()
+	if got := ts.command("get @note"); got != "second\n" {
+		t.Errorf("get @note once published = %q", got)
+	}
+	if got := ts.command("history @note"); strings.Count(got, "\n") != 2 {
+		t.Errorf("history @note once published = %q", got)
+	}
+}
+
+func TestMathNesting(t *testing.T) {
+	if got := texMathML(`\frac{1}{\sqrt{x^2}}`, false); !strings.Contains(got, "<mfrac>") {
+		t.Errorf("texMathML = %q", got)
+	}
+	// braces and \sqrt[ nested too deep for the parser are shown as they are
+	for _, tex := range []string{strings.Repeat("{", 1<<20), strings.Repeat("{", texMaxDepth+1) + "x", strings.Repeat(`\sqrt[`, 200) + "x"} {
+		start := time.Now()
+		got := texMathML(tex, true)
+		if !strings.HasPrefix(got, "<pre><code>") || time.Since(start) > time.Second {
+			t.Errorf("texMathML of %d bytes = %.40q in %v", len(tex), got, time.Since(start))
+		}
+	}
+	if got := texMathML(strings.Repeat("{", texMaxDepth-1)+"x", false); !strings.HasPrefix(got, "<math>") {
+		t.Errorf("texMathML %d deep = %.40q", texMaxDepth-1, got)
+	}
+}
+
+func TestMarkdownTime(t *testing.T) {
+	for _, tc := range []struct{ text, want string }{
+		{"[a link](https://example.com) and $x^2$", `<a href="https://example.com">a link</a>`},
+		{"[a link](https://example.com) and $x^2$", `<msup>`},
+		{"$5 and $10", "$5 and $10"},
+	} {
+		if got := string(renderMarkdown(tc.text, true)); !strings.Contains(got, tc.want) {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+	// what looks like the start of a link or math many times over renders in linear time,
+	// small enough to be quick with -race too, quadratic took seconds at 32 KiB
+	for _, text := range []string{strings.Repeat("[a](", 1<<15), strings.Repeat("[", 1<<17), strings.Repeat("$a ", 1<<15)} {
+		start := time.Now()
+		renderMarkdown(text, true)
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("renderMarkdown of %.12q... took %v", text, d)
+		}
+	}
+}
+
+func TestSlowExportReader(t *testing.T) {
+	ts := startServer(t, Config{})
+	p := ts.s.p
+	p.mutex.Lock()
+	for i := 0; i < 32; i++ {
+		p.texts = append(p.texts, &entry{ID: newID(), Text: strings.Repeat("x", 1<<20), When: time.Now().UTC()})
+	}
+	p.numberPastes()
+	p.mutex.Unlock()
+	// an export no one reads, more than the socket buffers take
+	c, err := net.Dial("tcp", ts.read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("export\n"))
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	if got := ts.command("stat"); !strings.Contains(got, "32") || time.Since(start) > 2*time.Second {
+		t.Errorf("stat while an export isn't read = %q after %v", got, time.Since(start))
+	}
+}
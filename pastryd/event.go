@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// event is a date, and maybe a time, found in a paste like "dentist Tuesday 14:30".
+type event struct {
+	Start   time.Time
+	AllDay  bool
+	Summary string
+}
+
+var (
+	isoDateRe = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	dayRe     = regexp.MustCompile(`(?i)\b(today|tomorrow|monday|tuesday|wednesday|thursday|friday|saturday|sunday)\b`)
+	dayMonRe  = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\s+(january|february|march|april|may|june|july|august|september|october|november|december|jan|feb|mar|apr|jun|jul|aug|sep|sept|oct|nov|dec)\b`)
+	monDayRe  = regexp.MustCompile(`(?i)\b(january|february|march|april|may|june|july|august|september|october|november|december|jan|feb|mar|apr|jun|jul|aug|sep|sept|oct|nov|dec)\s+(\d{1,2})(?:st|nd|rd|th)?\b`)
+	clockRe   = regexp.MustCompile(`\b([01]?\d|2[0-3])[:.]([0-5]\d)\b`)
+	ampmRe    = regexp.MustCompile(`(?i)\b(1[0-2]|0?[1-9])(?:[:.]([0-5]\d))?\s*(am|pm)\b`)
+)
+
+func month(s string) time.Month {
+	s = strings.ToLower(s)
+	for m := time.January; m <= time.December; m++ {
+		if strings.HasPrefix(strings.ToLower(m.String()), s[:3]) {
+			return m
+		}
+	}
+	return 0
+}
+
+// findDate finds a day in text, relative days counting from now. Days and months without
+// a year are the next time they come around.
+func findDate(text string, now time.Time) (time.Time, bool) {
+	y, mo, d := now.Date()
+	today := time.Date(y, mo, d, 0, 0, 0, 0, now.Location())
+
+	if m := isoDateRe.FindStringSubmatch(text); m != nil {
+		t, err := time.ParseInLocation("2006-01-02", m[0], now.Location())
+		return t, err == nil
+	}
+
+	var mon time.Month
+	var day int
+	if m := dayMonRe.FindStringSubmatch(text); m != nil {
+		day, _ = strconv.Atoi(m[1])
+		mon = month(m[2])
+	} else if m := monDayRe.FindStringSubmatch(text); m != nil {
+		day, _ = strconv.Atoi(m[2])
+		mon = month(m[1])
+	}
+	if mon != 0 && day >= 1 && day <= 31 {
+		t := time.Date(y, mon, day, 0, 0, 0, 0, now.Location())
+		if t.Before(today) {
+			t = t.AddDate(1, 0, 0)
+		}
+		return t, t.Day() == day
+	}
+
+	if m := dayRe.FindStringSubmatch(text); m != nil {
+		switch w := strings.ToLower(m[1]); w {
+		case "today":
+			return today, true
+		case "tomorrow":
+			return today.AddDate(0, 0, 1), true
+		default:
+			for n := 1; n <= 7; n++ {
+				if t := today.AddDate(0, 0, n); strings.ToLower(t.Weekday().String()) == w {
+					return t, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// findClock finds a time of day, 14:30, 14.30 or 2:30 pm.
+func findClock(text string) (int, int, bool) {
+	if m := ampmRe.FindStringSubmatch(text); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		min, _ := strconv.Atoi(m[2])
+		if h == 12 {
+			h = 0
+		}
+		if strings.ToLower(m[3]) == "pm" {
+			h += 12
+		}
+		return h, min, true
+	}
+	if m := clockRe.FindStringSubmatch(text); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		min, _ := strconv.Atoi(m[2])
+		return h, min, true
+	}
+	return 0, 0, false
+}
+
+func isCalendar(text string) bool {
+	return strings.Contains(text, "BEGIN:VCALENDAR")
+}
+
+// findEvent looks for a date in e, relative to when it was pasted. A time without a date is
+// too often something else to count.
+func findEvent(e *entry) *event {
+	if e.File != "" || isCalendar(e.Text) {
+		return nil
+	}
+	day, ok := findDate(e.Text, e.When.Local())
+	if !ok {
+		return nil
+	}
+	ev := &event{Start: day, AllDay: true, Summary: e.Title}
+	if h, m, ok := findClock(e.Text); ok {
+		ev.Start = day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+		ev.AllDay = false
+	}
+	if ev.Summary == "" {
+		ev.Summary = preview(e, 80)
+	}
+	return ev
+}
+
+func (ev *event) String() string {
+	if ev.AllDay {
+		return ev.Start.Format("Mon 2 Jan 2006")
+	}
+	return ev.Start.Format("Mon 2 Jan 2006 15:04")
+}
+
+// icsText escapes text for an iCalendar property value.
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r", "", "\n", `\n`).Replace(s)
+}
+
+// icsFold folds a content line at 75 bytes, without splitting a character.
+func icsFold(l string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range l {
+		if w := utf8.RuneLen(r); n+w > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += utf8.RuneLen(r)
+	}
+	return b.String()
+}
+
+// ics is a one event calendar, an hour long unless it lasts all day.
+func (ev *event) ics(e *entry) string {
+	const stamp = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//gmelchett//pastry//EN",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:%d@pastry", e.When.UnixNano()),
+		"DTSTAMP:" + e.When.UTC().Format(stamp),
+	}
+	if ev.AllDay {
+		lines = append(lines, "DTSTART;VALUE=DATE:"+ev.Start.Format("20060102"), "DTEND;VALUE=DATE:"+ev.Start.AddDate(0, 0, 1).Format("20060102"))
+	} else {
+		lines = append(lines, "DTSTART:"+ev.Start.UTC().Format(stamp), "DTEND:"+ev.Start.Add(time.Hour).UTC().Format(stamp))
+	}
+	lines = append(lines, "SUMMARY:"+icsText(ev.Summary), "DESCRIPTION:"+icsText(e.Text), "END:VEVENT", "END:VCALENDAR", "")
+	for i := range lines {
+		lines[i] = icsFold(lines[i])
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// pasteICS serves /p/<id>.ics, the paste itself if it is a calendar or else the event found in it.
+func (p *pastry) pasteICS(w http.ResponseWriter, r *http.Request, id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i, e, ok := p.lookupID(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var text string
+	if isCalendar(e.Text) {
+		text = e.Text
+	} else if ev := findEvent(e); ev != nil {
+		text = ev.ics(e)
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"pastry-%d.ics\"", i))
+	serveConditional(w, r, e.When.Truncate(time.Second), etag([]byte(text)), []byte(text))
+}
@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindDate(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2023, 5, 3, 15, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		text string
+		want string // 2006-01-02, "" for none
+	}{
+		{"release on 2023-06-01", "2023-06-01"},
+		{"2023-02-30", ""},
+		{"dentist tomorrow", "2023-05-04"},
+		{"Today!", "2023-05-03"},
+		{"dentist Tuesday 14:30", "2023-05-09"},
+		// the same weekday is the next one
+		{"wednesday", "2023-05-10"},
+		{"party 4th May", "2023-05-04"},
+		{"on June 1st", "2023-06-01"},
+		// gone this year
+		{"2 jan", "2024-01-02"},
+		{"31 feb", ""},
+		{"nothing planned", ""},
+	} {
+		got, ok := findDate(tc.text, now)
+		if s := got.Format("2006-01-02"); ok != (tc.want != "") || ok && s != tc.want {
+			t.Errorf("findDate(%q) = %s, %v, want %q", tc.text, s, ok, tc.want)
+		}
+	}
+}
+
+func TestFindClock(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		h, m int
+		ok   bool
+	}{
+		{"at 14:30", 14, 30, true},
+		{"at 9.05", 9, 5, true},
+		{"2:30 pm", 14, 30, true},
+		{"7am", 7, 0, true},
+		{"12 am", 0, 0, true},
+		{"12pm", 12, 0, true},
+		{"25:00", 0, 0, false},
+		{"no time", 0, 0, false},
+	} {
+		if h, m, ok := findClock(tc.text); h != tc.h || m != tc.m || ok != tc.ok {
+			t.Errorf("findClock(%q) = %d:%02d %v", tc.text, h, m, ok)
+		}
+	}
+}
+
+func TestFindEvent(t *testing.T) {
+	when := time.Date(2023, 5, 3, 15, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		e    entry
+		want string
+	}{
+		{entry{Text: "dentist tomorrow 14:30", When: when}, "Thu 4 May 2023 14:30"},
+		{entry{Text: "dentist tomorrow", When: when}, "Thu 4 May 2023"},
+		// a time alone is not an event
+		{entry{Text: "14:30", When: when}, ""},
+		{entry{Text: "BEGIN:VCALENDAR\ntomorrow\n", When: when}, ""},
+	} {
+		ev := findEvent(&tc.e)
+		if got := ""; ev != nil {
+			got = ev.String()
+			if got != tc.want {
+				t.Errorf("findEvent(%q) = %s, want %q", tc.e.Text, got, tc.want)
+			}
+		} else if tc.want != "" {
+			t.Errorf("findEvent(%q) = nil, want %s", tc.e.Text, tc.want)
+		}
+	}
+}
+
+func TestICSFold(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []int // the lengths in bytes of the folded lines
+	}{
+		{"short", []int{5}},
+		{strings.Repeat("a", 75), []int{75}},
+		{strings.Repeat("a", 160), []int{75, 75, 12}},
+		// å is two bytes and not split
+		{strings.Repeat("a", 74) + "å", []int{74, 3}},
+	} {
+		var got []int
+		for _, l := range strings.Split(icsFold(tc.line), "\r\n") {
+			got = append(got, len(l))
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("icsFold of %d bytes = lines of %v, want %v", len(tc.line), got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("icsFold of %d bytes = lines of %v, want %v", len(tc.line), got, tc.want)
+				break
+			}
+		}
+	}
+	if got := icsText("a;b,c\\d\r\ne"); got != `a\;b\,c\\d\ne` {
+		t.Errorf("icsText = %q", got)
+	}
+}
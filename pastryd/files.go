@@ -0,0 +1,460 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
+)
+
+// showSketch serves the drawing page, which uploads sketches as PNG or SVG.
+func (p *pastry) showSketch(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "sketch.html", struct{ Board string }{r.URL.Query().Get("board")})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// File pastes keep their content in the files directory, next to pastes.gob, and have an
+// empty Text, up to MaxUpload of the limits.
+
+// uploadTypes are the kinds of files that can be pasted, by the start of their MIME type.
+var uploadTypes = []string{"audio/", "image/png", "image/svg+xml"}
+
+func uploadAllowed(mimeType string) bool {
+	for _, t := range uploadTypes {
+		if strings.HasPrefix(mimeType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *entry) isAudio() bool {
+	return strings.HasPrefix(e.Mime, "audio/")
+}
+
+func (e *entry) isImage() bool {
+	return strings.HasPrefix(e.Mime, "image/")
+}
+
+// fileString describes a file paste where there is no text to show, like "[audio/ogg 24 kB]".
+func fileString(e *entry) string {
+	if e.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s %s]", e.Mime, humanize.Bytes(uint64(e.Size)))
+}
+
+// spoolMime is the type of the large texts of the write port, which are kept as files.
+const spoolMime = "text/plain; charset=utf-8"
+
+// blobName is the name in the files directory of content of the SHA-256 hash, in hex. The
+// same file pasted again is stored once.
+func blobName(hash, mimeType string) string {
+	if mimeType == spoolMime {
+		// rather than whichever of .asc, .conf, .txt and so on the system lists first
+		return hash + ".txt"
+	}
+	if ext, _ := mime.ExtensionsByType(mimeType); len(ext) > 0 {
+		return hash + ext[0]
+	}
+	return hash
+}
+
+// saveFile writes data to the files directory, unless it is there already, and returns its
+// name. With --no-persist the file is only kept in p.files.
+func (p *pastry) saveFile(data []byte, mimeType string) (string, error) {
+	if p.full() {
+		return "", errStorageFull
+	}
+	sum := sha256.Sum256(data)
+	name := blobName(hex.EncodeToString(sum[:]), mimeType)
+	p.mutex.Lock()
+	p.fresh(name)
+	if p.files != nil {
+		p.files[name] = data
+	}
+	p.mutex.Unlock()
+	if p.files != nil {
+		return name, nil
+	}
+	if err := createDir(p.filesDir); err != nil {
+		return "", err
+	}
+	path := filepath.Join(p.filesDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return name, nil
+	}
+	return name, writeBytesAtomic(path, 0644, p.seal.seal(data))
+}
+
+// spoolFile streams what c sends after head into the files directory, as spool does, and
+// returns its name. It is written to a temporary file first, the name is only known at the
+// end. Only what is kept in memory or sealed, which is sealed whole, is read in full first.
+func (p *pastry) spoolFile(c net.Conn, head []byte, max int, idle time.Duration) (name string, n int, hash string, cut bool, err error) {
+	if p.full() {
+		return "", 0, "", false, errStorageFull
+	}
+	h := sha256.New()
+	if p.files != nil || p.seal != nil {
+		var b bytes.Buffer
+		if n, cut, err = spool(io.MultiWriter(&b, h), c, head, max, idle); err == nil {
+			name, err = p.saveFile(b.Bytes(), spoolMime)
+		}
+		return name, n, hex.EncodeToString(h.Sum(nil)), cut, err
+	}
+	if err = createDir(p.filesDir); err != nil {
+		return "", 0, "", false, err
+	}
+	f, err := os.CreateTemp(p.filesDir, ".spool.*")
+	if err != nil {
+		return "", 0, "", false, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	n, cut, err = spool(io.MultiWriter(f, h), c, head, max, idle)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		return "", n, "", cut, err
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+	name = blobName(hash, spoolMime)
+	p.mutex.Lock()
+	p.fresh(name)
+	p.mutex.Unlock()
+	path := filepath.Join(p.filesDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return name, n, hash, cut, nil
+	}
+	return name, n, hash, cut, os.Rename(tmp, path)
+}
+
+// openFile opens the file of e, to be copied to the reader from disk a buffer at a time
+// rather than read into memory first. Sealed files are decrypted whole, there is no opening
+// a part of them. Must be called with the mutex held, the file can be read without it.
+func (p *pastry) openFile(e *entry) (io.ReadSeekCloser, error) {
+	if p.files != nil {
+		b, ok := p.files[e.File]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return nopCloser{bytes.NewReader(b)}, nil
+	}
+	f, err := os.Open(filepath.Join(p.filesDir, e.File))
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, len(sealMagic))
+	n, _ := io.ReadFull(f, head)
+	if !sealed(head[:n]) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	b, err := io.ReadAll(io.MultiReader(bytes.NewReader(head), f))
+	f.Close()
+	if err == nil {
+		b, err = p.seal.open(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+type nopCloser struct{ io.ReadSeeker }
+
+func (nopCloser) Close() error { return nil }
+
+// textReader reads s without handing all of it to a single Write, which would copy it.
+func textReader(s string) io.Reader {
+	return struct{ io.Reader }{strings.NewReader(s)}
+}
+
+// sealFiles encrypts the files uploaded before there was a store key.
+func (p *pastry) sealFiles() error {
+	for _, e := range p.texts {
+		if e.File == "" {
+			continue
+		}
+		name := filepath.Join(p.filesDir, e.File)
+		b, err := os.ReadFile(name)
+		if err != nil || !p.seal.plain(b) {
+			continue
+		}
+		if err := writeBytesAtomic(name, 0644, p.seal.seal(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard lets go of what e keeps outside pastes.gob, once e itself is gone, and leaves a
+// tombstone. Its file is removed by reclaim, when no other paste refers to it. Must be called
+// with the mutex held.
+func (p *pastry) discard(e *entry) {
+	p.bury(e.ID, time.Now().UTC())
+	if e.File != "" {
+		p.unlinked = append(p.unlinked, e.File)
+	}
+}
+
+// fresh tells reclaim that a new paste is about to refer to the file name, which it leaves
+// alone until the paste is added, rather than removing it in between. A paste that never is,
+// failing after its file was saved, leaves it for a while. Must be called with the mutex held.
+func (p *pastry) fresh(name string) {
+	if p.saved == nil {
+		p.saved = make(map[string]time.Time)
+	}
+	p.saved[name] = time.Now()
+}
+
+// freshFor is how long a saved file is left alone without a paste.
+const freshFor = time.Minute
+
+// reclaim removes the files discarded that no paste refers to any more, the pastes of the
+// trash included. It is the reference count of the files, counted when it matters. It runs
+// once the pastes are stored, so those stored never refer to a removed file. Must be called
+// with the mutex held.
+func (p *pastry) reclaim() {
+	now := time.Now()
+	for name, t := range p.saved {
+		if now.Sub(t) > freshFor {
+			delete(p.saved, name)
+		}
+	}
+	if len(p.unlinked) == 0 {
+		return
+	}
+	used := make(map[string]bool)
+	for _, e := range p.texts {
+		used[e.File] = true
+	}
+	for _, t := range p.trash {
+		used[t.old.File] = true
+	}
+	var later []string
+	for _, name := range p.unlinked {
+		switch {
+		case used[name]:
+		case !p.saved[name].IsZero():
+			later = append(later, name)
+		case p.files != nil:
+			delete(p.files, name)
+		default:
+			os.Remove(filepath.Join(p.filesDir, name))
+		}
+	}
+	p.unlinked = later
+}
+
+// upload handles POST /upload, a multipart form with the file in "file" and optionally a
+// title and a board. The record button of the web GUI posts voice memos here, and the
+// sketch page its drawings.
+func (p *pastry) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maxUpload := p.limit().MaxUpload
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUpload)+1024*1024)
+	f, hdr, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, int64(maxUpload)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxUpload {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	mimeType, _, err := mime.ParseMediaType(hdr.Header.Get("Content-Type"))
+	if err != nil || mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	if mimeType == "application/ogg" {
+		// what content sniffing calls any Ogg file
+		mimeType = "audio/ogg"
+	}
+	if !uploadAllowed(mimeType) {
+		http.Error(w, "Unsupported file type: "+mimeType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	name, err := p.saveFile(data, mimeType)
+	if err != nil {
+		notStored(w, err)
+		return
+	}
+	e := &entry{
+		Title:  strings.TrimSpace(r.FormValue("title")),
+		Board:  strings.TrimSpace(r.FormValue("board")),
+		Origin: deviceName(r),
+		File:   name,
+		Mime:   mimeType,
+		Size:   int64(len(data)),
+		Hash:   textHash(string(data)),
+	}
+	if rt := p.requestRoute(r); rt != nil {
+		rt.route(e)
+	}
+	if err := p.addEntry(e); err != nil {
+		notStored(w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// putFile takes the body of PUT /files/<name>, as curl -T sends it, as a paste named <name>.
+// The files upload takes become file pastes, other text becomes a text paste. The query can
+// give the title and board, like the upload form does.
+func (p *pastry) putFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		w.Header().Set("Allow", "PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, err := cleanName(strings.TrimPrefix(r.URL.Path, "/files/"))
+	if err != nil || name == "" {
+		http.Error(w, "PUT to /files/<name>: Names may only contain a-z, 0-9, '-', '_' and '.'", http.StatusBadRequest)
+		return
+	}
+	l := p.limit()
+	max := l.MaxUpload
+	if l.MaxPaste > max {
+		max = l.MaxPaste
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(max)))
+	if err != nil {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		http.Error(w, "Nothing to paste", http.StatusBadRequest)
+		return
+	}
+	// curl -T sends no Content-Type, the name tells more than sniffing the content
+	mimeType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+	}
+	if mimeType == "" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	if mimeType == "application/ogg" {
+		mimeType = "audio/ogg"
+	}
+
+	q := r.URL.Query()
+	e := &entry{
+		Title:  strings.TrimSpace(q.Get("title")),
+		Name:   name,
+		Board:  strings.TrimSpace(q.Get("board")),
+		Origin: deviceName(r),
+	}
+	switch {
+	case uploadAllowed(mimeType):
+		if len(data) > l.MaxUpload {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if e.File, err = p.saveFile(data, mimeType); err != nil {
+			notStored(w, err)
+			return
+		}
+		e.Mime, e.Size, e.Hash = mimeType, int64(len(data)), textHash(string(data))
+	case utf8.Valid(data):
+		if len(data) > l.MaxPaste {
+			http.Error(w, fmt.Sprintf("The paste is longer than max-paste, %d bytes", l.MaxPaste), http.StatusRequestEntityTooLarge)
+			return
+		}
+		e.Text = string(data)
+	default:
+		http.Error(w, "Unsupported file type: "+mimeType, http.StatusUnsupportedMediaType)
+		return
+	}
+	if rt := p.requestRoute(r); rt != nil {
+		rt.route(e)
+	}
+	if err := p.addEntry(e); err != nil {
+		notStored(w, err)
+		return
+	}
+	p.replyCreated(w, r, e)
+}
+
+// download serves the file of a file paste, by index, @name or id, for the players of the
+// web GUI and for saving it.
+// It is sent once the mutex is released, so a slow download holds up nobody.
+func (p *pastry) download(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	i, e, ok := p.lookup(r, "/download/")
+	if !ok || e.File == "" {
+		p.mutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	f, err := p.openFile(e)
+	if err != nil {
+		p.mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if markSeen(e, deviceName(r), time.Now()) {
+		p.store()
+	}
+	w.Header().Set("Content-Type", e.Mime)
+	// SVG can carry scripts, which must not run as pastry when the image is opened on its own.
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"pastry-%d%s\"", i, filepath.Ext(e.File)))
+	if e.Hash != "" {
+		// for If-Range, so an interrupted download resumes only if the file is the same
+		w.Header().Set("ETag", hashETag(e.Hash))
+	}
+	when := e.When
+	p.mutex.Unlock()
+
+	// Range requests resume downloads and let the players seek
+	http.ServeContent(w, r, "", when, f)
+}
+
+// hashETag is the ETag of a file of the sha256 hash, in hex, as etag has for what is in memory.
+func hashETag(hash string) string {
+	if len(hash) > 16 {
+		hash = hash[:16]
+	}
+	return `"` + hash + `"`
+}
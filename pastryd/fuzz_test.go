@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// commandSeeds are read port commands, good and bad, for the fuzzers to start from.
+var commandSeeds = []string{
+	"get", "get 0", "get -1", "get 99999999999999999999999", "get @note~1",
+	"list", "list --preview 5", "list --preview -9223372036854775808", "list --view", "list --board --category",
+	"grep apple", "grep --color apple", "grep --lang sv --color apple", "grep --lang=de", "list --lang", "--lang", "--lang sv list", "grep --color=always ", "grep ",
+	"list --width 40", "list --width=-3", "grep --width 9 --lang de apple", "--width", "--width=20 list", "history @note --width 99999999999999999999",
+	"drop", "drop 1", "clear", "clear yes-really", "expire 0 1d", "expire 0 never", "publish 0 tomorrow notify", "remind 0 10m",
+	"meta", "meta 0 title=a tags=x,y", "count", "caps", "view save v tag:x since:1d", "view drop v",
+	"history @note", "export 0-1 2", "export 1-0", "print 0",
+	"--device phone get", "grep --device phone two", "--device phone grep  two", "get --device=\xff\xfe", "--device " + strings.Repeat("ä", 40) + " get",
+	"get\x000", "\x00", "li\xe2\x82st", "\n\n\n",
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, s := range commandSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cmd := parseCommand(b)
+		if cmd.name == "" && len(cmd.args) > 0 {
+			t.Fatalf("arguments %q without a command", cmd.args)
+		}
+		for _, w := range append([]string{cmd.name}, cmd.args...) {
+			if strings.ContainsAny(w, " \t\n") {
+				t.Fatalf("word %q has blanks", w)
+			}
+			if w == "--device" || strings.HasPrefix(w, "--device=") {
+				t.Fatalf("--device left in %q", cmd.args)
+			}
+			if cmd.name != "grep" && (w == "--lang" || strings.HasPrefix(w, "--lang=")) {
+				t.Fatalf("--lang left in %q", cmd.args)
+			}
+			if cmd.name != "grep" && (w == "--width" || strings.HasPrefix(w, "--width=")) {
+				t.Fatalf("--width left in %q", cmd.args)
+			}
+		}
+		if cmd.width < 0 {
+			t.Fatalf("width %d", cmd.width)
+		}
+		if len(cmd.device) > 32 {
+			t.Fatalf("device %q is longer than 32", cmd.device)
+		}
+		if utf8.Valid(b) && !utf8.ValidString(cmd.device) {
+			t.Fatalf("device %q was cut in the middle of a character", cmd.device)
+		}
+		if first, _ := nextWord(cmd.pattern); cmd.name == "grep" && (first == "--device" || strings.HasPrefix(first, "--device=")) {
+			t.Fatalf("--device left in the pattern %q", cmd.pattern)
+		}
+		if cmd.name != "grep" && (cmd.pattern != "" || cmd.color) {
+			t.Fatalf("grep options for %q", cmd.name)
+		}
+	})
+}
+
+func FuzzHandleReadPaste(f *testing.F) {
+	for _, s := range commandSeeds {
+		f.Add([]byte(s))
+	}
+	s, err := New(Config{DataDir: f.TempDir(), PreviewLen: 60, Limits: limits{ReadTimeout: 10 * time.Millisecond}})
+	if err != nil {
+		f.Fatalf("New: %v", err)
+	}
+	defer s.Stop()
+	p := s.p
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) == 0 || isClipboardCommand(b) || isSessionCommand(b) {
+			// the latest paste after the read timeout, and the bridge protocol and sessions,
+			// which wait
+			return
+		}
+		p.mutex.Lock()
+		now := time.Now()
+		p.texts = []*entry{
+			{ID: "a", When: now.Add(-time.Hour), Text: "one apple\n", Name: "note"},
+			{ID: "b", When: now.Add(-time.Minute), Text: "two pears\nand two apples\n", Title: "fruit", Tags: []string{"x"}},
+			{ID: "c", When: now, Text: "\n\n   {\n  ärger\n", Name: "note"},
+		}
+		p.views = nil
+		p.mutex.Unlock()
+
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			p.handleReadPaste(context.Background(), server)
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(10 * time.Second))
+		// pastry reads what fits its buffer and hangs up on the rest
+		go client.Write(b)
+		if _, err := io.ReadAll(client); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		client.Close()
+		<-done
+	})
+}
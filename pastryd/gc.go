@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// pastry gc, and --gc-interval while pastry runs, tidy up what builds up over time in a data
+// directory that lives for years. The trash past its grace is emptied, the files no paste
+// refers to are removed, like those of a crash between saving a file and storing its paste,
+// the tombstones past tombstoneKeep are pruned, and the store is compacted.
+
+// tempFileAge is how old a temporary file of the files directory, of a spooled paste or an
+// atomic write, must be before gc takes it for left over by a crash rather than in progress.
+const tempFileAge = time.Hour
+
+// compacter is a store that can be rewritten smaller. The sizes are of what it keeps on disk.
+type compacter interface {
+	compactStore(texts []*entry) (before, after int64, err error)
+}
+
+type gcReport struct {
+	files             int   // removed
+	fileBytes         int64 // of those
+	tombs             int   // pruned, see tombstone.go
+	compacted         bool
+	store, storeAfter int64 // before compacting and after
+}
+
+func (r gcReport) String() string {
+	s := fmt.Sprintf("Removed %d files no paste refers to, %s", r.files, humanize.Bytes(uint64(r.fileBytes)))
+	if r.tombs > 0 {
+		s += fmt.Sprintf(", pruned %d tombstones", r.tombs)
+	}
+	if r.compacted {
+		s += fmt.Sprintf(", compacted the store from %s to %s", humanize.Bytes(uint64(r.store)), humanize.Bytes(uint64(r.storeAfter)))
+	}
+	return s
+}
+
+// reclaimed is how much less the data directory takes.
+func (r gcReport) reclaimed() int64 {
+	return r.fileBytes + r.store - r.storeAfter
+}
+
+// GC tidies up the data directory of cfg, see gc.go, and tells what it did. No pastry may be
+// running on it, as it would write over the store.
+func GC(cfg Config) (string, error) {
+	s, err := New(cfg)
+	if err != nil {
+		return "", err
+	}
+	r, err := s.p.gc(time.Now())
+	if cerr := s.Stop(); err == nil {
+		err = cerr
+	}
+	return fmt.Sprintf("%v, %s reclaimed", r, humanize.Bytes(uint64(r.reclaimed()))), err
+}
+
+func (p *pastry) gc(now time.Time) (gcReport, error) {
+	p.emptyTrash(now)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var r gcReport
+	r.tombs = p.pruneTombs(now)
+	// what is stored is what the files are kept for
+	if err := p.store(); err != nil {
+		return r, err
+	}
+	used := make(map[string]bool)
+	for _, e := range p.texts {
+		used[e.File] = true
+	}
+	for _, t := range p.trash {
+		used[t.old.File] = true
+	}
+	orphan := func(name string) bool {
+		return !used[name] && p.saved[name].IsZero()
+	}
+
+	if p.files != nil {
+		for name, b := range p.files {
+			if orphan(name) {
+				delete(p.files, name)
+				r.files++
+				r.fileBytes += int64(len(b))
+			}
+		}
+	} else {
+		dir, err := os.ReadDir(p.filesDir)
+		if err != nil && !os.IsNotExist(err) {
+			return r, err
+		}
+		for _, f := range dir {
+			info, err := f.Info()
+			if err != nil || f.IsDir() {
+				continue
+			}
+			if strings.HasPrefix(f.Name(), ".") && now.Sub(info.ModTime()) < tempFileAge || !orphan(f.Name()) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(p.filesDir, f.Name())); err != nil {
+				return r, err
+			}
+			r.files++
+			r.fileBytes += info.Size()
+		}
+	}
+
+	if c, ok := p.backend.(compacter); ok {
+		var err error
+		r.compacted = true
+		if r.store, r.storeAfter, err = c.compactStore(p.texts); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// gcNow runs gc for --gc-interval and logs what it did.
+func (p *pastry) gcNow(now time.Time) {
+	r, err := p.gc(now)
+	if err != nil {
+		log.Printf("gc failed: %v", err)
+		return
+	}
+	if r.reclaimed() > 0 || r.tombs > 0 {
+		log.Printf("gc: %v", r)
+	}
+}
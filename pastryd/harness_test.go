@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testServer is a whole pastry on ports of its own, with a store in a temporary directory.
+// It is stopped when the test ends.
+type testServer struct {
+	t     *testing.T
+	cfg   Config
+	s     *Server
+	web   string
+	write string
+	read  string
+}
+
+// startServer starts a pastry with cfg, on free ports of localhost and in a new data
+// directory unless cfg has one.
+func startServer(t *testing.T, cfg Config) *testServer {
+	t.Helper()
+	if cfg.DataDir == "" {
+		cfg.DataDir = t.TempDir()
+	}
+	cfg.HTTPAddr, cfg.WriteAddr, cfg.ReadAddr = "127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0"
+	ts := &testServer{t: t, cfg: cfg}
+	ts.start()
+	t.Cleanup(ts.stop)
+	return ts
+}
+
+func (ts *testServer) start() {
+	ts.t.Helper()
+	s, err := New(ts.cfg)
+	if err != nil {
+		ts.t.Fatalf("New: %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		ts.t.Fatalf("Start: %v", err)
+	}
+	ts.s = s
+	ts.web, ts.write, ts.read = s.Addrs()
+}
+
+func (ts *testServer) stop() {
+	if ts.s != nil {
+		if err := ts.s.Stop(); err != nil {
+			ts.t.Errorf("Stop: %v", err)
+		}
+		ts.s = nil
+	}
+}
+
+// restart stops the server and starts a new one on the same data directory.
+func (ts *testServer) restart() {
+	ts.t.Helper()
+	ts.stop()
+	ts.start()
+}
+
+// send writes b to addr, closes the sending side and returns all the server answers.
+func (ts *testServer) send(addr string, b []byte) string {
+	ts.t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		ts.t.Fatalf("Dial %s: %v", addr, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if len(b) > 0 {
+		if _, err := c.Write(b); err != nil {
+			ts.t.Fatalf("Write: %v", err)
+		}
+	}
+	c.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(c)
+	// the server hangs up on what it doesn't read, like the end of a paste over max-paste
+	if err != nil && !errors.Is(err, syscall.ECONNRESET) {
+		ts.t.Fatalf("Read: %v", err)
+	}
+	return string(reply)
+}
+
+// paste sends text to the write port, and returns the answer, if any.
+func (ts *testServer) paste(text string) string {
+	ts.t.Helper()
+	return ts.send(ts.write, []byte(text))
+}
+
+// command sends a command line to the read port.
+func (ts *testServer) command(cmd string) string {
+	ts.t.Helper()
+	return ts.send(ts.read, []byte(cmd+"\n"))
+}
+
+// quiet connects to the read port without sending anything, which gets the latest paste.
+func (ts *testServer) quiet() string {
+	ts.t.Helper()
+	c, err := net.Dial("tcp", ts.read)
+	if err != nil {
+		ts.t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	reply, err := io.ReadAll(c)
+	if err != nil {
+		ts.t.Fatalf("Read: %v", err)
+	}
+	return string(reply)
+}
+
+// get fetches a page of the web GUI.
+func (ts *testServer) get(path string) (int, string) {
+	ts.t.Helper()
+	return ts.do(http.Get("http://" + ts.web + path))
+}
+
+// post posts a form to the web GUI, without following redirects.
+func (ts *testServer) post(path string, form url.Values) (int, string) {
+	ts.t.Helper()
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	return ts.do(c.Post("http://"+ts.web+path, "application/x-www-form-urlencoded", strings.NewReader(form.Encode())))
+}
+
+// upload posts a file to the web GUI like the record button does.
+func (ts *testServer) upload(mimeType string, data []byte) int {
+	ts.t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, _ := w.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="file"`},
+		"Content-Type":        {mimeType},
+	})
+	part.Write(data)
+	w.Close()
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	code, _ := ts.do(c.Post("http://"+ts.web+"/upload", w.FormDataContentType(), &body))
+	return code
+}
+
+func (ts *testServer) do(resp *http.Response, err error) (int, string) {
+	ts.t.Helper()
+	if err != nil {
+		ts.t.Fatalf("HTTP: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatalf("HTTP body: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
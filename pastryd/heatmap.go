@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+const (
+	heatmapWeeks = 53
+	heatmapCell  = 11
+	heatmapGap   = 2
+	heatmapLeft  = 28
+	heatmapTop   = 16
+)
+
+var heatmapColors = []string{"#161b22", "#0e4429", "#006d32", "#26a641", "#39d353"}
+
+func day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// heatmap renders a calendar of the pastes per day over the last year, one column per week
+// starting on Monday. Must be called with the mutex held.
+func (p *pastry) heatmap(now time.Time) template.HTML {
+	today := day(now)
+	monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	start := monday.AddDate(0, 0, -7*(heatmapWeeks-1))
+
+	counts := make(map[time.Time]int)
+	max := 0
+	for _, e := range p.texts {
+		d := day(e.When.In(now.Location()))
+		if d.Before(start) || d.After(today) {
+			continue
+		}
+		if counts[d]++; counts[d] > max {
+			max = counts[d]
+		}
+	}
+
+	step := heatmapCell + heatmapGap
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="9" fill="currentColor">`,
+		heatmapLeft+heatmapWeeks*step, heatmapTop+7*step)
+
+	for i, name := range []string{"Mon", "Wed", "Fri"} {
+		fmt.Fprintf(&b, `<text x="0" y="%d">%s</text>`, heatmapTop+(2*i)*step+heatmapCell-2, name)
+	}
+
+	for w := 0; w < heatmapWeeks; w++ {
+		x := heatmapLeft + w*step
+		for wd := 0; wd < 7; wd++ {
+			d := start.AddDate(0, 0, 7*w+wd)
+			if d.After(today) {
+				break
+			}
+			if d.Day() == 1 {
+				fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, x, heatmapTop-5, d.Format("Jan"))
+			}
+			n := counts[d]
+			level := 0
+			if n > 0 {
+				level = (n*(len(heatmapColors)-1) + max - 1) / max
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" rx="2" fill="%s"><title>%s: %d pastes</title></rect>`,
+				x, heatmapTop+wd*step, heatmapCell, heatmapCell, heatmapColors[level], d.Format("2006-01-02"), n)
+		}
+	}
+	b.WriteString("</svg>")
+
+	// Only numbers, dates and fixed strings above, nothing from the pastes themselves.
+	return template.HTML(b.String())
+}
@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type special struct {
+	name  string
+	ascii string // what it is mistaken for, "" if invisible
+}
+
+// specials are the characters behind most "it looks right but fails" pastes.
+var specials = map[rune]special{
+	'\u00a0': {"NO-BREAK SPACE", " "},
+	'\u2007': {"FIGURE SPACE", " "},
+	'\u202f': {"NARROW NO-BREAK SPACE", " "},
+	'\u2009': {"THIN SPACE", " "},
+	'\u3000': {"IDEOGRAPHIC SPACE", " "},
+	'‘':      {"LEFT SINGLE QUOTATION MARK", "'"},
+	'’':      {"RIGHT SINGLE QUOTATION MARK", "'"},
+	'‚':      {"SINGLE LOW-9 QUOTATION MARK", "'"},
+	'′':      {"PRIME", "'"},
+	'“':      {"LEFT DOUBLE QUOTATION MARK", `"`},
+	'”':      {"RIGHT DOUBLE QUOTATION MARK", `"`},
+	'„':      {"DOUBLE LOW-9 QUOTATION MARK", `"`},
+	'″':      {"DOUBLE PRIME", `"`},
+	'‐':      {"HYPHEN", "-"},
+	'‑':      {"NON-BREAKING HYPHEN", "-"},
+	'–':      {"EN DASH", "-"},
+	'—':      {"EM DASH", "-"},
+	'−':      {"MINUS SIGN", "-"},
+	'…':      {"HORIZONTAL ELLIPSIS", "..."},
+	'⁄':      {"FRACTION SLASH", "/"},
+	'∕':      {"DIVISION SLASH", "/"},
+	'ǀ':      {"LATIN LETTER DENTAL CLICK", "|"},
+	'а':      {"CYRILLIC SMALL LETTER A", "a"},
+	'е':      {"CYRILLIC SMALL LETTER IE", "e"},
+	'о':      {"CYRILLIC SMALL LETTER O", "o"},
+	'р':      {"CYRILLIC SMALL LETTER ER", "p"},
+	'с':      {"CYRILLIC SMALL LETTER ES", "c"},
+	'х':      {"CYRILLIC SMALL LETTER HA", "x"},
+	'у':      {"CYRILLIC SMALL LETTER U", "y"},
+	'і':      {"CYRILLIC SMALL LETTER BYELORUSSIAN-UKRAINIAN I", "i"},
+	'А':      {"CYRILLIC CAPITAL LETTER A", "A"},
+	'В':      {"CYRILLIC CAPITAL LETTER VE", "B"},
+	'Е':      {"CYRILLIC CAPITAL LETTER IE", "E"},
+	'К':      {"CYRILLIC CAPITAL LETTER KA", "K"},
+	'М':      {"CYRILLIC CAPITAL LETTER EM", "M"},
+	'Н':      {"CYRILLIC CAPITAL LETTER EN", "H"},
+	'О':      {"CYRILLIC CAPITAL LETTER O", "O"},
+	'Р':      {"CYRILLIC CAPITAL LETTER ER", "P"},
+	'С':      {"CYRILLIC CAPITAL LETTER ES", "C"},
+	'Т':      {"CYRILLIC CAPITAL LETTER TE", "T"},
+	'Х':      {"CYRILLIC CAPITAL LETTER HA", "X"},
+	'ο':      {"GREEK SMALL LETTER OMICRON", "o"},
+	'Ο':      {"GREEK CAPITAL LETTER OMICRON", "O"},
+	'Α':      {"GREEK CAPITAL LETTER ALPHA", "A"},
+	'Β':      {"GREEK CAPITAL LETTER BETA", "B"},
+	'Ε':      {"GREEK CAPITAL LETTER EPSILON", "E"},
+	'\u200b': {"ZERO WIDTH SPACE", ""},
+	'\u200c': {"ZERO WIDTH NON-JOINER", ""},
+	'\u200d': {"ZERO WIDTH JOINER", ""},
+	'\u2060': {"WORD JOINER", ""},
+	'\ufeff': {"ZERO WIDTH NO-BREAK SPACE (BOM)", ""},
+	'\u00ad': {"SOFT HYPHEN", ""},
+	'\u180e': {"MONGOLIAN VOWEL SEPARATOR", ""},
+	'\u200e': {"LEFT-TO-RIGHT MARK", ""},
+	'\u200f': {"RIGHT-TO-LEFT MARK", ""},
+	'\u061c': {"ARABIC LETTER MARK", ""},
+	'\u202a': {"LEFT-TO-RIGHT EMBEDDING", ""},
+	'\u202b': {"RIGHT-TO-LEFT EMBEDDING", ""},
+	'\u202c': {"POP DIRECTIONAL FORMATTING", ""},
+	'\u202d': {"LEFT-TO-RIGHT OVERRIDE", ""},
+	'\u202e': {"RIGHT-TO-LEFT OVERRIDE", ""},
+	'\u2066': {"LEFT-TO-RIGHT ISOLATE", ""},
+	'\u2067': {"RIGHT-TO-LEFT ISOLATE", ""},
+	'\u2068': {"FIRST STRONG ISOLATE", ""},
+	'\u2069': {"POP DIRECTIONAL ISOLATE", ""},
+}
+
+type codepoint struct {
+	Line, Col int
+	Char      string
+	Code      string
+	Category  string
+	Name      string
+	Looks     string
+	Invisible bool
+}
+
+type inspection struct {
+	htmlEntry
+	Bytes, Runes, Lines int
+	Lookalikes          int
+	Invisible           int
+	Combining           int
+	Codepoints          []codepoint
+	Truncated           bool
+	Cleaned             string
+}
+
+const maxCodepoints = 2000
+
+var categoryNames []string
+
+func init() {
+	for name := range unicode.Categories {
+		if len(name) == 2 && name != "LC" {
+			categoryNames = append(categoryNames, name)
+		}
+	}
+	sort.Strings(categoryNames)
+}
+
+func category(r rune) string {
+	for _, name := range categoryNames {
+		if unicode.Is(unicode.Categories[name], r) {
+			return name
+		}
+	}
+	return "?"
+}
+
+// inspect lists every character outside printable ASCII, and builds a cleaned copy with
+// lookalikes replaced and invisible characters removed.
+func inspect(text string) inspection {
+	var in inspection
+	var cleaned strings.Builder
+
+	in.Bytes = len(text)
+	in.Runes = utf8.RuneCountInString(text)
+	in.Lines = strings.Count(text, "\n") + 1
+
+	line, col := 1, 0
+	for _, r := range text {
+		col++
+		if r == '\n' {
+			cleaned.WriteRune(r)
+			line, col = line+1, 0
+			continue
+		}
+		if r == '\t' || (r >= ' ' && r <= '~') {
+			cleaned.WriteRune(r)
+			continue
+		}
+
+		cp := codepoint{Line: line, Col: col, Char: string(r), Code: fmt.Sprintf("U+%04X", r), Category: category(r)}
+		if s, ok := specials[r]; ok {
+			cp.Name = s.name
+			cp.Looks = s.ascii
+			if s.ascii == "" {
+				cp.Invisible = true
+				in.Invisible++
+			} else {
+				in.Lookalikes++
+			}
+			cleaned.WriteString(s.ascii)
+		} else {
+			if unicode.Is(unicode.Mn, r) {
+				cp.Name = "combining mark"
+				in.Combining++
+			} else if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+				cp.Invisible = true
+				in.Invisible++
+			}
+			if !cp.Invisible {
+				cleaned.WriteRune(r)
+			}
+		}
+		if cp.Invisible {
+			cp.Char = ""
+		}
+
+		if len(in.Codepoints) < maxCodepoints {
+			in.Codepoints = append(in.Codepoints, cp)
+		} else {
+			in.Truncated = true
+		}
+	}
+	in.Cleaned = cleaned.String()
+	return in
+}
+
+func (p *pastry) inspectPaste(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i, e, ok := p.lookup(r, "/inspect/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	in := inspect(e.Text)
+	in.htmlEntry = newHTMLEntry(p.webFormatter(r), i, e)
+
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "inspect.html", in)
+	servePage(w, r, b.Bytes())
+}
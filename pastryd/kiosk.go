@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"pastry/format"
+)
+
+// pinTag keeps a paste on the kiosk page, above the latest ones.
+const pinTag = "pin"
+
+type kioskPage struct {
+	Refresh int
+	Pinned  []htmlEntry
+	Latest  []htmlEntry
+}
+
+func queryInt(r *http.Request, name string, def, min int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		return def
+	}
+	if v < min {
+		return min
+	}
+	return v
+}
+
+// showKiosk serves /kiosk, a plain large type page for e-ink displays and wall tablets that
+// reloads itself. ?n= is how many of the latest pastes to show, ?board= limits it to one board
+// and ?refresh= is the reload interval in seconds. Pastes tagged pin are always shown first.
+// The kiosk doesn't count as a device, so pastes stay unread.
+func (p *pastry) showKiosk(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	f := format.New(p.cfg.Locale, now)
+	n := queryInt(r, "n", 3, 0)
+	board := r.URL.Query().Get("board")
+	page := kioskPage{Refresh: queryInt(r, "refresh", 60, 10)}
+
+	for i := len(p.texts) - 1; i >= 0; i-- {
+		e := p.texts[i]
+		if !e.visible(now) || board != "" && e.Board != board {
+			continue
+		}
+		if hasTag(e, pinTag) {
+			page.Pinned = append(page.Pinned, newHTMLEntry(f, i, e))
+		} else if len(page.Latest) < n {
+			page.Latest = append(page.Latest, newHTMLEntry(f, i, e))
+		}
+	}
+
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "kiosk.html", page)
+	servePage(w, r, b.Bytes())
+}
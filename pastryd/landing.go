@@ -0,0 +1,46 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The landing view is what / shows without a query: everything, the pinned pastes, a board
+// or the kiosk. --landing sets it for all browsers, each browser can pick its own from the
+// sidebar, so the tablet in the kitchen can start on the shopping board.
+const landingCookie = "pastry_landing"
+
+func validLanding(s string) bool {
+	switch s {
+	case "index", "pinned", "kiosk":
+		return true
+	}
+	return strings.HasPrefix(s, "board:") && len(s) > len("board:")
+}
+
+// landing is the landing view of the browser, or the configured one.
+func (p *pastry) landing(r *http.Request) string {
+	if c, err := r.Cookie(landingCookie); err == nil && validLanding(c.Value) {
+		return c.Value
+	}
+	return p.cfg.Landing
+}
+
+// setLanding handles the landing form of the sidebar, an empty view goes back to the default.
+func (p *pastry) setLanding(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		v := r.FormValue("landing")
+		c := &http.Cookie{Name: landingCookie, Value: v, Path: "/", Expires: time.Now().AddDate(10, 0, 0)}
+		if !validLanding(v) {
+			c.Value, c.Expires, c.MaxAge = "", time.Time{}, -1
+		}
+		http.SetCookie(w, c)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,213 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// limits are the tunables that can be changed while pastry runs, by editing the limits file
+// and sending SIGHUP or from the limits page of the web GUI. They are swapped as a whole, so
+// a handler that loads them once sees one consistent set for the whole request. A limits
+// value is never changed once it is in use.
+type limits struct {
+	MaxPaste  int
+	MaxImport int
+	// MaxUpload is for files in the web GUI, the default is plenty for a voice memo of a few minutes.
+	// Pastes of the write port over MaxPaste are kept as files too, up to it.
+	MaxUpload int
+
+	// ReadTimeout is how long the read port waits for a command before sending the latest paste.
+	ReadTimeout time.Duration
+	// ImportIdle is how long a paste or an import may pause before it is taken as complete.
+	ImportIdle time.Duration
+
+	Boards boardPolicies
+}
+
+// defaultLimits are those of a Config that leaves them out.
+var defaultLimits = limits{
+	MaxPaste:    1024 * 1024,
+	MaxImport:   256 * 1024 * 1024,
+	MaxUpload:   16 * 1024 * 1024,
+	ReadTimeout: 100 * time.Millisecond,
+	ImportIdle:  time.Second,
+}
+
+// limit returns the limits in effect.
+func (p *pastry) limit() *limits {
+	return p.limits.Load()
+}
+
+func (bp boardPolicy) String() string {
+	var o []string
+	if bp.Keep > 0 {
+		o = append(o, fmt.Sprintf("keep=%d", bp.Keep))
+	}
+	if bp.MaxAge > 0 {
+		o = append(o, "age="+formatAge(bp.MaxAge))
+	}
+	if bp.MaxBytes > 0 {
+		o = append(o, "size="+strings.ReplaceAll(humanize.IBytes(bp.MaxBytes), " ", ""))
+	}
+	if bp.Expire > 0 {
+		o = append(o, "expire="+formatAge(bp.Expire))
+	}
+	if bp.PerDevice > 0 {
+		o = append(o, fmt.Sprintf("per-device=%d", bp.PerDevice))
+	}
+	if bp.Lazy {
+		o = append(o, "lazy")
+	}
+	if len(o) == 0 {
+		return bp.Name
+	}
+	return bp.Name + ":" + strings.Join(o, ",")
+}
+
+// String is l in the form of the limits file.
+func (l *limits) String() string {
+	size := func(n int) string { return strings.ReplaceAll(humanize.IBytes(uint64(n)), " ", "") }
+	s := fmt.Sprintf("max-paste=%s\nmax-import=%s\nmax-upload=%s\nread-timeout=%v\nimport-idle=%v\n",
+		size(l.MaxPaste), size(l.MaxImport), size(l.MaxUpload), l.ReadTimeout, l.ImportIdle)
+	for _, bp := range l.Boards {
+		s += "board=" + bp.String() + "\n"
+	}
+	return s
+}
+
+// setLimit sets the limit k, other than board, to v.
+func (l *limits) setLimit(k, v string) (err error) {
+	switch k {
+	case "max-paste":
+		l.MaxPaste, err = parseSize(v)
+	case "max-import":
+		l.MaxImport, err = parseSize(v)
+	case "max-upload":
+		l.MaxUpload, err = parseSize(v)
+	case "read-timeout":
+		l.ReadTimeout, err = parseTimeout(v)
+	case "import-idle":
+		l.ImportIdle, err = parseTimeout(v)
+	default:
+		err = fmt.Errorf("Unknown limit %s", k)
+	}
+	return err
+}
+
+// parseLimits reads key=value lines over base. Any board lines replace the boards of base.
+func parseLimits(base limits, text string) (limits, error) {
+	l := base
+	var boards boardPolicies
+	for n, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		var err error
+		if !ok {
+			err = fmt.Errorf("Expected %s=<value>", k)
+		} else if k == "board" {
+			err = boards.Set(v)
+		} else {
+			err = l.setLimit(k, v)
+		}
+		if err != nil {
+			return base, fmt.Errorf("Line %d: %v", n+1, err)
+		}
+	}
+	if boards != nil {
+		l.Boards = boards
+	}
+	l.Boards = append(boardPolicies(nil), l.Boards...).withClipboard()
+	return l, nil
+}
+
+func parseSize(s string) (int, error) {
+	n, err := humanize.ParseBytes(s)
+	if err == nil && (n == 0 || n > 1<<40) {
+		err = fmt.Errorf("Invalid size: %s", s)
+	}
+	return int(n), err
+}
+
+func parseTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("Invalid duration: %s", s)
+	}
+	return d, err
+}
+
+// reloadLimits reads the limits file over the limits of the flags, keeping the limits in
+// effect if the file is broken. A missing file just means the flags, as does --no-persist.
+func (p *pastry) reloadLimits() error {
+	var b []byte
+	var err error
+	if !p.cfg.NoPersist {
+		b, err = os.ReadFile(p.cfg.LimitsFile)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := parseLimits(p.cfg.Limits, string(b))
+	if err != nil {
+		return fmt.Errorf("%s: %v", p.cfg.LimitsFile, err)
+	}
+	p.setLimits(&l)
+	return nil
+}
+
+// setLimits puts l in effect. Boards that got stricter are trimmed right away rather than at
+// the next round of the maintenance loop.
+func (p *pastry) setLimits(l *limits) {
+	p.limits.Store(l)
+	p.spawn(func() { p.enforceBoards(time.Now()) })
+}
+
+// showLimits is the limits page, GET shows the limits in effect and POST changes them and
+// writes them to the limits file, so they survive a restart.
+func (p *pastry) showLimits(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Limits string
+		File   string
+		Error  string
+	}{Limits: p.limit().String()}
+	if !p.cfg.NoPersist {
+		page.File = p.cfg.LimitsFile
+	}
+	status := http.StatusOK
+
+	if r.Method == "POST" {
+		text := strings.ReplaceAll(r.FormValue("limits"), "\r\n", "\n")
+		l, err := parseLimits(p.cfg.Limits, text)
+		if err == nil && page.File != "" {
+			err = writeBytesAtomic(p.cfg.LimitsFile, 0o644, []byte(l.String()))
+		}
+		if err != nil {
+			page.Limits, page.Error, status = text, err.Error(), http.StatusBadRequest
+		} else {
+			p.setLimits(&l)
+			log.Printf("Limits changed from the web GUI")
+			http.Redirect(w, r, "/limits", http.StatusSeeOther)
+			return
+		}
+	}
+
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "limits.html", page)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
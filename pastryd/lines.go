@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// head and tail on the read port send the first or last lines of a paste, of a long log
+// without all of it, and info counts them. Large pastes of the write port are files, read only
+// as far as needed.
+
+// defaultLines is how many lines head and tail send when not told.
+const defaultLines = 10
+
+// countLines counts the lines of r as countText does, which doesn't count the blank lines at
+// the end.
+func countLines(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	lines, blank, any := 0, 0, false
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if b == '\n' {
+			lines++
+			blank++
+		} else {
+			blank, any = 0, true
+		}
+	}
+	if !any {
+		return 0, nil
+	}
+	return lines - blank + 1, nil
+}
+
+// headLines is the first n lines of r.
+func headLines(r io.Reader, n int) ([]byte, error) {
+	var b bytes.Buffer
+	br := bufio.NewReader(r)
+	for ; n > 0; n-- {
+		line, err := br.ReadBytes('\n')
+		b.Write(line)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// tailLines is the last n lines of r, read backwards from the end a chunk at a time. A
+// newline at the very end ends the last line rather than starting another.
+func tailLines(r io.ReadSeeker, n int) ([]byte, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil || n <= 0 {
+		return nil, err
+	}
+	var tail []byte
+	chunk := make([]byte, 64*1024)
+	for pos := end; pos > 0; {
+		size := int64(len(chunk))
+		if pos < size {
+			size = pos
+		}
+		pos -= size
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, chunk[:size]); err != nil {
+			return nil, err
+		}
+		tail = append(append([]byte(nil), chunk[:size]...), tail...)
+		// the newline before the first line wanted, which there is none of at the start
+		body := bytes.TrimSuffix(tail, []byte("\n"))
+		if bytes.Count(body, []byte("\n")) >= n {
+			for i := 0; i < n; i++ {
+				body = body[:bytes.LastIndexByte(body, '\n')]
+			}
+			return tail[len(body)+1:], nil
+		}
+	}
+	return tail, nil
+}
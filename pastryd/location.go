@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strconv"
+)
+
+type location struct {
+	Lat, Lon float64
+}
+
+var (
+	// geo:59.3293,18.0686 and map links, OpenStreetMap #map=17/59.3293/18.0686 or mlat=..&mlon=..
+	// and Google Maps @59.3293,18.0686,17z or q=59.3293,18.0686
+	geoRe     = regexp.MustCompile(`geo:(-?\d+(?:\.\d+)?),(-?\d+(?:\.\d+)?)`)
+	osmRe     = regexp.MustCompile(`openstreetmap\.org/.*#map=\d+/(-?\d+\.\d+)/(-?\d+\.\d+)`)
+	osmMarkRe = regexp.MustCompile(`openstreetmap\.org/.*mlat=(-?\d+\.\d+)&mlon=(-?\d+\.\d+)`)
+	googleRe  = regexp.MustCompile(`google\.[a-z.]+/maps.*(?:@|[?&](?:q|ll|query)=)(-?\d+\.\d+),(-?\d+\.\d+)`)
+
+	// Plain coordinates need some decimals, so "1.5, 2.5" isn't a place.
+	coordRe = regexp.MustCompile(`(?:^|[^\d.])(-?\d{1,2}\.\d{3,})\s*,\s*(-?\d{1,3}\.\d{3,})`)
+	// 59°19'46"N 18°4'7"E
+	dmsRe = regexp.MustCompile(`(\d{1,2})°\s*(\d{1,2})['′]\s*(\d{1,2}(?:\.\d+)?)["″]?\s*([NS])[,\s]+(\d{1,3})°\s*(\d{1,2})['′]\s*(\d{1,2}(?:\.\d+)?)["″]?\s*([EW])`)
+)
+
+func validLocation(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+func dms(d, m, s, dir string) float64 {
+	deg, _ := strconv.ParseFloat(d, 64)
+	min, _ := strconv.ParseFloat(m, 64)
+	sec, _ := strconv.ParseFloat(s, 64)
+	v := deg + min/60 + sec/3600
+	if dir == "S" || dir == "W" {
+		v = -v
+	}
+	return v
+}
+
+// findLocation returns the first place found in text, from a geo URI, a map link or coordinates.
+func findLocation(text string) *location {
+	for _, re := range []*regexp.Regexp{geoRe, osmRe, osmMarkRe, googleRe, coordRe} {
+		if m := re.FindStringSubmatch(text); m != nil {
+			lat, err1 := strconv.ParseFloat(m[1], 64)
+			lon, err2 := strconv.ParseFloat(m[2], 64)
+			if err1 == nil && err2 == nil && validLocation(lat, lon) {
+				return &location{lat, lon}
+			}
+		}
+	}
+	if m := dmsRe.FindStringSubmatch(text); m != nil {
+		l := &location{dms(m[1], m[2], m[3], m[4]), dms(m[5], m[6], m[7], m[8])}
+		if validLocation(l.Lat, l.Lon) {
+			return l
+		}
+	}
+	return nil
+}
+
+// GeoURI opens the map app on phones. html/template doesn't know the geo scheme and would
+// filter it out of links.
+func (l *location) GeoURI() template.URL {
+	return template.URL(fmt.Sprintf("geo:%.6f,%.6f", l.Lat, l.Lon))
+}
+
+func (l *location) OSM() string {
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=16/%.6f/%.6f", l.Lat, l.Lon, l.Lat, l.Lon)
+}
+
+// Embed is the OpenStreetMap map preview, about a kilometre across.
+func (l *location) Embed() string {
+	const d = 0.005
+	return fmt.Sprintf("https://www.openstreetmap.org/export/embed.html?bbox=%.6f,%.6f,%.6f,%.6f&layer=mapnik&marker=%.6f,%.6f",
+		l.Lon-2*d, l.Lat-d, l.Lon+2*d, l.Lat+d, l.Lat, l.Lon)
+}
@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import "testing"
+
+func TestFindLocation(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string // the geo URI, "" for none
+	}{
+		{"meet at geo:59.3293,18.0686", "geo:59.329300,18.068600"},
+		{"geo:-33.8688,151.2093", "geo:-33.868800,151.209300"},
+		{"https://www.openstreetmap.org/#map=17/59.3293/18.0686", "geo:59.329300,18.068600"},
+		{"https://www.openstreetmap.org/?mlat=59.3293&mlon=18.0686", "geo:59.329300,18.068600"},
+		{"https://www.google.com/maps/place/X/@59.3293,18.0686,17z", "geo:59.329300,18.068600"},
+		{"https://www.google.se/maps?q=59.3293,18.0686", "geo:59.329300,18.068600"},
+		{"the cabin is at 61.1234, 14.5678", "geo:61.123400,14.567800"},
+		{`59°19'46"N 18°4'7"E`, "geo:59.329444,18.068611"},
+		{`33°52'8"S 151°12'33"W`, "geo:-33.868889,-151.209167"},
+		// too few decimals, out of range or part of a version
+		{"1.5, 2.5", ""},
+		{"geo:91.0,10.0", ""},
+		{"v1.2.345, 6.789", ""},
+		{"nowhere", ""},
+	} {
+		got := ""
+		if l := findLocation(tc.text); l != nil {
+			got = string(l.GeoURI())
+		}
+		if got != tc.want {
+			t.Errorf("findLocation(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestLocationLinks(t *testing.T) {
+	l := &location{59.3293, 18.0686}
+	if got, want := l.OSM(), "https://www.openstreetmap.org/?mlat=59.329300&mlon=18.068600#map=16/59.329300/18.068600"; got != want {
+		t.Errorf("OSM = %q, want %q", got, want)
+	}
+	if got, want := l.Embed(), "https://www.openstreetmap.org/export/embed.html?bbox=18.058600,59.324300,18.078600,59.334300&layer=mapnik&marker=59.329300,18.068600"; got != want {
+		t.Errorf("Embed = %q, want %q", got, want)
+	}
+}
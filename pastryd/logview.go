@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// The log viewer shows log pastes a line at a time with the level picked out, so the web
+// GUI can color them and filter on level and text without going back to the server.
+
+var logLevels = []string{"error", "warn", "info", "debug"}
+
+var (
+	levelKeyRe  = regexp.MustCompile(`(?i)\b(?:level|lvl|severity|priority)=["']?(\w+)`)
+	levelWordRe = regexp.MustCompile(`(?i)(?:^|[\s\[(<|])(fatal|panic|emerg|emergency|alert|crit|critical|err|error|warn|warning|notice|info|debug|trace)(?:$|[\s\]):>|])`)
+	// klog and glog, I0102 15:04:05.000000
+	klogRe = regexp.MustCompile(`^([IWEF])\d{4} \d\d:\d\d:\d\d`)
+)
+
+type logLine struct {
+	Level string
+	Text  string
+}
+
+// dockerLine is a line of docker's json-file log driver.
+type dockerLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// parseDocker unwraps a docker JSON log line into time and message.
+func parseDocker(l string) (string, bool) {
+	if !strings.HasPrefix(l, `{"log":`) {
+		return "", false
+	}
+	var d dockerLine
+	if json.Unmarshal([]byte(l), &d) != nil {
+		return "", false
+	}
+	return strings.TrimSpace(d.Time + " " + strings.TrimRight(d.Log, "\n")), true
+}
+
+// isDockerLog is true when most lines are docker JSON log lines, which detectKind takes
+// for neither logs nor JSON.
+func isDockerLog(text string) bool {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	n := 0
+	for _, l := range lines {
+		if _, ok := parseDocker(l); ok {
+			n++
+		}
+	}
+	return n*2 > len(lines)
+}
+
+// normalLevel maps the many names of levels onto logLevels.
+func normalLevel(s string) string {
+	switch strings.ToLower(s) {
+	case "fatal", "panic", "emerg", "emergency", "alert", "crit", "critical", "err", "error", "e", "f", "0", "1", "2", "3":
+		return "error"
+	case "warn", "warning", "w", "4":
+		return "warn"
+	case "notice", "info", "i", "5", "6":
+		return "info"
+	case "debug", "trace", "d", "7":
+		return "debug"
+	}
+	return ""
+}
+
+// lineLevel finds the level of a log line, from level=, klog's first letter or the first
+// level word standing on its own.
+func lineLevel(l string) string {
+	if m := levelKeyRe.FindStringSubmatch(l); m != nil {
+		if lvl := normalLevel(m[1]); lvl != "" {
+			return lvl
+		}
+	}
+	if m := klogRe.FindStringSubmatch(l); m != nil {
+		return normalLevel(m[1])
+	}
+	if m := levelWordRe.FindStringSubmatch(l); m != nil {
+		return normalLevel(m[1])
+	}
+	return ""
+}
+
+// parseLog splits a log into lines with levels. Indented lines without a level of their own,
+// stack traces and the like, belong to the line before.
+func parseLog(text string) []logLine {
+	var lines []logLine
+	prev := ""
+	for _, l := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if d, ok := parseDocker(l); ok {
+			l = d
+		}
+		lvl := lineLevel(l)
+		if lvl == "" && (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) {
+			lvl = prev
+		}
+		prev = lvl
+		lines = append(lines, logLine{Level: lvl, Text: l})
+	}
+	return lines
+}
+
+// usedLevels are the levels found in lines, in the order of logLevels.
+func usedLevels(lines []logLine) []string {
+	found := make(map[string]bool)
+	for _, l := range lines {
+		found[l.Level] = true
+	}
+	var used []string
+	for _, lvl := range logLevels {
+		if found[lvl] {
+			used = append(used, lvl)
+		}
+	}
+	return used
+}
@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineLevel(t *testing.T) {
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{`time=2023-05-01T10:00:00Z level=error msg="disk full"`, "error"},
+		{`ts=1 lvl=WARN caller=main.go:3`, "warn"},
+		{`priority="6" message=started`, "info"},
+		{"I0102 15:04:05.000000   1 main.go:10] started", "info"},
+		{"F0102 15:04:05.000000   1 main.go:10] dying", "error"},
+		{"2023-05-01 10:00:00 [DEBUG] cache miss", "debug"},
+		{"2023/05/01 10:00:00 WARNING: slow", "warn"},
+		{"<crit> the disk", "error"},
+		// words in a word don't count
+		{"the informer resynced", ""},
+		{"errors are counted, no level here", ""},
+		{"", ""},
+	} {
+		if got := lineLevel(tc.line); got != tc.want {
+			t.Errorf("lineLevel(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	text := "INFO starting\nERROR failed\n\tat one\n  at two\nno level\n" +
+		`{"log":"WARN from docker\n","stream":"stderr","time":"2023-05-01T10:00:00Z"}` + "\n"
+	want := []logLine{
+		{"info", "INFO starting"},
+		{"error", "ERROR failed"},
+		{"error", "\tat one"},
+		{"error", "  at two"},
+		{"", "no level"},
+		{"warn", "2023-05-01T10:00:00Z WARN from docker"},
+	}
+	got := parseLog(text)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLog = %q\nwant %q", got, want)
+	}
+	if used := usedLevels(got); !reflect.DeepEqual(used, []string{"error", "warn", "info"}) {
+		t.Errorf("usedLevels = %q", used)
+	}
+}
+
+func TestIsDockerLog(t *testing.T) {
+	line := `{"log":"hello\n","stream":"stdout","time":"2023-05-01T10:00:00Z"}`
+	for _, tc := range []struct {
+		text string
+		want bool
+	}{
+		{line + "\n" + line + "\n", true},
+		{line + "\n" + line + "\nplain\n", true},
+		{line + "\nplain\nplain\n", false},
+		{`{"log": 1}` + "\n", false},
+		{"plain\n", false},
+	} {
+		if got := isDockerLog(tc.text); got != tc.want {
+			t.Errorf("isDockerLog(%q) = %v", tc.text, got)
+		}
+	}
+}
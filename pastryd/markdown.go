@@ -0,0 +1,233 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// The Markdown of notes, not all of CommonMark: headings, paragraphs, lists, quotes, rules,
+// fenced code blocks, emphasis, code spans and links. With math on, $...$ and $$...$$ are
+// TeX, see math.go.
+
+var (
+	headingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	ruleRe     = regexp.MustCompile(`^\s{0,3}([-*_])(\s*[-*_]){2,}\s*$`)
+	bulletRe   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	numberedRe = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	fenceRe    = regexp.MustCompile("^\\s*(```+|~~~+)\\s*([\\w+#.-]*)")
+	// a link ends before the next [, so looking for one at every [ reads each byte once
+	linkRe     = regexp.MustCompile(`^\[([^\[\]]+)\]\(([^)\s\[]+)\)`)
+	autoLinkRe = regexp.MustCompile(`^<(https?://[^>\s]+)>`)
+)
+
+// isMarkdown is true for pastes said to be Markdown, and for ones without a language that
+// have fences or display math. Headings count for plain text only, shell and Python
+// comments start with # too.
+func isMarkdown(e *entry) bool {
+	if e.Lang != "" {
+		l := strings.ToLower(e.Lang)
+		return l == "md" || l == "markdown"
+	}
+	headings := false
+	for _, l := range strings.Split(e.Text, "\n") {
+		if fenceRe.MatchString(l) || strings.TrimSpace(l) == "$$" {
+			return true
+		}
+		headings = headings || headingRe.MatchString(l)
+	}
+	return headings && detectKind(e.Text) == "text"
+}
+
+type markdown struct {
+	b    strings.Builder
+	math bool
+}
+
+func renderMarkdown(text string, math bool) template.HTML {
+	m := &markdown{math: math}
+	m.blocks(strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n"))
+	return template.HTML(m.b.String())
+}
+
+func (m *markdown) blocks(lines []string) {
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		t := strings.TrimSpace(l)
+
+		switch {
+		case t == "":
+			i++
+		case fenceRe.MatchString(l):
+			f := fenceRe.FindStringSubmatch(l)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), f[1]); i++ {
+				code = append(code, lines[i])
+			}
+			i++
+			class := ""
+			if f[2] != "" {
+				class = ` class="language-` + html.EscapeString(f[2]) + `"`
+			}
+			m.b.WriteString("<pre><code" + class + ">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case m.math && strings.HasPrefix(t, "$$"):
+			var tex []string
+			if rest := strings.TrimPrefix(t, "$$"); strings.HasSuffix(rest, "$$") && rest != "" {
+				tex = append(tex, strings.TrimSuffix(rest, "$$"))
+				i++
+			} else {
+				tex = append(tex, rest)
+				for i++; i < len(lines) && !strings.HasSuffix(strings.TrimSpace(lines[i]), "$$"); i++ {
+					tex = append(tex, lines[i])
+				}
+				if i < len(lines) {
+					tex = append(tex, strings.TrimSuffix(strings.TrimSpace(lines[i]), "$$"))
+				}
+				i++
+			}
+			m.b.WriteString(texMathML(strings.Join(tex, "\n"), true) + "\n")
+		case headingRe.MatchString(l):
+			h := headingRe.FindStringSubmatch(l)
+			n := string(rune('0' + len(h[1])))
+			m.b.WriteString("<h" + n + ">" + m.inline(h[2]) + "</h" + n + ">\n")
+			i++
+		case ruleRe.MatchString(l):
+			m.b.WriteString("<hr/>\n")
+			i++
+		case strings.HasPrefix(t, ">"):
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(q, " "))
+			}
+			m.b.WriteString("<blockquote>\n")
+			m.blocks(quote)
+			m.b.WriteString("</blockquote>\n")
+		case bulletRe.MatchString(l) || numberedRe.MatchString(l):
+			re, tag := bulletRe, "ul"
+			if !bulletRe.MatchString(l) {
+				re, tag = numberedRe, "ol"
+			}
+			m.b.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && re.MatchString(lines[i]); i++ {
+				m.b.WriteString("<li>" + m.inline(re.FindStringSubmatch(lines[i])[1]) + "</li>\n")
+			}
+			m.b.WriteString("</" + tag + ">\n")
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && !m.blockStart(lines[i]); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			m.b.WriteString("<p>" + m.inline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+}
+
+func (m *markdown) blockStart(l string) bool {
+	t := strings.TrimSpace(l)
+	return fenceRe.MatchString(l) || headingRe.MatchString(l) || ruleRe.MatchString(l) || strings.HasPrefix(t, ">") ||
+		bulletRe.MatchString(l) || numberedRe.MatchString(l) || m.math && strings.HasPrefix(t, "$$")
+}
+
+// safeURL lets through the links that can't run script.
+func safeURL(u string) bool {
+	l := strings.ToLower(u)
+	return strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://") || strings.HasPrefix(l, "mailto:") ||
+		strings.HasPrefix(l, "/") || strings.HasPrefix(l, "#")
+}
+
+// inline renders emphasis, code spans, links and inline math, escaping everything else.
+func (m *markdown) inline(s string) string {
+	var b strings.Builder
+	var mathEnds []int
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.ContainsRune("\\`*_[]()#+-.!$<>", rune(rest[1])):
+			b.WriteString(html.EscapeString(rest[1:2]))
+			i += 2
+		case rest[0] == '`':
+			n := len(rest) - len(strings.TrimLeft(rest, "`"))
+			fence := rest[:n]
+			if end := strings.Index(rest[n:], fence); end >= 0 {
+				b.WriteString("<code>" + html.EscapeString(strings.TrimSpace(rest[n:n+end])) + "</code>")
+				i += n + end + n
+			} else {
+				b.WriteString(fence)
+				i += n
+			}
+		case m.math && rest[0] == '$' && len(rest) > 2 && rest[1] != ' ' && rest[1] != '$':
+			if mathEnds == nil {
+				mathEnds = findMathEnds(s)
+			}
+			end := mathEnds[i+2] - i
+			if mathEnds[i+2] < 0 {
+				b.WriteString("$")
+				i++
+				continue
+			}
+			b.WriteString(texMathML(rest[1:end], false))
+			i += end + 1
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if end := strings.Index(rest[2:], rest[:2]); end > 0 {
+				b.WriteString("<strong>" + m.inline(rest[2:2+end]) + "</strong>")
+				i += end + 4
+			} else {
+				b.WriteString(rest[:2])
+				i += 2
+			}
+		case rest[0] == '*' || rest[0] == '_' && (i == 0 || !isWordByte(s[i-1])):
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end > 0 && rest[1] != ' ' && (rest[0] == '*' || 2+end >= len(rest) || !isWordByte(rest[2+end])) {
+				b.WriteString("<em>" + m.inline(rest[1:1+end]) + "</em>")
+				i += end + 2
+			} else {
+				b.WriteByte(rest[0])
+				i++
+			}
+		case rest[0] == '[' && linkRe.MatchString(rest):
+			l := linkRe.FindStringSubmatch(rest)
+			if safeURL(l[2]) {
+				b.WriteString(`<a href="` + html.EscapeString(l[2]) + `">` + m.inline(l[1]) + "</a>")
+			} else {
+				b.WriteString(html.EscapeString(l[0]))
+			}
+			i += len(l[0])
+		case rest[0] == '<' && autoLinkRe.MatchString(rest):
+			l := autoLinkRe.FindStringSubmatch(rest)
+			b.WriteString(`<a href="` + html.EscapeString(l[1]) + `">` + html.EscapeString(l[1]) + "</a>")
+			i += len(l[0])
+		case rest[0] == '\n':
+			b.WriteString("\n")
+			i++
+		default:
+			b.WriteString(html.EscapeString(rest[:1]))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// findMathEnds is for each byte of s where the next closing $ of inline math is, or -1. $5 and
+// $10 is not math, the closing $ must not have a space before or a digit after. They are found
+// once for all of s, looking for the next one from every $ takes the square of its length.
+func findMathEnds(s string) []int {
+	ends := make([]int, len(s)+1)
+	ends[len(s)] = -1
+	for j := len(s) - 1; j >= 0; j-- {
+		ends[j] = ends[j+1]
+		if s[j] == '$' && j > 0 && s[j-1] != ' ' && s[j-1] != '\\' && (j+1 == len(s) || s[j+1] < '0' || s[j+1] > '9') {
+			ends[j] = j
+		}
+	}
+	return ends
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
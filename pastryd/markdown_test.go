@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"# Title #\n", "<h1>Title</h1>\n"},
+		{"one\ntwo\n\nthree\n", "<p>one\ntwo</p>\n<p>three</p>\n"},
+		{"- a\n- b\n", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"1. a\n2) b\n", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"> quoted\n> more\n", "<blockquote>\n<p>quoted\nmore</p>\n</blockquote>\n"},
+		{"---\n", "<hr/>\n"},
+		{"```go\nx := <1>\n```\n", "<pre><code class=\"language-go\">x := &lt;1&gt;</code></pre>\n"},
+		{"*em* **strong** `co<de>`\n", "<p><em>em</em> <strong>strong</strong> <code>co&lt;de&gt;</code></p>\n"},
+		{"[pastry](https://example.com/a?b=1&c=2)\n", "<p><a href=\"https://example.com/a?b=1&amp;c=2\">pastry</a></p>\n"},
+		{"<https://example.com>\n", "<p><a href=\"https://example.com\">https://example.com</a></p>\n"},
+		// what could run script stays text
+		{"[bad](javascript:alert(1))\n", "<p>[bad](javascript:alert(1))</p>\n"},
+		{"<b>raw</b>\n", "<p>&lt;b&gt;raw&lt;/b&gt;</p>\n"},
+	} {
+		if got := string(renderMarkdown(tc.text, false)); got != tc.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestRenderMarkdownMath(t *testing.T) {
+	for _, tc := range []struct {
+		text       string
+		math       bool
+		want, miss string
+	}{
+		{"$x^2$\n", true, "<p><math><semantics><mrow><msup>", ""},
+		{"$$\nx\n$$\n", true, `<math display="block">`, "<p>"},
+		{"$x^2$\n", false, "<p>$x^2$</p>", "<math>"},
+		// prices are not math
+		{"$5 and $10\n", true, "<p>$5 and $10</p>", "<math>"},
+	} {
+		got := string(renderMarkdown(tc.text, tc.math))
+		if !strings.Contains(got, tc.want) || tc.miss != "" && strings.Contains(got, tc.miss) {
+			t.Errorf("renderMarkdown(%q, %v) = %q", tc.text, tc.math, got)
+		}
+	}
+}
+
+func TestIsMarkdown(t *testing.T) {
+	for _, tc := range []struct {
+		e    entry
+		want bool
+	}{
+		{entry{Text: "# Notes\n\nsome text\n"}, true},
+		{entry{Text: "```\ncode\n```\n"}, true},
+		{entry{Text: "$$\nx\n$$\n"}, true},
+		{entry{Text: "plain text\n"}, false},
+		{entry{Text: "# Notes\n", Lang: "md"}, true},
+		{entry{Text: "# Notes\n", Lang: "sh"}, false},
+		// a comment of a script is not a heading
+		{entry{Text: "#!/bin/sh\n# clean up\nrm -rf build\n"}, false},
+	} {
+		if got := isMarkdown(&tc.e); got != tc.want {
+			t.Errorf("isMarkdown(%q, %q) = %v", tc.e.Text, tc.e.Lang, got)
+		}
+	}
+}
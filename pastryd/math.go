@@ -0,0 +1,388 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// TeX math is turned into MathML, which browsers draw themselves, so no fonts or scripts
+// need to be served. It is the common subset: fractions, roots, scripts, Greek letters,
+// operators, \left and \right, accents, \text and the math alphabets.
+
+var texIdentifiers = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε", "zeta": "ζ",
+	"eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν",
+	"xi": "ξ", "pi": "π", "varpi": "ϖ", "rho": "ρ", "varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ",
+	"upsilon": "υ", "phi": "ϕ", "varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π", "Sigma": "Σ",
+	"Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "emptyset": "∅", "hbar": "ℏ", "ell": "ℓ", "Re": "ℜ", "Im": "ℑ",
+	"aleph": "ℵ",
+}
+
+var texOperators = map[string]string{
+	"cdot": "⋅", "times": "×", "div": "÷", "pm": "±", "mp": "∓", "ast": "∗", "star": "⋆", "circ": "∘", "bullet": "∙",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "approx": "≈", "equiv": "≡", "sim": "∼",
+	"simeq": "≃", "cong": "≅", "propto": "∝", "ll": "≪", "gg": "≫",
+	"sum": "∑", "prod": "∏", "coprod": "∐", "int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+	"bigcup": "⋃", "bigcap": "⋂",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←", "leftrightarrow": "↔", "Rightarrow": "⇒",
+	"Leftarrow": "⇐", "Leftrightarrow": "⇔", "implies": "⟹", "iff": "⟺", "mapsto": "↦", "uparrow": "↑",
+	"downarrow": "↓",
+	"in":        "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "supset": "⊃", "subseteq": "⊆", "supseteq": "⊇",
+	"cup": "∪", "cap": "∩", "setminus": "∖", "forall": "∀", "exists": "∃", "neg": "¬", "lnot": "¬",
+	"land": "∧", "wedge": "∧", "lor": "∨", "vee": "∨", "oplus": "⊕", "otimes": "⊗", "perp": "⊥",
+	"parallel": "∥", "mid": "∣", "angle": "∠", "prime": "′",
+	"ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮", "ddots": "⋱",
+	"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+	"{": "{", "}": "}", "|": "‖", "vert": "|", "Vert": "‖", "backslash": "∖",
+}
+
+// texFunctions are set upright, like the function names they are.
+var texFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true, "arcsin": true, "arccos": true,
+	"arctan": true, "sinh": true, "cosh": true, "tanh": true, "log": true, "ln": true, "lg": true, "exp": true,
+	"lim": true, "sup": true, "inf": true, "max": true, "min": true, "det": true, "dim": true, "ker": true,
+	"gcd": true, "deg": true, "arg": true, "Pr": true, "mod": true,
+}
+
+var texSpaces = map[string]string{",": "0.167em", ":": "0.222em", ";": "0.278em", " ": "0.333em", "quad": "1em", "qquad": "2em", "!": "0"}
+
+// texAlphabets are where the capital A of each math alphabet is in Unicode, the small a
+// follows 26 places later. Browsers only know mathvariant="normal", so the letters are swapped.
+var texAlphabets = map[string]rune{
+	"mathbf": 0x1d400, "boldsymbol": 0x1d400, "mathit": 0x1d434, "mathcal": 0x1d49c, "mathscr": 0x1d49c,
+	"mathfrak": 0x1d504, "mathbb": 0x1d538, "mathsf": 0x1d5a0, "mathtt": 0x1d670,
+}
+
+// Letters that were in Unicode before the math alphabets and are left out of them.
+var texAlphabetHoles = map[rune]rune{
+	0x1d455: 'ℎ',
+	0x1d49d: 'ℬ', 0x1d4a0: 'ℰ', 0x1d4a1: 'ℱ', 0x1d4a3: 'ℋ', 0x1d4a4: 'ℐ', 0x1d4a7: 'ℒ', 0x1d4a8: 'ℳ', 0x1d4ad: 'ℛ',
+	0x1d4ba: 'ℯ', 0x1d4bc: 'ℊ', 0x1d4c4: 'ℴ',
+	0x1d506: 'ℭ', 0x1d50b: 'ℌ', 0x1d50c: 'ℑ', 0x1d515: 'ℜ', 0x1d51d: 'ℨ',
+	0x1d53a: 'ℂ', 0x1d53f: 'ℍ', 0x1d545: 'ℕ', 0x1d547: 'ℙ', 0x1d548: 'ℚ', 0x1d549: 'ℝ', 0x1d551: 'ℤ',
+}
+
+var texLetterRe = regexp.MustCompile(`<mi>([A-Za-z])</mi>`)
+
+func texAlphabet(mathml string, capitalA rune) string {
+	return texLetterRe.ReplaceAllStringFunc(mathml, func(m string) string {
+		r := rune(m[4])
+		if r >= 'a' {
+			r = capitalA + 26 + r - 'a'
+		} else {
+			r = capitalA + r - 'A'
+		}
+		if h, ok := texAlphabetHoles[r]; ok {
+			r = h
+		}
+		return "<mi>" + string(r) + "</mi>"
+	})
+}
+
+// The parser recurses for every brace and argument, formulas nested deeper or longer than
+// these are shown as they were written.
+const (
+	texMaxDepth = 64
+	texMaxLen   = 64 << 10
+)
+
+type texParser struct {
+	s       []rune
+	pos     int
+	depth   int
+	tooDeep bool
+}
+
+func (t *texParser) eof() bool {
+	return t.pos >= len(t.s)
+}
+
+func (t *texParser) skipSpace() {
+	for !t.eof() && unicode.IsSpace(t.s[t.pos]) {
+		t.pos++
+	}
+}
+
+// command reads the name after a backslash, letters or a single other character.
+func (t *texParser) command() string {
+	start := t.pos
+	for !t.eof() && unicode.IsLetter(t.s[t.pos]) {
+		t.pos++
+	}
+	if t.pos == start && !t.eof() {
+		t.pos++
+	}
+	return string(t.s[start:t.pos])
+}
+
+// expr parses atoms with their scripts until the end, a closing brace or \right.
+func (t *texParser) expr() string {
+	var b strings.Builder
+	for {
+		t.skipSpace()
+		if t.eof() || t.s[t.pos] == '}' || t.peekCommand("right") {
+			return b.String()
+		}
+		b.WriteString(t.scripted())
+	}
+}
+
+func (t *texParser) peekCommand(name string) bool {
+	n := []rune(`\` + name)
+	if t.pos+len(n) > len(t.s) || string(t.s[t.pos:t.pos+len(n)]) != string(n) {
+		return false
+	}
+	return t.pos+len(n) == len(t.s) || !unicode.IsLetter(t.s[t.pos+len(n)])
+}
+
+func (t *texParser) scripted() string {
+	base := t.atom()
+	var sub, sup string
+	for {
+		t.skipSpace()
+		if t.eof() {
+			break
+		}
+		switch t.s[t.pos] {
+		case '_':
+			t.pos++
+			sub = t.script()
+			continue
+		case '^':
+			t.pos++
+			sup = t.script()
+			continue
+		case '\'':
+			t.pos++
+			sup += "<mo>′</mo>"
+			continue
+		}
+		break
+	}
+	switch {
+	case sub != "" && sup != "":
+		return "<msubsup>" + mrow(base) + mrow(sub) + mrow(sup) + "</msubsup>"
+	case sub != "":
+		return "<msub>" + mrow(base) + mrow(sub) + "</msub>"
+	case sup != "":
+		return "<msup>" + mrow(base) + mrow(sup) + "</msup>"
+	}
+	return base
+}
+
+// script is a sub- or superscript, where x^23 is x squared followed by 3 like in TeX.
+func (t *texParser) script() string {
+	t.skipSpace()
+	if !t.eof() && unicode.IsDigit(t.s[t.pos]) {
+		t.pos++
+		return "<mn>" + string(t.s[t.pos-1]) + "</mn>"
+	}
+	return t.atom()
+}
+
+func mrow(s string) string {
+	if s == "" {
+		return "<mrow></mrow>"
+	}
+	return "<mrow>" + s + "</mrow>"
+}
+
+// group is an argument, in braces or a single atom.
+func (t *texParser) group() string {
+	t.skipSpace()
+	if !t.eof() && t.s[t.pos] == '{' {
+		t.pos++
+		s := t.expr()
+		if !t.eof() && t.s[t.pos] == '}' {
+			t.pos++
+		}
+		return s
+	}
+	return t.atom()
+}
+
+// rawGroup is the text of an argument in braces, for \text.
+func (t *texParser) rawGroup() string {
+	t.skipSpace()
+	if t.eof() || t.s[t.pos] != '{' {
+		return t.command()
+	}
+	depth, start := 0, t.pos+1
+	for ; !t.eof(); t.pos++ {
+		switch t.s[t.pos] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				t.pos++
+				return string(t.s[start : t.pos-1])
+			}
+		}
+	}
+	return string(t.s[start:])
+}
+
+// delimiter reads what follows \left or \right, "." being none.
+func (t *texParser) delimiter() string {
+	t.skipSpace()
+	if t.eof() {
+		return ""
+	}
+	r := t.s[t.pos]
+	t.pos++
+	if r == '\\' {
+		if op, ok := texOperators[t.command()]; ok {
+			return op
+		}
+		return ""
+	}
+	if r == '.' {
+		return ""
+	}
+	return string(r)
+}
+
+func (t *texParser) atom() string {
+	t.skipSpace()
+	if t.eof() {
+		return ""
+	}
+	if t.depth++; t.depth > texMaxDepth {
+		t.tooDeep = true
+		t.pos = len(t.s)
+		return ""
+	}
+	defer func() { t.depth-- }()
+	r := t.s[t.pos]
+	switch {
+	case r == '{':
+		return mrow(t.group())
+	case r == '\\':
+		t.pos++
+		return t.commandAtom(t.command())
+	case unicode.IsDigit(r) || r == '.' && t.pos+1 < len(t.s) && unicode.IsDigit(t.s[t.pos+1]):
+		start := t.pos
+		for !t.eof() && (unicode.IsDigit(t.s[t.pos]) || t.s[t.pos] == '.') {
+			t.pos++
+		}
+		return "<mn>" + string(t.s[start:t.pos]) + "</mn>"
+	case unicode.IsLetter(r):
+		t.pos++
+		return "<mi>" + html.EscapeString(string(r)) + "</mi>"
+	}
+	t.pos++
+	return "<mo>" + html.EscapeString(string(r)) + "</mo>"
+}
+
+func (t *texParser) commandAtom(name string) string {
+	if s, ok := texIdentifiers[name]; ok {
+		return "<mi>" + s + "</mi>"
+	}
+	if s, ok := texOperators[name]; ok {
+		return "<mo>" + html.EscapeString(s) + "</mo>"
+	}
+	if texFunctions[name] {
+		return `<mi mathvariant="normal">` + name + "</mi><mo>⁡</mo>"
+	}
+	if w, ok := texSpaces[name]; ok {
+		return `<mspace width="` + w + `"></mspace>`
+	}
+	if a, ok := texAlphabets[name]; ok {
+		return mrow(texAlphabet(t.group(), a))
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac":
+		num := t.group()
+		return "<mfrac>" + mrow(num) + mrow(t.group()) + "</mfrac>"
+	case "binom":
+		n := t.group()
+		return "<mrow><mo>(</mo><mfrac linethickness=\"0\">" + mrow(n) + mrow(t.group()) + "</mfrac><mo>)</mo></mrow>"
+	case "sqrt":
+		t.skipSpace()
+		if !t.eof() && t.s[t.pos] == '[' {
+			t.pos++
+			start := t.pos
+			for !t.eof() && t.s[t.pos] != ']' {
+				t.pos++
+			}
+			ip := &texParser{s: t.s[start:t.pos], depth: t.depth}
+			index := ip.expr()
+			if ip.tooDeep {
+				t.tooDeep = true
+				t.pos = len(t.s)
+				return ""
+			}
+			t.pos++
+			return "<mroot>" + mrow(t.group()) + mrow(index) + "</mroot>"
+		}
+		return "<msqrt>" + t.group() + "</msqrt>"
+	case "mathrm":
+		return mrow(strings.ReplaceAll(t.group(), "<mi>", `<mi mathvariant="normal">`))
+	case "text", "textrm", "mbox", "operatorname":
+		return "<mtext>" + html.EscapeString(t.rawGroup()) + "</mtext>"
+	case "left":
+		open := t.delimiter()
+		inner := t.expr()
+		close := ""
+		if t.peekCommand("right") {
+			t.pos += len("right") + 1
+			close = t.delimiter()
+		}
+		return "<mrow><mo fence=\"true\">" + html.EscapeString(open) + "</mo>" + inner + "<mo fence=\"true\">" + html.EscapeString(close) + "</mo></mrow>"
+	case "overline", "bar":
+		return "<mover>" + mrow(t.group()) + "<mo>¯</mo></mover>"
+	case "hat":
+		return "<mover>" + mrow(t.group()) + "<mo>^</mo></mover>"
+	case "vec":
+		return "<mover>" + mrow(t.group()) + "<mo>→</mo></mover>"
+	case "dot":
+		return "<mover>" + mrow(t.group()) + "<mo>˙</mo></mover>"
+	case "tilde":
+		return "<mover>" + mrow(t.group()) + "<mo>~</mo></mover>"
+	}
+	return "<merror><mtext>\\" + html.EscapeString(name) + "</mtext></merror>"
+}
+
+// texMathML converts TeX to a MathML element, a block of its own if display is set.
+func texMathML(tex string, display bool) string {
+	if len(tex) > texMaxLen {
+		return texPlain(tex, display)
+	}
+	t := &texParser{s: []rune(tex)}
+	var b strings.Builder
+	for !t.eof() {
+		b.WriteString(t.expr())
+		if t.peekCommand("right") {
+			t.pos += len(`\right`)
+		} else if !t.eof() {
+			// a stray closing brace
+			t.pos++
+		}
+	}
+	if t.tooDeep {
+		return texPlain(tex, display)
+	}
+	mode := ""
+	if display {
+		mode = ` display="block"`
+	}
+	return "<math" + mode + "><semantics><mrow>" + b.String() + `</mrow><annotation encoding="application/x-tex">` +
+		html.EscapeString(tex) + "</annotation></semantics></math>"
+}
+
+// texPlain is the TeX as it was written, for formulas too large to convert.
+func texPlain(tex string, display bool) string {
+	if display {
+		return "<pre><code>" + html.EscapeString(tex) + "</code></pre>"
+	}
+	return "<code>" + html.EscapeString(tex) + "</code>"
+}
@@ -0,0 +1,274 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A three-way merge by lines, for the edit page when someone else changed the paste since it
+// was opened. Changes to different lines are both kept, changes to the same lines are put
+// between conflict markers, as git does.
+
+// maxDiffCells limits the table of diffLines, larger texts are taken as changed all over.
+const maxDiffCells = 4 << 20
+
+const (
+	markYours  = "<<<<<<< yours\n"
+	markSplit  = "=======\n"
+	markTheirs = ">>>>>>> theirs\n"
+)
+
+// hunk replaces the lines from to to of the base with lines.
+type hunk struct {
+	from, to int
+	lines    []string
+}
+
+// splitLines splits s after each newline, the last line may have none.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines is the hunks turning a into b, along their longest common subsequence.
+func diffLines(a, b []string) []hunk {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if len(ma) == 0 && len(mb) == 0 {
+		return nil
+	}
+	if len(ma)*len(mb) > maxDiffCells || len(ma) == 0 || len(mb) == 0 {
+		return []hunk{{pre, pre + len(ma), mb}}
+	}
+
+	// lcs[i][j] is the length of the common subsequence of ma[i:] and mb[j:]
+	w := len(mb) + 1
+	lcs := make([]int32, (len(ma)+1)*w)
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			} else if lcs[(i+1)*w+j] >= lcs[i*w+j+1] {
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			} else {
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+	var hunks []hunk
+	var cur *hunk
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		if i < len(ma) && j < len(mb) && ma[i] == mb[j] {
+			cur = nil
+			i, j = i+1, j+1
+			continue
+		}
+		if cur == nil {
+			hunks = append(hunks, hunk{from: pre + i, to: pre + i})
+			cur = &hunks[len(hunks)-1]
+		}
+		if j < len(mb) && (i == len(ma) || lcs[i*w+j+1] >= lcs[(i+1)*w+j]) {
+			cur.lines = append(cur.lines, mb[j])
+			j++
+		} else {
+			i++
+			cur.to = pre + i
+		}
+	}
+	return hunks
+}
+
+// overlap is whether a and b change the same lines, or insert at the same place.
+func overlap(a, b hunk) bool {
+	switch {
+	case a.from == b.from:
+		return true
+	case a.from == a.to:
+		return b.from < a.from && a.from < b.to
+	case b.from == b.to:
+		return a.from < b.from && b.from < a.to
+	}
+	return a.from < b.to && b.from < a.to
+}
+
+// apply is base[from:to] with the hunks, which are within it.
+func apply(base []string, from, to int, hunks []hunk) []string {
+	var out []string
+	at := from
+	for _, h := range hunks {
+		out = append(out, base[at:h.from]...)
+		out = append(out, h.lines...)
+		at = h.to
+	}
+	return append(out, base[at:to]...)
+}
+
+func withNewline(lines []string) string {
+	s := strings.Join(lines, "")
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
+// merge3 merges the changes of yours and theirs to base. clean is false when both changed
+// the same lines, which are then between conflict markers.
+func merge3(base, yours, theirs string) (merged string, clean bool) {
+	switch {
+	case yours == theirs || theirs == base:
+		return yours, true
+	case yours == base:
+		return theirs, true
+	}
+	b := splitLines(base)
+	hy, ht := diffLines(b, splitLines(yours)), diffLines(b, splitLines(theirs))
+
+	var out strings.Builder
+	clean = true
+	at := 0
+	for len(hy) > 0 || len(ht) > 0 {
+		// the next hunk and all the hunks of either side overlapping it, transitively
+		var ys, ts []hunk
+		if len(ht) == 0 || len(hy) > 0 && hy[0].from <= ht[0].from {
+			ys, hy = hy[:1], hy[1:]
+		} else {
+			ts, ht = ht[:1], ht[1:]
+		}
+		from, to := 0, 0
+		for {
+			all := append(append([]hunk(nil), ys...), ts...)
+			from, to = all[0].from, all[0].to
+			for _, h := range all {
+				if h.from < from {
+					from = h.from
+				}
+				if h.to > to {
+					to = h.to
+				}
+			}
+			region := hunk{from: from, to: to}
+			if len(hy) > 0 && (overlap(region, hy[0]) || hy[0].from < to) {
+				ys, hy = append(ys, hy[0]), hy[1:]
+			} else if len(ht) > 0 && (overlap(region, ht[0]) || ht[0].from < to) {
+				ts, ht = append(ts, ht[0]), ht[1:]
+			} else {
+				break
+			}
+		}
+		out.WriteString(strings.Join(b[at:from], ""))
+		mine, their := apply(b, from, to, ys), apply(b, from, to, ts)
+		switch {
+		case len(ts) == 0:
+			out.WriteString(strings.Join(mine, ""))
+		case len(ys) == 0:
+			out.WriteString(strings.Join(their, ""))
+		case strings.Join(mine, "") == strings.Join(their, ""):
+			out.WriteString(strings.Join(mine, ""))
+		default:
+			clean = false
+			if s := out.String(); s != "" && !strings.HasSuffix(s, "\n") {
+				out.WriteString("\n")
+			}
+			out.WriteString(markYours + withNewline(mine) + markSplit + withNewline(their) + markTheirs)
+		}
+		at = to
+	}
+	out.WriteString(strings.Join(b[at:], ""))
+	return out.String(), clean
+}
+
+// revision identifies what the edit page was opened on.
+func revision(e *entry) string {
+	return strings.Trim(etag([]byte(e.Title+"\x00"+e.Text)), `"`)
+}
+
+type editPage struct {
+	Index     int
+	ID        string // the form goes by, as the index may change meanwhile
+	Title     string
+	Text      string
+	Rev       string // of the paste the page was made from
+	Base      string // its text and title, for merging
+	BaseTitle string
+
+	Conflict bool
+	Clean    bool
+	Theirs   string
+}
+
+// editPaste serves /edit/<id>, the edit page of a text paste. The page has the revision and
+// the text it started from, so a save after someone else's is merged with it rather than
+// overwriting it, and shown again to check.
+func (p *pastry) editPaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i, e, ok := p.lookup(r, "/edit/")
+	if !ok || e.File != "" {
+		http.NotFound(w, r)
+		return
+	}
+	page := editPage{Index: i, ID: e.ID, Title: e.Title, Text: e.Text, Rev: revision(e), Base: e.Text, BaseTitle: e.Title}
+	status := http.StatusOK
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		// browsers send the newlines of forms as CRLF
+		text := strings.ReplaceAll(r.FormValue("text"), "\r\n", "\n")
+		title := strings.TrimSpace(r.FormValue("title"))
+		if len(text) > p.limit().MaxPaste {
+			http.Error(w, fmt.Sprintf("The text is longer than max-paste, %d bytes", p.limit().MaxPaste), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.FormValue("rev") == page.Rev {
+			p.toTrash(w, e, false, "Edited "+label(i, e))
+			e.Text, e.Title, e.Original = text, title, ""
+			p.normalize(e)
+			e.Category = categorize(e)
+			e.Modified = time.Now()
+			if err := p.store(); err != nil {
+				http.Error(w, "Not stored: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf("/p/%d", i), http.StatusSeeOther)
+			return
+		}
+		base := strings.ReplaceAll(r.FormValue("base"), "\r\n", "\n")
+		page.Text, page.Clean = merge3(base, text, e.Text)
+		if title != r.FormValue("basetitle") {
+			page.Title = title
+		}
+		page.Conflict, page.Theirs = true, e.Text
+		status = http.StatusConflict
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "edit.html", page)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import "testing"
+
+func TestMerge3(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\n"
+	for _, tc := range []struct {
+		yours, theirs string
+		want          string
+		clean         bool
+	}{
+		{base, base, base, true},
+		{"one\n2\nthree\nfour\n", base, "one\n2\nthree\nfour\n", true},
+		{base, "one\ntwo\nthree\n4\n", "one\ntwo\nthree\n4\n", true},
+		// different lines
+		{"1\ntwo\nthree\nfour\n", "one\ntwo\nthree\n4\n", "1\ntwo\nthree\n4\n", true},
+		{"one\ntwo\nand a half\nthree\nfour\n", "zero\none\ntwo\nthree\nfour\n", "zero\none\ntwo\nand a half\nthree\nfour\n", true},
+		{"one\nthree\nfour\n", "one\ntwo\nthree\nfour\nfive\n", "one\nthree\nfour\nfive\n", true},
+		// the same change on both sides
+		{"one\n2\nthree\nfour\n", "one\n2\nthree\nfour\n", "one\n2\nthree\nfour\n", true},
+		// the same lines
+		{"one\n2\nthree\nfour\n", "one\nTWO\nthree\nfour\n", "one\n" + markYours + "2\n" + markSplit + "TWO\n" + markTheirs + "three\nfour\n", false},
+		{"one\ntwo\nthree\nfour\nfive", "one\ntwo\nthree\nfour\nsix", "one\ntwo\nthree\nfour\n" + markYours + "five\n" + markSplit + "six\n" + markTheirs, false},
+		{"", "one\ntwo\nthree\n", markYours + markSplit + "one\ntwo\nthree\n" + markTheirs, false},
+	} {
+		got, clean := merge3(base, tc.yours, tc.theirs)
+		if got != tc.want || clean != tc.clean {
+			t.Errorf("merge3(%q, %q) = %q, %v, want %q, %v", tc.yours, tc.theirs, got, clean, tc.want, tc.clean)
+		}
+	}
+}
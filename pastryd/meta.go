@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseMeta splits "title=Shopping list lang=md tags=a,b" into key/value pairs.
+// Values run until the next key=, so titles can contain spaces.
+func parseMeta(args []string) ([]string, map[string]string) {
+	var keys []string
+	kv := make(map[string]string)
+	key := ""
+
+	for _, a := range args {
+		if k, v, ok := strings.Cut(a, "="); ok && isMetaKey(k) {
+			key = k
+			if _, seen := kv[k]; !seen {
+				keys = append(keys, k)
+			}
+			kv[k] = v
+		} else if key != "" {
+			kv[key] += " " + a
+		}
+	}
+	return keys, kv
+}
+
+func isMetaKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, r := range k {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// applyMeta must be called with the mutex held.
+func (p *pastry) applyMeta(e *entry, keys []string, kv map[string]string) error {
+	for _, k := range keys {
+		v := strings.TrimSpace(kv[k])
+		switch k {
+		case "title":
+			e.Title = v
+		case "name":
+			if err := p.setName(e, v); err != nil {
+				return err
+			}
+		case "board":
+			e.Board = v
+		case "lang":
+			e.Lang = v
+			e.Category = categorize(e)
+		case "category":
+			if v == "" {
+				v = categorize(e)
+			} else if !isCategory(v) {
+				return fmt.Errorf("Unknown category: %s, use one of %s", v, strings.Join(categories, ", "))
+			}
+			e.Category = v
+		case "tags":
+			announced := hasTag(e, announceTag)
+			e.Tags = splitTags(v)
+			if !announced && hasTag(e, announceTag) {
+				p.announce(e)
+			}
+		case "strict":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("Invalid strict value: %s", v)
+			}
+			e.Strict = b
+			if e.Strict && e.Original != "" {
+				e.Text, e.Original = e.Original, ""
+			}
+		default:
+			return fmt.Errorf("Unknown meta key: %s", k)
+		}
+	}
+	return nil
+}
+
+func metaString(e *entry) string {
+	return fmt.Sprintf("title=%s\nname=%s\nboard=%s\nlang=%s\ncategory=%s\ntags=%s\nstrict=%t\n", e.Title, e.Name, e.Board, e.Lang, e.Category, strings.Join(e.Tags, ","), e.Strict)
+}
+
+// named returns the index of the newest paste called name, or -1. Must be called with the mutex held.
+func (p *pastry) named(name string) int {
+	for i := len(p.texts) - 1; i >= 0; i-- {
+		if p.texts[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// revisions returns the indexes of all pastes called name, oldest first. When a newer
+// paste takes over a name the older ones are kept as its history. A paste not published
+// by now isn't one of them yet. Must be called with the mutex held.
+func (p *pastry) revisions(name string, now time.Time) []int {
+	var idx []int
+	for i, e := range p.texts {
+		if e.Name == name && e.visible(now) {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// revision resolves "name" or "name~N", the latter being N revisions back.
+// Must be called with the mutex held.
+func (p *pastry) revision(s string, now time.Time) (int, error) {
+	name, back, _ := strings.Cut(s, "~")
+	revs := p.revisions(name, now)
+	n := 0
+	if back != "" {
+		var err error
+		if n, err = strconv.Atoi(back); err != nil || n < 0 {
+			return 0, fmt.Errorf("Invalid revision: %s", s)
+		}
+	}
+	if n >= len(revs) {
+		return 0, fmt.Errorf("No paste named %s", s)
+	}
+	return revs[len(revs)-1-n], nil
+}
+
+func validName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func cleanName(name string) (string, error) {
+	name = strings.ToLower(name)
+	if name != "" && !validName(name) {
+		return "", fmt.Errorf("Names may only contain a-z, 0-9, '-', '_' and '.'")
+	}
+	return name, nil
+}
+
+// setName names e, or removes its name with "". A name can be taken over by a newer
+// paste, but not by an older one. Must be called with the mutex held.
+func (p *pastry) setName(e *entry, name string) error {
+	name, err := cleanName(name)
+	if err != nil || name == "" || name == e.Name {
+		e.Name = name
+		return err
+	}
+	for i := len(p.texts) - 1; i >= 0 && p.texts[i] != e; i-- {
+		if p.texts[i].Name == name {
+			return fmt.Errorf("%s is already the name of the newer #%d", name, i)
+		}
+	}
+	e.Name = name
+	return nil
+}
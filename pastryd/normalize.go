@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import "strings"
+
+// trimBlank drops leading and trailing blank lines and collapses runs of more than
+// maxBlank blank lines. A blank line is empty or only whitespace.
+func trimBlank(text string, maxBlank int) string {
+	lines := strings.Split(text, "\n")
+	blank := func(l string) bool { return strings.TrimSpace(l) == "" }
+
+	start, end := 0, len(lines)
+	for start < end && blank(lines[start]) {
+		start++
+	}
+	for end > start && blank(lines[end-1]) {
+		end--
+	}
+
+	out := make([]string, 0, end-start)
+	run := 0
+	for _, l := range lines[start:end] {
+		if blank(l) {
+			if run++; run > maxBlank {
+				continue
+			}
+		} else {
+			run = 0
+		}
+		out = append(out, l)
+	}
+
+	s := strings.Join(out, "\n")
+	if s != "" && strings.HasSuffix(text, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
+// normalize applies the configured ingest normalization, keeping the original
+// so it can be brought back if the paste is flagged strict later.
+func (p *pastry) normalize(e *entry) {
+	if !p.cfg.TrimBlank || e.Strict {
+		return
+	}
+	if t := trimBlank(e.Text, p.cfg.MaxBlank); t != e.Text && t != "" {
+		e.Original = e.Text
+		e.Text = t
+	}
+}
@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type notification struct {
+	Title string     `json:"title"`
+	Text  string     `json:"text"`
+	When  time.Time  `json:"when"`
+	Paste *pasteMeta `json:"paste,omitempty"` // that it is about
+}
+
+type notifier func(n notification) error
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func post(url, contentType string, body []byte, header map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier posts the notification as JSON.
+func webhookNotifier(url string) notifier {
+	return func(n notification) error {
+		b, _ := json.Marshal(n)
+		return post(url, "application/json", b, nil)
+	}
+}
+
+// ntfyNotifier publishes to an ntfy topic, e.g. https://ntfy.sh/my-pastry.
+func ntfyNotifier(url string) notifier {
+	return func(n notification) error {
+		return post(url, "text/plain; charset=utf-8", []byte(n.Text), map[string]string{"Title": n.Title})
+	}
+}
+
+// chatNotifier posts {"text": ...}, which Slack, Mattermost and Rocket.Chat incoming webhooks understand.
+func chatNotifier(url string) notifier {
+	return func(n notification) error {
+		b, _ := json.Marshal(map[string]string{"text": "*" + n.Title + "*\n" + n.Text})
+		return post(url, "application/json", b, nil)
+	}
+}
+
+func newNotifiers(cfg Config) []notifier {
+	var n []notifier
+	if cfg.WebhookURL != "" {
+		n = append(n, webhookNotifier(cfg.WebhookURL))
+	}
+	if cfg.NtfyURL != "" {
+		n = append(n, ntfyNotifier(cfg.NtfyURL))
+	}
+	if cfg.ChatURL != "" {
+		n = append(n, chatNotifier(cfg.ChatURL))
+	}
+	return n
+}
+
+// notify sends in the background, so it is fine to call with the mutex held.
+func (p *pastry) notify(n notification) {
+	for _, send := range p.notifiers {
+		send := send
+		p.spawn(func() {
+			if err := send(n); err != nil {
+				log.Printf("Notification failed: %v", err)
+			}
+		})
+	}
+}
+
+func entryNotification(title string, e *entry) notification {
+	if e.Title != "" {
+		title += ": " + e.Title
+	}
+	meta := newPasteMeta(e)
+	return notification{Title: title, Text: e.Text, When: e.When, Paste: &meta}
+}
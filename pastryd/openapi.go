@@ -0,0 +1,217 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OpenAPI 3 document of the JSON API, at /api/v1/openapi.json. The schemas are made from
+// the types of api.go, so they can't drift from what the API takes and gives.
+
+const openAPIPath = "/api/v1/openapi.json"
+
+type object = map[string]interface{}
+
+// schemaOf is the JSON schema of values of t as encoding/json writes them.
+func schemaOf(t reflect.Type) object {
+	if t == reflect.TypeOf(time.Time{}) {
+		return object{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaOf(t.Elem())
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Slice:
+		return object{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := object{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				// its fields are those of t, as encoding/json has them
+				embedded := schemaOf(f.Type)
+				for k, v := range embedded["properties"].(object) {
+					props[k] = v
+				}
+				if r, ok := embedded["required"].([]string); ok {
+					required = append(required, r...)
+				}
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" || !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaOf(f.Type)
+			if opts != "omitempty" && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+		s := object{"type": "object", "properties": props}
+		if required != nil {
+			s["required"] = required
+		}
+		return s
+	}
+	return object{}
+}
+
+func schemaRef(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema object) object {
+	return object{"application/json": object{"schema": schema}}
+}
+
+func response(desc string, schema object) object {
+	r := object{"description": desc}
+	if schema != nil {
+		r["content"] = jsonContent(schema)
+	}
+	return r
+}
+
+// serveOpenAPI serves the document, which is made once.
+func serveOpenAPI() http.HandlerFunc {
+	doc := openAPI()
+	tag := etag(doc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		serveConditional(w, r, time.Time{}, tag, doc)
+	}
+}
+
+// openAPI is the document.
+func openAPI() []byte {
+	paste := schemaOf(reflect.TypeOf(apiPaste{}))
+	paste["description"] = "A paste, addressed by its index, @name or id. The id stays the same as pastes come and go."
+	newPaste := schemaOf(reflect.TypeOf(apiNewPaste{}))
+	newPaste["required"] = []string{"text"}
+	newPaste["description"] = "A new paste, the times are RFC 3339 or ages like 1h and 2d."
+	edit := schemaOf(reflect.TypeOf(apiEdit{}))
+	edit["description"] = "PUT replaces the text and all the rest, PATCH changes only what it gives and \"\" clears a time. " +
+		"A revision fails it with 409 unless the paste is still at that revision."
+	op := schemaOf(reflect.TypeOf(batchOp{}))
+	op["description"] = "create with a paste, or delete or tag (add and remove) the paste of an id, at the revision if given."
+	op["properties"].(object)["op"] = object{"type": "string", "enum": []string{"create", "delete", "tag"}}
+	op["properties"].(object)["paste"] = schemaRef("NewPaste")
+	result := schemaOf(reflect.TypeOf(batchResult{}))
+	result["description"] = "The status the operation would have had on its own, with the paste created or tagged or the error."
+	result["properties"].(object)["paste"] = schemaRef("Paste")
+	apiErr := object{"type": "object", "properties": object{"error": object{"type": "string"}}, "required": []string{"error"}}
+
+	failed := func(codes ...int) object {
+		r := object{}
+		for _, c := range codes {
+			r[strconv.Itoa(c)] = response(http.StatusText(c), schemaRef("Error"))
+		}
+		return r
+	}
+	with := func(r object, code int, resp object) object {
+		r[strconv.Itoa(code)] = resp
+		return r
+	}
+	id := object{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"},
+		"description": "Index, negative from the end, @name or id"}
+	query := func(name, typ, desc string) object {
+		return object{"name": name, "in": "query", "schema": object{"type": typ}, "description": desc}
+	}
+	ifMatch := object{"name": "If-Match", "in": "header", "schema": object{"type": "string"},
+		"description": "The revision the change is for, it fails with 409 if the paste is at another"}
+	editOp := func(summary string) object {
+		return object{
+			"summary":     summary,
+			"parameters":  []object{ifMatch},
+			"requestBody": object{"required": true, "content": jsonContent(schemaRef("Edit"))},
+			"responses":   with(failed(400, 404, 409, 413, 500), 200, response("The edited paste", schemaRef("Paste"))),
+		}
+	}
+
+	doc := object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "pastry",
+			"description": "The JSON API of pastry, the snippets of the LAN. Device keys go in an Authorization: Bearer header.",
+			"version":     "1",
+		},
+		"servers": []object{{"url": "/"}},
+		"paths": object{
+			apiPrefix: object{
+				"get": object{
+					"summary": "The visible pastes, oldest first",
+					"parameters": []object{
+						query("limit", "integer", "At most this many, the newest"),
+						query("offset", "integer", "Leaving out this many of the newest"),
+						query("since", "string", "Pasted or edited after this, RFC 3339 or an age like 1h"),
+						query("q", "string", "Having this in the text or title, in any case"),
+					},
+					"responses": with(failed(400), 200, response("The pastes, X-Total-Count says how many before limit and offset",
+						object{"type": "array", "items": schemaRef("Paste")})),
+				},
+				"post": object{
+					"summary":     "Add a paste",
+					"requestBody": object{"required": true, "content": jsonContent(schemaRef("NewPaste"))},
+					"responses":   with(failed(400, 413, 500, 507), 201, response("The new paste", schemaRef("Paste"))),
+				},
+			},
+			apiPrefix + "/{id}": object{
+				"parameters": []object{id},
+				"get": object{
+					"summary":   "One paste",
+					"responses": with(failed(404), 200, response("The paste", schemaRef("Paste"))),
+				},
+				"put":   editOp("Replace a paste, keeping its time and id"),
+				"patch": editOp("Change some of a paste"),
+				"delete": object{
+					"summary":    "Drop a paste",
+					"parameters": []object{ifMatch, query("revision", "string", "As If-Match")},
+					"responses":  with(failed(404, 409, 500), 204, response("Dropped", nil)),
+				},
+			},
+			batchPath: object{
+				"post": object{
+					"summary": "Create, delete and tag many pastes, one operation after the other",
+					"requestBody": object{"required": true, "content": jsonContent(object{
+						"type": "array", "items": schemaRef("BatchOp"), "maxItems": maxBatch})},
+					"responses": with(failed(400, 413, 500), 200, response("The result of each operation, in order",
+						object{"type": "array", "items": schemaRef("BatchResult")})),
+				},
+			},
+		},
+		"components": object{"schemas": object{
+			"Paste":       paste,
+			"NewPaste":    newPaste,
+			"Edit":        edit,
+			"BatchOp":     op,
+			"BatchResult": result,
+			"Error":       apiErr,
+		}},
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import "sort"
+
+// Pastes are kept, indexed and synced in the order they arrived, by their Seq, which counts
+// up with each paste whatever the clock says. When is only shown, so a paste made while the
+// clock was wrong is still listed right after the one before it. Pastes stored before there
+// was a Seq are numbered by When as they are loaded. Imports are placed by When among the
+// pastes there are, which is all an archive knows of them, and renumbered with them.
+
+// before is true when a arrived before b. Pastes without a Seq come first, by When, as do
+// pastes of the same Seq, from two pastry sharing a store.
+func before(a, b *entry) bool {
+	switch {
+	case a.Seq == b.Seq:
+		return a.When.Before(b.When)
+	case a.Seq == 0 || b.Seq == 0:
+		return a.Seq == 0
+	}
+	return a.Seq < b.Seq
+}
+
+// sortPastes sorts texts in the order they arrived.
+func sortPastes(texts []*entry) {
+	sort.SliceStable(texts, func(i, j int) bool { return before(texts[i], texts[j]) })
+}
+
+// nextSeq is the Seq of a new paste. Must be called with the mutex held.
+func (p *pastry) nextSeq() uint64 {
+	p.seq++
+	return p.seq
+}
+
+// numberPastes gives the pastes without a Seq one, renumbering them all in their order, and
+// catches up with the Seq of pastes another pastry stored. Must be called with the mutex held.
+func (p *pastry) numberPastes() {
+	for _, e := range p.texts {
+		if e.Seq == 0 {
+			p.seq = 0
+			for _, e := range p.texts {
+				e.Seq = p.nextSeq()
+			}
+			return
+		}
+		if e.Seq > p.seq {
+			p.seq = e.Seq
+		}
+	}
+}
+
+// mergeByWhen places the unnumbered pastes of add among texts by When, keeping the order of
+// texts, and numbers them all again.
+func (p *pastry) mergeByWhen(add []*entry) {
+	sort.SliceStable(add, func(i, j int) bool { return add[i].When.Before(add[j].When) })
+	merged := make([]*entry, 0, len(p.texts)+len(add))
+	i := 0
+	for _, e := range p.texts {
+		for ; i < len(add) && add[i].When.Before(e.When); i++ {
+			merged = append(merged, add[i])
+		}
+		merged = append(merged, e)
+	}
+	p.texts = append(merged, add[i:]...)
+	for _, e := range add {
+		e.Seq = 0
+	}
+	p.numberPastes()
+}
@@ -0,0 +1,949 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+// Package pastryd is the pastry server, a pastebin for your home network. The pastry
+// command runs it, other programs can run it too with New and Start.
+package pastryd
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
+)
+
+//go:embed css/pico-master.zip
+var picocssZipFile []byte
+
+//go:embed tmpl/*.html
+var templates embed.FS
+
+//go:embed static
+var staticFiles embed.FS
+
+type entry struct {
+	ID       string // the key the paste is stored under, see storage.go
+	Text     string
+	When     time.Time
+	Seq      uint64    // the order it arrived in, see order.go
+	Modified time.Time // of the last edit through the API, see apiEdit
+	Title    string
+	Name     string
+	Board    string
+	Lang     string
+	Tags     []string
+	Expires  time.Time
+	Publish  time.Time
+	Remind   time.Time
+	SeenBy   map[string]time.Time
+	Origin   string // device the paste came from, if known
+
+	// Category is code, log, url, prose, secret or data, see category.go.
+	Category string
+
+	// File pastes, see files.go.
+	File string
+	Mime string
+	Size int64
+	Hash string // hex SHA-256 of the file
+
+	// Strict pastes are shown exactly as pasted, without wrapping.
+	Strict        bool
+	NotifyPublish bool
+
+	// Original is the text before ingest normalization, if it changed anything.
+	Original string
+
+	data    []byte    // the file of a paste read from an archive, until importEntries saves it
+	deleted time.Time // of a tombstone read from an archive
+
+	shingles   []uint64 // of shingledOf, see similar.go
+	shingledOf string
+}
+
+type pastry struct {
+	mutex     sync.Mutex
+	texts     []*entry
+	seq       uint64 // of the latest paste
+	cfg       Config
+	views     []*view
+	notifiers []notifier
+	clipSubs  map[*clipSub]bool
+	viewers   map[*viewer]bool // of the web GUI, see presence.go
+	tmpl      *template.Template
+	modified  time.Time
+	dirty     bool
+	backend   backend
+	seal      *sealer
+	viewsFile string
+	tombsFile string
+	tombs     map[string]time.Time // by id, of the pastes gone, see tombstone.go
+	tombDirty bool
+	filesDir  string
+	files     map[string][]byte    // the uploaded files with --no-persist, by name
+	unlinked  []string             // the files of discarded pastes, for reclaim
+	saved     map[string]time.Time // the files just saved, for reclaim
+	diagrams  map[string][]byte
+	trash     []*trashed // of the web GUI, see trash.go
+	limits    atomic.Pointer[limits]
+	diskFull  atomic.Bool  // under --min-free, see disk.go
+	diskFree  atomic.Int64 // bytes, -1 when unknown
+	wg        sync.WaitGroup
+	// of the web GUI as it listens, for the permalinks the write port answers with
+	webScheme, webPort string
+}
+
+// addEntry adds a new paste, the error is from storing it.
+func (p *pastry) addEntry(e *entry) error {
+	if p.full() {
+		return errStorageFull
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e.ID = newID()
+	e.When = p.pastedAt()
+	e.Seq = p.nextSeq()
+	p.normalize(e)
+	e.Category = categorize(e)
+	p.boardDefaults(e)
+	// reclaim counts it from here on
+	delete(p.saved, e.File)
+	if e.Board == clipboardBoard {
+		p.publishClip(e)
+	} else {
+		p.announce(e)
+	}
+	p.showViewers(e)
+	if bp := p.policy(e.Board); bp != nil && bp.Lazy {
+		p.addLazy(e, bp)
+		return nil
+	}
+	p.texts = append(p.texts, e)
+	return p.store()
+}
+
+// pastedAt is now in UTC, without the monotonic reading, which isn't stored anyway. When the
+// clock has gone back to before the latest paste, as when NTP corrects a Raspberry Pi that
+// booted without an RTC, it is just after that paste instead, so the times go on in the order
+// of the pastes, see order.go. Must be called with the mutex held.
+func (p *pastry) pastedAt() time.Time {
+	now := time.Now().UTC().Round(0)
+	if n := len(p.texts); n > 0 && !now.After(p.texts[n-1].When) {
+		return p.texts[n-1].When.UTC().Add(time.Nanosecond)
+	}
+	return now
+}
+
+// lastModified is when e was pasted, or edited since.
+func (e *entry) lastModified() time.Time {
+	if e.Modified.After(e.When) {
+		return e.Modified
+	}
+	return e.When
+}
+
+// clearToken is what clear wants to hear before dropping every paste.
+const clearToken = "yes-really"
+
+// drop removes the paste at index i. Must be called with the mutex held.
+func (p *pastry) drop(i int) error {
+	p.discard(p.texts[i])
+	p.texts = append(p.texts[:i], p.texts[i+1:]...)
+	return p.store()
+}
+
+// dropToTrash removes the paste at index i with an undo, keeping its file until the undo is
+// too late. Must be called with the mutex held.
+func (p *pastry) dropToTrash(w http.ResponseWriter, i int) error {
+	p.toTrash(w, p.texts[i], true, "Deleted "+label(i, p.texts[i]))
+	p.texts = append(p.texts[:i], p.texts[i+1:]...)
+	return p.store()
+}
+
+// index resolves a positive or negative (from the end) index, or @name[~revision].
+// Must be called with the mutex held.
+func (p *pastry) index(s string) (int, error) {
+	if strings.HasPrefix(s, "@") {
+		return p.revision(s[1:], time.Now())
+	}
+	if v, err := strconv.Atoi(s); err == nil {
+		if v >= 0 && v < len(p.texts) {
+			return v, nil
+		} else if v < 0 && (len(p.texts)+v) >= 0 {
+			return len(p.texts) + v, nil
+		}
+	}
+	return 0, fmt.Errorf("Out of bounds")
+}
+
+// store must be called with the mutex held. Errors are logged as well, most callers have
+// no one to tell.
+func (p *pastry) store() error {
+	p.modified = time.Now()
+	p.dirty = false
+	err := p.backend.save(p.texts)
+	if err != nil {
+		log.Printf("Failed to store pastes: %v", err)
+	} else {
+		p.reclaim()
+		p.storeTombs()
+	}
+	return err
+}
+
+// removeExpired drops entries past their expiry time.
+func (p *pastry) removeExpired(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	texts := p.texts[:0]
+	for _, e := range p.texts {
+		if e.Expires.IsZero() || now.Before(e.Expires) {
+			texts = append(texts, e)
+		} else {
+			p.discard(e)
+		}
+	}
+	if len(texts) != len(p.texts) {
+		for i := len(texts); i < len(p.texts); i++ {
+			p.texts[i] = nil
+		}
+		p.texts = texts
+		p.store()
+	}
+}
+
+func (p *pastry) maintain(ctx context.Context) {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	var gc <-chan time.Time
+	if p.cfg.GCInterval > 0 {
+		gct := time.NewTicker(p.cfg.GCInterval)
+		defer gct.Stop()
+		gc = gct.C
+	}
+	for {
+		select {
+		case now := <-gc:
+			p.gcNow(now)
+		case now := <-t.C:
+			p.removeExpired(now)
+			p.enforceBoards(now)
+			p.publishDue(now)
+			p.remindDue(now)
+			p.emptyTrash(now)
+			p.checkDisk()
+			p.flush()
+			p.syncStore()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func expiresString(e *entry) string {
+	if e.Expires.IsZero() {
+		return ""
+	}
+	return "expires " + humanize.Time(e.Expires)
+}
+
+const (
+	importPreamble = "import\n"
+	clipPreamble   = "clip\n"
+)
+
+// readIdle reads until EOF, max bytes, or until nothing has arrived for idle. Plain netcat
+// never closes its end of the connection, so EOF can't be relied on.
+func readIdle(c net.Conn, data []byte, max int, idle time.Duration) ([]byte, error) {
+	chunk := make([]byte, 64*1024)
+	for len(data) < max {
+		c.SetReadDeadline(time.Now().Add(idle))
+		n, err := c.Read(chunk)
+		data = append(data, chunk[:n]...)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() || err == io.EOF {
+			return data, nil
+		} else if err != nil {
+			return data, err
+		}
+	}
+	return data, fmt.Errorf("More than %d bytes", max)
+}
+
+var errNotText = errors.New("Not UTF-8 text")
+
+// spool copies head and then what c sends to w until EOF, or a pause of idle, and returns
+// how much it wrote. Over max bytes it cuts the text, at a character, and says so. It fails
+// on what isn't UTF-8 text, the start of a character split between reads waits for the rest.
+func spool(w io.Writer, c net.Conn, head []byte, max int, idle time.Duration) (n int, cut bool, err error) {
+	chunk := make([]byte, 64*1024)
+	var rest []byte
+	for data := head; ; {
+		b := append(rest, data...)
+		end := len(b)
+		for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+			if utf8.RuneStart(b[len(b)-i]) {
+				if !utf8.FullRune(b[len(b)-i:]) {
+					end = len(b) - i
+				}
+				break
+			}
+		}
+		b, rest = b[:end], append([]byte(nil), b[end:]...)
+		if n+len(b) > max {
+			b, cut = b[:max-n], true
+			for i := 0; i < utf8.UTFMax-1 && len(b) > 0 && !utf8.Valid(b); i++ {
+				b = b[:len(b)-1]
+			}
+		}
+		if !utf8.Valid(b) {
+			return n, cut, errNotText
+		}
+		if _, err := w.Write(b); err != nil {
+			return n, cut, err
+		}
+		if n += len(b); cut {
+			return n, cut, nil
+		}
+		c.SetReadDeadline(time.Now().Add(idle))
+		m, err := c.Read(chunk)
+		data = chunk[:m]
+		if ne, ok := err.(net.Error); ok && ne.Timeout() || err == io.EOF {
+			if len(rest) > 0 {
+				return n, cut, errNotText
+			}
+			return n, cut, nil
+		} else if err != nil {
+			return n, cut, err
+		}
+	}
+}
+
+// handleWritePaste takes what is sent until EOF, or a pause of import-idle, as one paste,
+// however many packets it comes in. A paste over max-paste is streamed into a file rather
+// than memory, as a file paste of text, up to max-upload. Beyond the larger of the two it
+// is cut.
+func (p *pastry) handleWritePaste(c net.Conn) {
+	defer c.Close()
+	lim := p.limit()
+	buf := make([]byte, 64*1024)
+
+	n, err := c.Read(buf)
+	if err != nil && err != io.EOF || n == 0 {
+		return
+	}
+	// the first packet tells what is coming, and the key
+	b, rt, err := p.keyPreamble(buf[:n])
+	if err != nil {
+		c.Write([]byte("# " + err.Error() + "\n"))
+		return
+	}
+	if bytes.HasPrefix(b, []byte(importPreamble)) {
+		p.handleImport(c, b[len(importPreamble):])
+		return
+	}
+	e := &entry{}
+	if bytes.HasPrefix(b, []byte(clipPreamble)) {
+		b, e.Board = b[len(clipPreamble):], clipboardBoard
+	}
+	if b, err = readIdle(c, append([]byte(nil), b...), lim.MaxPaste+1, lim.ImportIdle); err != nil && len(b) <= lim.MaxPaste {
+		c.Write([]byte("# Not stored: " + err.Error() + "\n"))
+		return
+	}
+	if len(b) > lim.MaxPaste && lim.MaxUpload > lim.MaxPaste {
+		p.handleLargePaste(c, e, rt, b)
+		return
+	}
+	if len(b) > lim.MaxPaste {
+		b = b[:lim.MaxPaste]
+		// not in the middle of a character
+		for i := 0; i < utf8.UTFMax-1 && len(b) > 0 && !utf8.Valid(b); i++ {
+			b = b[:len(b)-1]
+		}
+		c.Write([]byte(fmt.Sprintf("# Cut to max-paste, %d bytes\n", lim.MaxPaste)))
+	}
+	if !utf8.Valid(b) {
+		c.Write([]byte("# Not stored: " + errNotText.Error() + "\n"))
+		return
+	}
+	e.Text = string(b)
+	if rt != nil {
+		rt.route(e)
+	}
+	if err := p.addEntry(e); err != nil {
+		writeNotStored(c, err)
+		return
+	}
+	p.ack(c, e)
+}
+
+// ack answers a paste with its index, id and permalink, for scripts to know what they pasted:
+//
+//	12 3f9c2a71d0e4b8a5 http://10.0.0.2:9180/p/3f9c2a71d0e4b8a5
+//
+// The permalink is at the address the write port was reached at. It isn't a # line, which
+// clients take as an error.
+func (p *pastry) ack(c net.Conn, e *entry) {
+	id := p.storedID(e)
+	p.mutex.Lock()
+	i, _, ok := p.lookupID(id)
+	p.mutex.Unlock()
+	if !ok {
+		// gone already, like a clipboard paste pushed out by the next
+		return
+	}
+	reply := fmt.Sprintf("%d %s", i, id)
+	if host, _, err := net.SplitHostPort(c.LocalAddr().String()); err == nil && p.webPort != "" {
+		reply += " " + p.webScheme + "://" + net.JoinHostPort(host, p.webPort) + "/p/" + id
+	}
+	c.Write([]byte(reply + "\n"))
+}
+
+// handleLargePaste keeps a paste over max-paste, of which head has arrived, as a file.
+func (p *pastry) handleLargePaste(c net.Conn, e *entry, rt *deviceRoute, head []byte) {
+	lim := p.limit()
+	name, n, hash, cut, err := p.spoolFile(c, head, lim.MaxUpload, lim.ImportIdle)
+	if err != nil {
+		writeNotStored(c, err)
+		return
+	}
+	if cut {
+		c.Write([]byte(fmt.Sprintf("# Cut to max-upload, %d bytes\n", lim.MaxUpload)))
+	}
+	e.File, e.Mime, e.Size, e.Hash = name, spoolMime, int64(n), hash
+	if rt != nil {
+		rt.route(e)
+	}
+	if err := p.addEntry(e); err != nil {
+		writeNotStored(c, err)
+		return
+	}
+	p.ack(c, e)
+}
+
+// handleImport replays an archive sent after the "import" preamble on the write port.
+func (p *pastry) handleImport(c net.Conn, data []byte) {
+	lim := p.limit()
+	data, err := readIdle(c, append([]byte(nil), data...), lim.MaxImport, lim.ImportIdle)
+	if err == nil {
+		var entries []*entry
+		n := 0
+		if entries, err = readArchive(data); err == nil {
+			n, err = p.importEntries(entries)
+		}
+		if err == nil {
+			c.Write([]byte(fmt.Sprintf("# Imported %d pastes\n", n)))
+			return
+		}
+	}
+	c.Write([]byte("# Import failed: " + err.Error() + "\n"))
+}
+
+var noDeadline time.Time
+
+func (p *pastry) handleReadPaste(ctx context.Context, c net.Conn) {
+	defer c.Close()
+
+	buf := make([]byte, 1024*1024)
+	c.SetReadDeadline(time.Now().Add(p.limit().ReadTimeout))
+
+	n, err := c.Read(buf)
+	switch {
+	case err == nil && isClipboardCommand(buf[:n]):
+		p.clipboardSession(ctx, c, buf[:n])
+		return
+	case err == nil && isSessionCommand(buf[:n]):
+		p.session(ctx, c, buf[:n])
+		return
+	case err != nil:
+		n = 0
+	}
+	// the answer is written once the mutex is released, a reader that doesn't keep up only
+	// holds up itself, an export of everything included
+	var out bytes.Buffer
+	send := p.runCommand(&out, buf[:n])
+	c.Write(out.Bytes())
+	if send != nil {
+		io.Copy(c, send)
+		closeSend(send)
+	}
+}
+
+// closeSend closes what runCommand returned once it is sent, when it is a file.
+func closeSend(send io.Reader) {
+	if f, ok := send.(io.Closer); ok {
+		f.Close()
+	}
+}
+
+// runCommand runs the command line b of the read port, writing the answer to c, and an empty
+// one gets the latest paste. c is a buffer rather than the connection, as the mutex is held.
+// What get sends is returned to be copied once the mutex is released, so a slow reader of a
+// large paste holds up nobody.
+func (p *pastry) runCommand(c io.Writer, b []byte) (send io.Reader) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+
+	if len(b) == 0 {
+		if i := p.latest(now); i >= 0 {
+			send = textReader(p.texts[i].Text)
+		}
+		return
+	}
+
+	cmd := parseCommand(b)
+	if cmd.name == "" {
+		return
+	}
+
+	toIdx := func() (int, error) {
+		if len(cmd.args) == 0 {
+			if i := p.latest(now); i >= 0 {
+				return i, nil
+			}
+			return 0, fmt.Errorf("Out of bounds")
+		}
+		return p.index(cmd.args[0])
+	}
+
+	switch cmd.name {
+	case "get":
+		if i, err := toIdx(); err == nil {
+			if p.texts[i].File != "" {
+				if f, err := p.openFile(p.texts[i]); err == nil {
+					send = f
+				}
+			} else {
+				send = textReader(p.texts[i].Text)
+			}
+			if markSeen(p.texts[i], cmd.device, now) {
+				p.store()
+			}
+		}
+	case "head", "tail":
+		i, err := toIdx()
+		n := defaultLines
+		if err == nil && len(cmd.args) > 1 {
+			if n, err = strconv.Atoi(cmd.arg(1)); n < 0 {
+				err = fmt.Errorf("Negative")
+			}
+		}
+		if err != nil || p.texts[i].File != "" && p.texts[i].Mime != spoolMime {
+			c.Write([]byte("# Usage: " + cmd.name + " <id> [lines], of a text paste\n"))
+			return
+		}
+		e := p.texts[i]
+		var r io.ReadSeeker = strings.NewReader(e.Text)
+		if e.File != "" {
+			f, err := p.openFile(e)
+			if err != nil {
+				c.Write([]byte("# " + err.Error() + "\n"))
+				return
+			}
+			defer f.Close()
+			r = f
+		}
+		var b []byte
+		if cmd.name == "head" {
+			b, err = headLines(r, n)
+		} else {
+			b, err = tailLines(r, n)
+		}
+		if err != nil {
+			c.Write([]byte("# " + err.Error() + "\n"))
+			return
+		}
+		c.Write(b)
+		if markSeen(e, cmd.device, now) {
+			p.store()
+		}
+	case "grep":
+		var b bytes.Buffer
+		m, color := cmd.pattern, cmd.color
+		f := p.formatter(cmd, now)
+		for i := range p.texts {
+			if !p.texts[i].visible(now) {
+				continue
+			}
+			for num, l := range strings.Split(p.texts[i].Text, "\n") {
+				if idx := strings.Index(l, m); idx != -1 {
+					b.WriteString(f.Row(color, i, num+1, p.texts[i].When, color.match(l, m)) + "\n")
+				}
+			}
+		}
+		c.Write(b.Bytes())
+	case "list":
+		var b bytes.Buffer
+		var v *view
+		color := colorOption(cmd.args)
+
+		if name, ok := option(cmd.args, "view"); ok {
+			if v = p.findView(name); v == nil {
+				c.Write([]byte("# Unknown view\n"))
+				return
+			}
+		}
+
+		previewLen := p.cfg.PreviewLen
+		if s, ok := option(cmd.args, "preview"); ok {
+			if n, err := strconv.Atoi(s); err == nil {
+				previewLen = n
+			}
+		}
+
+		board, onBoard := option(cmd.args, "board")
+		category, onCategory := option(cmd.args, "category")
+		f := p.formatter(cmd, now)
+		for i := range p.texts {
+			if !p.texts[i].visible(now) || v != nil && !v.match(p.texts[i], now) || onBoard && p.texts[i].Board != board ||
+				onCategory && p.texts[i].Category != category {
+				continue
+			}
+			text := preview(p.texts[i], previewLen)
+			if rem := remindString(p.texts[i]); rem != "" {
+				text = "[" + rem + "] " + text
+			}
+			text = color.expiry(p.texts[i], now) + text
+			b.WriteString(f.Row(color, i, 0, p.texts[i].When, text) + "\n")
+		}
+		c.Write(b.Bytes())
+
+	case "drop":
+		if i, err := toIdx(); err == nil {
+			p.drop(i)
+		}
+	case "clear":
+		// everything at once, so not without being asked twice
+		if len(cmd.args) != 1 || cmd.arg(0) != clearToken {
+			c.Write([]byte("# Usage: clear " + clearToken + ", drops every paste\n"))
+			return
+		}
+		n := len(p.texts)
+		for _, e := range p.texts {
+			p.discard(e)
+		}
+		p.texts = nil
+		if err := p.store(); err != nil {
+			c.Write([]byte("# Not stored: " + err.Error() + "\n"))
+			return
+		}
+		c.Write([]byte(fmt.Sprintf("Cleared %d pastes\n", n)))
+	case "expire":
+		i, err := toIdx()
+		if err != nil || len(cmd.args) < 2 {
+			c.Write([]byte("# Usage: expire <id> <duration>|never\n"))
+			return
+		}
+		if cmd.arg(1) == "never" {
+			p.texts[i].Expires = time.Time{}
+		} else if d, err := parseAge(cmd.arg(1)); err == nil {
+			p.texts[i].Expires = time.Now().Add(d)
+		} else {
+			c.Write([]byte("# " + err.Error() + "\n"))
+			return
+		}
+		p.store()
+	case "publish":
+		i, err := toIdx()
+		if err != nil || len(cmd.args) < 2 {
+			c.Write([]byte("# Usage: publish <id> <when> [notify]\n"))
+			return
+		}
+		t, err := parseWhen(cmd.arg(1), now)
+		if err != nil {
+			c.Write([]byte("# " + err.Error() + "\n"))
+			return
+		}
+		p.texts[i].Publish = t
+		p.texts[i].NotifyPublish = cmd.arg(2) == "notify"
+		p.store()
+	case "remind":
+		i, err := toIdx()
+		if err != nil || len(cmd.args) < 2 {
+			c.Write([]byte("# Usage: remind <id> <when>|never\n"))
+			return
+		}
+		if cmd.arg(1) == "never" {
+			p.texts[i].Remind = time.Time{}
+		} else if t, err := parseWhen(cmd.arg(1), now); err == nil {
+			p.texts[i].Remind = t
+		} else {
+			c.Write([]byte("# " + err.Error() + "\n"))
+			return
+		}
+		p.store()
+	case "meta":
+		i, err := toIdx()
+		if err != nil {
+			c.Write([]byte("# Usage: meta <id> [title=...] [lang=...] [category=...] [tags=a,b]\n"))
+			return
+		}
+		keys, kv := parseMeta(cmd.from(1))
+		if len(keys) == 0 {
+			c.Write([]byte(metaString(p.texts[i])))
+			return
+		}
+		if err := p.applyMeta(p.texts[i], keys, kv); err != nil {
+			c.Write([]byte("# " + err.Error() + "\n"))
+			return
+		}
+		p.store()
+	case "count":
+		i, err := toIdx()
+		if err != nil || p.texts[i].File != "" {
+			c.Write([]byte("# Usage: count <id>, of a text paste\n"))
+			return
+		}
+		c.Write([]byte(countString(countText(p.texts[i].Text))))
+	case "info":
+		i, err := toIdx()
+		if err != nil {
+			c.Write([]byte("# Usage: info <id>\n"))
+			return
+		}
+		b, err := p.info(i, p.texts[i])
+		if err != nil {
+			c.Write([]byte("# " + err.Error() + "\n"))
+			return
+		}
+		c.Write(b)
+	case "stat":
+		c.Write([]byte(storeStats(p.texts)))
+	case "caps":
+		c.Write([]byte(p.caps()))
+	case "view":
+		c.Write(p.viewCommand(cmd.args))
+	case "history":
+		if !strings.HasPrefix(cmd.arg(0), "@") {
+			c.Write([]byte("# Usage: history @<name>\n"))
+			return
+		}
+		var b bytes.Buffer
+		f := p.formatter(cmd, now)
+		revs := p.revisions(strings.TrimPrefix(cmd.arg(0), "@"), now)
+		for n := len(revs) - 1; n >= 0; n-- {
+			i := revs[n]
+			b.WriteString(f.Line(fmt.Sprintf("%s~%d\t#% 3d\t%s\t", cmd.arg(0), len(revs)-1-n, i, f.Since(p.texts[i].When)), preview(p.texts[i], p.cfg.PreviewLen)) + "\n")
+		}
+		c.Write(b.Bytes())
+	case "export":
+		idx, err := p.parseRange(cmd.args)
+		if err != nil {
+			c.Write([]byte("# " + err.Error() + "\n"))
+			return
+		}
+		p.writeTar(c, idx)
+	case "print":
+		i, err := toIdx()
+		if err != nil {
+			c.Write([]byte("# Usage: print <id>\n"))
+			return
+		}
+		if err := p.print(p.texts[i]); err != nil {
+			c.Write([]byte("# " + err.Error() + "\n"))
+		}
+	default:
+		c.Write([]byte("# Unknown command\n"))
+	}
+	return
+}
+
+type htmlEntry struct {
+	Index    int
+	DateTime string
+	Modified string
+	Title    string
+	Name     string
+	Board    string
+	Lang     string
+	Text     string
+	Tags     []string
+	Expires  string
+	Deadline string // Expires as RFC 3339, for the countdown of the page
+	Publish  string
+	Remind   string
+	SeenBy   []string
+	Unread   bool
+	Strict   bool
+	Category string
+	Icon     string
+	File     string
+	Audio    bool
+	Image    bool
+
+	Checklist []checkItem
+	Location  *location
+	Event     *event
+	Calendar  bool
+	Contact   *contact
+}
+
+type htmlPage struct {
+	Device  string
+	Unread  bool
+	Entries []htmlEntry
+	Views   []*view
+	View    *view
+	Boards  []string
+	Board   string
+	Pinned  bool
+	Landing string
+	Undo    *undoToast
+}
+
+func (p *pastry) showPastry(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == "/" {
+		p.pasteBody(w, r)
+		return
+	}
+	query := r.URL.Query()
+	landing := p.landing(r)
+	asJSON := wantsJSON(r)
+	if len(query) == 0 {
+		switch {
+		case landing == "kiosk" && !asJSON:
+			p.showKiosk(w, r)
+			return
+		case landing == "pinned":
+			query.Set("pinned", "")
+		case strings.HasPrefix(landing, "board:"):
+			query.Set("board", strings.TrimPrefix(landing, "board:"))
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	page := htmlPage{Device: deviceName(r), Entries: make([]htmlEntry, 0, len(p.texts)), Views: p.views, Boards: p.boards(), Landing: landing, Undo: p.undoable(r)}
+	onBoard := query.Has("board")
+	page.Board = query.Get("board")
+	page.Pinned = query.Has("pinned")
+	category := query.Get("category")
+
+	if name := query.Get("view"); name != "" {
+		page.View = p.findView(name)
+	}
+
+	now := time.Now()
+	f := p.webFormatter(r)
+	var read time.Time
+	if !asJSON {
+		read = readMark(w, r, now)
+	}
+	seen := false
+	pastes := []apiPaste{}
+	for i := len(p.texts) - 1; i >= 0; i-- {
+		if !p.texts[i].visible(now) || page.View != nil && !page.View.match(p.texts[i], now) ||
+			onBoard && p.texts[i].Board != page.Board || category != "" && p.texts[i].Category != category ||
+			page.Pinned && !hasTag(p.texts[i], pinTag) {
+			continue
+		}
+		if asJSON {
+			pastes = append(pastes, newAPIPaste(i, p.texts[i]))
+			continue
+		}
+		seen = markSeen(p.texts[i], page.Device, now) || seen
+		h := newHTMLEntry(f, i, p.texts[i])
+		h.Unread = p.texts[i].When.After(read)
+		page.Unread = page.Unread || h.Unread
+		page.Entries = append(page.Entries, h)
+	}
+	if seen {
+		p.store()
+	}
+
+	w.Header().Set("Vary", "Cookie, Accept-Language, Accept")
+	var b bytes.Buffer
+	if asJSON {
+		// oldest first, like the API
+		for i, j := 0, len(pastes)-1; i < j; i, j = i+1, j-1 {
+			pastes[i], pastes[j] = pastes[j], pastes[i]
+		}
+		json.NewEncoder(&b).Encode(pastes)
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		p.tmpl.ExecuteTemplate(&b, "index.html", page)
+	}
+	servePage(w, r, b.Bytes())
+}
+
+func (p *pastry) paste(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		name, err := cleanName(strings.TrimSpace(r.FormValue("name")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		text := r.FormValue("text")
+		if text == "" {
+			http.Error(w, "A paste needs its text", http.StatusBadRequest)
+			return
+		}
+		e := &entry{
+			Text:  text,
+			Title: strings.TrimSpace(r.FormValue("title")),
+			Name:  name,
+			Board: strings.TrimSpace(r.FormValue("board")),
+			Lang:  strings.TrimSpace(r.FormValue("lang")),
+			Tags:  splitTags(r.FormValue("tags")),
+
+			Strict: r.FormValue("strict") != "",
+		}
+		if rt := p.requestRoute(r); rt != nil {
+			rt.route(e)
+		}
+		if s := r.FormValue("publish"); s != "" {
+			t, err := parseWhen(s, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			e.Publish = t
+			e.NotifyPublish = r.FormValue("notify") != ""
+		}
+		if s := r.FormValue("remind"); s != "" {
+			t, err := parseWhen(s, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			e.Remind = t
+		}
+		if err := p.addEntry(e); err != nil {
+			notStored(w, err)
+			return
+		}
+		// on to the permalink of the new paste, and its id for scripts posting the form
+		id := p.storedID(e)
+		w.Header().Set("Location", "/p/"+id)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusSeeOther)
+		fmt.Fprintln(w, id)
+	}
+}
+
+func createDir(dir string) error {
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return os.MkdirAll(dir, 0755)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"pastry/format"
+)
+
+// A4 in points, text is set in the PDF base fonts so nothing needs to be embedded.
+const (
+	pdfWidth    = 595
+	pdfHeight   = 842
+	pdfMargin   = 50
+	pdfTextSize = 10
+	// Courier is 0.6 em wide
+	pdfColumns = (pdfWidth - 2*pdfMargin) * 10 / (6 * pdfTextSize)
+)
+
+var pdfFonts = []string{"Helvetica", "Helvetica-Bold", "Courier"}
+
+const (
+	pdfSans = "/F1"
+	pdfBold = "/F2"
+	pdfMono = "/F3"
+)
+
+// winAnsi has the characters of Windows-1252 that aren't at their Unicode code point.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88, '‰': 0x89,
+	'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95,
+	'–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b, 'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// pdfString encodes s as a PDF string in WinAnsiEncoding, anything it can't show becomes '?'.
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= ' ' && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			b.WriteByte(byte(r))
+		case winAnsi[r] != 0:
+			b.WriteByte(winAnsi[r])
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+type pdfDoc struct {
+	pages []*bytes.Buffer
+	y     int
+}
+
+func (d *pdfDoc) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfHeight - pdfMargin
+}
+
+// line sets one line of text, starting a new page when this one is full.
+func (d *pdfDoc) line(font string, size int, s string) {
+	lead := size * 12 / 10
+	if len(d.pages) == 0 || d.y-lead < pdfMargin {
+		d.newPage()
+	}
+	d.y -= lead
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT %s %d Tf %d %d Td %s Tj ET\n", font, size, pdfMargin, d.y, pdfString(s))
+}
+
+func (d *pdfDoc) space(n int) {
+	d.y -= n
+}
+
+// paste adds the title, time and text of e. The text is wrapped at the page width, tabs are expanded.
+func (d *pdfDoc) paste(e *entry) {
+	if len(d.pages) > 0 && d.y-4*pdfTextSize < pdfMargin {
+		d.newPage()
+	}
+	if e.Title != "" {
+		d.line(pdfBold, 14, format.Truncate(e.Title, 70))
+	}
+	d.line(pdfSans, 9, e.When.Local().Format("Monday 2 January 2006 15:04"))
+	d.space(pdfTextSize / 2)
+	for _, l := range strings.Split(strings.TrimRight(e.Text, "\n"), "\n") {
+		r := []rune(strings.ReplaceAll(l, "\t", "        "))
+		for len(r) > pdfColumns {
+			d.line(pdfMono, pdfTextSize, string(r[:pdfColumns]))
+			r = r[pdfColumns:]
+		}
+		d.line(pdfMono, pdfTextSize, string(r))
+	}
+	d.space(2 * pdfTextSize)
+}
+
+// bytes writes the document. Objects are the catalog, the page tree, the fonts and then
+// a page and its content stream for every page.
+func (d *pdfDoc) bytes() []byte {
+	if len(d.pages) == 0 {
+		d.newPage()
+	}
+	var b bytes.Buffer
+	var offsets []int
+	obj := func(format string, args ...interface{}) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n", len(offsets))
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString("\nendobj\n")
+	}
+
+	first := 3 + len(pdfFonts)
+	var kids, fonts []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", first+2*i))
+	}
+	for i := range pdfFonts {
+		fonts = append(fonts, fmt.Sprintf("/F%d %d 0 R", i+1, 3+i))
+	}
+
+	b.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages))
+	for _, f := range pdfFonts {
+		obj("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f)
+	}
+	for i, c := range d.pages {
+		obj("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, strings.Join(fonts, " "), first+2*i+1)
+		obj("<< /Length %d >>\nstream\n%sendstream", c.Len(), c.Bytes())
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return b.Bytes()
+}
+
+func servePDF(w http.ResponseWriter, r *http.Request, name string, mod time.Time, b []byte) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name))
+	serveConditional(w, r, mod, etag(b), b)
+}
+
+func (p *pastry) pastePDF(w http.ResponseWriter, r *http.Request, id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i, e, ok := p.lookupID(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var d pdfDoc
+	d.paste(e)
+	servePDF(w, r, fmt.Sprintf("pastry-%d.pdf", i), e.When.Truncate(time.Second), d.bytes())
+}
+
+// exportPDF serves /pdf?from=2006-01-02&to=2006-01-02&board=name, all published pastes
+// between the two days, both included. Leaving out from or to leaves that end open.
+func (p *pastry) exportPDF(w http.ResponseWriter, r *http.Request) {
+	var from, to time.Time
+	for _, d := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if s := r.URL.Query().Get(d.name); s != "" {
+			t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+			if err != nil {
+				http.Error(w, "Invalid date: "+s, http.StatusBadRequest)
+				return
+			}
+			*d.t = t
+		}
+	}
+	if !to.IsZero() {
+		to = to.AddDate(0, 0, 1)
+	}
+	board := r.URL.Query().Get("board")
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	var d pdfDoc
+	for _, e := range p.texts {
+		if !e.visible(now) || e.When.Before(from) || !to.IsZero() && !e.When.Before(to) || board != "" && e.Board != board {
+			continue
+		}
+		d.paste(e)
+	}
+	servePDF(w, r, "pastry.pdf", p.modified.Truncate(time.Second), d.bytes())
+}
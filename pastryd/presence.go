@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The index and the pages of pastes keep an EventSource open on /presence?board=<board>,
+// which counts them by board and sends each the count as it changes. The header shows it
+// when someone else is looking, a hint that a paste will be seen right away. New pastes of
+// the board come as paste events with their pasteMeta, for integrations that follow it.
+
+// presenceKeepAlive is how often an idle stream sends a comment, so proxies keep it open.
+const presenceKeepAlive = 30 * time.Second
+
+type viewer struct {
+	board  string
+	ch     chan int
+	pastes chan pasteMeta
+}
+
+// showViewers sends e to the viewers of its board. One that doesn't keep up misses it rather
+// than stalling everyone. Must be called with the mutex held.
+func (p *pastry) showViewers(e *entry) {
+	if len(p.viewers) == 0 || !e.visible(time.Now()) {
+		return
+	}
+	meta := newPasteMeta(e)
+	for v := range p.viewers {
+		if v.board == e.Board {
+			select {
+			case v.pastes <- meta:
+			default:
+			}
+		}
+	}
+}
+
+// tellViewers sends the viewers of board how many they are. A viewer only needs the latest
+// count, so one that hasn't read the last gets this one instead. Must be called with the
+// mutex held.
+func (p *pastry) tellViewers(board string) {
+	n := 0
+	for v := range p.viewers {
+		if v.board == board {
+			n++
+		}
+	}
+	for v := range p.viewers {
+		if v.board != board {
+			continue
+		}
+		select {
+		case <-v.ch:
+		default:
+		}
+		v.ch <- n
+	}
+}
+
+// dropViewers ends the streams when the web server shuts down, which would otherwise wait
+// for them until the shutdown timeout.
+func (p *pastry) dropViewers() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for v := range p.viewers {
+		close(v.ch)
+	}
+	p.viewers = nil
+}
+
+func (p *pastry) presence(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	v := &viewer{board: r.URL.Query().Get("board"), ch: make(chan int, 1), pastes: make(chan pasteMeta, 8)}
+	p.mutex.Lock()
+	if p.viewers == nil {
+		p.viewers = make(map[*viewer]bool)
+	}
+	p.viewers[v] = true
+	p.tellViewers(v.board)
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		if p.viewers[v] {
+			delete(p.viewers, v)
+			p.tellViewers(v.board)
+		}
+		p.mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// reconnect after a second rather than three when the stream is cut, by a proxy or the
+	// read timeout
+	fmt.Fprintf(w, "retry: 1000\n\n")
+	flusher.Flush()
+	keepAlive := time.NewTicker(presenceKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case n, ok := <-v.ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "data: %d\n\n", n)
+		case meta := <-v.pastes:
+			b, _ := json.Marshal(meta)
+			fmt.Fprintf(w, "event: paste\ndata: %s\n\n", b)
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": still here\n\n")
+		}
+		flusher.Flush()
+	}
+}
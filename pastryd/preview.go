@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"pastry/format"
+)
+
+// meaningful is false for blank lines, shebangs and lines of only punctuation like ``` or ---.
+func meaningful(l string) bool {
+	l = strings.TrimSpace(l)
+	if l == "" || strings.HasPrefix(l, "#!") {
+		return false
+	}
+	return strings.IndexFunc(l, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) != -1
+}
+
+// preview is the title and first meaningful line of e, cut to n characters.
+func preview(e *entry, n int) string {
+	line := ""
+	lines := strings.Split(e.Text, "\n")
+	for _, l := range lines {
+		if meaningful(l) {
+			line = strings.TrimSpace(l)
+			break
+		}
+	}
+	if line == "" {
+		line = strings.TrimSpace(strings.Join(lines, " "))
+	}
+	if line == "" {
+		line = fileString(e)
+	}
+	if e.Title != "" {
+		line = e.Title + ": " + line
+	}
+	if e.Name != "" {
+		line = "@" + e.Name + " " + line
+	}
+	return format.Truncate(line, n)
+}
+
+// formatter formats the answers of the read port to cmd, in its --lang if there is a locale
+// for it and otherwise in that of --locale, and cut to its --width.
+func (p *pastry) formatter(cmd command, now time.Time) format.Formatter {
+	return format.New(format.Match(cmd.lang, p.cfg.Locale), now).Columns(cmd.width)
+}
@@ -0,0 +1,143 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// IPP, RFC 8010 and RFC 8011. Only what is needed for a Print-Job with plain text.
+const (
+	ippPrintJob = 0x0002
+
+	ippOperationTag = 0x01
+	ippEndTag       = 0x03
+
+	ippName     = 0x42
+	ippURI      = 0x45
+	ippCharset  = 0x47
+	ippLanguage = 0x48
+	ippMimeType = 0x49
+)
+
+var printClient = &http.Client{Timeout: 30 * time.Second}
+
+func ippAttribute(b *bytes.Buffer, tag byte, name, value string) {
+	b.WriteByte(tag)
+	binary.Write(b, binary.BigEndian, uint16(len(name)))
+	b.WriteString(name)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.WriteString(value)
+}
+
+// printerURLs returns the printer-uri to put in the request and the HTTP URL to post it to.
+// ipp:// and ipps:// default to port 631, like CUPS.
+func printerURLs(s string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	ipp, h := *u, *u
+	switch u.Scheme {
+	case "ipp", "ipps":
+		h.Scheme = strings.Replace(u.Scheme, "ipp", "http", 1)
+		if u.Port() == "" {
+			h.Host = u.Hostname() + ":631"
+		}
+	case "http", "https":
+		ipp.Scheme = strings.Replace(u.Scheme, "http", "ipp", 1)
+	default:
+		return "", "", fmt.Errorf("Unsupported printer URL: %s", s)
+	}
+	return ipp.String(), h.String(), nil
+}
+
+// ippPrint sends text as a Print-Job to an IPP printer, or a CUPS queue like ipp://host/printers/name.
+func ippPrint(printer, title, text string) error {
+	uri, target, err := printerURLs(printer)
+	if err != nil {
+		return err
+	}
+	if title == "" {
+		title = "pastry"
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{1, 1})
+	binary.Write(&b, binary.BigEndian, uint16(ippPrintJob))
+	binary.Write(&b, binary.BigEndian, uint32(1))
+	b.WriteByte(ippOperationTag)
+	ippAttribute(&b, ippCharset, "attributes-charset", "utf-8")
+	ippAttribute(&b, ippLanguage, "attributes-natural-language", "en")
+	ippAttribute(&b, ippURI, "printer-uri", uri)
+	ippAttribute(&b, ippName, "requesting-user-name", "pastry")
+	ippAttribute(&b, ippName, "job-name", title)
+	ippAttribute(&b, ippMimeType, "document-format", "text/plain")
+	b.WriteByte(ippEndTag)
+	b.WriteString(text)
+
+	resp, err := printClient.Post(target, "application/ipp", &b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", printer, resp.Status)
+	}
+	var head [8]byte
+	if _, err := io.ReadFull(resp.Body, head[:]); err != nil {
+		return fmt.Errorf("Bad IPP response: %v", err)
+	}
+	// 0x0000-0x00ff are the successful status codes
+	if status := binary.BigEndian.Uint16(head[2:4]); status > 0x00ff {
+		return fmt.Errorf("Printer refused the job, IPP status 0x%04x", status)
+	}
+	return nil
+}
+
+// print sends the paste to the configured printer in the background, so it is fine
+// to call with the mutex held.
+func (p *pastry) print(e *entry) error {
+	if p.cfg.PrinterURL == "" {
+		return fmt.Errorf("No printer configured")
+	}
+	title, text := e.Title, e.Text
+	p.spawn(func() {
+		if err := ippPrint(p.cfg.PrinterURL, title, text); err != nil {
+			log.Printf("Printing failed: %v", err)
+		}
+	})
+	return nil
+}
+
+// printPaste handles POST /print/<id> from the print button of the paste page.
+func (p *pastry) printPaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, "/print/")
+	_, e, ok := p.lookupID(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := p.print(e); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, "/p/"+id, http.StatusSeeOther)
+}
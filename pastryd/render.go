@@ -0,0 +1,333 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"pastry/format"
+)
+
+// A 5x7 bitmap font for printable ASCII, drawn at twice the size in 6x10 cells. Letters with
+// descenders are moved down two rows. Anything else is drawn as a box.
+const (
+	glyphScale = 2
+	cellWidth  = 6 * glyphScale
+	cellHeight = 10 * glyphScale
+	pngMargin  = 8 * glyphScale
+
+	pngColumns = 100
+	pngLines   = 200
+)
+
+var glyphs = [...][7]byte{
+	{}, // space
+	{0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04}, // '!'
+	{0x0a, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00}, // '"'
+	{0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a}, // '#'
+	{0x04, 0x0f, 0x14, 0x0e, 0x05, 0x1e, 0x04}, // '$'
+	{0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03}, // '%'
+	{0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d}, // '&'
+	{0x04, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00}, // '\''
+	{0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02}, // '('
+	{0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08}, // ')'
+	{0x00, 0x04, 0x15, 0x0e, 0x15, 0x04, 0x00}, // '*'
+	{0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00}, // '+'
+	{0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08}, // ','
+	{0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00}, // '-'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c}, // '.'
+	{0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00}, // '/'
+	{0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e}, // '0'
+	{0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e}, // '1'
+	{0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f}, // '2'
+	{0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e}, // '3'
+	{0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02}, // '4'
+	{0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e}, // '5'
+	{0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e}, // '6'
+	{0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08}, // '7'
+	{0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e}, // '8'
+	{0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c}, // '9'
+	{0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00}, // ':'
+	{0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x04, 0x08}, // ';'
+	{0x02, 0x04, 0x08, 0x10, 0x08, 0x04, 0x02}, // '<'
+	{0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00}, // '='
+	{0x08, 0x04, 0x02, 0x01, 0x02, 0x04, 0x08}, // '>'
+	{0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04}, // '?'
+	{0x0e, 0x11, 0x01, 0x0d, 0x15, 0x15, 0x0e}, // '@'
+	{0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11}, // 'A'
+	{0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e}, // 'B'
+	{0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e}, // 'C'
+	{0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c}, // 'D'
+	{0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f}, // 'E'
+	{0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10}, // 'F'
+	{0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f}, // 'G'
+	{0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11}, // 'H'
+	{0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e}, // 'I'
+	{0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c}, // 'J'
+	{0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11}, // 'K'
+	{0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f}, // 'L'
+	{0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11}, // 'M'
+	{0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11}, // 'N'
+	{0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e}, // 'O'
+	{0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10}, // 'P'
+	{0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d}, // 'Q'
+	{0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11}, // 'R'
+	{0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e}, // 'S'
+	{0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04}, // 'T'
+	{0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e}, // 'U'
+	{0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04}, // 'V'
+	{0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a}, // 'W'
+	{0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11}, // 'X'
+	{0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04}, // 'Y'
+	{0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f}, // 'Z'
+	{0x0e, 0x08, 0x08, 0x08, 0x08, 0x08, 0x0e}, // '['
+	{0x00, 0x10, 0x08, 0x04, 0x02, 0x01, 0x00}, // '\\'
+	{0x0e, 0x02, 0x02, 0x02, 0x02, 0x02, 0x0e}, // ']'
+	{0x04, 0x0a, 0x11, 0x00, 0x00, 0x00, 0x00}, // '^'
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f}, // '_'
+	{0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00}, // '`'
+	{0x00, 0x00, 0x0e, 0x01, 0x0f, 0x11, 0x0f}, // 'a'
+	{0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x1e}, // 'b'
+	{0x00, 0x00, 0x0e, 0x10, 0x10, 0x11, 0x0e}, // 'c'
+	{0x01, 0x01, 0x0d, 0x13, 0x11, 0x11, 0x0f}, // 'd'
+	{0x00, 0x00, 0x0e, 0x11, 0x1f, 0x10, 0x0e}, // 'e'
+	{0x06, 0x09, 0x08, 0x1c, 0x08, 0x08, 0x08}, // 'f'
+	{0x00, 0x0f, 0x11, 0x11, 0x0f, 0x01, 0x0e}, // 'g'
+	{0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x11}, // 'h'
+	{0x04, 0x00, 0x0c, 0x04, 0x04, 0x04, 0x0e}, // 'i'
+	{0x02, 0x00, 0x06, 0x02, 0x02, 0x12, 0x0c}, // 'j'
+	{0x10, 0x10, 0x12, 0x14, 0x18, 0x14, 0x12}, // 'k'
+	{0x0c, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e}, // 'l'
+	{0x00, 0x00, 0x1a, 0x15, 0x15, 0x11, 0x11}, // 'm'
+	{0x00, 0x00, 0x16, 0x19, 0x11, 0x11, 0x11}, // 'n'
+	{0x00, 0x00, 0x0e, 0x11, 0x11, 0x11, 0x0e}, // 'o'
+	{0x00, 0x00, 0x1e, 0x11, 0x1e, 0x10, 0x10}, // 'p'
+	{0x00, 0x00, 0x0d, 0x13, 0x0f, 0x01, 0x01}, // 'q'
+	{0x00, 0x00, 0x16, 0x19, 0x10, 0x10, 0x10}, // 'r'
+	{0x00, 0x00, 0x0e, 0x10, 0x0e, 0x01, 0x1e}, // 's'
+	{0x08, 0x08, 0x1c, 0x08, 0x08, 0x09, 0x06}, // 't'
+	{0x00, 0x00, 0x11, 0x11, 0x11, 0x13, 0x0d}, // 'u'
+	{0x00, 0x00, 0x11, 0x11, 0x11, 0x0a, 0x04}, // 'v'
+	{0x00, 0x00, 0x11, 0x11, 0x15, 0x15, 0x0a}, // 'w'
+	{0x00, 0x00, 0x11, 0x0a, 0x04, 0x0a, 0x11}, // 'x'
+	{0x00, 0x00, 0x11, 0x11, 0x0f, 0x01, 0x0e}, // 'y'
+	{0x00, 0x00, 0x1f, 0x02, 0x04, 0x08, 0x1f}, // 'z'
+	{0x02, 0x04, 0x04, 0x08, 0x04, 0x04, 0x02}, // '{'
+	{0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04}, // '|'
+	{0x08, 0x04, 0x04, 0x02, 0x04, 0x04, 0x08}, // '}'
+	{0x00, 0x00, 0x08, 0x15, 0x02, 0x00, 0x00}, // '~'
+}
+
+const (
+	plainColor = iota
+	keywordColor
+	stringColor
+	commentColor
+	numberColor
+	backgroundColor
+)
+
+// The dark pico theme of the web GUI.
+var pngPalette = color.Palette{
+	plainColor:      color.RGBA{0xc2, 0xc7, 0xd0, 0xff},
+	keywordColor:    color.RGBA{0xc6, 0x78, 0xdd, 0xff},
+	stringColor:     color.RGBA{0x98, 0xc3, 0x79, 0xff},
+	commentColor:    color.RGBA{0x73, 0x82, 0x8c, 0xff},
+	numberColor:     color.RGBA{0xd1, 0x9a, 0x66, 0xff},
+	backgroundColor: color.RGBA{0x11, 0x19, 0x1f, 0xff},
+}
+
+var keywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`break case chan const continue default defer else fallthrough for func go goto if
+		import interface map package range return select struct switch type var and as assert async await class def
+		del elif except finally from global in is lambda nonlocal not or pass raise try while with yield do done esac
+		fi then function let new this throw catch typeof null nil true false True False None`) {
+		keywords[k] = true
+	}
+}
+
+// commentPrefix is how line comments start in the language of e, if the language is known.
+func commentPrefix(e *entry) string {
+	switch kind(e) {
+	case "go", "c", "c++", "cpp", "java", "js", "javascript", "ts", "typescript", "rust", "swift", "kotlin":
+		return "//"
+	case "python", "shell", "sh", "bash", "ruby", "perl", "yaml", "toml", "make", "conf":
+		return "#"
+	case "sql", "lua", "haskell":
+		return "--"
+	}
+	return ""
+}
+
+// highlight gives each rune of line a color. It only knows about line comments, quoted strings,
+// numbers and a common set of keywords, which is plenty for pasted snippets.
+func highlight(line []rune, comment string) []uint8 {
+	colors := make([]uint8, len(line))
+	for i := 0; i < len(line); {
+		r := line[i]
+		switch {
+		case comment != "" && strings.HasPrefix(string(line[i:]), comment):
+			for ; i < len(line); i++ {
+				colors[i] = commentColor
+			}
+		case r == '"' || r == '\'' || r == '`':
+			colors[i] = stringColor
+			for i++; i < len(line); i++ {
+				colors[i] = stringColor
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					colors[i] = stringColor
+				} else if line[i] == r {
+					i++
+					break
+				}
+			}
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(line) && (unicode.IsLetter(line[j]) || unicode.IsDigit(line[j]) || line[j] == '_') {
+				j++
+			}
+			if keywords[string(line[i:j])] {
+				for ; i < j; i++ {
+					colors[i] = keywordColor
+				}
+			}
+			i = j
+		case unicode.IsDigit(r):
+			for ; i < len(line) && (unicode.IsDigit(line[i]) || unicode.IsLetter(line[i]) || line[i] == '.'); i++ {
+				colors[i] = numberColor
+			}
+		default:
+			i++
+		}
+	}
+	return colors
+}
+
+// pngLinesOf expands tabs and wraps, or for strict pastes cuts, lines at pngColumns.
+func pngLinesOf(e *entry) [][]rune {
+	var lines [][]rune
+	for _, l := range strings.Split(strings.TrimRight(e.Text, "\n"), "\n") {
+		var line []rune
+		for _, r := range l {
+			if r == '\t' {
+				line = append(line, ' ')
+				for len(line)%8 != 0 {
+					line = append(line, ' ')
+				}
+				continue
+			}
+			line = append(line, r)
+		}
+		for len(line) > pngColumns && !e.Strict {
+			lines = append(lines, line[:pngColumns])
+			line = line[pngColumns:]
+		}
+		if len(line) > pngColumns {
+			line = line[:pngColumns]
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > pngLines {
+		lines = append(lines[:pngLines-1], []rune("…"))
+	}
+	return lines
+}
+
+func drawGlyph(img *image.Paletted, x, y int, r rune, c uint8) {
+	var g [7]byte
+	top := 1
+	if strings.ContainsRune("gjpqy", r) {
+		top = 3
+	}
+	switch {
+	case r == ' ':
+		return
+	case r > ' ' && r <= '~':
+		g = glyphs[r-' ']
+	case r == '…':
+		g = [7]byte{0, 0, 0, 0, 0, 0, 0x15}
+	default:
+		g = [7]byte{0x1f, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1f}
+	}
+	for row := 0; row < 7; row++ {
+		for col := 0; col < 5; col++ {
+			if g[row]&(0x10>>col) == 0 {
+				continue
+			}
+			for dy := 0; dy < glyphScale; dy++ {
+				for dx := 0; dx < glyphScale; dx++ {
+					img.SetColorIndex(x+col*glyphScale+dx, y+(row+top)*glyphScale+dy, c)
+				}
+			}
+		}
+	}
+}
+
+// renderPNG draws the text of e, the title on top if there is one.
+func renderPNG(e *entry) *image.Paletted {
+	lines := pngLinesOf(e)
+	var title []rune
+	if e.Title != "" {
+		title = []rune(format.Truncate(e.Title, pngColumns))
+	}
+
+	width := 0
+	for _, l := range append(lines, title) {
+		if len(l) > width {
+			width = len(l)
+		}
+	}
+	height := len(lines)
+	if title != nil {
+		height += 2
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, width*cellWidth+2*pngMargin, height*cellHeight+2*pngMargin), pngPalette)
+	for i := range img.Pix {
+		img.Pix[i] = backgroundColor
+	}
+
+	y := pngMargin
+	if title != nil {
+		for x, r := range title {
+			drawGlyph(img, pngMargin+x*cellWidth, y, r, numberColor)
+		}
+		y += 2 * cellHeight
+	}
+	comment := commentPrefix(e)
+	for _, l := range lines {
+		colors := highlight(l, comment)
+		for x, r := range l {
+			drawGlyph(img, pngMargin+x*cellWidth, y, r, colors[x])
+		}
+		y += cellHeight
+	}
+	return img
+}
+
+func (p *pastry) pastePNG(w http.ResponseWriter, r *http.Request, id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, e, ok := p.lookupID(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var b bytes.Buffer
+	png.Encode(&b, renderPNG(e))
+	w.Header().Set("Content-Type", "image/png")
+	serveConditional(w, r, e.When.Truncate(time.Second), etag(b.Bytes()), b.Bytes())
+}
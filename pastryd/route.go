@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// deviceRoute sends the pastes of a device to a board with an expiry, unless the paste says
+// otherwise. A route with a key only applies to pastes that come with the key, on the write
+// port after a "key <key>" line and in the web GUI as a bearer token or a key field.
+// Routes without a key go by the device name a browser has chosen.
+type deviceRoute struct {
+	Name   string
+	Key    string
+	Board  string
+	Expire time.Duration
+}
+
+// deviceRoutes is a repeatable flag of "phone:key=secret,board=mobile,expire=7d".
+type deviceRoutes []deviceRoute
+
+func (d *deviceRoutes) String() string {
+	var s []string
+	for _, rt := range *d {
+		s = append(s, rt.Name)
+	}
+	return strings.Join(s, ";")
+}
+
+// Set accepts one route, or several separated by ';' as in PASTRY_DEVICES.
+func (d *deviceRoutes) Set(s string) error {
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		rt, err := parseDeviceRoute(v)
+		if err != nil {
+			return err
+		}
+		*d = append(*d, rt)
+	}
+	return nil
+}
+
+func parseDeviceRoute(s string) (deviceRoute, error) {
+	name, opts, _ := strings.Cut(s, ":")
+	rt := deviceRoute{Name: cleanDevice(name)}
+	if rt.Name == "" {
+		return rt, fmt.Errorf("Device without a name: %s", s)
+	}
+
+	for _, o := range strings.Split(opts, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(o, "=")
+		var err error
+		switch k {
+		case "key":
+			rt.Key = v
+		case "board":
+			rt.Board = v
+		case "expire":
+			rt.Expire, err = parseAge(v)
+		default:
+			err = fmt.Errorf("Unknown option %s", k)
+		}
+		if err != nil {
+			return rt, fmt.Errorf("Device %s: %v", rt.Name, err)
+		}
+	}
+	return rt, nil
+}
+
+// deviceRoute finds the route of a key, or without a key the keyless route of device.
+func (p *pastry) deviceRoute(key, device string) *deviceRoute {
+	for i, rt := range p.cfg.Devices {
+		if key != "" && rt.Key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(rt.Key)) == 1 ||
+			key == "" && rt.Key == "" && device != "" && rt.Name == device {
+			return &p.cfg.Devices[i]
+		}
+	}
+	return nil
+}
+
+// requestRoute is the route of a web request, by key or by the device name of the browser.
+func (p *pastry) requestRoute(r *http.Request) *deviceRoute {
+	key := r.FormValue("key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return p.deviceRoute(key, deviceName(r))
+}
+
+// route gives e the board and expiry of rt, where e has none of its own.
+func (rt *deviceRoute) route(e *entry) {
+	e.Origin = rt.Name
+	if e.Board == "" {
+		e.Board = rt.Board
+	}
+	if rt.Expire > 0 && e.Expires.IsZero() {
+		e.Expires = time.Now().Add(rt.Expire)
+	}
+}
+
+// keyPreamble takes a "key <key>" first line off a paste on the write port. With devices
+// configured a key that isn't one of theirs is an error, rather than pasting the key.
+func (p *pastry) keyPreamble(b []byte) ([]byte, *deviceRoute, error) {
+	line, rest, ok := strings.Cut(string(b), "\n")
+	key := strings.TrimSpace(strings.TrimPrefix(line, "key "))
+	if !ok || !strings.HasPrefix(line, "key ") || len(p.cfg.Devices) == 0 || strings.ContainsAny(key, " \t") {
+		return b, nil, nil
+	}
+	rt := p.deviceRoute(key, "")
+	if rt == nil {
+		return nil, nil, fmt.Errorf("Unknown key")
+	}
+	return []byte(rest), rt, nil
+}
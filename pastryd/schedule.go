@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// parseWhen accepts a duration from now ("12h", "2d"), RFC 3339, "2006-01-02T15:04"
+// or "15:04", the latter meaning the next time the clock shows it.
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if d, err := parseAge(s); err == nil {
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", s, time.Local); err == nil {
+		t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time: %s", s)
+}
+
+// visible is false for pastes scheduled to be published later.
+func (e *entry) visible(now time.Time) bool {
+	return e.Publish.IsZero() || !now.Before(e.Publish)
+}
+
+// latest returns the index of the newest visible paste, or -1. Must be called with the mutex held.
+func (p *pastry) latest(now time.Time) int {
+	for i := len(p.texts) - 1; i >= 0; i-- {
+		if p.texts[i].visible(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// publishDue sends the notifications of pastes that just got published. What is shown changes
+// with them, so modified moves on as well even when no one is notified.
+func (p *pastry) publishDue(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	changed := false
+	for _, e := range p.texts {
+		if !e.visible(p.modified) && e.visible(now) {
+			p.modified = now
+		}
+		if e.NotifyPublish && e.visible(now) {
+			e.NotifyPublish = false
+			p.notify(entryNotification("Published", e))
+			changed = true
+		}
+	}
+	if changed {
+		p.store()
+	}
+}
+
+func publishString(e *entry, now time.Time) string {
+	if e.visible(now) {
+		return ""
+	}
+	return "publishes " + e.Publish.Format("2006-01-02 15:04")
+}
+
+// remindDue fires the reminders that are due.
+func (p *pastry) remindDue(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	changed := false
+	for _, e := range p.texts {
+		if !e.Remind.IsZero() && !now.Before(e.Remind) {
+			e.Remind = time.Time{}
+			p.notify(entryNotification("Reminder", e))
+			changed = true
+		}
+	}
+	if changed {
+		p.store()
+	}
+}
+
+func remindString(e *entry) string {
+	if e.Remind.IsZero() {
+		return ""
+	}
+	return "reminder " + humanize.Time(e.Remind)
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// With a store key, what pastry keeps on disk of the pastes, the store and the uploaded
+// files, is encrypted with AES-256-GCM. Every piece of sealed data starts with sealMagic and
+// a random nonce, so data written before there was a key is still read, and rewritten
+// sealed on start.
+
+var sealMagic = []byte("\x00pastry1")
+
+var errNoKey = errors.New("the store is encrypted, start pastry with its --store-key-file or PASTRY_STORE_KEY")
+
+// sealer encrypts and decrypts with the store key. A nil sealer leaves data as it is.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// ParseKey reads a store key, 32 bytes written as hex or base64, as made by
+// openssl rand -hex 32.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, fmt.Errorf("a store key is 32 bytes as hex or base64, e.g. from openssl rand -hex 32")
+}
+
+// sealed tells if b was written by seal.
+func sealed(b []byte) bool {
+	return bytes.HasPrefix(b, sealMagic)
+}
+
+func (s *sealer) seal(b []byte) []byte {
+	if s == nil {
+		return b
+	}
+	out := make([]byte, len(sealMagic)+s.aead.NonceSize(), len(sealMagic)+s.aead.NonceSize()+len(b)+s.aead.Overhead())
+	copy(out, sealMagic)
+	rand.Read(out[len(sealMagic):])
+	return s.aead.Seal(out, out[len(sealMagic):], b, nil)
+}
+
+// open decrypts what seal wrote. Data that isn't sealed is returned as it is.
+func (s *sealer) open(b []byte) ([]byte, error) {
+	if !sealed(b) {
+		return b, nil
+	}
+	if s == nil {
+		return nil, errNoKey
+	}
+	b = b[len(sealMagic):]
+	if len(b) < s.aead.NonceSize() {
+		return nil, errors.New("sealed data cut short")
+	}
+	out, err := s.aead.Open(nil, b[:s.aead.NonceSize()], b[s.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("can't decrypt the store, is it the right store key?")
+	}
+	return out, nil
+}
+
+// plain tells if b, read from disk, should be rewritten sealed.
+func (s *sealer) plain(b []byte) bool {
+	return s != nil && len(b) > 0 && !sealed(b)
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	deviceCookie = "pastry_device"
+	readCookie   = "pastry_read"
+)
+
+// deviceName is the name a browser has chosen for itself, or "".
+func deviceName(r *http.Request) string {
+	if c, err := r.Cookie(deviceCookie); err == nil {
+		return cleanDevice(c.Value)
+	}
+	return ""
+}
+
+func cleanDevice(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 32 {
+		// not in the middle of a character
+		n := 32
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n]
+	}
+	return s
+}
+
+// markSeen records that device has seen e, and reports if that is news.
+func markSeen(e *entry, device string, now time.Time) bool {
+	if device == "" {
+		return false
+	}
+	if _, ok := e.SeenBy[device]; ok {
+		return false
+	}
+	if e.SeenBy == nil {
+		e.SeenBy = make(map[string]time.Time)
+	}
+	e.SeenBy[device] = now
+	return true
+}
+
+// seenBy lists the devices that have seen e, in the order they saw it.
+func seenBy(e *entry) []string {
+	devices := make([]string, 0, len(e.SeenBy))
+	for d := range e.SeenBy {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return e.SeenBy[devices[i]].Before(e.SeenBy[devices[j]])
+	})
+	return devices
+}
+
+// takeOption removes "--name value" or "--name=value" from args and returns its value.
+func takeOption(args []string, name string) (string, []string) {
+	v, ok := option(args, name)
+	if !ok {
+		return "", args
+	}
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--"+name {
+			if i+1 < len(args) && args[i+1] == v {
+				i++
+			}
+			continue
+		}
+		if strings.HasPrefix(args[i], "--"+name+"=") {
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	return v, rest
+}
+
+func (p *pastry) setDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		http.SetCookie(w, &http.Cookie{
+			Name:    deviceCookie,
+			Value:   cleanDevice(r.FormValue("device")),
+			Path:    "/",
+			Expires: time.Now().AddDate(10, 0, 0),
+		})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func setReadCookie(w http.ResponseWriter, t time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    readCookie,
+		Value:   strconv.FormatInt(t.UnixNano(), 10),
+		Path:    "/",
+		Expires: t.AddDate(10, 0, 0),
+	})
+}
+
+// readMark is the server time this browser last marked everything as read. A browser
+// without a mark gets one, and starts out with nothing unread.
+func readMark(w http.ResponseWriter, r *http.Request, now time.Time) time.Time {
+	if c, err := r.Cookie(readCookie); err == nil {
+		if ns, err := strconv.ParseInt(c.Value, 10, 64); err == nil {
+			return time.Unix(0, ns)
+		}
+	}
+	setReadCookie(w, now)
+	return now
+}
+
+func markAllRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		setReadCookie(w, time.Now())
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,328 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Server is a pastry, with its web GUI, write port and read port.
+type Server struct {
+	p       *pastry
+	handler http.Handler
+	tls     *tls.Config    // of the web GUI, nil for plain HTTP
+	ports   []net.Listener // web GUI, write port and read port
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// New sets up a pastry and loads its pastes, but doesn't listen yet.
+func New(cfg Config) (*Server, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	css, err := unzip(picocssZipFile)
+	if err != nil {
+		return nil, fmt.Errorf("pico-master.zip is faulty: %v", err)
+	}
+	static, err := staticAssets()
+	if err != nil {
+		return nil, fmt.Errorf("Static files: %v", err)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --tls-cert or --tls-key: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	p := &pastry{cfg: cfg, notifiers: newNotifiers(cfg)}
+	if p.seal, err = newSealer(cfg.StoreKey); err != nil {
+		return nil, fmt.Errorf("Invalid store key: %v", err)
+	}
+	p.tmpl = template.Must(template.ParseFS(templates, "tmpl/*.html"))
+
+	if cfg.NoPersist {
+		p.files = make(map[string][]byte)
+	} else {
+		if err = createDir(cfg.DataDir); err != nil {
+			return nil, fmt.Errorf("Failed to create data directory: %v", err)
+		}
+		p.viewsFile = filepath.Join(cfg.DataDir, "views.gob")
+		p.tombsFile = filepath.Join(cfg.DataDir, "tombstones.gob")
+		p.filesDir = filepath.Join(cfg.DataDir, "files")
+	}
+
+	if err = p.loadPastes(); err != nil {
+		if p.backend != nil {
+			p.backend.close()
+		}
+		return nil, fmt.Errorf("Failed to load pastes: %v", err)
+	}
+	if err = p.reloadLimits(); err != nil {
+		p.backend.close()
+		return nil, fmt.Errorf("Failed to read limits: %v", err)
+	}
+	p.modified = time.Now()
+	p.checkDisk()
+	p.loadTombs()
+
+	if f, err := os.Open(p.viewsFile); !cfg.NoPersist && err == nil {
+		gob.NewDecoder(f).Decode(&p.views)
+		f.Close()
+	}
+	return &Server{p: p, handler: p.routes(css, static), tls: tlsConfig}, nil
+}
+
+// The web GUI gives a connection headerTimeout to send its request headers, or less with a
+// shorter --http-read-timeout, so a device that stalls halfway only holds on to its own
+// connection for that long. --http-write-timeout is off by default as downloads and the
+// event streams take as long as they take.
+const (
+	headerTimeout  = 10 * time.Second
+	maxHeaderBytes = 64 << 10
+)
+
+// webServer is the http.Server of the web GUI, it serves HTTP/2 as well with TLS.
+func (s *Server) webServer() *http.Server {
+	cfg := s.p.cfg
+	header := headerTimeout
+	if cfg.HTTPReadTimeout > 0 && cfg.HTTPReadTimeout < header {
+		header = cfg.HTTPReadTimeout
+	}
+	return &http.Server{
+		Handler:           s.handler,
+		TLSConfig:         s.tls,
+		ReadHeaderTimeout: header,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+func (p *pastry) routes(css, static assets) *http.ServeMux {
+	mux := http.NewServeMux()
+	t := p.newTimeouts()
+	page := func(route string, h http.HandlerFunc) {
+		mux.Handle(route, t.wrap(route, h))
+	}
+
+	page("/", p.showPastry)
+	mux.Handle("/css/", http.StripPrefix("/css/", css))
+	page("/paste", p.paste)
+	page("/view", p.saveViewForm)
+	page("/device", p.setDevice)
+	page("/landing", p.setLanding)
+	mux.HandleFunc("/read", markAllRead)
+	mux.HandleFunc("/healthz", p.healthz)
+	mux.HandleFunc("/raw/", p.raw)
+	page("/p", p.pasteBody)
+	page("/p/", p.permalink)
+	page("/n/", p.namedPaste)
+	page("/inspect/", p.inspectPaste)
+	page("/stats", p.showStats)
+	page("/limits", p.showLimits)
+	page("/kiosk", p.showKiosk)
+	page("/pdf", p.exportPDF)
+	mux.HandleFunc("/upload", p.upload)
+	mux.HandleFunc("/files/", p.putFile)
+	// a stream, which the timeout handler can't flush
+	mux.HandleFunc("/presence", p.presence)
+	page("/sketch", p.showSketch)
+	page("/check/", p.checkPaste)
+	mux.HandleFunc("/download/", p.download)
+	page("/print/", p.printPaste)
+	page("/edit/", p.editPaste)
+	page("/delete/", p.deletePaste)
+	page("/undo/", p.undo)
+	page(apiPrefix, p.apiPastes)
+	page(apiPrefix+"/", p.apiPaste)
+	page(batchPath, p.apiBatch)
+	mux.HandleFunc(openAPIPath, serveOpenAPI())
+	for name := range static {
+		mux.Handle("/"+name, static)
+	}
+	return mux
+}
+
+// Start listens and serves in the background until ctx is done or Stop is called.
+func (s *Server) Start(ctx context.Context) error {
+	cfg := s.p.cfg
+	for _, addr := range []string{cfg.HTTPAddr, cfg.WriteAddr, cfg.ReadAddr} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range s.ports {
+				l.Close()
+			}
+			s.ports = nil
+			return fmt.Errorf("Failed to listen to %s: %v", addr, err)
+		}
+		s.ports = append(s.ports, l)
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.err = s.p.serve(ctx, s.webServer(), s.ports[0], s.ports[1], s.ports[2])
+		s.p.backend.close()
+	}()
+	web, write, read := s.Addrs()
+	from := cfg.DataDir
+	if cfg.NoPersist {
+		from = "from memory only"
+	}
+	log.Printf("pastry serving %s, web GUI on %s, write port %s, read port %s", from, web, write, read)
+	return nil
+}
+
+// Addrs are the addresses Start listens to, with the actual ports when configured with port 0.
+func (s *Server) Addrs() (web, write, read string) {
+	if len(s.ports) != 3 {
+		return s.p.cfg.HTTPAddr, s.p.cfg.WriteAddr, s.p.cfg.ReadAddr
+	}
+	return s.ports[0].Addr().String(), s.ports[1].Addr().String(), s.ports[2].Addr().String()
+}
+
+// Wait waits for the server to stop, and returns why if it wasn't asked to.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Stop stops the server, lets what is in progress finish and stores what isn't stored yet.
+// A server that never started just closes its store.
+func (s *Server) Stop() error {
+	if s.done == nil {
+		s.p.wg.Wait()
+		return s.p.backend.close()
+	}
+	s.cancel()
+	return s.Wait()
+}
+
+// Reload reads the limits file again, as SIGHUP does for the pastry command.
+func (s *Server) Reload() error {
+	return s.p.reloadLimits()
+}
+
+const (
+	// shutdownGrace is how long connections in the middle of something get to finish it
+	// once pastry is stopping.
+	shutdownGrace = 2 * time.Second
+	// shutdownTimeout is how long the web GUI waits for its requests before closing them.
+	shutdownTimeout = 5 * time.Second
+)
+
+// spawn runs f in the background, tracked so shutdown waits for it.
+func (p *pastry) spawn(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+}
+
+// accept hands the connections of l to handle until l is closed. When ctx is done the
+// connections still open get shutdownGrace to finish.
+func (p *pastry) accept(ctx context.Context, l net.Listener, handle func(net.Conn)) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		p.spawn(func() {
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					c.SetDeadline(time.Now().Add(shutdownGrace))
+				case <-done:
+				}
+			}()
+			handle(c)
+		})
+	}
+}
+
+// serve runs pastry on the listeners until ctx is done or one of them fails. It then stops
+// accepting, lets the web requests and connections in progress finish, waits for everything
+// it started and stores what isn't stored yet.
+func (p *pastry) serve(ctx context.Context, web *http.Server, webPort, writePort, readPort net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failed := make(chan error, 3)
+	web.RegisterOnShutdown(p.dropViewers)
+	p.webScheme = "http"
+	if web.TLSConfig != nil {
+		p.webScheme = "https"
+	}
+	_, p.webPort, _ = net.SplitHostPort(webPort.Addr().String())
+	p.spawn(func() {
+		serve := web.Serve
+		if web.TLSConfig != nil {
+			// the certificate is in TLSConfig already
+			serve = func(l net.Listener) error { return web.ServeTLS(l, "", "") }
+		}
+		if err := serve(webPort); err != http.ErrServerClosed {
+			failed <- fmt.Errorf("Web GUI failed: %v", err)
+		}
+	})
+	p.spawn(func() {
+		if err := p.accept(ctx, writePort, p.handleWritePaste); err != nil {
+			failed <- fmt.Errorf("Accept on write port failed: %v", err)
+		}
+	})
+	p.spawn(func() {
+		if err := p.accept(ctx, readPort, func(c net.Conn) { p.handleReadPaste(ctx, c) }); err != nil {
+			failed <- fmt.Errorf("Accept on read port failed: %v", err)
+		}
+	})
+	p.spawn(func() { p.maintain(ctx) })
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Printf("Stopping")
+	case err = <-failed:
+	}
+	cancel()
+
+	writePort.Close()
+	readPort.Close()
+	sctx, scancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer scancel()
+	if web.Shutdown(sctx) != nil {
+		web.Close()
+	}
+	p.wg.Wait()
+	// too late for an undo once pastry stops
+	p.emptyTrash(time.Now().Add(undoGrace))
+	p.flush()
+	return err
+}
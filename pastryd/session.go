@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// A read port connection that starts with "session" stays open for one command a line, as
+// many as the client likes, rather than one a connection that has to arrive within the read
+// timeout. Each answer comes after a "# <n> bytes" line, so a script knows where it ends and
+// an answer without a newline at the end doesn't run into the next. Empty lines are skipped,
+// rather than getting the latest paste, and "quit" ends the session as EOF does.
+
+const (
+	sessionCommand = "session"
+	// sessionIdle is how long a session waits for the next command.
+	sessionIdle = 10 * time.Minute
+)
+
+func isSessionCommand(b []byte) bool {
+	line, _, _ := bytes.Cut(b, []byte("\n"))
+	return strings.TrimSpace(string(line)) == sessionCommand
+}
+
+// session runs the commands of a session, first holds the "session" line and whatever
+// arrived with it.
+func (p *pastry) session(ctx context.Context, c net.Conn, first []byte) {
+	_, rest, _ := bytes.Cut(first, []byte("\n"))
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(rest), c))
+	w := bufio.NewWriter(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(sessionIdle))
+		if ctx.Err() != nil {
+			// pastry is stopping, the deadline it set would be undone
+			return
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return
+		}
+		cmd := strings.TrimSpace(string(line))
+		switch cmd {
+		case "":
+			continue
+		case "quit":
+			return
+		}
+		var b bytes.Buffer
+		if send := p.runCommand(&b, []byte(cmd)); send != nil {
+			_, err := io.Copy(&b, send)
+			closeSend(send)
+			if err != nil {
+				// rather than a part of it
+				b.Reset()
+				fmt.Fprintf(&b, "# %v\n", err)
+			}
+		}
+		fmt.Fprintf(w, "# %d bytes\n", b.Len())
+		w.Write(b.Bytes())
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"pastry/format"
+)
+
+const (
+	shingleSize   = 3
+	minSimilarity = 0.3
+	maxSimilar    = 5
+)
+
+// shingles hashes every run of shingleSize words, or the single words of very short texts,
+// sorted and each once.
+func shingles(text string) []uint64 {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	n := shingleSize
+	if len(words) < n {
+		n = 1
+	}
+
+	set := make([]uint64, 0, len(words))
+	for i := 0; i+n <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+n], " ")))
+		set = append(set, h.Sum64())
+	}
+	sort.Slice(set, func(a, b int) bool { return set[a] < set[b] })
+	kept := set[:0]
+	for i, h := range set {
+		if i == 0 || h != set[i-1] {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// shingleSet is the shingles of e, made once for as long as its text stays the same. Must
+// be called with the mutex held.
+func (e *entry) shingleSet() []uint64 {
+	if e.shingles == nil || e.shingledOf != e.Text {
+		e.shingles, e.shingledOf = shingles(e.Text), e.Text
+	}
+	return e.shingles
+}
+
+// jaccard is the size of the intersection over the size of the union, of sorted shingles.
+func jaccard(a, b []uint64) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			common++
+			i++
+			j++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+type similarEntry struct {
+	htmlEntry
+	Preview string
+	Percent int
+}
+
+// similar finds the pastes most like the one at index i, of those published by now. Must be
+// called with the mutex held.
+func (p *pastry) similar(f format.Formatter, i int, now time.Time) []similarEntry {
+	var found []similarEntry
+	set := p.texts[i].shingleSet()
+
+	for j, e := range p.texts {
+		if j == i || !e.visible(now) {
+			continue
+		}
+		if s := jaccard(set, e.shingleSet()); s >= minSimilarity {
+			found = append(found, similarEntry{htmlEntry: newHTMLEntry(f, j, e), Preview: preview(e, 80), Percent: int(s * 100)})
+		}
+	}
+	sort.SliceStable(found, func(a, b int) bool { return found[a].Percent > found[b].Percent })
+	if len(found) > maxSimilar {
+		found = found[:maxSimilar]
+	}
+	return found
+}
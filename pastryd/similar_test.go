@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"testing"
+	"time"
+
+	"pastry/format"
+)
+
+func TestJaccard(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want float64
+	}{
+		{"the quick brown fox", "the quick brown fox", 1},
+		{"The quick, brown fox!", "the quick brown fox", 1},
+		{"the quick brown fox", "the quick brown dog", 1.0 / 3},
+		{"one two", "one three", 1.0 / 3},
+		{"the quick brown fox", "", 0},
+		{"a a a a a", "a a a", 1},
+	} {
+		if got := jaccard(shingles(tc.a), shingles(tc.b)); got != tc.want {
+			t.Errorf("jaccard(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestSimilar(t *testing.T) {
+	now := time.Now()
+	p := &pastry{texts: []*entry{
+		{Text: "the quick brown fox jumps"},
+		{Text: "the quick brown fox jumps high"},
+		{Text: "the quick brown fox jumps again", Publish: now.Add(time.Hour)},
+		{Text: "something else entirely"},
+	}}
+	found := p.similar(format.New("en", now), 0, now)
+	if len(found) != 1 || found[0].Index != 1 || found[0].Percent != 75 {
+		t.Errorf("similar = %+v, want only #1, not the unpublished #2", found)
+	}
+	// the shingles are kept until the text changes
+	p.texts[1].Text = "something else entirely"
+	if found := p.similar(format.New("en", now), 0, now); len(found) != 0 {
+		t.Errorf("similar after an edit = %+v", found)
+	}
+}
@@ -0,0 +1,184 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Stack traces of Go panics, Python exceptions and Java exceptions are shown a frame at a
+// time, collapsed, with what went wrong on top and the frames of libraries and runtimes
+// greyed out.
+
+var (
+	goPanicRe     = regexp.MustCompile(`^(panic: |fatal error: )`)
+	goroutineRe   = regexp.MustCompile(`^goroutine \d+ \[.*\]:$`)
+	goLocationRe  = regexp.MustCompile(`^\t(\S+\.go:\d+)`)
+	pyTracebackRe = regexp.MustCompile(`^Traceback \(most recent call last\):$`)
+	pyFrameRe     = regexp.MustCompile(`^\s+File "(.+)", line (\d+), in (.+)$`)
+	javaHeadRe    = regexp.MustCompile(`^(?:Exception in thread "[^"]*" |Caused by: )?([\w$]+\.)+[\w$]*(?:Exception|Error|Throwable)(?::.*)?$`)
+	javaFrameRe   = regexp.MustCompile(`^\s+at ([\w$.<>/]+)\((.*)\)$`)
+	javaMoreRe    = regexp.MustCompile(`^\s+\.\.\. \d+ (?:more|common frames omitted)$`)
+)
+
+type traceFrame struct {
+	Func     string
+	Location string
+	Code     string
+	Library  bool
+	Open     bool
+}
+
+type traceGroup struct {
+	Header string
+	Frames []traceFrame
+	More   string
+}
+
+// trace is a stack trace, Message the panic or the exception that was raised.
+type trace struct {
+	Lang    string
+	Message string
+	Groups  []traceGroup
+}
+
+func libraryFrame(lang, fn, loc string) bool {
+	switch lang {
+	case "go":
+		return strings.HasPrefix(fn, "runtime.") || strings.Contains(loc, "/go/src/") || strings.Contains(loc, "/pkg/mod/")
+	case "python":
+		return strings.Contains(loc, "site-packages") || strings.Contains(loc, "/lib/python") || strings.HasPrefix(loc, "<frozen")
+	case "java":
+		for _, p := range []string{"java.", "javax.", "jdk.", "sun.", "kotlin.", "scala.", "org.junit.", "org.springframework."} {
+			if strings.HasPrefix(fn, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openFirst opens the first frame of code that isn't a library, where the bug most likely is.
+func (t *trace) openFirst() {
+	for g := range t.Groups {
+		for f := range t.Groups[g].Frames {
+			if !t.Groups[g].Frames[f].Library {
+				t.Groups[g].Frames[f].Open = true
+				return
+			}
+		}
+	}
+}
+
+func parseGoTrace(lines []string) *trace {
+	t := &trace{Lang: "go"}
+	var g *traceGroup
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		switch {
+		case goPanicRe.MatchString(l) && t.Message == "":
+			t.Message = l
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "[signal ") {
+				t.Message += "\n" + lines[i+1]
+				i++
+			}
+		case goroutineRe.MatchString(l):
+			t.Groups = append(t.Groups, traceGroup{Header: l})
+			g = &t.Groups[len(t.Groups)-1]
+		case g != nil && l != "" && !strings.HasPrefix(l, "\t") && i+1 < len(lines) && goLocationRe.MatchString(lines[i+1]):
+			fn, args := l, ""
+			if n := strings.LastIndex(l, "("); n > 0 && !strings.HasPrefix(l, "created by ") {
+				fn, args = l[:n], l[n:]
+			}
+			if args == "()" || args == "(...)" {
+				args = ""
+			}
+			loc := goLocationRe.FindStringSubmatch(lines[i+1])[1]
+			g.Frames = append(g.Frames, traceFrame{Func: fn, Location: loc, Code: args, Library: libraryFrame("go", fn, loc)})
+			i++
+		}
+	}
+	if len(t.Groups) == 0 {
+		return nil
+	}
+	return t
+}
+
+func parsePythonTrace(lines []string) *trace {
+	t := &trace{Lang: "python"}
+	var g *traceGroup
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		switch {
+		case pyTracebackRe.MatchString(l):
+			t.Groups = append(t.Groups, traceGroup{})
+			g = &t.Groups[len(t.Groups)-1]
+		case g != nil && pyFrameRe.MatchString(l):
+			m := pyFrameRe.FindStringSubmatch(l)
+			f := traceFrame{Func: m[3], Location: m[1] + ":" + m[2], Library: libraryFrame("python", m[3], m[1])}
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "    ") && !pyFrameRe.MatchString(lines[i+1]) {
+				f.Code = strings.TrimSpace(lines[i+1])
+				i++
+			}
+			g.Frames = append(g.Frames, f)
+		case g != nil && l != "" && !strings.HasPrefix(l, " "):
+			// the exception ends a traceback, the last one is what was raised
+			g.Header = l
+			t.Message = l
+			g = nil
+		}
+	}
+	if len(t.Groups) == 0 {
+		return nil
+	}
+	return t
+}
+
+func parseJavaTrace(lines []string) *trace {
+	t := &trace{Lang: "java"}
+	var g *traceGroup
+	for _, l := range lines {
+		switch {
+		case javaHeadRe.MatchString(l):
+			if t.Message == "" {
+				t.Message = l
+			}
+			t.Groups = append(t.Groups, traceGroup{Header: l})
+			g = &t.Groups[len(t.Groups)-1]
+		case g != nil && javaFrameRe.MatchString(l):
+			m := javaFrameRe.FindStringSubmatch(l)
+			g.Frames = append(g.Frames, traceFrame{Func: m[1], Location: m[2], Library: libraryFrame("java", m[1], m[2])})
+		case g != nil && javaMoreRe.MatchString(l):
+			g.More = strings.TrimSpace(l)
+		}
+	}
+	if len(t.Groups) == 0 || len(t.Groups[0].Frames) == 0 {
+		return nil
+	}
+	return t
+}
+
+// findTrace looks for a stack trace in text, nil if there is none.
+func findTrace(text string) *trace {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var t *trace
+	for _, l := range lines {
+		if goroutineRe.MatchString(l) {
+			t = parseGoTrace(lines)
+		} else if pyTracebackRe.MatchString(l) {
+			t = parsePythonTrace(lines)
+		} else if javaFrameRe.MatchString(l) {
+			t = parseJavaTrace(lines)
+		} else {
+			continue
+		}
+		if t != nil {
+			t.openFirst()
+		}
+		return t
+	}
+	return nil
+}
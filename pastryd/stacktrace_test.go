@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import "testing"
+
+func TestFindTrace(t *testing.T) {
+	for _, tc := range []struct {
+		text          string
+		lang, message string
+		frames        int    // of the first group
+		open          string // the frame opened
+	}{
+		{"panic: runtime error: index out of range [3] with length 3\n\ngoroutine 1 [running]:\nmain.last(...)\n\t/home/me/src/app/main.go:12\nmain.main()\n\t/home/me/src/app/main.go:7 +0x1d\nexit status 2\n",
+			"go", "panic: runtime error: index out of range [3] with length 3", 2, "main.last"},
+		{"panic: oops\n[signal SIGSEGV: segmentation violation]\n\ngoroutine 7 [running]:\nruntime.panicmem()\n\t/usr/lib/go/src/runtime/panic.go:260 +0x2c\nmain.run(0x0)\n\t/src/main.go:3 +0x9\n",
+			"go", "panic: oops\n[signal SIGSEGV: segmentation violation]", 2, "main.run"},
+		{"Traceback (most recent call last):\n  File \"/usr/lib/python3.11/runpy.py\", line 198, in _run_module_as_main\n    return _run_code(code, main_globals, None,\n  File \"app.py\", line 4, in <module>\n    print(1 / 0)\nZeroDivisionError: division by zero\n",
+			"python", "ZeroDivisionError: division by zero", 2, "<module>"},
+		{"Exception in thread \"main\" java.lang.IllegalStateException: closed\n\tat java.base/java.util.Scanner.ensureOpen(Scanner.java:1150)\n\tat com.example.App.read(App.java:21)\n\tat com.example.App.main(App.java:9)\nCaused by: java.io.IOException: gone\n\tat com.example.Io.open(Io.java:5)\n\t... 2 more\n",
+			"java", "Exception in thread \"main\" java.lang.IllegalStateException: closed", 3, "com.example.App.read"},
+		{"just a line\nand another\n", "", "", 0, ""},
+		// a frame alone isn't a Java trace
+		{"\tat somewhere(nowhere)\n", "", "", 0, ""},
+	} {
+		tr := findTrace(tc.text)
+		if tr == nil {
+			if tc.lang != "" {
+				t.Errorf("findTrace(%.30q) = nil", tc.text)
+			}
+			continue
+		}
+		if tc.lang == "" {
+			t.Errorf("findTrace(%.30q) = %+v, want nil", tc.text, tr)
+			continue
+		}
+		open := ""
+		for _, g := range tr.Groups {
+			for _, f := range g.Frames {
+				if f.Open {
+					open = f.Func
+				}
+			}
+		}
+		if tr.Lang != tc.lang || tr.Message != tc.message || len(tr.Groups[0].Frames) != tc.frames || open != tc.open {
+			t.Errorf("findTrace(%.30q) = %s %q, %d frames, %q open, want %s %q, %d, %q",
+				tc.text, tr.Lang, tr.Message, len(tr.Groups[0].Frames), open, tc.lang, tc.message, tc.frames, tc.open)
+		}
+	}
+}
+
+func TestLibraryFrame(t *testing.T) {
+	for _, tc := range []struct {
+		lang, fn, loc string
+		want          bool
+	}{
+		{"go", "runtime.gopanic", "/usr/lib/go/src/runtime/panic.go:884", true},
+		{"go", "github.com/x/y.Do", "/home/me/go/pkg/mod/github.com/x/y@v1/y.go:3", true},
+		{"go", "main.main", "/home/me/src/app/main.go:7", false},
+		{"python", "get", "/venv/lib/python3.11/site-packages/requests/api.py", true},
+		{"python", "main", "app.py", false},
+		{"java", "java.util.Scanner.ensureOpen", "Scanner.java:1150", true},
+		{"java", "com.example.App.main", "App.java:9", false},
+	} {
+		if got := libraryFrame(tc.lang, tc.fn, tc.loc); got != tc.want {
+			t.Errorf("libraryFrame(%s, %s, %s) = %v", tc.lang, tc.fn, tc.loc, got)
+		}
+	}
+}
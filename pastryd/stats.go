@@ -0,0 +1,266 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
+
+	"pastry/format"
+)
+
+var (
+	logLineRe = regexp.MustCompile(`^\s*\[?(\d{4}-\d\d-\d\d[ T]\d\d:\d\d|[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d|\d\d:\d\d:\d\d)`)
+	goRe      = regexp.MustCompile(`(?m)^(package \w+|func \w*\(|import \()`)
+	pythonRe  = regexp.MustCompile(`(?m)^(def \w+\(.*\):|class \w+.*:|from [\w.]+ import |import \w+$)`)
+	shellRe   = regexp.MustCompile(`(?m)^(#!/.*\b(sh|bash|zsh)\b|\$ \S+)`)
+)
+
+// detectKind guesses what a paste is, for pastes without a language set.
+func detectKind(text string) string {
+	t := strings.TrimSpace(text)
+	if t == "" {
+		return "empty"
+	}
+	if (t[0] == '{' || t[0] == '[') && json.Valid([]byte(t)) {
+		return "json"
+	}
+
+	lines := strings.Split(t, "\n")
+	urls, logs := 0, 0
+	for _, l := range lines {
+		if u, err := url.Parse(strings.TrimSpace(l)); err == nil && u.Scheme != "" && u.Host != "" {
+			urls++
+		}
+		if logLineRe.MatchString(l) {
+			logs++
+		}
+	}
+
+	switch {
+	case urls == len(lines):
+		return "url"
+	case logs*2 > len(lines):
+		return "log"
+	case goRe.MatchString(t):
+		return "go"
+	case pythonRe.MatchString(t):
+		return "python"
+	case shellRe.MatchString(t):
+		return "shell"
+	case t[0] == '<' && strings.HasSuffix(t, ">"):
+		return "html/xml"
+	}
+	return "text"
+}
+
+// kind is the language given to e, or the detected one.
+func kind(e *entry) string {
+	if e.Lang != "" {
+		return strings.ToLower(e.Lang)
+	}
+	return detectKind(e.Text)
+}
+
+// wordsPerMinute is a common guess at how fast people read.
+const wordsPerMinute = 230
+
+// textCount is the size of a paste as someone drafting a message or post cares about it.
+type textCount struct {
+	Words   int `json:"words"`
+	Chars   int `json:"characters"`
+	Lines   int `json:"lines"`
+	Minutes int `json:"reading_minutes"`
+}
+
+// countText counts text, reading time rounded up to whole minutes.
+func countText(text string) textCount {
+	c := textCount{Words: len(strings.Fields(text)), Chars: utf8.RuneCountInString(text)}
+	if t := strings.TrimRight(text, "\n"); t != "" {
+		c.Lines = strings.Count(t, "\n") + 1
+	}
+	c.Minutes = (c.Words + wordsPerMinute - 1) / wordsPerMinute
+	return c
+}
+
+func (c textCount) String() string {
+	return fmt.Sprintf("%s words, %s characters, %d min read", humanize.Comma(int64(c.Words)), humanize.Comma(int64(c.Chars)), c.Minutes)
+}
+
+// countString is what count writes, in the key=value form of meta.
+func countString(c textCount) string {
+	return fmt.Sprintf("words=%d\ncharacters=%d\nlines=%d\nreading=%dmin\n", c.Words, c.Chars, c.Lines, c.Minutes)
+}
+
+// storeStats sums up texts for scripts watching the store, as key=value lines like count.
+// The sizes are of the text, or of the file of file pastes.
+func storeStats(texts []*entry) string {
+	sizes := make([]int64, 0, len(texts))
+	var total int64
+	files := 0
+	for _, e := range texts {
+		n := int64(len(e.Text))
+		if e.File != "" {
+			n = e.Size
+			files++
+		}
+		sizes = append(sizes, n)
+		total += n
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "pastes=%d\nfiles=%d\nbytes=%d\n", len(texts), files, total)
+	if len(texts) == 0 {
+		return b.String()
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	fmt.Fprintf(&b, "oldest=%s\nnewest=%s\n", texts[0].When.Format(time.RFC3339), texts[len(texts)-1].When.Format(time.RFC3339))
+	fmt.Fprintf(&b, "smallest=%d\nmedian=%d\nmean=%d\nlargest=%d\n", sizes[0], sizes[len(sizes)/2], total/int64(len(sizes)), sizes[len(sizes)-1])
+	return b.String()
+}
+
+// info is what there is to know of a paste before getting or dropping it, as key=value lines.
+// Lines are counted of text only, files besides those of large pastes aren't lines. Must be
+// called with the mutex held.
+func (p *pastry) info(i int, e *entry) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "index=%d\nid=%s\nwhen=%s\n", i, e.ID, e.When.Format(time.RFC3339))
+	if e.File == "" {
+		fmt.Fprintf(&b, "bytes=%d\nlines=%d\nsha256=%s\n", len(e.Text), countText(e.Text).Lines, textHash(e.Text))
+		return b.Bytes(), nil
+	}
+	fmt.Fprintf(&b, "bytes=%d\n", e.Size)
+	if e.Mime == spoolMime {
+		f, err := p.openFile(e)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		n, err := countLines(f)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "lines=%d\n", n)
+	}
+	fmt.Fprintf(&b, "sha256=%s\nmime=%s\n", e.Hash, e.Mime)
+	return b.Bytes(), nil
+}
+
+type statsCount struct {
+	Name    string
+	Count   int
+	Bytes   string
+	Percent int
+}
+
+type statsMonth struct {
+	Month string
+	Count int
+	Tags  []statsCount
+}
+
+type statsPage struct {
+	Count          int
+	Bytes          string
+	Oldest, Newest string
+	Kinds          []statsCount
+	Tags           []statsCount
+	Months         []statsMonth
+	Heatmap        template.HTML
+	DiskFree       string // of the data directory, when known
+	DiskFull       bool
+}
+
+// ranked sorts counts, largest first, and fills in their share of total.
+func ranked(counts map[string]int, sizes map[string]int, total, max int) []statsCount {
+	r := make([]statsCount, 0, len(counts))
+	for name, n := range counts {
+		c := statsCount{Name: name, Count: n}
+		if total > 0 {
+			c.Percent = n * 100 / total
+		}
+		if sizes != nil {
+			c.Bytes = humanize.Bytes(uint64(sizes[name]))
+		}
+		r = append(r, c)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Count != r[j].Count {
+			return r[i].Count > r[j].Count
+		}
+		return r[i].Name < r[j].Name
+	})
+	if max > 0 && len(r) > max {
+		r = r[:max]
+	}
+	return r
+}
+
+// stats must be called with the mutex held.
+func (p *pastry) stats() statsPage {
+	var s statsPage
+	kinds, kindBytes := make(map[string]int), make(map[string]int)
+	tags := make(map[string]int)
+	months := make(map[string]map[string]int)
+	monthCount := make(map[string]int)
+	total := 0
+
+	for _, e := range p.texts {
+		k := kind(e)
+		kinds[k]++
+		kindBytes[k] += len(e.Text)
+		total += len(e.Text)
+
+		m := e.When.Local().Format("2006-01")
+		monthCount[m]++
+		if months[m] == nil {
+			months[m] = make(map[string]int)
+		}
+		for _, t := range e.Tags {
+			t = strings.ToLower(t)
+			tags[t]++
+			months[m][t]++
+		}
+	}
+
+	s.Count = len(p.texts)
+	if free := p.diskFree.Load(); p.cfg.MinFree > 0 && free >= 0 && !p.cfg.NoPersist {
+		s.DiskFree, s.DiskFull = humanize.IBytes(uint64(free)), p.full()
+	}
+	s.Bytes = humanize.Bytes(uint64(total))
+	if len(p.texts) > 0 {
+		f := format.New("en", time.Now())
+		s.Oldest = f.Since(p.texts[0].When)
+		s.Newest = f.Since(p.texts[len(p.texts)-1].When)
+	}
+	s.Kinds = ranked(kinds, kindBytes, len(p.texts), 0)
+	s.Tags = ranked(tags, nil, len(p.texts), 20)
+
+	for m, n := range monthCount {
+		s.Months = append(s.Months, statsMonth{Month: m, Count: n, Tags: ranked(months[m], nil, n, 5)})
+	}
+	sort.Slice(s.Months, func(i, j int) bool { return s.Months[i].Month > s.Months[j].Month })
+	s.Heatmap = p.heatmap(time.Now())
+	return s
+}
+
+func (p *pastry) showStats(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "stats.html", p.stats())
+	servePage(w, r, b.Bytes())
+}
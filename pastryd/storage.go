@@ -0,0 +1,297 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backend is where the pastes are kept. save is given all of them after every change, the
+// backends that store pastes one by one use a tracker to only write what changed.
+type backend interface {
+	load() ([]*entry, error)
+	save(texts []*entry) error
+	close() error
+}
+
+// syncer is a backend other pastry write to as well. sync is what they changed since load or
+// the last sync, the pastes they added or changed and the ids of those they removed.
+type syncer interface {
+	sync() (put []*entry, removed []string, err error)
+}
+
+// flusher is a backend whose save leaves the writing for later, to be done without the
+// mutex. flush waits until what save was last given is written.
+type flusher interface {
+	flush() error
+}
+
+// backends are the storage backends pastry was built with, by the name --store takes.
+// Other than gob they are behind build tags, as they need more modules.
+// They seal what they write with s, see seal.go.
+var backends = map[string]func(cfg Config, s *sealer) (backend, error){
+	"gob": func(cfg Config, s *sealer) (backend, error) { return newGob(cfg.DataDir, s), nil },
+}
+
+func openBackend(cfg Config, s *sealer) (backend, error) {
+	if cfg.NoPersist {
+		return memoryBackend{}, nil
+	}
+	name := cfg.Store
+	open, ok := backends[name]
+	if !ok {
+		var names []string
+		for n := range backends {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown store %s, this pastry was built with %s (see the README for the others)", name, strings.Join(names, ", "))
+	}
+	return open(cfg, s)
+}
+
+// memoryBackend is the store of --no-persist, which stores nothing. The pastes are only in
+// p.texts and are gone when pastry stops.
+type memoryBackend struct{}
+
+func (memoryBackend) load() ([]*entry, error)   { return nil, nil }
+func (memoryBackend) save(texts []*entry) error { return nil }
+func (memoryBackend) close() error              { return nil }
+
+// writeFileAtomic writes a file by way of a temporary file next to it, which is synced to
+// disk and then renamed over name. A crash half way leaves the old file as it was rather
+// than a half written one.
+func writeFileAtomic(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// the rename is only durable once the directory is synced, which Windows can't do
+	if d, err := os.Open(filepath.Dir(name)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func writeBytesAtomic(name string, perm os.FileMode, b []byte) error {
+	return writeFileAtomic(name, perm, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// newID is the key a paste is stored under.
+func newID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// tracker remembers what a backend last stored of each paste, by a hash of its JSON, so
+// save only writes the pastes that are new or changed and deletes the ones that are gone.
+type tracker struct {
+	saved   map[string][32]byte
+	pending map[string][32]byte
+}
+
+func newTracker() *tracker {
+	return &tracker{saved: make(map[string][32]byte)}
+}
+
+func entryHash(e *entry) ([]byte, [32]byte, error) {
+	b, err := json.Marshal(e)
+	return b, sha256.Sum256(b), err
+}
+
+// loaded records texts as stored.
+func (t *tracker) loaded(texts []*entry) {
+	for _, e := range texts {
+		if _, h, err := entryHash(e); err == nil {
+			t.saved[e.ID] = h
+		}
+	}
+}
+
+// changes are the pastes to write, with their JSON, and the ids of those to delete. The
+// backend calls commit once they are stored.
+func (t *tracker) changes(texts []*entry) (map[*entry][]byte, []string, error) {
+	changed := make(map[*entry][]byte)
+	t.pending = make(map[string][32]byte, len(texts))
+	for _, e := range texts {
+		b, h, err := entryHash(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.pending[e.ID] = h
+		if old, ok := t.saved[e.ID]; !ok || old != h {
+			changed[e] = b
+		}
+	}
+	var removed []string
+	for id := range t.saved {
+		if _, ok := t.pending[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	return changed, removed, nil
+}
+
+func (t *tracker) commit() {
+	t.saved, t.pending = t.pending, nil
+}
+
+// loadPastes opens the store and loads it. A new store of another kind starts out with
+// what is in pastes.gob, so switching --store keeps the history.
+func (p *pastry) loadPastes() error {
+	b, err := openBackend(p.cfg, p.seal)
+	if err != nil {
+		return err
+	}
+	p.backend = b
+	if p.texts, err = b.load(); err != nil {
+		return err
+	}
+	var old *gobBackend
+	if len(p.texts) == 0 && p.cfg.Store != "gob" && !p.cfg.NoPersist {
+		old = newGob(p.cfg.DataDir, p.seal)
+		if p.texts, err = old.load(); err != nil || len(p.texts) == 0 {
+			p.texts, old = nil, nil
+		}
+	}
+	for _, e := range p.texts {
+		if e.ID == "" {
+			e.ID = newID()
+		}
+		if e.Category == "" {
+			e.Category = categorize(e)
+		}
+	}
+	p.numberPastes()
+	if old != nil {
+		// moved out of the way, so emptying the new store doesn't bring them back
+		if err := saveNow(b, p.texts); err != nil {
+			return err
+		}
+		log.Printf("Moved %d pastes from %s to the %s store", len(p.texts), old.file, p.cfg.Store)
+		return old.retire()
+	}
+	if p.seal != nil {
+		// the backends leave out of their tracker what they read in plaintext, so it is
+		// written again sealed, rather than at its next change
+		if err := saveNow(b, p.texts); err != nil {
+			return err
+		}
+		return p.sealFiles()
+	}
+	return nil
+}
+
+// saveNow saves texts to b and waits until they are written, which most backends do in save.
+func saveNow(b backend, texts []*entry) error {
+	err := b.save(texts)
+	if f, ok := b.(flusher); ok && err == nil {
+		err = f.flush()
+	}
+	return err
+}
+
+// syncStore takes in what other pastry changed in a shared store. The store is asked
+// without the mutex, a paste changed here meanwhile is kept over what came in when it was
+// changed later.
+func (p *pastry) syncStore() {
+	s, ok := p.backend.(syncer)
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	if p.dirty {
+		// what is only in memory would be lost to what comes in
+		p.store()
+	}
+	p.mutex.Unlock()
+	put, removed, err := s.sync()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to sync the %s store: %v", p.cfg.Store, err)
+		return
+	}
+	if len(put) == 0 && len(removed) == 0 {
+		return
+	}
+	gone := make(map[string]bool, len(removed))
+	now := time.Now().UTC()
+	for _, id := range removed {
+		gone[id] = true
+		p.bury(id, now)
+	}
+	byID := make(map[string]*entry, len(put))
+	buried := false
+	for _, e := range put {
+		if p.buried(e) {
+			// written again by a pastry that hadn't heard of the delete, and deleted again
+			// with the next store
+			gone[e.ID], buried = true, true
+			continue
+		}
+		byID[e.ID] = e
+	}
+	kept := p.texts[:0]
+	for _, e := range p.texts {
+		if n, ok := byID[e.ID]; ok {
+			if e.lastModified().After(n.lastModified()) {
+				n = e
+			}
+			kept = append(kept, n)
+			delete(byID, e.ID)
+		} else if !gone[e.ID] {
+			kept = append(kept, e)
+		}
+	}
+	for _, e := range put {
+		if _, ok := byID[e.ID]; ok {
+			kept = append(kept, e)
+		}
+	}
+	p.texts = kept
+	sortPastes(p.texts)
+	p.numberPastes()
+	p.modified = time.Now()
+	if buried {
+		p.store()
+	} else {
+		p.storeTombs()
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+//go:build bolt
+
+package pastryd
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bbolt store keeps each paste under its id in the pastes bucket of pastes.bolt, as JSON.
+// bbolt is pure Go, so unlike SQLite it builds without cgo, and every save is one transaction
+// that either lands on disk completely or not at all. With a store key the values are sealed.
+
+var boltBucket = []byte("pastes")
+
+func init() {
+	backends["bolt"] = openBolt
+}
+
+type boltBackend struct {
+	db      *bolt.DB
+	tracker *tracker
+	seal    *sealer
+}
+
+func openBolt(cfg Config, seal *sealer) (backend, error) {
+	db, err := bolt.Open(filepath.Join(cfg.DataDir, "pastes.bolt"), 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltBackend{db: db, tracker: newTracker(), seal: seal}, nil
+}
+
+func (s *boltBackend) load() ([]*entry, error) {
+	var texts, stored []*entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(_, v []byte) error {
+			plain := s.seal.plain(v)
+			v, err := s.seal.open(v)
+			if err != nil {
+				return err
+			}
+			e := &entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			texts = append(texts, e)
+			if !plain {
+				stored = append(stored, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the keys are random, the order is by time
+	sortPastes(texts)
+	s.tracker.loaded(stored)
+	return texts, nil
+}
+
+func (s *boltBackend) save(texts []*entry) error {
+	changed, removed, err := s.tracker.changes(texts)
+	if err != nil || len(changed) == 0 && len(removed) == 0 {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for e, v := range changed {
+			if err := b.Put([]byte(e.ID), s.seal.seal(v)); err != nil {
+				return err
+			}
+		}
+		for _, id := range removed {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.tracker.commit()
+	}
+	return err
+}
+
+func (s *boltBackend) close() error {
+	return s.db.Close()
+}
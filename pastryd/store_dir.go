@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The dir store keeps every paste as a plain text file in the pastes directory, with its
+// title, tags and so on in a JSON file next to it. The names start with the time of the
+// paste, so ls sorts them, and the pastes can be grepped, rsynced and backed up as they are.
+// A text edited on disk is what pastry shows after the next start. With a store key both
+// files are sealed, which of course is the end of grepping them.
+
+func init() {
+	backends["dir"] = openDir
+}
+
+type dirBackend struct {
+	dir     string
+	tracker *tracker
+	seal    *sealer
+	names   map[string]string // id to file name without extension
+}
+
+func openDir(cfg Config, s *sealer) (backend, error) {
+	d := &dirBackend{dir: filepath.Join(cfg.DataDir, "pastes"), tracker: newTracker(), seal: s, names: make(map[string]string)}
+	return d, createDir(d.dir)
+}
+
+// name is the file name of a new paste, loaded pastes keep the name they have.
+func (d *dirBackend) name(e *entry) string {
+	return e.When.UTC().Format("20060102-150405") + "-" + e.ID
+}
+
+func (d *dirBackend) load() ([]*entry, error) {
+	metas, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var texts, stored []*entry
+	for _, m := range metas {
+		b, err := os.ReadFile(m)
+		if err != nil {
+			return nil, err
+		}
+		plain := d.seal.plain(b)
+		if b, err = d.seal.open(b); err != nil {
+			return nil, fmt.Errorf("%s: %v", m, err)
+		}
+		e := &entry{}
+		if err := json.Unmarshal(b, e); err != nil {
+			return nil, err
+		}
+		base := strings.TrimSuffix(m, ".json")
+		if text, err := os.ReadFile(base + ".txt"); err == nil {
+			plain = plain || d.seal.plain(text)
+			if text, err = d.seal.open(text); err != nil {
+				return nil, fmt.Errorf("%s.txt: %v", base, err)
+			}
+			e.Text = string(text)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if e.ID == "" {
+			e.ID = newID()
+		}
+		d.names[e.ID] = filepath.Base(base)
+		texts = append(texts, e)
+		if !plain {
+			stored = append(stored, e)
+		}
+	}
+	sortPastes(texts)
+	d.tracker.loaded(stored)
+	return texts, nil
+}
+
+func (d *dirBackend) save(texts []*entry) error {
+	changed, removed, err := d.tracker.changes(texts)
+	if err != nil {
+		return err
+	}
+	for e := range changed {
+		meta := *e
+		meta.Text = ""
+		b, err := json.MarshalIndent(&meta, "", "\t")
+		if err != nil {
+			return err
+		}
+		name, ok := d.names[e.ID]
+		if !ok {
+			name = d.name(e)
+		}
+		if err := writeBytesAtomic(filepath.Join(d.dir, name+".txt"), 0o644, d.seal.seal([]byte(e.Text))); err != nil {
+			return err
+		}
+		if err := writeBytesAtomic(filepath.Join(d.dir, name+".json"), 0o644, d.seal.seal(append(b, '\n'))); err != nil {
+			return err
+		}
+		d.names[e.ID] = name
+	}
+	for _, id := range removed {
+		if name, ok := d.names[id]; ok {
+			os.Remove(filepath.Join(d.dir, name+".json"))
+			os.Remove(filepath.Join(d.dir, name+".txt"))
+			delete(d.names, id)
+		}
+	}
+	d.tracker.commit()
+	return nil
+}
+
+func (d *dirBackend) close() error {
+	return nil
+}
@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// The gob store is pastes.gob, a snapshot of all pastes, and pastes.journal, with the changes
+// since as one JSON line each. A new paste is one line appended to the journal rather than
+// the whole history written again. Once the journal has grown as large as the snapshot it is
+// compacted, the snapshot is rewritten and the journal emptied. With a store key the
+// snapshot is sealed as a whole and every journal line on its own, as base64.
+
+// minJournal is how large the journal may grow before compaction, however small the snapshot.
+const minJournal = 1024 * 1024
+
+// journalRecord is a line of the journal, either a paste or the id of one that was removed.
+type journalRecord struct {
+	Put    *entry `json:",omitempty"`
+	Delete string `json:",omitempty"`
+}
+
+type gobBackend struct {
+	file    string
+	journal string
+	tracker *tracker
+	seal    *sealer
+
+	j            *os.File
+	journalSize  int64
+	snapshotSize int64
+	// mustCompact is set when the journal can't just be appended to, after a crash, for
+	// a snapshot from before pastes had ids or for plaintext to be sealed.
+	mustCompact bool
+}
+
+func newGob(dataDir string, s *sealer) *gobBackend {
+	return &gobBackend{
+		file:    filepath.Join(dataDir, "pastes.gob"),
+		journal: filepath.Join(dataDir, "pastes.journal"),
+		tracker: newTracker(),
+		seal:    s,
+	}
+}
+
+// load reads the snapshot and plays the journal on top of it. A line cut short by a crash
+// is skipped, and dropped at the next compaction.
+func (g *gobBackend) load() ([]*entry, error) {
+	var texts []*entry
+	if b, err := os.ReadFile(g.file); err == nil {
+		g.snapshotSize = int64(len(b))
+		g.mustCompact = g.seal.plain(b)
+		if b, err = g.seal.open(b); err != nil {
+			return nil, err
+		}
+		if err = gob.NewDecoder(bytes.NewReader(b)).Decode(&texts); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range texts {
+		if e.ID == "" {
+			e.ID, g.mustCompact = newID(), true
+		}
+	}
+
+	b, err := os.ReadFile(g.journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	g.journalSize = int64(len(b))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		// cut short by a crash, a sealed line that is would only fail to decrypt
+		b = b[:bytes.LastIndexByte(b, '\n')+1]
+		g.mustCompact = true
+	}
+	if len(b) > 0 {
+		byID := make(map[string]int, len(texts))
+		for i, e := range texts {
+			byID[e.ID] = i
+		}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		s.Buffer(nil, 1<<30)
+		for s.Scan() {
+			var r journalRecord
+			line, err := g.openLine(s.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", g.journal, err)
+			}
+			if err := json.Unmarshal(line, &r); err != nil {
+				log.Printf("Skipping a broken line of %s: %v", g.journal, err)
+				g.mustCompact = true
+				continue
+			}
+			if r.Put != nil {
+				if i, ok := byID[r.Put.ID]; ok {
+					texts[i] = r.Put
+				} else {
+					byID[r.Put.ID] = len(texts)
+					texts = append(texts, r.Put)
+				}
+			} else if i, ok := byID[r.Delete]; ok {
+				texts[i] = nil
+				delete(byID, r.Delete)
+			}
+		}
+		kept := texts[:0]
+		for _, e := range texts {
+			if e != nil {
+				kept = append(kept, e)
+			}
+		}
+		texts = kept
+		sortPastes(texts)
+	}
+	g.tracker.loaded(texts)
+	return texts, nil
+}
+
+func (g *gobBackend) save(texts []*entry) error {
+	changed, removed, err := g.tracker.changes(texts)
+	if err != nil || len(changed) == 0 && len(removed) == 0 && !g.mustCompact {
+		return err
+	}
+
+	var lines bytes.Buffer
+	for e := range changed {
+		b, err := json.Marshal(journalRecord{Put: e})
+		if err != nil {
+			return err
+		}
+		lines.Write(append(g.sealLine(b), '\n'))
+	}
+	for _, id := range removed {
+		b, _ := json.Marshal(journalRecord{Delete: id})
+		lines.Write(append(g.sealLine(b), '\n'))
+	}
+
+	if size := g.journalSize + int64(lines.Len()); g.mustCompact || size > g.snapshotSize && size > minJournal {
+		err = g.compact(texts)
+	} else {
+		err = g.append(lines.Bytes())
+	}
+	if err == nil {
+		g.tracker.commit()
+	}
+	return err
+}
+
+// compactStore compacts now rather than once the journal has grown, for gc.
+func (g *gobBackend) compactStore(texts []*entry) (before, after int64, err error) {
+	before = g.snapshotSize + g.journalSize
+	if _, _, err = g.tracker.changes(texts); err != nil {
+		return before, before, err
+	}
+	if err = g.compact(texts); err != nil {
+		return before, before, err
+	}
+	g.tracker.commit()
+	return before, g.snapshotSize, nil
+}
+
+// append adds lines to the journal and syncs it to disk.
+func (g *gobBackend) append(lines []byte) error {
+	if g.j == nil {
+		j, err := os.OpenFile(g.journal, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		g.j = j
+	}
+	_, err := g.j.Write(lines)
+	if err == nil {
+		err = g.j.Sync()
+	}
+	if err != nil {
+		// a line cut short would run into the next one, what was written is taken back and
+		// the next save compacts, which writes it all again
+		g.j.Truncate(g.journalSize)
+		g.mustCompact = true
+		return err
+	}
+	g.journalSize += int64(len(lines))
+	return nil
+}
+
+// compact writes texts as the new snapshot and empties the journal. Playing a journal that
+// is already in the snapshot again changes nothing, so a crash in between loses nothing.
+func (g *gobBackend) compact(texts []*entry) error {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(texts); err != nil {
+		return err
+	}
+	sealed := g.seal.seal(b.Bytes())
+	if err := writeBytesAtomic(g.file, 0o644, sealed); err != nil {
+		return err
+	}
+	g.snapshotSize = int64(len(sealed))
+	if g.j != nil {
+		g.j.Close()
+		g.j = nil
+	}
+	if err := os.Truncate(g.journal, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	g.journalSize, g.mustCompact = 0, false
+	return nil
+}
+
+// sealLine seals a journal line, as base64 so it stays a line.
+func (g *gobBackend) sealLine(b []byte) []byte {
+	if g.seal == nil {
+		return b
+	}
+	return []byte(base64.StdEncoding.EncodeToString(g.seal.seal(b)))
+}
+
+// openLine reads a journal line back. Those in plaintext are JSON objects, base64 never
+// starts with a brace. What is neither is left for the JSON decoder to reject.
+func (g *gobBackend) openLine(b []byte) ([]byte, error) {
+	if len(b) > 0 && b[0] == '{' {
+		if g.seal != nil {
+			g.mustCompact = true
+		}
+		return b, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil {
+		return b, nil
+	}
+	return g.seal.open(sealed)
+}
+
+// retire moves the files out of the way once their pastes are in another store.
+func (g *gobBackend) retire() error {
+	g.close()
+	for _, f := range []string{g.file, g.journal} {
+		if err := os.Rename(f, f+".migrated"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *gobBackend) close() error {
+	if g.j == nil {
+		return nil
+	}
+	err := g.j.Close()
+	g.j = nil
+	return err
+}
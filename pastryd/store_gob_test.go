@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"os"
+	"testing"
+)
+
+func gobTexts(t *testing.T, g *gobBackend) string {
+	t.Helper()
+	texts, err := g.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	s := ""
+	for _, e := range texts {
+		s += e.Text
+	}
+	return s
+}
+
+func TestGobTornLine(t *testing.T) {
+	dir := t.TempDir()
+	g := newGob(dir, nil)
+	a := &entry{ID: "a", Text: "one ", Seq: 1}
+	if err := g.save([]*entry{a}); err != nil {
+		t.Fatal(err)
+	}
+	// a line cut short, and what was appended after it on a line of its own
+	f, _ := os.OpenFile(g.journal, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"Put":{"ID":"b","Te` + "\n")
+	f.Close()
+	g.close()
+	g = newGob(dir, nil)
+	texts, err := g.load()
+	if err != nil || len(texts) != 1 || !g.mustCompact {
+		t.Fatalf("load of a torn line = %v, %v, compact %v", texts, err, g.mustCompact)
+	}
+	if err := g.save(append(texts, &entry{ID: "c", Text: "three", Seq: 3})); err != nil {
+		t.Fatal(err)
+	}
+	g.close()
+	if got := gobTexts(t, newGob(dir, nil)); got != "one three" {
+		t.Errorf("texts after the torn line = %q", got)
+	}
+	// cut short in the middle, the lines after it are still read
+	os.WriteFile(g.journal, []byte(`{"Put":{"ID":"b","Te`+"\n"+`{"Put":{"ID":"d","Text":" four","Seq":4}}`+"\n"), 0o644)
+	if got := gobTexts(t, newGob(dir, nil)); got != "one three four" {
+		t.Errorf("texts after a torn line in the middle = %q", got)
+	}
+}
+
+func TestGobFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	g := newGob(dir, nil)
+	a := &entry{ID: "a", Text: "one ", Seq: 1}
+	if err := g.save([]*entry{a}); err != nil {
+		t.Fatal(err)
+	}
+	// the journal can't be written to, and then it can again
+	g.j.Close()
+	b := &entry{ID: "b", Text: "two", Seq: 2}
+	if err := g.save([]*entry{a, b}); err == nil || !g.mustCompact {
+		t.Fatalf("save to a closed journal = %v, compact %v", err, g.mustCompact)
+	}
+	if err := g.save([]*entry{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	g.close()
+	if got := gobTexts(t, newGob(dir, nil)); got != "one two" {
+		t.Errorf("texts after a failed append = %q", got)
+	}
+}
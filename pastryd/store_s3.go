@@ -0,0 +1,444 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The S3 store keeps each paste as JSON in an object of its own, <prefix><id>.json, in a
+// bucket of S3 or anything speaking its API, like MinIO or Garage. --s3-url is the endpoint
+// with the bucket and an optional prefix as the path, as in https://nas:9000/pastry/home.
+// Several pastry can share the bucket, they pick up what the others changed with sync.
+//
+// The requests are signed with AWS Signature Version 4 here rather than with an SDK, there
+// are only four of them: list, get, put and delete.
+//
+// They take a while, and are not made with the mutex of pastry held. save takes the pastes
+// as JSON and leaves the writing to a goroutine of the store, which writes the latest of
+// what it was given. sync writes that first, then lists the bucket, without the mutex.
+
+const s3Timeout = 30 * time.Second
+
+func init() {
+	backends["s3"] = openS3
+}
+
+type s3Backend struct {
+	endpoint *url.URL // scheme and host
+	bucket   string
+	prefix   string
+	region   string
+	access   string
+	secret   string
+	client   *http.Client
+	seal     *sealer
+	now      func() time.Time
+
+	mutex   sync.Mutex // held over the requests, by the writer and sync
+	tracker *tracker
+	etags   map[string]string // of the objects by paste id, as last seen
+
+	queue   sync.Mutex
+	next    map[string]s3Object // the pastes as save was last given them, not yet written
+	failed  error               // of the last write by the writer, returned by the next save
+	wake    chan struct{}
+	stopped bool
+}
+
+// s3Object is a paste as written, its JSON and the hash of it.
+type s3Object struct {
+	b []byte
+	h [32]byte
+}
+
+func openS3(cfg Config, s *sealer) (backend, error) {
+	u, err := url.Parse(cfg.S3URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("--s3-url must be like https://host/bucket[/prefix], not %q", cfg.S3URL)
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("--s3-url %q has no bucket", cfg.S3URL)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, fmt.Errorf("The s3 store needs PASTRY_S3_ACCESS_KEY and PASTRY_S3_SECRET_KEY")
+	}
+	region := cfg.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	s3 := &s3Backend{
+		endpoint: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:   bucket,
+		prefix:   prefix,
+		region:   region,
+		access:   cfg.S3AccessKey,
+		secret:   cfg.S3SecretKey,
+		client:   &http.Client{Timeout: s3Timeout},
+		tracker:  newTracker(),
+		seal:     s,
+		etags:    make(map[string]string),
+		now:      time.Now,
+		wake:     make(chan struct{}, 1),
+	}
+	go s3.writer()
+	return s3, nil
+}
+
+func (s *s3Backend) key(id string) string {
+	return s.prefix + id + ".json"
+}
+
+func (s *s3Backend) load() ([]*entry, error) {
+	objects, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	var texts, stored []*entry
+	for id, etag := range objects {
+		e, plain, err := s.get(id)
+		if err != nil {
+			return nil, err
+		}
+		s.etags[id] = etag
+		texts = append(texts, e)
+		if !plain {
+			stored = append(stored, e)
+		}
+	}
+	sortPastes(texts)
+	s.tracker.loaded(stored)
+	return texts, nil
+}
+
+// save hands texts to the writer. The error is that of the write before, if it failed, the
+// pastes it didn't write are written with these.
+func (s *s3Backend) save(texts []*entry) error {
+	next := make(map[string]s3Object, len(texts))
+	for _, e := range texts {
+		b, h, err := entryHash(e)
+		if err != nil {
+			return err
+		}
+		next[e.ID] = s3Object{b, h}
+	}
+	s.queue.Lock()
+	defer s.queue.Unlock()
+	if s.stopped {
+		return fmt.Errorf("The s3 store is closed")
+	}
+	s.next = next
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	err := s.failed
+	s.failed = nil
+	return err
+}
+
+// writer writes what save was given, until close.
+func (s *s3Backend) writer() {
+	for range s.wake {
+		err := s.flush()
+		s.queue.Lock()
+		s.failed = err
+		s.queue.Unlock()
+	}
+}
+
+// flush waits until what save was given is written.
+func (s *s3Backend) flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.writeNext()
+}
+
+// writeNext writes the pastes save was last given, what has changed of them since the last
+// write, and deletes those that are gone. What isn't written is tried again with the next.
+// Must be called with s.mutex held.
+func (s *s3Backend) writeNext() error {
+	s.queue.Lock()
+	next := s.next
+	s.next = nil
+	s.queue.Unlock()
+	if next == nil {
+		return nil
+	}
+	err := s.write(next)
+	if err != nil {
+		s.queue.Lock()
+		if s.next == nil {
+			s.next = next
+		}
+		s.queue.Unlock()
+	}
+	return err
+}
+
+func (s *s3Backend) write(next map[string]s3Object) error {
+	for id, o := range next {
+		if old, ok := s.tracker.saved[id]; ok && old == o.h {
+			continue
+		}
+		resp, err := s.do("PUT", s.key(id), nil, s.seal.seal(o.b))
+		if err != nil {
+			return err
+		}
+		s.etags[id] = resp.Header.Get("ETag")
+		s.tracker.saved[id] = o.h
+	}
+	for id := range s.tracker.saved {
+		if _, ok := next[id]; ok {
+			continue
+		}
+		if _, err := s.do("DELETE", s.key(id), nil, nil); err != nil {
+			return err
+		}
+		delete(s.etags, id)
+		delete(s.tracker.saved, id)
+	}
+	return nil
+}
+
+// close writes what is left to write and stops the writer.
+func (s *s3Backend) close() error {
+	s.queue.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.wake)
+	}
+	s.queue.Unlock()
+	return s.flush()
+}
+
+// sync lists the bucket and fetches what other pastry put there since it was last looked
+// at, after writing what this one has yet to. removed are the pastes it no longer has.
+func (s *s3Backend) sync() (put []*entry, removed []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.writeNext(); err != nil {
+		return nil, nil, err
+	}
+	objects, err := s.list()
+	if err != nil {
+		return nil, nil, err
+	}
+	for id, etag := range objects {
+		if old, ok := s.etags[id]; ok && old == etag {
+			continue
+		}
+		e, _, err := s.get(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.etags[id] = etag
+		s.tracker.loaded([]*entry{e})
+		put = append(put, e)
+	}
+	for id := range s.etags {
+		if _, ok := objects[id]; !ok {
+			delete(s.etags, id)
+			delete(s.tracker.saved, id)
+			removed = append(removed, id)
+		}
+	}
+	return put, removed, nil
+}
+
+func (s *s3Backend) get(id string) (e *entry, plain bool, err error) {
+	resp, err := s.do("GET", s.key(id), nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	b := resp.body
+	plain = s.seal.plain(b)
+	if b, err = s.seal.open(b); err != nil {
+		return nil, false, fmt.Errorf("%s: %v", s.key(id), err)
+	}
+	e = &entry{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, false, fmt.Errorf("%s: %v", s.key(id), err)
+	}
+	e.ID = id
+	return e, plain, nil
+}
+
+// list is the ETags of the pastes in the bucket, by id.
+func (s *s3Backend) list() (map[string]string, error) {
+	objects := make(map[string]string)
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key  string
+				ETag string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(resp.body, &result); err != nil {
+			return nil, fmt.Errorf("Listing the bucket: %v", err)
+		}
+		for _, o := range result.Contents {
+			name := strings.TrimPrefix(o.Key, s.prefix)
+			// only the pastes, not what is further down under the prefix
+			if id := strings.TrimSuffix(name, ".json"); id != name && id != "" && !strings.Contains(id, "/") {
+				objects[id] = o.ETag
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type s3Response struct {
+	*http.Response
+	body []byte
+}
+
+// do sends a signed request for the object key, or for the bucket when key is "". Answers
+// other than 2xx are errors, with the message S3 gave.
+func (s *s3Backend) do(method, key string, query url.Values, body []byte) (*s3Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	signS3(req, body, s.access, s.secret, s.region, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct{ Code, Message string }
+		if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("S3 %s %s: %s: %s", method, u.Path, e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("S3 %s %s: %s", method, u.Path, resp.Status)
+	}
+	return &s3Response{Response: resp, body: b}, nil
+}
+
+// s3Escape is the URI encoding of Signature Version 4, which leaves only A-Z, a-z, 0-9 and
+// -._~ as they are, and / too in paths.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 || path && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the query in the canonical form, sorted and escaped, which is also how it is sent.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signS3 signs req for S3 with Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html. Host,
+// Range and the X-Amz- headers are signed.
+func signS3(req *http.Request, body []byte, access, secret, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if p, err := url.PathUnescape(path); err == nil {
+		path = s3Escape(p, true)
+	}
+	if path == "" {
+		path = "/"
+	}
+	request := strings.Join([]string{req.Method, path, s3Query(req.URL.Query()), canonical.String(), signed, hex.EncodeToString(payload[:])}, "\n")
+	requestHash := sha256.Sum256([]byte(request))
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	mac := func(key []byte, s string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		return h.Sum(nil)
+	}
+	key := mac(mac(mac(mac([]byte("AWS4"+secret), date), region), "s3"), "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		access, scope, signed, hex.EncodeToString(mac(key, toSign))))
+}
@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+//go:build sqlite
+
+package pastryd
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The SQLite store keeps each paste in a row of pastes.db, written in one transaction with
+// only the pastes that changed. The columns besides entry, the paste as JSON, are there to
+// query the history with, the store itself only reads entry back. With a store key entry
+// is sealed, as base64, and only id, created and expires are kept in the clear.
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS pastes (
+	id       TEXT PRIMARY KEY,
+	created  INTEGER NOT NULL,
+	title    TEXT,
+	name     TEXT,
+	board    TEXT,
+	lang     TEXT,
+	category TEXT,
+	tags     TEXT,
+	expires  INTEGER,
+	text     TEXT,
+	entry    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS pastes_created ON pastes(created);
+`
+
+func init() {
+	backends["sqlite"] = openSqlite
+}
+
+type sqliteBackend struct {
+	file    string
+	db      *sql.DB
+	tracker *tracker
+	seal    *sealer
+}
+
+func openSqlite(cfg Config, seal *sealer) (backend, error) {
+	file := filepath.Join(cfg.DataDir, "pastes.db")
+	db, err := sql.Open("sqlite3", "file:"+file+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteBackend{file: file, db: db, tracker: newTracker(), seal: seal}, nil
+}
+
+func (s *sqliteBackend) load() ([]*entry, error) {
+	rows, err := s.db.Query("SELECT entry FROM pastes ORDER BY created, rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var texts, stored []*entry
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		plain := len(b) > 0 && b[0] == '{'
+		if !plain {
+			if b, err = base64.StdEncoding.DecodeString(string(b)); err == nil {
+				b, err = s.seal.open(b)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		e := &entry{}
+		if err := json.Unmarshal(b, e); err != nil {
+			return nil, err
+		}
+		texts = append(texts, e)
+		if !plain || s.seal == nil {
+			stored = append(stored, e)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.tracker.loaded(stored)
+	// created is When, which isn't the order they arrived in when the clock was wrong
+	sortPastes(texts)
+	return texts, nil
+}
+
+func (s *sqliteBackend) save(texts []*entry) error {
+	changed, removed, err := s.tracker.changes(texts)
+	if err != nil || len(changed) == 0 && len(removed) == 0 {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ins, err := tx.Prepare(`INSERT OR REPLACE INTO pastes (id, created, title, name, board, lang, category, tags, expires, text, entry)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	for e, b := range changed {
+		var expires interface{}
+		if !e.Expires.IsZero() {
+			expires = e.Expires.Unix()
+		}
+		var err error
+		if s.seal == nil {
+			_, err = ins.Exec(e.ID, e.When.UnixNano(), e.Title, e.Name, e.Board, e.Lang, e.Category,
+				strings.Join(e.Tags, ","), expires, e.Text, string(b))
+		} else {
+			_, err = ins.Exec(e.ID, e.When.UnixNano(), nil, nil, nil, nil, nil, nil, expires, nil,
+				base64.StdEncoding.EncodeToString(s.seal.seal(b)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range removed {
+		if _, err := tx.Exec("DELETE FROM pastes WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.tracker.commit()
+	return nil
+}
+
+// compactStore vacuums pastes.db, for gc. The pastes are stored already.
+func (s *sqliteBackend) compactStore([]*entry) (before, after int64, err error) {
+	before = s.size()
+	if _, err = s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err == nil {
+		_, err = s.db.Exec("VACUUM")
+	}
+	return before, s.size(), err
+}
+
+// size is that of pastes.db and its write-ahead log.
+func (s *sqliteBackend) size() int64 {
+	var n int64
+	for _, name := range []string{s.file, s.file + "-wal"} {
+		if info, err := os.Stat(name); err == nil {
+			n += info.Size()
+		}
+	}
+	return n
+}
+
+func (s *sqliteBackend) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The pages of the web GUI are given --render-timeout to be put together, and answered with
+// 503 and the busy page when they take longer, so a huge store or a slow backend doesn't
+// leave browsers hanging. Downloads, raw texts and uploads take as long as they take.
+
+// routeTimeout is the timeout of the pages under one route of the mux, 0 for none.
+type routeTimeout struct {
+	Route   string
+	Timeout time.Duration
+}
+
+// routeTimeouts is a repeatable flag of "/pdf=2m".
+type routeTimeouts []routeTimeout
+
+func (rt *routeTimeouts) String() string {
+	var s []string
+	for _, t := range *rt {
+		s = append(s, t.Route+"="+t.Timeout.String())
+	}
+	return strings.Join(s, ";")
+}
+
+// Set accepts one timeout, or several separated by ';' as in PASTRY_ROUTE_TIMEOUTS.
+func (rt *routeTimeouts) Set(s string) error {
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		route, d, ok := strings.Cut(v, "=")
+		if !ok || !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("Route timeout must be like /pdf=2m, not %q", v)
+		}
+		t, err := time.ParseDuration(d)
+		if err != nil || t < 0 {
+			return fmt.Errorf("Invalid timeout of %s: %q", route, d)
+		}
+		*rt = append(*rt, routeTimeout{Route: route, Timeout: t})
+	}
+	return nil
+}
+
+// of is the timeout of route, the last one given for it or def.
+func (rt routeTimeouts) of(route string, def time.Duration) time.Duration {
+	for i := len(rt) - 1; i >= 0; i-- {
+		if rt[i].Route == route {
+			return rt[i].Timeout
+		}
+	}
+	return def
+}
+
+// timeouts wraps the handlers of the mux in their timeouts.
+type timeouts struct {
+	p    *pastry
+	busy string // the page
+	api  string // and what the API says instead
+}
+
+func (p *pastry) newTimeouts() *timeouts {
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "busy.html", nil)
+	api, _ := json.Marshal(map[string]string{"error": "Pastry is busy, try again in a little while"})
+	return &timeouts{p: p, busy: b.String(), api: string(api)}
+}
+
+func (t *timeouts) wrap(route string, h http.HandlerFunc) http.Handler {
+	d := t.p.cfg.RouteTimeouts.of(route, t.p.cfg.RenderTimeout)
+	if d <= 0 {
+		return h
+	}
+	if strings.HasPrefix(route, "/api/") {
+		return http.TimeoutHandler(h, d, t.api)
+	}
+	return http.TimeoutHandler(h, d, t.busy)
+}
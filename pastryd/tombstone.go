@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"os"
+	"time"
+)
+
+// A paste that is gone for good leaves a tombstone, its id and when it went, for
+// tombstoneKeep. The JSON archive of pastry export carries them, as {"id", "deleted"} lines
+// after the pastes, and so does the tar of the export command, as empty files. An import
+// drops the pastes it has tombstones for, unless they were edited since, and leaves out
+// those this pastry has tombstones of, so merging a stale copy of a store doesn't bring
+// back what was deleted. Syncing a shared store leaves out in the same way what a pastry
+// that hadn't heard of the delete writes again. They are kept in tombstones.gob, sealed
+// with the store key, and gc prunes the old ones.
+
+const tombstoneKeep = 90 * 24 * time.Hour
+
+// bury records that the paste of id went at when. Must be called with the mutex held.
+func (p *pastry) bury(id string, when time.Time) {
+	if p.tombs == nil {
+		p.tombs = make(map[string]time.Time)
+	}
+	if when.After(p.tombs[id]) {
+		p.tombs[id] = when
+		p.tombDirty = true
+	}
+}
+
+// buried is true when e was deleted after its last change. Must be called with the mutex
+// held.
+func (p *pastry) buried(e *entry) bool {
+	t, ok := p.tombs[e.ID]
+	return ok && !e.lastModified().After(t)
+}
+
+// buryImported takes in a tombstone of an archive, dropping the paste it is of unless that
+// was edited since. Must be called with the mutex held.
+func (p *pastry) buryImported(id string, when time.Time) {
+	for i, e := range p.texts {
+		if e.ID == id && !e.lastModified().After(when) {
+			p.discard(e)
+			p.texts = append(p.texts[:i], p.texts[i+1:]...)
+			// as of when it went, rather than now as discard has it
+			delete(p.tombs, id)
+			break
+		}
+	}
+	p.bury(id, when)
+}
+
+// pruneTombs drops the tombstones older than tombstoneKeep and returns how many. Must be
+// called with the mutex held.
+func (p *pastry) pruneTombs(now time.Time) int {
+	n := 0
+	for id, t := range p.tombs {
+		if now.Sub(t) > tombstoneKeep {
+			delete(p.tombs, id)
+			n++
+		}
+	}
+	if n > 0 {
+		p.tombDirty = true
+	}
+	return n
+}
+
+// loadTombs reads tombstones.gob, which is sealed like the store. One written before there
+// was a store key is rewritten sealed with the next change.
+func (p *pastry) loadTombs() {
+	b, err := os.ReadFile(p.tombsFile)
+	if p.cfg.NoPersist || err != nil {
+		return
+	}
+	p.tombDirty = p.seal.plain(b)
+	if b, err = p.seal.open(b); err == nil {
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&p.tombs)
+	}
+	if err != nil {
+		log.Printf("Failed to read %s: %v", p.tombsFile, err)
+	}
+}
+
+// storeTombs writes the tombstones when they have changed. Must be called with the mutex
+// held.
+func (p *pastry) storeTombs() {
+	if p.cfg.NoPersist || !p.tombDirty {
+		return
+	}
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(p.tombs)
+	if err == nil {
+		err = writeBytesAtomic(p.tombsFile, 0o644, p.seal.seal(b.Bytes()))
+	}
+	if err != nil {
+		log.Printf("Failed to store tombstones: %v", err)
+		return
+	}
+	p.tombDirty = false
+}
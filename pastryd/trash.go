@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The trash keeps what the web GUI deleted or changed for undoGrace, and the pages shown in
+// the meantime offer to undo it. The browser that did it has the token of the undo in a
+// cookie. The file of a deleted file paste is only removed once the grace is over.
+
+const (
+	undoGrace  = time.Minute
+	undoCookie = "pastry_undo"
+)
+
+type trashed struct {
+	token   string
+	old     entry // the paste as it was
+	deleted bool  // or only changed
+	what    string
+	until   time.Time
+}
+
+// undoToast is what the pages show of an undo.
+type undoToast struct {
+	Token string
+	What  string
+}
+
+// toTrash keeps e as it is before the web GUI drops or changes it, and gives the browser the
+// undo. Must be called with the mutex held.
+func (p *pastry) toTrash(w http.ResponseWriter, e *entry, deleted bool, what string) {
+	t := &trashed{token: newID(), old: *e, deleted: deleted, what: what, until: time.Now().Add(undoGrace)}
+	t.old.Tags = append([]string(nil), e.Tags...)
+	p.trash = append(p.trash, t)
+	http.SetCookie(w, &http.Cookie{Name: undoCookie, Value: t.token, Path: "/", MaxAge: int(undoGrace / time.Second), SameSite: http.SameSiteLaxMode})
+}
+
+// label is how the toast calls a paste.
+func label(i int, e *entry) string {
+	if e.Title != "" {
+		return e.Title
+	}
+	return fmt.Sprintf("#%d", i)
+}
+
+func (p *pastry) findTrash(token string) int {
+	for i, t := range p.trash {
+		if t.token == token {
+			return i
+		}
+	}
+	return -1
+}
+
+// undoable is the undo the browser of r can still make. Must be called with the mutex held.
+func (p *pastry) undoable(r *http.Request) *undoToast {
+	c, err := r.Cookie(undoCookie)
+	if err != nil {
+		return nil
+	}
+	if i := p.findTrash(c.Value); i >= 0 && time.Now().Before(p.trash[i].until) {
+		return &undoToast{Token: c.Value, What: p.trash[i].what}
+	}
+	return nil
+}
+
+// emptyTrash forgets what is past its grace, and removes the files of the pastes that were
+// deleted for good.
+func (p *pastry) emptyTrash(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	kept := p.trash[:0]
+	for _, t := range p.trash {
+		switch {
+		case now.Before(t.until):
+			kept = append(kept, t)
+		case t.deleted:
+			p.discard(&t.old)
+		}
+	}
+	p.trash = kept
+	// deleted for good when they went to the trash
+	p.reclaim()
+	p.storeTombs()
+}
+
+// undo serves the Undo button, a POST to /undo/<token>. A deleted paste comes back where it
+// was, a changed one as it was unless it has been deleted since.
+func (p *pastry) undo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := p.findTrash(strings.TrimPrefix(r.URL.Path, "/undo/"))
+	if n < 0 || !time.Now().Before(p.trash[n].until) {
+		http.Error(w, "Too late to undo", http.StatusGone)
+		return
+	}
+	t := p.trash[n]
+	old := t.old
+	to := "/"
+	if t.deleted {
+		i := sort.Search(len(p.texts), func(i int) bool { return before(&old, p.texts[i]) })
+		p.texts = append(p.texts[:i], append([]*entry{&old}, p.texts[i:]...)...)
+	} else {
+		i, _, ok := p.lookupID(old.ID)
+		if !ok {
+			http.Error(w, "The paste is gone", http.StatusGone)
+			return
+		}
+		p.texts[i] = &old
+		to = "/p/" + old.ID
+	}
+	p.trash = append(p.trash[:n], p.trash[n+1:]...)
+	if err := p.store(); err != nil {
+		http.Error(w, "Not stored: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: undoCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, to, http.StatusSeeOther)
+}
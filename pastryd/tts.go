@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"pastry/format"
+)
+
+// announceTag marks pastes that are read out loud even without --announce-all.
+const announceTag = "announce"
+
+// maxSpoken is how many characters of a paste are read out, nobody wants to hear a whole log file.
+const maxSpoken = 500
+
+// homeAssistantTTS calls a Home Assistant TTS service, e.g. http://ha.local:8123/api/services/tts/speak.
+// Sonos, DLNA and Chromecast speakers all show up in Home Assistant as media players.
+func homeAssistantTTS(cfg Config) func(text string) error {
+	return func(text string) error {
+		body := map[string]string{"message": text}
+		if cfg.TTSEntity != "" {
+			body["entity_id"] = cfg.TTSEntity
+		}
+		if cfg.TTSPlayer != "" {
+			// The legacy *_say services take the media player as entity_id.
+			if cfg.TTSEntity == "" {
+				body["entity_id"] = cfg.TTSPlayer
+			} else {
+				body["media_player_entity_id"] = cfg.TTSPlayer
+			}
+		}
+		var header map[string]string
+		if cfg.TTSToken != "" {
+			header = map[string]string{"Authorization": "Bearer " + cfg.TTSToken}
+		}
+		b, _ := json.Marshal(body)
+		return post(cfg.TTSURL, "application/json", b, header)
+	}
+}
+
+func spoken(e *entry) string {
+	text := strings.Join(strings.Fields(e.Text), " ")
+	if e.Title != "" {
+		text = e.Title + ". " + text
+	}
+	return format.Truncate(text, maxSpoken)
+}
+
+// announce reads e out loud if it should be, but never before it is published. It runs in
+// the background, so it is fine to call with the mutex held.
+func (p *pastry) announce(e *entry) {
+	if p.cfg.TTSURL == "" || !p.cfg.AnnounceAll && !hasTag(e, announceTag) || !e.visible(time.Now()) ||
+		e.Category == "secret" && !hasTag(e, announceTag) {
+		return
+	}
+	text := spoken(e)
+	p.spawn(func() {
+		if err := homeAssistantTTS(p.cfg)(text); err != nil {
+			log.Printf("Announcement failed: %v", err)
+		}
+	})
+}
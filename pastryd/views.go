@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// view is a saved search, shown in the web sidebar and usable with `list --view <name>`.
+type view struct {
+	Name  string
+	Tag   string
+	Text  string
+	Since time.Duration
+}
+
+func (v *view) match(e *entry, now time.Time) bool {
+	if v.Tag != "" && !hasTag(e, v.Tag) {
+		return false
+	}
+	if v.Text != "" && !strings.Contains(strings.ToLower(e.Text), strings.ToLower(v.Text)) {
+		return false
+	}
+	if v.Since > 0 && now.Sub(e.When) > v.Since {
+		return false
+	}
+	return true
+}
+
+func (v *view) String() string {
+	var b strings.Builder
+	b.WriteString(v.Name)
+	if v.Tag != "" {
+		b.WriteString(" tag:" + v.Tag)
+	}
+	if v.Since > 0 {
+		b.WriteString(" since:" + formatAge(v.Since))
+	}
+	if v.Text != "" {
+		b.WriteString(" " + v.Text)
+	}
+	return b.String()
+}
+
+func hasTag(e *entry, tag string) bool {
+	for _, t := range e.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// parseAge is time.ParseDuration that also understands days ("7d") and weeks ("2w").
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			if v, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); err == nil && v >= 0 {
+				return time.Duration(v) * unit, nil
+			}
+			return 0, fmt.Errorf("Invalid age: %s", s)
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+func formatAge(d time.Duration) string {
+	day := 24 * time.Hour
+	if d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+	return d.String()
+}
+
+// option returns the value of "--name value" or "--name=value" in args.
+func option(args []string, name string) (string, bool) {
+	for i, a := range args {
+		if strings.HasPrefix(a, "--"+name+"=") {
+			return strings.TrimPrefix(a, "--"+name+"="), true
+		}
+		if a == "--"+name {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				return args[i+1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// findView must be called with the mutex held.
+func (p *pastry) findView(name string) *view {
+	for _, v := range p.views {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// saveView replaces any view with the same name. Must be called with the mutex held.
+func (p *pastry) saveView(v *view) {
+	if old := p.findView(v.Name); old != nil {
+		*old = *v
+	} else {
+		p.views = append(p.views, v)
+	}
+	p.storeViews()
+}
+
+// dropView must be called with the mutex held.
+func (p *pastry) dropView(name string) {
+	for i := range p.views {
+		if p.views[i].Name == name {
+			p.views = append(p.views[:i], p.views[i+1:]...)
+			p.storeViews()
+			return
+		}
+	}
+}
+
+func (p *pastry) storeViews() {
+	if p.cfg.NoPersist {
+		return
+	}
+	views := p.views
+	err := writeFileAtomic(p.viewsFile, 0o644, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(views)
+	})
+	if err != nil {
+		log.Printf("Failed to store views: %v", err)
+	}
+}
+
+// parseView parses "<name> [tag:<tag>] [since:<age>] [text...]".
+func parseView(args []string) (*view, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Missing view name")
+	}
+	v := &view{Name: args[0]}
+	var text []string
+	for _, a := range args[1:] {
+		if strings.HasPrefix(a, "tag:") {
+			v.Tag = strings.TrimPrefix(a, "tag:")
+		} else if strings.HasPrefix(a, "since:") {
+			d, err := parseAge(strings.TrimPrefix(a, "since:"))
+			if err != nil {
+				return nil, err
+			}
+			v.Since = d
+		} else {
+			text = append(text, a)
+		}
+	}
+	v.Text = strings.Join(text, " ")
+	return v, nil
+}
+
+// viewCommand handles `view [list]`, `view save <name> ...` and `view drop <name>`.
+// Must be called with the mutex held.
+func (p *pastry) viewCommand(args []string) []byte {
+	var b bytes.Buffer
+
+	if len(args) == 0 || args[0] == "list" {
+		for _, v := range p.views {
+			b.WriteString(v.String() + "\n")
+		}
+		return b.Bytes()
+	}
+
+	switch args[0] {
+	case "save":
+		v, err := parseView(args[1:])
+		if err != nil {
+			return []byte("# " + err.Error() + "\n")
+		}
+		p.saveView(v)
+	case "drop":
+		if len(args) > 1 {
+			p.dropView(args[1])
+		}
+	default:
+		b.WriteString("# Unknown view command\n")
+	}
+	return b.Bytes()
+}
+
+func (p *pastry) saveViewForm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		return
+	}
+	r.ParseForm()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if r.FormValue("drop") != "" {
+		p.dropView(name)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	v := &view{Name: name, Tag: strings.TrimSpace(r.FormValue("tag")), Text: r.FormValue("q")}
+	if s := strings.TrimSpace(r.FormValue("since")); s != "" {
+		d, err := parseAge(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.Since = d
+	}
+	if v.Name == "" {
+		http.Error(w, "Missing view name", http.StatusBadRequest)
+		return
+	}
+	p.saveView(v)
+	http.Redirect(w, r, "/?view="+url.QueryEscape(v.Name), http.StatusSeeOther)
+}
@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOption(t *testing.T) {
+	for _, tc := range []struct {
+		args  string
+		value string
+		ok    bool
+	}{
+		{"--view work", "work", true},
+		{"list --view=work --width 80", "work", true},
+		{"--view --width 80", "", true},
+		{"--view", "", true},
+		{"--viewer work", "", false},
+		{"view work", "", false},
+	} {
+		if value, ok := option(strings.Fields(tc.args), "view"); value != tc.value || ok != tc.ok {
+			t.Errorf("option(%q) = %q, %v", tc.args, value, ok)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"-1d", 0, false},
+		{"xd", 0, false},
+		{"soon", 0, false},
+	} {
+		if got, err := parseAge(tc.s); got != tc.want || (err == nil) != tc.ok {
+			t.Errorf("parseAge(%q) = %v, %v", tc.s, got, err)
+		}
+	}
+}
+
+func TestParseView(t *testing.T) {
+	for _, tc := range []struct {
+		args string
+		want string // the view as view list shows it, "" for an error
+	}{
+		{"work tag:job since:7d standup notes", "work tag:job since:7d standup notes"},
+		{"recent since:90m", "recent since:1h30m0s"},
+		{"all", "all"},
+		{"bad since:soon", ""},
+		{"", ""},
+	} {
+		v, err := parseView(strings.Fields(tc.args))
+		if got := ""; err == nil {
+			got = v.String()
+			if got != tc.want {
+				t.Errorf("parseView(%q) = %q, want %q", tc.args, got, tc.want)
+			}
+		} else if tc.want != "" {
+			t.Errorf("parseView(%q): %v", tc.args, err)
+		}
+	}
+}
+
+func TestViewMatch(t *testing.T) {
+	now := time.Date(2023, 5, 3, 12, 0, 0, 0, time.UTC)
+	e := &entry{Text: "Standup Notes\n", Tags: []string{"Job"}, When: now.Add(-48 * time.Hour)}
+	for _, tc := range []struct {
+		v    view
+		want bool
+	}{
+		{view{}, true},
+		{view{Tag: "job"}, true},
+		{view{Tag: "home"}, false},
+		{view{Text: "standup"}, true},
+		{view{Text: "retro"}, false},
+		{view{Since: 7 * 24 * time.Hour}, true},
+		{view{Since: 24 * time.Hour}, false},
+		{view{Tag: "job", Text: "notes", Since: 72 * time.Hour}, true},
+	} {
+		if got := tc.v.match(e, now); got != tc.want {
+			t.Errorf("%+v matches = %v", tc.v, got)
+		}
+	}
+}
+
+func TestFindView(t *testing.T) {
+	p := &pastry{cfg: Config{NoPersist: true}}
+	p.saveView(&view{Name: "work", Tag: "job"})
+	p.saveView(&view{Name: "home", Tag: "house"})
+	p.saveView(&view{Name: "work", Tag: "office"})
+	if v := p.findView("work"); v == nil || v.Tag != "office" || len(p.views) != 2 {
+		t.Errorf("findView(work) = %+v of %d views", v, len(p.views))
+	}
+	p.dropView("work")
+	if v := p.findView("work"); v != nil || p.findView("home") == nil {
+		t.Errorf("findView(work) after the drop = %+v", v)
+	}
+}
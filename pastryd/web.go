@@ -0,0 +1,349 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package pastryd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"pastry/format"
+)
+
+// webFormatter writes times in the first language of the browser there is a locale for, or in
+// that of --locale.
+func (p *pastry) webFormatter(r *http.Request) format.Formatter {
+	return format.New(format.Match(append(strings.Split(r.Header.Get("Accept-Language"), ","), p.cfg.Locale)...), time.Now())
+}
+
+func newHTMLEntry(f format.Formatter, i int, e *entry) htmlEntry {
+	return htmlEntry{
+		Index:    i,
+		DateTime: f.Since(e.When),
+		Modified: modifiedString(f, e),
+		Title:    e.Title,
+		Name:     e.Name,
+		Board:    e.Board,
+		Lang:     e.Lang,
+		Text:     e.Text,
+		Tags:     e.Tags,
+		Expires:  expiresString(e),
+		Deadline: deadline(e),
+		Publish:  publishString(e, time.Now()),
+		Remind:   remindString(e),
+		SeenBy:   seenBy(e),
+		Strict:   e.Strict || defaultStrict(e.Category),
+		Category: e.Category,
+		Icon:     categoryIcons[e.Category],
+		File:     fileString(e),
+		Audio:    e.isAudio(),
+		Image:    e.isImage(),
+
+		Checklist: checklist(e.Text),
+		Location:  findLocation(e.Text),
+		Event:     findEvent(e),
+		Calendar:  isCalendar(e.Text),
+		Contact:   findContact(e),
+	}
+}
+
+func deadline(e *entry) string {
+	if e.Expires.IsZero() {
+		return ""
+	}
+	return e.Expires.UTC().Format(time.RFC3339)
+}
+
+func modifiedString(f format.Formatter, e *entry) string {
+	if e.Modified.IsZero() {
+		return ""
+	}
+	return "edited " + f.Since(e.Modified)
+}
+
+func etag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// pageETag is an ETag for rendered HTML, so relative dates changing also changes the tag.
+func pageETag(b []byte) string {
+	return "W/" + etag(b)
+}
+
+// servePage serves rendered HTML by its ETag alone. It has no Last-Modified, the relative dates
+// on it change while the pastes do not.
+func servePage(w http.ResponseWriter, r *http.Request, page []byte) {
+	serveConditional(w, r, time.Time{}, pageETag(page), page)
+}
+
+// serveConditional answers HEAD, If-None-Match and If-Modified-Since requests.
+func serveConditional(w http.ResponseWriter, r *http.Request, mod time.Time, tag string, content []byte) {
+	serveContent(w, r, mod, tag, bytes.NewReader(content))
+}
+
+// serveContent is serveConditional from content, which is read a buffer at a time.
+func serveContent(w http.ResponseWriter, r *http.Request, mod time.Time, tag string, content io.ReadSeeker) {
+	w.Header().Set("ETag", tag)
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	http.ServeContent(w, r, "", mod, content)
+}
+
+// lookup resolves the index, @name or id at the end of the request path. Must be called with the mutex held.
+func (p *pastry) lookup(r *http.Request, prefix string) (int, *entry, bool) {
+	return p.lookupID(strings.TrimPrefix(r.URL.Path, prefix))
+}
+
+// lookupID finds a paste by id, index or @name, the id being what a link can keep using as
+// pastes come and go. The ids come first, one can be all digits. Must be called with the
+// mutex held.
+func (p *pastry) lookupID(id string) (int, *entry, bool) {
+	for i, e := range p.texts {
+		if e.ID == id {
+			return i, e, true
+		}
+	}
+	if i, err := p.index(id); err == nil {
+		return i, p.texts[i], true
+	}
+	return 0, nil, false
+}
+
+// raw serves /raw/<id>, the text of a paste by index, @name or id as it is, for curl and
+// pipes. It is sent once the mutex is released.
+func (p *pastry) raw(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	i, e, ok := p.lookup(r, "/raw/")
+	if !ok {
+		p.mutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	var f io.ReadSeekCloser
+	if e.Mime == spoolMime {
+		// a large text of the write port, from its file
+		var err error
+		if f, err = p.openFile(e); err != nil {
+			p.mutex.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+	}
+	if markSeen(e, deviceName(r), time.Now()) {
+		p.store()
+	}
+	text, hash, when := e.Text, e.Hash, e.lastModified()
+	p.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// never HTML, whatever the text looks like to a browser
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"pastry-%d.txt\"", i))
+	if f != nil {
+		serveContent(w, r, when.Truncate(time.Second), hashETag(hash), f)
+		return
+	}
+	serveContent(w, r, when.Truncate(time.Second), etag([]byte(text)), strings.NewReader(text))
+}
+
+// pasteBody takes a paste as the whole body of a POST to / or /p, as sent by
+// curl --data-binary @file, and answers with its /raw/ URL. The query can give the title,
+// name, board, lang, tags and expires, like the form does.
+func (p *pastry) pasteBody(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	max := p.limit().MaxPaste
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(max)))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("The paste is longer than max-paste, %d bytes", max), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		http.Error(w, "Nothing to paste", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	name, err := cleanName(strings.TrimSpace(q.Get("name")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e := &entry{
+		Text:   string(b),
+		Title:  strings.TrimSpace(q.Get("title")),
+		Name:   name,
+		Board:  strings.TrimSpace(q.Get("board")),
+		Lang:   strings.TrimSpace(q.Get("lang")),
+		Tags:   splitTags(q.Get("tags")),
+		Origin: deviceName(r),
+	}
+	if s := q.Get("expires"); s != "" {
+		if e.Expires, err = parseWhen(s, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if rt := p.requestRoute(r); rt != nil {
+		rt.route(e)
+	}
+	if err := p.addEntry(e); err != nil {
+		notStored(w, err)
+		return
+	}
+	p.replyCreated(w, r, e)
+}
+
+// storedID is the id of the paste e was stored as, which is e unless a lazy board kept the
+// paste e repeats instead.
+func (p *pastry) storedID(e *entry) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := len(p.texts) - 1; i >= 0; i-- {
+		if t := p.texts[i]; t == e || e.File == "" && t.Text == e.Text && t.Board == e.Board {
+			return t.ID
+		}
+	}
+	return e.ID
+}
+
+// replyCreated answers a paste added from the body of a request with the URL it can be
+// fetched at again, /raw/ for text and /download/ for files, and its permalink as the
+// Location.
+func (p *pastry) replyCreated(w http.ResponseWriter, r *http.Request, e *entry) {
+	id := p.storedID(e)
+	scheme, route := "http", "raw"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if e.File != "" {
+		route = "download"
+	}
+	w.Header().Set("Location", "/p/"+id)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%s://%s/%s/%s\n", scheme, r.Host, route, id)
+}
+
+// deletePaste serves the Delete button of a paste page, a POST to /delete/<id>, the
+// form's way of DELETE /api/v1/pastes/<id>.
+func (p *pastry) deletePaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i, _, ok := p.lookup(r, "/delete/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := p.dropToTrash(w, i); err != nil {
+		http.Error(w, "Not stored: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// permalink serves /p/<id>, and /p/<id>.png, .pdf, .svg, .ics and .vcf. Names may contain dots,
+// so @notes.png is only the image of @notes when there is no paste called notes.png.
+func (p *pastry) permalink(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/p/")
+	switch {
+	case strings.HasSuffix(id, ".png") && !p.exists(id):
+		p.pastePNG(w, r, strings.TrimSuffix(id, ".png"))
+	case strings.HasSuffix(id, ".pdf") && !p.exists(id):
+		p.pastePDF(w, r, strings.TrimSuffix(id, ".pdf"))
+	case strings.HasSuffix(id, ".svg") && !p.exists(id):
+		p.pasteSVG(w, r, strings.TrimSuffix(id, ".svg"))
+	case strings.HasSuffix(id, ".ics") && !p.exists(id):
+		p.pasteICS(w, r, strings.TrimSuffix(id, ".ics"))
+	case strings.HasSuffix(id, ".vcf") && !p.exists(id):
+		p.pasteVCF(w, r, strings.TrimSuffix(id, ".vcf"))
+	default:
+		p.showPaste(w, r, id)
+	}
+}
+
+func (p *pastry) exists(id string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, _, ok := p.lookupID(id)
+	return ok
+}
+
+// namedPaste serves /n/<name>, the same as /p/@<name>.
+func (p *pastry) namedPaste(w http.ResponseWriter, r *http.Request) {
+	p.showPaste(w, r, "@"+strings.TrimPrefix(r.URL.Path, "/n/"))
+}
+
+func (p *pastry) showPaste(w http.ResponseWriter, r *http.Request, id string) {
+	p.mutex.Lock()
+	i, e, ok := p.lookupID(id)
+	if !ok {
+		p.mutex.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	if markSeen(e, deviceName(r), time.Now()) {
+		p.store()
+	}
+	f := p.webFormatter(r)
+
+	page := struct {
+		htmlEntry
+		Similar  []similarEntry
+		History  []htmlEntry
+		Printer  bool
+		Maps     bool
+		Markdown template.HTML
+		Diagram  bool
+		Count    string
+		Trace    *trace
+		Log      []logLine
+		Levels   []string
+		Undo     *undoToast
+	}{htmlEntry: newHTMLEntry(f, i, e), Undo: p.undoable(r), Similar: p.similar(f, i, time.Now()), Printer: p.cfg.PrinterURL != "", Maps: p.cfg.Maps,
+		Diagram: p.cfg.Diagrams && diagramKind(e) != ""}
+
+	if e.File == "" {
+		page.Count = countText(e.Text).String()
+	}
+	if e.Name != "" {
+		if revs := p.revisions(e.Name, time.Now()); len(revs) > 1 {
+			for n := len(revs) - 1; n >= 0; n-- {
+				page.History = append(page.History, newHTMLEntry(f, revs[n], p.texts[revs[n]]))
+			}
+		}
+	}
+	text, markdown, category, math := e.Text, isMarkdown(e), e.Category, p.cfg.Math
+	p.mutex.Unlock()
+
+	// a long paste takes a while to render, the other requests need not wait for it
+	if markdown {
+		page.Markdown = renderMarkdown(text, math)
+	} else if page.Trace = findTrace(text); page.Trace == nil && category == "log" {
+		page.Log = parseLog(text)
+		page.Levels = usedLevels(page.Log)
+	}
+
+	var b bytes.Buffer
+	p.tmpl.ExecuteTemplate(&b, "paste.html", page)
+	servePage(w, r, b.Bytes())
+}
@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"pastry/pastryd"
+)
+
+// runService handles `pastry service install|start|stop|uninstall [flags]`.
+// The flags given to install are the ones the service is started with. What the service
+// is depends on the system, see serviceKind.
+func runService(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: pastry service install|start|stop|uninstall [flags], pastry runs as a %s", serviceKind)
+	}
+
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		cfg := pastryd.ParseConfig(args[1:])
+		if cfg.DataDir, err = filepath.Abs(cfg.DataDir); err != nil {
+			return err
+		}
+		if err = os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			return err
+		}
+		if err = serviceInstall(exe, serviceArgs(args[1:], cfg.DataDir), cfg.DataDir); err != nil {
+			return err
+		}
+		fmt.Printf("Installed pastry as a %s\n", serviceKind)
+		return nil
+	case "start":
+		return serviceStart()
+	case "stop":
+		return serviceStop()
+	case "uninstall":
+		return serviceUninstall()
+	}
+	return fmt.Errorf("Unknown service command: %s", args[0])
+}
+
+// serviceArgs are the flags given to install, as they were given, with the data directory
+// made absolute since the service is not started from where install was run.
+func serviceArgs(args []string, dataDir string) []string {
+	a := make([]string, 0, len(args)+2)
+	given := false
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		switch {
+		case name == "data-dir" && strings.HasPrefix(args[i], "-"):
+			a = append(a, args[i], dataDir)
+			i++
+			given = true
+		case strings.HasPrefix(name, "data-dir=") && strings.HasPrefix(args[i], "-"):
+			a = append(a, args[i][:len(args[i])-len(name)]+"data-dir="+dataDir)
+			given = true
+		default:
+			a = append(a, args[i])
+		}
+	}
+	if !given {
+		a = append(a, "--data-dir", dataDir)
+	}
+	return a
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const launchdLabel = "com.github.gmelchett.pastry"
+
+const serviceKind = "launchd agent"
+
+func launchdPlist() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist"), nil
+}
+
+func plistString(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return "<string>" + b.String() + "</string>"
+}
+
+// serviceInstall writes a launchd agent that starts pastry at log in and keeps it running.
+func serviceInstall(exe string, args []string, dataDir string) error {
+	path, err := launchdPlist()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	var prog strings.Builder
+	for _, a := range append([]string{exe}, args...) {
+		prog.WriteString("\t\t" + plistString(a) + "\n")
+	}
+	logFile := plistString(filepath.Join(dataDir, "pastry.log"))
+
+	plist := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	` + plistString(launchdLabel) + `
+	<key>ProgramArguments</key>
+	<array>
+` + prog.String() + `	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	` + logFile + `
+	<key>StandardErrorPath</key>
+	` + logFile + `
+</dict>
+</plist>
+`
+	return os.WriteFile(path, []byte(plist), 0644)
+}
+
+func serviceStart() error {
+	path, err := launchdPlist()
+	if err != nil {
+		return err
+	}
+	return run("launchctl", "load", "-w", path)
+}
+
+func serviceStop() error {
+	path, err := launchdPlist()
+	if err != nil {
+		return err
+	}
+	return run("launchctl", "unload", path)
+}
+
+func serviceUninstall() error {
+	path, err := launchdPlist()
+	if err != nil {
+		return err
+	}
+	serviceStop()
+	return os.Remove(path)
+}
@@ -0,0 +1,29 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+//go:build !darwin && !windows
+
+package main
+
+import "fmt"
+
+const serviceKind = "systemd service, see pastry@.service"
+
+var errNoService = fmt.Errorf("Not supported on this system, use the provided pastry@.service for systemd")
+
+func serviceInstall(string, []string, string) error {
+	return errNoService
+}
+
+func serviceStart() error {
+	return errNoService
+}
+
+func serviceStop() error {
+	return errNoService
+}
+
+func serviceUninstall() error {
+	return errNoService
+}
@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2023 Jonas Aaberg
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "syscall"
+
+const taskName = "pastry"
+
+const serviceKind = "scheduled task run at log on"
+
+// serviceInstall registers pastry as a scheduled task started at log on. A proper
+// Windows service would have to talk to the service control manager, which needs
+// golang.org/x/sys.
+func serviceInstall(exe string, args []string, _ string) error {
+	cmdline := syscall.EscapeArg(exe)
+	for _, a := range args {
+		cmdline += " " + syscall.EscapeArg(a)
+	}
+	return run("schtasks", "/Create", "/F", "/TN", taskName, "/SC", "ONLOGON", "/RL", "LIMITED", "/TR", cmdline)
+}
+
+func serviceStart() error {
+	return run("schtasks", "/Run", "/TN", taskName)
+}
+
+func serviceStop() error {
+	return run("schtasks", "/End", "/TN", taskName)
+}
+
+func serviceUninstall() error {
+	serviceStop()
+	return run("schtasks", "/Delete", "/F", "/TN", taskName)
+}